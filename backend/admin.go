@@ -0,0 +1,448 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Admin API limits
+const (
+	defaultAuditQueryLimit       = 100
+	maxAuditQueryLimit           = 1000
+	maxAdminBody           int64 = 64 * 1024
+)
+
+// adminActor is the actor of admin API actions in the audit log and in
+// group notices
+const adminActor = "server admin"
+
+// adminToken authorizes the admin API. It is set with CHATSYNC_ADMIN_TOKEN;
+// without it the admin API is disabled.
+var adminToken string
+
+// requireAdmin checks the bearer token of an admin API request and writes
+// the error response if it is missing or wrong
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if adminToken == "" {
+		http.Error(w, "The admin API is disabled", http.StatusNotFound)
+		return false
+	}
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		log.Printf("Refused admin API request for %s from %s", r.URL.Path, clientIP(r))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="chatsync-admin"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// auditQuery selects audit entries. Empty fields match everything.
+type auditQuery struct {
+	Actor   string
+	Actions map[string]bool
+	Group   string
+	Target  string
+	IP      string
+	After   time.Time
+	Before  time.Time
+	Limit   int
+}
+
+// parseAuditQuery reads the query parameters of /api/admin/audit
+func parseAuditQuery(get func(string) string) (auditQuery, error) {
+	q := auditQuery{
+		Actor:  get("actor"),
+		Group:  get("group"),
+		Target: get("target"),
+		IP:     get("ip"),
+		Limit:  defaultAuditQueryLimit,
+	}
+	if v := get("action"); v != "" {
+		q.Actions = make(map[string]bool)
+		for _, action := range strings.Split(v, ",") {
+			q.Actions[strings.TrimSpace(action)] = true
+		}
+	}
+	var err error
+	if v := get("after"); v != "" {
+		if q.After, err = parseSearchDate(v); err != nil {
+			return q, err
+		}
+	}
+	if v := get("before"); v != "" {
+		if q.Before, err = parseSearchDate(v); err != nil {
+			return q, err
+		}
+	}
+	if v := get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 || q.Limit > maxAuditQueryLimit {
+			return q, errors.New("limit must be between 1 and 1000")
+		}
+	}
+	return q, nil
+}
+
+// matches reports whether an audit entry is selected by the query
+func (q auditQuery) matches(entry protocol.AuditEntry) bool {
+	if (q.Actor != "" && entry.Actor != q.Actor) ||
+		(q.Actions != nil && !q.Actions[entry.Action]) ||
+		(q.Group != "" && entry.Group != q.Group) ||
+		(q.Target != "" && entry.Target != q.Target) ||
+		(q.IP != "" && entry.IP != q.IP) {
+		return false
+	}
+	if !q.After.IsZero() || !q.Before.IsZero() {
+		t, err := time.Parse(time.RFC3339, entry.Time)
+		if err != nil || (!q.After.IsZero() && t.Before(q.After)) || (!q.Before.IsZero() && !t.Before(q.Before)) {
+			return false
+		}
+	}
+	return true
+}
+
+// queryAudit returns the latest audit entries selected by q, newest first
+func queryAudit(q auditQuery) ([]protocol.AuditEntry, error) {
+	var matched []protocol.AuditEntry
+	err := moderationStore.ScanAudit(func(entry protocol.AuditEntry) {
+		if !q.matches(entry) {
+			return
+		}
+		matched = append(matched, entry)
+		if len(matched) > q.Limit {
+			matched = matched[1:]
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]protocol.AuditEntry, len(matched))
+	for i, entry := range matched {
+		entries[len(matched)-1-i] = entry
+	}
+	return entries, nil
+}
+
+// handleAdminAudit serves the audit log to admins, newest first. Query
+// parameters, all optional: actor, action (comma separated), group, target,
+// ip, after and before (dates as for search) and limit.
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	if moderationStore == nil {
+		http.Error(w, "The audit log is not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	q, err := parseAuditQuery(r.URL.Query().Get)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	entries, err := queryAudit(q)
+	if err != nil {
+		log.Printf("Error reading the audit log: %v", err)
+		http.Error(w, "Error reading the audit log", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{protocol.KeyAuditLog: entries})
+}
+
+// handleAdminClients lists the connected clients and companion connections,
+// oldest connection first
+func handleAdminClients(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	now := time.Now()
+	list := make([]protocol.ConnectedClient, 0)
+	add := func(client *Client) {
+		entry := protocol.ConnectedClient{
+			Username:      client.Username,
+			IP:            client.ip,
+			Bot:           client.conn == nil,
+			Companion:     client.companion,
+			Detached:      client.detached,
+			QueueDepth:    len(client.send),
+			QueueCapacity: cap(client.send),
+		}
+		if !client.connectedAt.IsZero() {
+			entry.ConnectedAt = client.connectedAt.Format(time.RFC3339)
+			entry.AgeSeconds = int(now.Sub(client.connectedAt) / time.Second)
+		}
+		list = append(list, entry)
+	}
+	clientsMux.RLock()
+	for _, client := range clients {
+		add(client)
+	}
+	for _, set := range companions {
+		for client := range set {
+			add(client)
+		}
+	}
+	clientsMux.RUnlock()
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].AgeSeconds != list[j].AgeSeconds {
+			return list[i].AgeSeconds > list[j].AgeSeconds
+		}
+		return list[i].Username < list[j].Username
+	})
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{protocol.KeyClients: list})
+}
+
+// handleAdminClient force-disconnects a user with DELETE
+// /api/admin/clients/{username}. The optional reason query parameter is
+// sent in the close frame.
+func handleAdminClient(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	username := strings.TrimPrefix(r.URL.Path, "/api/admin/clients/")
+	clientsMux.RLock()
+	client, exists := clients[username]
+	clientsMux.RUnlock()
+	if !exists {
+		http.Error(w, "User not connected", http.StatusNotFound)
+		return
+	}
+	if client.conn == nil {
+		http.Error(w, "Bots cannot be disconnected", http.StatusBadRequest)
+		return
+	}
+
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "Disconnected by an administrator"
+	}
+	log.Printf("Admin at %s disconnected %s", clientIP(r), username)
+	disconnectUser(username, reason)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminGroups lists every group, sorted by name
+func handleAdminGroups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	groupsMux.RLock()
+	list := make([]protocol.Group, 0, len(groups))
+	for _, group := range groups {
+		list = append(list, cloneGroup(group))
+	}
+	groupsMux.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{protocol.KeyGroups: list})
+}
+
+// handleAdminGroup serves GET /api/admin/groups/{id} and edits the group
+// with PATCH, whose body is a JSON protocol.GroupUpdate. Admin edits are
+// not subject to group roles.
+func handleAdminGroup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	groupID := strings.TrimPrefix(r.URL.Path, "/api/admin/groups/")
+
+	var update protocol.GroupUpdate
+	if r.Method == http.MethodPatch {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&update); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid group update: %v", err), http.StatusBadRequest)
+			return
+		}
+		if problems := checkGroupUpdate(&update); len(problems) > 0 {
+			http.Error(w, strings.Join(problems, "; "), http.StatusBadRequest)
+			return
+		}
+	}
+
+	groupsMux.Lock()
+	group, exists := groups[groupID]
+	if !exists {
+		groupsMux.Unlock()
+		http.Error(w, "Group not found", http.StatusNotFound)
+		return
+	}
+	var notices []string
+	var err error
+	if r.Method == http.MethodPatch {
+		notices, err = applyGroupUpdate(group, update, adminActor)
+	}
+	snapshot := cloneGroup(group)
+	groupsMux.Unlock()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if len(notices) > 0 {
+		log.Printf("Admin at %s updated group %s", clientIP(r), groupID)
+		writeAudit(protocol.AuditEntry{
+			Actor:  adminActor,
+			Action: protocol.ActionUpdateGroup,
+			Group:  groupID,
+			Reason: strings.Join(notices, "; "),
+			IP:     clientIP(r),
+		})
+		announceGroupUpdate(groupID, notices)
+	}
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// handleAdminBroadcast sends a system announcement to everyone online. The
+// body is {"content": "..."}.
+func handleAdminBroadcast(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	var body struct {
+		Content string `json:"content"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody)).Decode(&body); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid JSON body: %v", err), http.StatusBadRequest)
+		return
+	}
+	body.Content = strings.TrimSpace(body.Content)
+	if body.Content == "" {
+		http.Error(w, "content is required", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Admin at %s broadcast an announcement", clientIP(r))
+	writeAudit(protocol.AuditEntry{
+		Actor:  adminActor,
+		Action: protocol.ActionBroadcast,
+		Reason: body.Content,
+		IP:     clientIP(r),
+	})
+	broadcastSystemMessage(body.Content)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAdminStats reports how much the server is holding
+func handleAdminStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, serverStats())
+}
+
+// serverStats collects the storage statistics
+func serverStats() protocol.ServerStats {
+	var stats protocol.ServerStats
+
+	clientsMux.RLock()
+	for _, client := range clients {
+		if client.conn == nil {
+			stats.Bots++
+		} else {
+			stats.Clients++
+		}
+	}
+	clientsMux.RUnlock()
+
+	groupsMux.RLock()
+	stats.Groups = len(groups)
+	groupsMux.RUnlock()
+
+	msgMux.RLock()
+	stats.PrivateConversations = len(privateMessages)
+	for _, messages := range privateMessages {
+		stats.PrivateMessages += len(messages)
+	}
+	for _, messages := range groupMessages {
+		stats.GroupMessages += len(messages)
+	}
+	msgMux.RUnlock()
+
+	stats.IndexedMessages = searchIndex.Len()
+
+	attachmentsMux.RLock()
+	stats.Attachments = len(attachments)
+	attachmentsMux.RUnlock()
+	if blobStore != nil {
+		var err error
+		if stats.Blobs, stats.BlobBytes, err = blobStore.Usage(); err != nil {
+			log.Printf("Error measuring the blob store: %v", err)
+		}
+	}
+
+	profilesMux.RLock()
+	stats.Profiles = len(profiles)
+	profilesMux.RUnlock()
+
+	moderationMux.RLock()
+	stats.Bans = len(bans)
+	for _, report := range reports {
+		if report.Status == protocol.StatusPending {
+			stats.PendingReports++
+		}
+	}
+	moderationMux.RUnlock()
+
+	invitationsMux.Lock()
+	stats.Invitations = len(invitations)
+	invitationsMux.Unlock()
+
+	if moderationStore != nil {
+		if info, err := os.Stat(moderationStore.AuditPath()); err == nil {
+			stats.AuditLogBytes = info.Size()
+		}
+	}
+	return stats
+}
+
+// writeJSON writes v as the JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
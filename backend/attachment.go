@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+var (
+	// Attachment configuration
+	blobDir                 = "data/blobs"
+	maxAttachmentSize int64 = 25 * 1024 * 1024 // 25MB
+	maxAttachments          = 10               // Per message
+
+	blobStore *BlobStore
+
+	attachments    = make(map[string]*attachmentRecord) // key: attachment ID
+	attachmentsMux sync.RWMutex
+)
+
+// attachmentRecord is the server-side view of an uploaded file
+type attachmentRecord struct {
+	protocol.Attachment
+	Hash          string
+	ThumbnailHash string
+	Uploader      string
+	ChatType      string // protocol.TypePrivate or protocol.TypeGroup
+	ChatID        string // Other user for private chats, group ID for groups
+	CreatedAt     time.Time
+}
+
+// isGroupMember reports whether username belongs to a group
+func isGroupMember(groupID, username string) bool {
+	groupsMux.RLock()
+	defer groupsMux.RUnlock()
+
+	group, exists := groups[groupID]
+	return exists && contains(group.Members, username)
+}
+
+// canAccessAttachment reports whether username takes part in the
+// conversation the attachment was uploaded to
+func canAccessAttachment(rec *attachmentRecord, username string) bool {
+	if username == "" {
+		return false
+	}
+	if rec.ChatType == protocol.TypeGroup {
+		return isGroupMember(rec.ChatID, username)
+	}
+	return username == rec.Uploader || username == rec.ChatID
+}
+
+// resolveAttachments replaces the attachment references in a message with
+// their full metadata. References that do not exist, were uploaded by
+// someone else or belong to another conversation are dropped.
+func resolveAttachments(msg *protocol.Message) {
+	if len(msg.Attachments) == 0 {
+		return
+	}
+	if len(msg.Attachments) > maxAttachments {
+		log.Printf("User %s sent %d attachments, keeping the first %d", msg.From, len(msg.Attachments), maxAttachments)
+		msg.Attachments = msg.Attachments[:maxAttachments]
+	}
+
+	chatType := protocol.TypePrivate
+	if msg.Type == protocol.TypeGroupMessage {
+		chatType = protocol.TypeGroup
+	}
+
+	resolved := make([]protocol.Attachment, 0, len(msg.Attachments))
+	attachmentsMux.RLock()
+	for _, ref := range msg.Attachments {
+		rec, exists := attachments[ref.ID]
+		if !exists || rec.Uploader != msg.From || rec.ChatType != chatType || rec.ChatID != msg.To {
+			log.Printf("Dropping invalid attachment %s from %s to %s", ref.ID, msg.From, msg.To)
+			continue
+		}
+		resolved = append(resolved, rec.Attachment)
+	}
+	attachmentsMux.RUnlock()
+
+	msg.Attachments = resolved
+}
+
+// handleAttachmentUpload stores a multipart "file" upload for a conversation.
+// Query parameters: username, chat_type (private or group) and chat_id.
+func handleAttachmentUpload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if blobStore == nil {
+		http.Error(w, "Attachments are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	username := query.Get("username")
+	chatType := query.Get("chat_type")
+	chatID := query.Get("chat_id")
+	if username == "" || chatID == "" {
+		http.Error(w, "username and chat_id are required", http.StatusBadRequest)
+		return
+	}
+	if refuseBanned(w, r, username) {
+		return
+	}
+
+	switch chatType {
+	case protocol.TypePrivate:
+		if chatID == username {
+			http.Error(w, "Cannot upload to a chat with yourself", http.StatusBadRequest)
+			return
+		}
+	case protocol.TypeGroup:
+		if !isGroupMember(chatID, username) {
+			http.Error(w, "Not a member of this group", http.StatusForbidden)
+			return
+		}
+	default:
+		http.Error(w, "chat_type must be private or group", http.StatusBadRequest)
+		return
+	}
+
+	// Leave room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, maxAttachmentSize+1024*1024)
+	reader, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "Expected a multipart/form-data body", http.StatusBadRequest)
+		return
+	}
+
+	var rec *attachmentRecord
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			http.Error(w, "Invalid multipart body", http.StatusBadRequest)
+			return
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		rec, err = storeAttachment(part, part.FileName(), part.Header.Get("Content-Type"))
+		part.Close()
+		if errors.Is(err, errBlobTooLarge) {
+			http.Error(w, "File is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			log.Printf("Error storing attachment from %s: %v", username, err)
+			http.Error(w, "Could not store file", http.StatusInternalServerError)
+			return
+		}
+		break
+	}
+
+	if rec == nil {
+		http.Error(w, "Missing file field", http.StatusBadRequest)
+		return
+	}
+
+	rec.Uploader = username
+	rec.ChatType = chatType
+	rec.ChatID = chatID
+
+	attachmentsMux.Lock()
+	attachments[rec.ID] = rec
+	attachmentsMux.Unlock()
+
+	log.Printf("Stored attachment %s (%s, %d bytes, %s) from %s for %s %s",
+		rec.ID, rec.Name, rec.Size, rec.MIMEType, username, chatType, chatID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(rec.Attachment)
+}
+
+// storeAttachment writes an upload to the blob store, detects its MIME type
+// and generates a thumbnail for images
+func storeAttachment(r io.Reader, name, declaredType string) (*attachmentRecord, error) {
+	hash, size, err := blobStore.Put(r, maxAttachmentSize)
+	if err != nil {
+		return nil, err
+	}
+
+	blob, err := blobStore.Open(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(blob, head)
+	mimeType := http.DetectContentType(head[:n])
+	if mimeType == "application/octet-stream" && declaredType != "" {
+		mimeType = declaredType
+	}
+
+	name = filepath.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == "" {
+		name = "file"
+	}
+
+	id := generateID(12)
+	rec := &attachmentRecord{
+		Attachment: protocol.Attachment{
+			ID:       id,
+			Name:     name,
+			Size:     size,
+			MIMEType: mimeType,
+			URL:      "/api/attachments/" + id,
+		},
+		Hash:      hash,
+		CreatedAt: time.Now(),
+	}
+
+	if strings.HasPrefix(mimeType, "image/") {
+		if _, err := blob.Seek(0, io.SeekStart); err == nil {
+			thumb, err := makeThumbnail(blob)
+			if err != nil {
+				log.Printf("Could not create thumbnail for %s: %v", name, err)
+			} else if thumbHash, _, err := blobStore.Put(bytes.NewReader(thumb), int64(len(thumb))); err == nil {
+				rec.ThumbnailHash = thumbHash
+				rec.ThumbnailURL = rec.URL + "/thumbnail"
+			}
+		}
+	}
+
+	return rec, nil
+}
+
+// handleAttachment serves /api/attachments/{id} and
+// /api/attachments/{id}/thumbnail to participants of the conversation
+func handleAttachment(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if blobStore == nil {
+		http.Error(w, "Attachments are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/attachments/"), "/")
+	thumbnail := len(parts) == 2 && parts[1] == "thumbnail"
+	if parts[0] == "" || len(parts) > 2 || (len(parts) == 2 && !thumbnail) {
+		http.NotFound(w, r)
+		return
+	}
+
+	attachmentsMux.RLock()
+	rec, exists := attachments[parts[0]]
+	attachmentsMux.RUnlock()
+	if !exists {
+		http.NotFound(w, r)
+		return
+	}
+
+	username := r.URL.Query().Get("username")
+	if refuseBanned(w, r, username) {
+		return
+	}
+	if !canAccessAttachment(rec, username) {
+		log.Printf("User %q denied access to attachment %s", username, rec.ID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	hash, contentType := rec.Hash, rec.MIMEType
+	if thumbnail {
+		if rec.ThumbnailHash == "" {
+			http.NotFound(w, r)
+			return
+		}
+		hash, contentType = rec.ThumbnailHash, "image/jpeg"
+	}
+
+	blob, err := blobStore.Open(hash)
+	if err != nil {
+		log.Printf("Error opening blob %s for attachment %s: %v", hash, rec.ID, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer blob.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(rec.MIMEType, "image/") {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": rec.Name}))
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	http.ServeContent(w, r, "", rec.CreatedAt, blob)
+}
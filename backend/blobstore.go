@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// errBlobTooLarge is returned by BlobStore.Put when the content exceeds the limit
+var errBlobTooLarge = errors.New("blob exceeds maximum size")
+
+// BlobStore is a content-addressed store on the local filesystem. Blobs are
+// named by the hex SHA-256 of their content and stored under
+// dir/<first two hex chars>/<hash>, so identical uploads are kept once.
+type BlobStore struct {
+	dir string
+}
+
+// NewBlobStore creates the store directory if needed and returns the store
+func NewBlobStore(dir string) (*BlobStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating blob directory: %w", err)
+	}
+	return &BlobStore{dir: dir}, nil
+}
+
+func (s *BlobStore) path(hash string) string {
+	return filepath.Join(s.dir, hash[:2], hash)
+}
+
+// Put stores up to maxSize bytes from r and returns the content hash and size
+func (s *BlobStore) Put(r io.Reader, maxSize int64) (string, int64, error) {
+	tmp, err := os.CreateTemp(s.dir, "upload-*")
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, hasher), io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return "", 0, err
+	}
+	if size > maxSize {
+		return "", 0, errBlobTooLarge
+	}
+	if err := tmp.Close(); err != nil {
+		return "", 0, err
+	}
+
+	hash := hex.EncodeToString(hasher.Sum(nil))
+	dest := s.path(hash)
+	if _, err := os.Stat(dest); err == nil {
+		// Already stored
+		return hash, size, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return "", 0, err
+	}
+	return hash, size, nil
+}
+
+// Usage returns the number of stored blobs and their total size
+func (s *BlobStore) Usage() (count int, size int64, err error) {
+	err = filepath.WalkDir(s.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Blobs live one level down; uploads in progress sit at the top
+		if d.IsDir() || filepath.Dir(filepath.Dir(path)) != s.dir {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		count++
+		size += info.Size()
+		return nil
+	})
+	return count, size, err
+}
+
+// Open returns the blob with the given hash
+func (s *BlobStore) Open(hash string) (*os.File, error) {
+	if len(hash) != sha256.Size*2 {
+		return nil, os.ErrNotExist
+	}
+	if _, err := hex.DecodeString(hash); err != nil {
+		return nil, os.ErrNotExist
+	}
+	return os.Open(s.path(hash))
+}
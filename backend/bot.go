@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Bot is a server-side pseudo-user. Bots appear in the user list like any
+// other client, can be added to groups, receive private messages and
+// mentions, and provide slash commands to the groups they belong to.
+type Bot struct {
+	Name        string
+	Description string
+
+	// OnMessage is called for private messages sent to the bot and for
+	// group messages that mention it. If nil, the bot replies with its help.
+	OnMessage func(bot *Bot, msg protocol.Message)
+
+	commands map[string]*BotCommand
+}
+
+// BotCommand is a slash command provided by a bot
+type BotCommand struct {
+	Name      string // Command name without the leading slash
+	Usage     string // Argument synopsis, e.g. "<duration> <text>"
+	Help      string // One line description
+	MinArgs   int    // Minimum number of arguments
+	AdminOnly bool   // Only the group owner and admins may run the command
+	// Handler runs the command. Its error is shown to the user as the
+	// reason the command failed.
+	Handler func(ctx *CommandContext) error
+}
+
+// CommandContext carries a single slash command invocation
+type CommandContext struct {
+	Bot     *Bot
+	Group   string   // Group the command was run in
+	User    string   // User who ran the command
+	IsAdmin bool     // Whether User is the group owner or an admin
+	Args    []string // Parsed arguments
+}
+
+var (
+	bots    = make(map[string]*Bot) // key: bot name
+	botsMux sync.RWMutex
+)
+
+// AddCommand registers a slash command on the bot
+func (b *Bot) AddCommand(cmd *BotCommand) {
+	if b.commands == nil {
+		b.commands = make(map[string]*BotCommand)
+	}
+	b.commands[strings.ToLower(cmd.Name)] = cmd
+}
+
+// SendGroup posts a group message as the bot
+func (b *Bot) SendGroup(groupID, content string) {
+	deliverGroupMessage(protocol.Message{
+		Type:      protocol.TypeGroupMessage,
+		From:      b.Name,
+		To:        groupID,
+		Content:   content,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+}
+
+// SendPrivate sends a private message from the bot to a user
+func (b *Bot) SendPrivate(username, content string) {
+	deliverPrivateMessage(protocol.Message{
+		Type:      protocol.TypePrivateMessage,
+		From:      b.Name,
+		To:        username,
+		Content:   content,
+		Timestamp: time.Now().Format(time.RFC3339),
+	})
+}
+
+// helpText describes the bot and its commands
+func (b *Bot) helpText() string {
+	var sb strings.Builder
+	sb.WriteString(b.Name)
+	if b.Description != "" {
+		sb.WriteString(": " + b.Description)
+	}
+	for _, cmd := range b.sortedCommands() {
+		sb.WriteString("\n" + cmd.synopsis())
+	}
+	return sb.String()
+}
+
+func (b *Bot) sortedCommands() []*BotCommand {
+	cmds := make([]*BotCommand, 0, len(b.commands))
+	for _, cmd := range b.commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// synopsis returns a help line such as "/remind <duration> <text> - Set a reminder"
+func (cmd *BotCommand) synopsis() string {
+	line := "/" + cmd.Name
+	if cmd.Usage != "" {
+		line += " " + cmd.Usage
+	}
+	if cmd.Help != "" {
+		line += " - " + cmd.Help
+	}
+	if cmd.AdminOnly {
+		line += " (admin only)"
+	}
+	return line
+}
+
+// registerBot adds a bot to the clients map so it shows up as a connected
+// user, and starts the goroutine that consumes its messages
+func registerBot(b *Bot) {
+	client := &Client{
+		Username: b.Name,
+		send:     make(chan outFrame, 256),
+	}
+
+	botsMux.Lock()
+	bots[b.Name] = b
+	botsMux.Unlock()
+
+	clientsMux.Lock()
+	clients[b.Name] = client
+	clientsMux.Unlock()
+
+	log.Printf("Registered bot: %s", b.Name)
+	go b.run(client)
+}
+
+// isBot reports whether username belongs to a registered bot
+func isBot(username string) bool {
+	botsMux.RLock()
+	defer botsMux.RUnlock()
+	_, exists := bots[username]
+	return exists
+}
+
+// botNames returns the sorted names of all registered bots
+func botNames() []string {
+	botsMux.RLock()
+	names := make([]string, 0, len(bots))
+	for name := range bots {
+		names = append(names, name)
+	}
+	botsMux.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// run plays the role of writePump for a bot: it reads everything the server
+// sends to the bot and hands chat messages addressed to it to OnMessage
+func (b *Bot) run(client *Client) {
+	for f := range client.send {
+		var msg protocol.Message
+		if err := json.Unmarshal(f.data, &msg); err != nil {
+			continue
+		}
+		if msg.From == b.Name {
+			continue
+		}
+
+		switch msg.Type {
+		case protocol.TypePrivateMessage:
+			if msg.To != b.Name {
+				continue
+			}
+		case protocol.TypeGroupMessage:
+			if !mentions(msg.Content, b.Name) {
+				continue
+			}
+		default:
+			continue
+		}
+
+		if b.OnMessage != nil {
+			b.OnMessage(b, msg)
+		} else {
+			b.SendPrivate(msg.From, b.helpText())
+		}
+	}
+	log.Printf("Bot %s stopped", b.Name)
+}
+
+// mentions reports whether content contains an @name mention
+func mentions(content, name string) bool {
+	return contains(parseMentions(content), strings.ToLower(name))
+}
+
+func isNameChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' || r == '-' || r == '.'
+}
+
+// isSlashCommand reports whether a message should be handled as a command
+func isSlashCommand(content string) bool {
+	return len(content) > 1 && content[0] == '/' && content[1] != '/' && content[1] != ' '
+}
+
+// parseCommandArgs splits a command line into arguments. Arguments are
+// separated by whitespace; single or double quotes group words together.
+func parseCommandArgs(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	var quote rune
+	inArg := false
+
+	for _, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				current.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, current.String())
+				current.Reset()
+				inArg = false
+			}
+		default:
+			current.WriteRune(r)
+			inArg = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+// groupCommand is a command together with the bot that provides it
+type groupCommand struct {
+	bot *Bot
+	cmd *BotCommand
+}
+
+// groupCommands returns the commands of every bot that is a member of the group
+func groupCommands(members []string) map[string]groupCommand {
+	available := make(map[string]groupCommand)
+
+	botsMux.RLock()
+	defer botsMux.RUnlock()
+	for _, member := range members {
+		b, ok := bots[member]
+		if !ok {
+			continue
+		}
+		for name, cmd := range b.commands {
+			if _, taken := available[name]; !taken {
+				available[name] = groupCommand{b, cmd}
+			}
+		}
+	}
+	return available
+}
+
+// handleSlashCommand parses a "/command args..." group message and runs it
+// on the bot in the group that provides the command
+func handleSlashCommand(msg protocol.Message) {
+	groupsMux.RLock()
+	group, exists := groups[msg.To]
+	var members []string
+	var role string
+	if exists {
+		members = append(members, group.Members...)
+		role = groupRole(group, msg.From)
+	}
+	groupsMux.RUnlock()
+
+	if !exists {
+		log.Printf("Group %s not found", msg.To)
+		return
+	}
+	if !contains(members, msg.From) {
+		log.Printf("User %s is not a member of group %s", msg.From, msg.To)
+		return
+	}
+
+	args, err := parseCommandArgs(msg.Content[1:])
+	if err != nil {
+		sendCommandReply(msg.From, "", fmt.Sprintf("Could not parse command: %v", err))
+		return
+	}
+	if len(args) == 0 {
+		return
+	}
+	name := strings.ToLower(args[0])
+	args = args[1:]
+
+	available := groupCommands(members)
+
+	if name == "help" {
+		sendCommandReply(msg.From, "", commandHelp(available))
+		return
+	}
+
+	entry, ok := available[name]
+	if !ok {
+		sendCommandReply(msg.From, "", fmt.Sprintf("Unknown command /%s. Type /help to list commands.", name))
+		return
+	}
+
+	ctx := &CommandContext{
+		Bot:     entry.bot,
+		Group:   msg.To,
+		User:    msg.From,
+		IsAdmin: isAdminRole(role),
+		Args:    args,
+	}
+
+	if entry.cmd.AdminOnly && !ctx.IsAdmin {
+		log.Printf("User %s is not authorized to run /%s in group %s", msg.From, name, msg.To)
+		sendCommandReply(msg.From, entry.bot.Name, fmt.Sprintf("Only group admins can run /%s", name))
+		return
+	}
+	if len(args) < entry.cmd.MinArgs {
+		sendCommandReply(msg.From, entry.bot.Name, "Usage: "+entry.cmd.synopsis())
+		return
+	}
+
+	log.Printf("User %s running /%s in group %s via bot %s", msg.From, name, msg.To, entry.bot.Name)
+	if err := entry.cmd.Handler(ctx); err != nil {
+		sendCommandReply(msg.From, entry.bot.Name, fmt.Sprintf("/%s failed: %v", name, err))
+	}
+}
+
+// commandHelp lists the commands available in a group
+func commandHelp(available map[string]groupCommand) string {
+	if len(available) == 0 {
+		return "No commands are available in this group. Add a bot to the group to enable its commands."
+	}
+
+	names := make([]string, 0, len(available))
+	for name := range available {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := []string{"Available commands:"}
+	for _, name := range names {
+		entry := available[name]
+		lines = append(lines, fmt.Sprintf("%s [%s]", entry.cmd.synopsis(), entry.bot.Name))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sendCommandReply sends command feedback to the user who ran it without
+// storing it in any conversation
+func sendCommandReply(username, botName, content string) {
+	reply := protocol.Message{
+		Type:      protocol.TypeSystem,
+		From:      botName,
+		To:        username,
+		Content:   content,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	msgBytes, _ := json.Marshal(reply)
+	sendToUser(username, msgBytes)
+}
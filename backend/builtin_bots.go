@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Built-in bot names
+const (
+	PollBotName   = "pollbot"
+	RemindBotName = "remindbot"
+)
+
+// maxReminderDelay caps how far in the future /remind may schedule
+const maxReminderDelay = 7 * 24 * time.Hour
+
+// poll is an open poll in a group
+type poll struct {
+	Question string
+	Options  []string
+	Creator  string
+	Votes    map[string]int // key: username, value: option index
+}
+
+var (
+	polls    = make(map[string]*poll) // key: group ID
+	pollsMux sync.Mutex
+)
+
+// registerBuiltinBots registers the bots that ship with the server
+func registerBuiltinBots() {
+	registerBot(newPollBot())
+	registerBot(newRemindBot())
+}
+
+// newPollBot returns a bot that runs simple polls in groups
+func newPollBot() *Bot {
+	b := &Bot{
+		Name:        PollBotName,
+		Description: "Runs polls in groups",
+	}
+
+	b.AddCommand(&BotCommand{
+		Name:    "poll",
+		Usage:   `"<question>" "<option>" "<option>" ...`,
+		Help:    "Start a poll",
+		MinArgs: 3,
+		Handler: func(ctx *CommandContext) error {
+			pollsMux.Lock()
+			if _, exists := polls[ctx.Group]; exists {
+				pollsMux.Unlock()
+				return errors.New("a poll is already running in this group; close it with /endpoll first")
+			}
+			p := &poll{
+				Question: ctx.Args[0],
+				Options:  ctx.Args[1:],
+				Creator:  ctx.User,
+				Votes:    make(map[string]int),
+			}
+			polls[ctx.Group] = p
+			pollsMux.Unlock()
+
+			lines := []string{fmt.Sprintf("%s started a poll: %s", ctx.User, p.Question)}
+			for i, option := range p.Options {
+				lines = append(lines, fmt.Sprintf("%d. %s", i+1, option))
+			}
+			lines = append(lines, "Vote with /vote <number>")
+			ctx.Bot.SendGroup(ctx.Group, strings.Join(lines, "\n"))
+			return nil
+		},
+	})
+
+	b.AddCommand(&BotCommand{
+		Name:    "vote",
+		Usage:   "<number>",
+		Help:    "Vote in the current poll",
+		MinArgs: 1,
+		Handler: func(ctx *CommandContext) error {
+			choice, err := strconv.Atoi(ctx.Args[0])
+			if err != nil {
+				return fmt.Errorf("%q is not an option number", ctx.Args[0])
+			}
+
+			pollsMux.Lock()
+			p, exists := polls[ctx.Group]
+			if !exists {
+				pollsMux.Unlock()
+				return errors.New("there is no poll running in this group")
+			}
+			if choice < 1 || choice > len(p.Options) {
+				pollsMux.Unlock()
+				return fmt.Errorf("choose an option between 1 and %d", len(p.Options))
+			}
+			p.Votes[ctx.User] = choice - 1
+			option := p.Options[choice-1]
+			pollsMux.Unlock()
+
+			sendCommandReply(ctx.User, ctx.Bot.Name, fmt.Sprintf("You voted for %q", option))
+			return nil
+		},
+	})
+
+	b.AddCommand(&BotCommand{
+		Name: "results",
+		Help: "Show the current poll results",
+		Handler: func(ctx *CommandContext) error {
+			pollsMux.Lock()
+			p, exists := polls[ctx.Group]
+			var summary string
+			if exists {
+				summary = p.summary()
+			}
+			pollsMux.Unlock()
+
+			if !exists {
+				return errors.New("there is no poll running in this group")
+			}
+			sendCommandReply(ctx.User, ctx.Bot.Name, summary)
+			return nil
+		},
+	})
+
+	b.AddCommand(&BotCommand{
+		Name:      "endpoll",
+		Help:      "Close the current poll and post the results",
+		AdminOnly: true,
+		Handler: func(ctx *CommandContext) error {
+			pollsMux.Lock()
+			p, exists := polls[ctx.Group]
+			if !exists {
+				pollsMux.Unlock()
+				return errors.New("there is no poll running in this group")
+			}
+			delete(polls, ctx.Group)
+			summary := p.summary()
+			pollsMux.Unlock()
+
+			ctx.Bot.SendGroup(ctx.Group, "Poll closed. "+summary)
+			return nil
+		},
+	})
+
+	return b
+}
+
+// summary renders the vote tally. The caller must hold pollsMux.
+func (p *poll) summary() string {
+	counts := make([]int, len(p.Options))
+	for _, choice := range p.Votes {
+		counts[choice]++
+	}
+
+	lines := []string{fmt.Sprintf("Results for %q (%d votes):", p.Question, len(p.Votes))}
+	for i, option := range p.Options {
+		lines = append(lines, fmt.Sprintf("%d. %s: %d", i+1, option, counts[i]))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// newRemindBot returns a bot that sends reminders after a delay
+func newRemindBot() *Bot {
+	b := &Bot{
+		Name:        RemindBotName,
+		Description: "Sends you a private reminder after a delay",
+	}
+
+	b.AddCommand(&BotCommand{
+		Name:    "remind",
+		Usage:   "<duration> <text>",
+		Help:    "Remind yourself, e.g. /remind 10m stand-up",
+		MinArgs: 2,
+		Handler: func(ctx *CommandContext) error {
+			delay, err := time.ParseDuration(ctx.Args[0])
+			if err != nil || delay <= 0 {
+				return fmt.Errorf("%q is not a valid duration, use e.g. 30s, 10m or 2h", ctx.Args[0])
+			}
+			if delay > maxReminderDelay {
+				return fmt.Errorf("reminders can be at most %s away", maxReminderDelay)
+			}
+
+			text := strings.Join(ctx.Args[1:], " ")
+			user, group, bot := ctx.User, ctx.Group, ctx.Bot
+			time.AfterFunc(delay, func() {
+				if !botInGroup(bot.Name, group) {
+					log.Printf("Dropped the reminder of %s: group %s is gone or %s left it", user, group, bot.Name)
+					return
+				}
+				log.Printf("Sending reminder to %s from group %s", user, group)
+				bot.SendPrivate(user, fmt.Sprintf("Reminder from %s: %s", groupLabel(group), text))
+			})
+
+			sendCommandReply(ctx.User, ctx.Bot.Name, fmt.Sprintf("I'll remind you in %s", delay))
+			return nil
+		},
+	})
+
+	b.AddCommand(&BotCommand{
+		Name:      "announce",
+		Usage:     "<duration> <text>",
+		Help:      "Post a reminder to the whole group after a delay",
+		MinArgs:   2,
+		AdminOnly: true,
+		Handler: func(ctx *CommandContext) error {
+			delay, err := time.ParseDuration(ctx.Args[0])
+			if err != nil || delay <= 0 {
+				return fmt.Errorf("%q is not a valid duration, use e.g. 30s, 10m or 2h", ctx.Args[0])
+			}
+			if delay > maxReminderDelay {
+				return fmt.Errorf("reminders can be at most %s away", maxReminderDelay)
+			}
+
+			content := "Reminder: " + strings.Join(ctx.Args[1:], " ")
+			user, group, bot := ctx.User, ctx.Group, ctx.Bot
+			time.AfterFunc(delay, func() {
+				if reason := checkAnnouncement(bot.Name, user, group, content); reason != "" {
+					log.Printf("Dropped the announcement of %s in group %s: %s", user, group, reason)
+					return
+				}
+				bot.SendGroup(group, content)
+			})
+
+			sendCommandReply(ctx.User, ctx.Bot.Name, fmt.Sprintf("I'll remind the group in %s", delay))
+			return nil
+		},
+	})
+
+	return b
+}
+
+// botInGroup reports whether a group still exists and bot is a member.
+// Timers check it before posting, since the group may be deleted or the bot
+// removed while they wait.
+func botInGroup(bot, groupID string) bool {
+	groupsMux.RLock()
+	defer groupsMux.RUnlock()
+
+	group, exists := groups[groupID]
+	return exists && contains(group.Members, bot)
+}
+
+// checkAnnouncement returns why an announcement that user scheduled in a
+// group must be dropped when it is due, or "". The group and its policies
+// may have changed since it was scheduled, so it is checked again as if the
+// user posted it now.
+func checkAnnouncement(bot, user, groupID, content string) string {
+	groupsMux.RLock()
+	group, exists := groups[groupID]
+	present := exists && contains(group.Members, bot)
+	var role string
+	if present {
+		role = groupRole(group, user)
+	}
+	groupsMux.RUnlock()
+
+	if !present {
+		return fmt.Sprintf("the group is gone or %s left it", bot)
+	}
+	if !isAdminRole(role) {
+		return fmt.Sprintf("%s is no longer an admin", user)
+	}
+
+	msg := protocol.Message{Type: protocol.TypeGroupMessage, From: user, To: groupID, Content: content}
+	if reason := checkMute(msg); reason != "" {
+		return reason
+	}
+	msg.From = bot
+	if reason := checkMute(msg); reason != "" {
+		return reason
+	}
+	msg.From = user
+	return checkPostingPolicy(msg)
+}
+
+// deleteGroupPolls forgets the poll of a deleted group
+func deleteGroupPolls(groupID string) {
+	pollsMux.Lock()
+	defer pollsMux.Unlock()
+
+	delete(polls, groupID)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// maxPreviewMessages is how much history of a public group non-members see
+const maxPreviewMessages = 50
+
+// isPublicGroup reports whether a group is listed in the directory and open
+// to everyone
+func isPublicGroup(groupID string) bool {
+	groupsMux.RLock()
+	defer groupsMux.RUnlock()
+
+	group, exists := groups[groupID]
+	return exists && group.Visibility == protocol.VisibilityPublic
+}
+
+// groupHistoryFor returns the history of a group as username may see it:
+// everything for members, the latest messages of a public group as a
+// preview for everyone else, and nothing for private groups
+func groupHistoryFor(username, groupID string) []protocol.Message {
+	if isGroupMember(groupID, username) {
+		return getGroupHistory(groupID)
+	}
+	if !isPublicGroup(groupID) {
+		log.Printf("User %s is not allowed to read the history of group %s", username, groupID)
+		return []protocol.Message{}
+	}
+
+	history := getGroupHistory(groupID)
+	if len(history) > maxPreviewMessages {
+		history = history[len(history)-maxPreviewMessages:]
+	}
+	log.Printf("Previewing %d messages of group %s for %s", len(history), groupID, username)
+	return history
+}
+
+// getPublicGroups returns the directory of public groups, sorted by name
+func getPublicGroups() []protocol.PublicGroup {
+	groupsMux.RLock()
+	directory := make([]protocol.PublicGroup, 0)
+	for _, group := range groups {
+		if group.Visibility != protocol.VisibilityPublic {
+			continue
+		}
+		directory = append(directory, protocol.PublicGroup{
+			ID:          group.ID,
+			Name:        group.Name,
+			Topic:       group.Topic,
+			Description: group.Description,
+			Avatar:      group.Avatar,
+			MemberCount: len(group.Members),
+			CreatedAt:   group.CreatedAt,
+		})
+	}
+	groupsMux.RUnlock()
+
+	sort.Slice(directory, func(i, j int) bool {
+		return strings.ToLower(directory[i].Name) < strings.ToLower(directory[j].Name)
+	})
+	return directory
+}
+
+// sendPublicGroups answers a list_public_groups message
+func sendPublicGroups(client *Client) {
+	directory := getPublicGroups()
+	message := map[string]interface{}{
+		protocol.KeyType:         protocol.TypePublicGroups,
+		protocol.KeyPublicGroups: directory,
+		protocol.KeyTimestamp:    time.Now().Format(time.RFC3339),
+	}
+
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling public groups for client %s: %v", client.Username, err)
+		return
+	}
+
+	log.Printf("Sending %d public groups to %s", len(directory), client.Username)
+	sendToUser(client.Username, messageBytes)
+}
+
+// joinGroup adds the sender to a public group. msg.To is the group's ID or
+// name, since people find public groups by name. Private groups are
+// reported as not found, so outsiders cannot tell whether they exist.
+func joinGroup(msg protocol.Message) {
+	groupID, exists := lookupGroup(msg.To, msg.From)
+	if exists && isGroupMember(groupID, msg.From) {
+		sendError(msg.From, fmt.Sprintf("You are already a member of %s", groupLabel(groupID)))
+		return
+	}
+	if !exists || !isPublicGroup(groupID) {
+		sendError(msg.From, fmt.Sprintf("Group %s not found", msg.To))
+		return
+	}
+	name := groupLabel(groupID)
+	if !addMember(groupID, msg.From) {
+		sendError(msg.From, fmt.Sprintf("Group %s no longer exists", name))
+		return
+	}
+
+	log.Printf("User %s joined public group %s", msg.From, groupID)
+	recordAudit(msg.From, protocol.ActionJoinGroup, groupID, msg.From, "public group")
+	sendGroupNotice(groupID, fmt.Sprintf("%s joined the group", msg.From))
+	sendGroupList()
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// httpURL turns a path on the server into an absolute HTTP URL derived from
+// the WebSocket URL, adding the client's username as a query parameter
+func (c *Client) httpURL(path string, query url.Values) (string, error) {
+	u, err := url.Parse(c.cfg.URL)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+
+	if query == nil {
+		query = url.Values{}
+	}
+	query.Set("username", c.cfg.Username)
+
+	u.Path = path
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// UploadAttachment uploads a file to a conversation. The returned attachment
+// can be passed to SendPrivateWithAttachments or SendGroupWithAttachments.
+func (c *Client) UploadAttachment(ctx context.Context, chatType, chatID, name string, r io.Reader) (protocol.Attachment, error) {
+	var attachment protocol.Attachment
+
+	endpoint, err := c.httpURL("/api/attachments", url.Values{
+		"chat_type": {chatType},
+		"chat_id":   {chatID},
+	})
+	if err != nil {
+		return attachment, err
+	}
+
+	// Stream the multipart body instead of buffering the whole file
+	body, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+	go func() {
+		part, err := form.CreateFormFile("file", name)
+		if err == nil {
+			_, err = io.Copy(part, r)
+		}
+		if err == nil {
+			err = form.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, body)
+	if err != nil {
+		body.Close()
+		return attachment, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return attachment, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return attachment, fmt.Errorf("client: upload failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&attachment); err != nil {
+		return attachment, fmt.Errorf("client: decoding upload response: %w", err)
+	}
+	return attachment, nil
+}
+
+// AttachmentURL returns an absolute download URL for an attachment that is
+// authorized for the client's user
+func (c *Client) AttachmentURL(attachment protocol.Attachment) (string, error) {
+	return c.httpURL("/api/attachments/"+attachment.ID, nil)
+}
+
+// SendPrivateWithAttachments sends a private message with uploaded files
+func (c *Client) SendPrivateWithAttachments(to, content string, attachments ...protocol.Attachment) error {
+	return c.Send(protocol.Message{Type: protocol.TypePrivateMessage, To: to, Content: content, Attachments: refs(attachments)})
+}
+
+// SendGroupWithAttachments sends a group message with uploaded files
+func (c *Client) SendGroupWithAttachments(group, content string, attachments ...protocol.Attachment) error {
+	return c.Send(protocol.Message{Type: protocol.TypeGroupMessage, To: group, Content: content, Attachments: refs(attachments)})
+}
+
+// refs strips attachments down to their IDs, which is all the server reads
+func refs(attachments []protocol.Attachment) []protocol.Attachment {
+	out := make([]protocol.Attachment, len(attachments))
+	for i, a := range attachments {
+		out[i] = protocol.Attachment{ID: a.ID}
+	}
+	return out
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.cfg.HTTPClient != nil {
+		return c.cfg.HTTPClient
+	}
+	return http.DefaultClient
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"context"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// PublicGroups returns the directory of public groups, sorted by name. Use
+// History to preview a public group's recent messages before joining it.
+func (c *Client) PublicGroups(ctx context.Context) ([]protocol.PublicGroup, error) {
+	reply, err := c.request(ctx, protocol.TypePublicGroups, func() error {
+		return c.Send(protocol.Message{Type: protocol.TypeListPublicGroups})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.PublicGroups, nil
+}
+
+// JoinGroup joins a public group by ID or name
+func (c *Client) JoinGroup(group string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeJoinGroup, To: group})
+}
+
+// SetGroupVisibility makes a group protocol.VisibilityPublic or
+// protocol.VisibilityPrivate
+func (c *Client) SetGroupVisibility(group, visibility string) error {
+	return c.UpdateGroup(group, protocol.GroupUpdate{Visibility: &visibility})
+}
@@ -0,0 +1,719 @@
+// Package client is a Go client for the ChatSync server.
+//
+// A Client keeps a WebSocket connection to the server's /ws endpoint open,
+// reconnecting with exponential backoff when it drops, and turns incoming
+// frames into typed callbacks:
+//
+//	c, err := client.Dial(ctx, client.Config{
+//		URL:      "ws://localhost:8080/ws",
+//		Username: "deploy-bot",
+//		Handlers: client.Handlers{
+//			OnPrivateMessage: func(msg protocol.Message) {
+//				log.Printf("%s: %s", msg.From, msg.Content)
+//			},
+//		},
+//	})
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	defer c.Close()
+//	c.SendPrivate("alice", "deploy finished")
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// ErrNotConnected is returned by send methods while the client is
+	// between connections
+	ErrNotConnected = errors.New("client: not connected")
+
+	// ErrClosed is returned once the client has been closed or has given up
+	// reconnecting
+	ErrClosed = errors.New("client: closed")
+)
+
+// Default reconnect and write settings
+const (
+	DefaultMinBackoff = 500 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+	writeWait         = 10 * time.Second
+)
+
+// Handlers are the event callbacks of a Client. Every field is optional.
+// Callbacks run on the client's read goroutine, so they should return
+// quickly; they may call the Client's send methods.
+type Handlers struct {
+	// OnConnect is called after every successful (re)connect
+	OnConnect func()
+	// OnDisconnect is called when an established connection drops
+	OnDisconnect func(err error)
+	// OnResume is called when the server resumed the session after a
+	// reconnect. The frames missed in between follow, and the server sends
+	// no fresh user and group lists.
+	OnResume func()
+
+	OnPrivateMessage func(msg protocol.Message)
+	OnGroupMessage   func(msg protocol.Message)
+	OnSystem         func(msg protocol.Message)
+	OnUserList       func(users, bots []string)
+	OnGroupList      func(groups []protocol.Group)
+	OnUnreadCounts   func(counts map[string]int)
+	OnMentionCounts  func(counts map[string]int) // Unread mentions per group
+	OnMention        func(msg protocol.Message)  // A group message mentioning the user
+	OnMessageDeleted func(chatType, chatID, messageID, by string)
+	OnError          func(msg protocol.Message) // A request was rejected
+	OnInvitation     func(inv protocol.Invitation)
+	OnJoinRequest    func(req protocol.JoinRequest)
+	OnProfile        func(profile protocol.UserProfile) // The user's own profile, on connect and on change
+	OnReport         func(report protocol.Report)       // A report was filed or handled
+
+	// OnRetention is called when the retention policy of a chat changes;
+	// chatID is the group ID, or the other user of a private chat
+	OnRetention func(chatID string, policy protocol.RetentionPolicy)
+
+	// OnInvitationList receives the pending invitations and join requests
+	// after every connect
+	OnInvitationList func(invitations []protocol.Invitation, requests []protocol.JoinRequest)
+	OnHistory        func(chatType, chatID string, messages []protocol.Message)
+	OnWebhookList    func(group string, webhooks []protocol.Webhook)
+	OnSearchResults  func(query string, results []protocol.Message)
+
+	// OnFrame receives every frame, including types this package does not
+	// know about, before the typed callbacks run
+	OnFrame func(frameType string, data []byte)
+}
+
+// Config configures a Client
+type Config struct {
+	URL      string // WebSocket endpoint, e.g. ws://localhost:8080/ws
+	Username string
+
+	// Dialer is used to open connections; defaults to websocket.DefaultDialer
+	// with compression enabled
+	Dialer *websocket.Dialer
+
+	// HTTPClient is used for uploads, exports and imports; defaults to
+	// http.DefaultClient
+	HTTPClient *http.Client
+
+	// MinBackoff and MaxBackoff bound the delay between reconnect attempts
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// MaxRetries is the number of consecutive failed reconnect attempts
+	// after which the client gives up. Zero retries forever.
+	MaxRetries int
+
+	// Binary asks the server for MessagePack frames, which are smaller than
+	// JSON. Servers without MessagePack support fall back to JSON.
+	Binary bool
+
+	// Companion connects alongside the user's own connection instead of
+	// replacing it. The server neither announces nor lists the user for a
+	// companion, and sends it everything sent to the user. Tools that act
+	// for a user who may be chatting elsewhere should set it.
+	Companion bool
+
+	Handlers Handlers
+}
+
+// Client is a connection to a ChatSync server
+type Client struct {
+	cfg    Config
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu      sync.Mutex
+	conn    *websocket.Conn
+	waiters map[string][]chan *frame // Pending requests, see request
+	token   string                   // Resume token of the session
+	seq     uint64                   // Frames received in the session
+
+	writeMu sync.Mutex
+}
+
+// frame is a superset of every frame the server sends
+type frame struct {
+	ID          string                `json:"id"`
+	Type        string                `json:"type"`
+	From        string                `json:"from"`
+	To          string                `json:"to"`
+	Content     json.RawMessage       `json:"content"`
+	Timestamp   string                `json:"timestamp"`
+	Integration string                `json:"integration"`
+	Attachments []protocol.Attachment `json:"attachments"`
+	Mentions    []string              `json:"mentions"`
+	ExpiresAt   string                `json:"expires_at"`
+	ChatType    string                `json:"chat_type"`
+	Users       map[string]string     `json:"users"`
+	Bots        []string              `json:"bots"`
+	Groups      []protocol.Group      `json:"groups"`
+	Webhooks    []protocol.Webhook    `json:"webhooks"`
+	Query       string                `json:"query"`
+	Results     []protocol.Message    `json:"results"`
+	Error       string                `json:"error"`
+
+	MentionCounts map[string]int            `json:"mention_counts"`
+	Invitation    *protocol.Invitation      `json:"invitation"`
+	Invitations   []protocol.Invitation     `json:"invitations"`
+	JoinRequest   *protocol.JoinRequest     `json:"join_request"`
+	JoinRequests  []protocol.JoinRequest    `json:"join_requests"`
+	PublicGroups  []protocol.PublicGroup    `json:"public_groups"`
+	Profile       *protocol.UserProfile     `json:"profile"`
+	Report        *protocol.Report          `json:"report"`
+	Reports       []protocol.Report         `json:"reports"`
+	AuditLog      []protocol.AuditEntry     `json:"audit_log"`
+	Filters       *protocol.FilterConfig    `json:"filters"`
+	Retention     *protocol.RetentionPolicy `json:"retention"`
+
+	Token   string `json:"token"`
+	Resumed bool   `json:"resumed"`
+	Seq     uint64 `json:"seq"`
+}
+
+// Dial connects to the server and starts the client. The first connection
+// attempt is made synchronously and its error is returned; later drops are
+// handled by reconnecting in the background until Close is called.
+func Dial(ctx context.Context, cfg Config) (*Client, error) {
+	if cfg.URL == "" {
+		return nil, errors.New("client: URL is required")
+	}
+	if cfg.Username == "" {
+		return nil, errors.New("client: Username is required")
+	}
+	if cfg.Dialer == nil {
+		dialer := *websocket.DefaultDialer
+		dialer.EnableCompression = true
+		cfg.Dialer = &dialer
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = DefaultMinBackoff
+	}
+	if cfg.MaxBackoff < cfg.MinBackoff {
+		cfg.MaxBackoff = DefaultMaxBackoff
+		if cfg.MaxBackoff < cfg.MinBackoff {
+			cfg.MaxBackoff = cfg.MinBackoff
+		}
+	}
+
+	c := &Client{
+		cfg:     cfg,
+		done:    make(chan struct{}),
+		waiters: make(map[string][]chan *frame),
+	}
+	c.ctx, c.cancel = context.WithCancel(context.Background())
+
+	conn, err := c.connect(ctx)
+	if err != nil {
+		c.cancel()
+		return nil, err
+	}
+
+	go c.run(conn)
+	return c, nil
+}
+
+// Close disconnects from the server and stops reconnecting
+func (c *Client) Close() error {
+	c.cancel()
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+
+	if conn != nil {
+		c.writeMu.Lock()
+		conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(writeWait))
+		c.writeMu.Unlock()
+		conn.Close()
+	}
+
+	<-c.done
+	return nil
+}
+
+// Done is closed when the client has stopped, either because Close was
+// called or because it gave up reconnecting
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// Connected reports whether the client currently has an open connection
+func (c *Client) Connected() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.conn != nil
+}
+
+// Username returns the username the client connects as
+func (c *Client) Username() string {
+	return c.cfg.Username
+}
+
+// connect dials the server once
+func (c *Client) connect(ctx context.Context) (*websocket.Conn, error) {
+	u, err := url.Parse(c.cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("client: invalid URL: %w", err)
+	}
+	q := u.Query()
+	q.Set("username", c.cfg.Username)
+	if c.cfg.Companion {
+		q.Set("companion", "true")
+	}
+	c.mu.Lock()
+	if c.token != "" {
+		q.Set("resume", c.token)
+		q.Set("seq", strconv.FormatUint(c.seq, 10))
+	}
+	c.mu.Unlock()
+	u.RawQuery = q.Encode()
+
+	var header http.Header
+	if c.cfg.Binary {
+		header = http.Header{"Sec-WebSocket-Protocol": {protocol.SubprotocolMsgpack}}
+	}
+	conn, resp, err := c.cfg.Dialer.DialContext(ctx, u.String(), header)
+	if err != nil {
+		if resp != nil {
+			return nil, fmt.Errorf("client: dial %s: %w (HTTP %d)", c.cfg.URL, err, resp.StatusCode)
+		}
+		return nil, fmt.Errorf("client: dial %s: %w", c.cfg.URL, err)
+	}
+
+	// Close may have run while dialing; it only closes the conn it finds
+	// here, so a conn stored after it would never be closed
+	c.mu.Lock()
+	if c.ctx.Err() != nil {
+		c.mu.Unlock()
+		conn.Close()
+		return nil, ErrClosed
+	}
+	c.conn = conn
+	c.mu.Unlock()
+
+	if c.cfg.Handlers.OnConnect != nil {
+		c.cfg.Handlers.OnConnect()
+	}
+	return conn, nil
+}
+
+// run reads from conn until it fails, then reconnects, until the client is
+// closed or runs out of retries
+func (c *Client) run(conn *websocket.Conn) {
+	defer close(c.done)
+
+	for {
+		err := c.readLoop(conn)
+
+		c.mu.Lock()
+		c.conn = nil
+		c.mu.Unlock()
+		conn.Close()
+
+		if c.ctx.Err() != nil {
+			return
+		}
+		if c.cfg.Handlers.OnDisconnect != nil {
+			c.cfg.Handlers.OnDisconnect(err)
+		}
+
+		conn = c.reconnect()
+		if conn == nil {
+			return
+		}
+		if c.ctx.Err() != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// reconnect retries connecting with exponential backoff and jitter. It
+// returns nil if the client was closed or MaxRetries was exceeded.
+func (c *Client) reconnect() *websocket.Conn {
+	delay := c.cfg.MinBackoff
+	for attempt := 1; c.cfg.MaxRetries == 0 || attempt <= c.cfg.MaxRetries; attempt++ {
+		// Wait between half and all of the current delay
+		wait := delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+		select {
+		case <-time.After(wait):
+		case <-c.ctx.Done():
+			return nil
+		}
+
+		conn, err := c.connect(c.ctx)
+		if err == nil {
+			return conn
+		}
+		log.Printf("client: reconnect attempt %d for %s failed: %v", attempt, c.cfg.Username, err)
+
+		delay *= 2
+		if delay > c.cfg.MaxBackoff {
+			delay = c.cfg.MaxBackoff
+		}
+	}
+
+	log.Printf("client: giving up reconnecting %s after %d attempts", c.cfg.Username, c.cfg.MaxRetries)
+	c.cancel()
+	return nil
+}
+
+// readLoop dispatches frames from conn until reading fails
+func (c *Client) readLoop(conn *websocket.Conn) error {
+	for {
+		messageType, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if messageType == websocket.BinaryMessage {
+			if data, err = protocol.MsgpackToJSON(nil, data); err != nil {
+				log.Printf("client: error decoding frame: %v", err)
+				continue
+			}
+		}
+		c.dispatch(data)
+	}
+}
+
+// dispatch decodes a frame and calls the matching handler
+func (c *Client) dispatch(data []byte) {
+	var f frame
+	err := json.Unmarshal(data, &f)
+	if err == nil && f.Type == protocol.TypeSession {
+		c.startSession(&f)
+		return
+	}
+
+	// Every other frame counts towards where a resumed session continues
+	c.mu.Lock()
+	c.seq++
+	c.mu.Unlock()
+	if err != nil {
+		log.Printf("client: error decoding frame: %v", err)
+		return
+	}
+
+	h := c.cfg.Handlers
+	if h.OnFrame != nil {
+		h.OnFrame(f.Type, data)
+	}
+
+	switch f.Type {
+	case protocol.TypePrivateMessage, protocol.TypeGroupMessage, protocol.TypeSystem, protocol.TypeMention:
+		msg := f.message()
+		switch {
+		case f.Type == protocol.TypeMention && h.OnMention != nil:
+			msg.Type = protocol.TypeGroupMessage
+			h.OnMention(msg)
+		case f.Type == protocol.TypePrivateMessage && h.OnPrivateMessage != nil:
+			h.OnPrivateMessage(msg)
+		case f.Type == protocol.TypeGroupMessage && h.OnGroupMessage != nil:
+			h.OnGroupMessage(msg)
+		case f.Type == protocol.TypeSystem && h.OnSystem != nil:
+			h.OnSystem(msg)
+		}
+	case protocol.TypeUserList:
+		if h.OnUserList != nil {
+			users := make([]string, 0, len(f.Users))
+			for username := range f.Users {
+				users = append(users, username)
+			}
+			sort.Strings(users)
+			h.OnUserList(users, f.Bots)
+		}
+	case protocol.TypeGroupList:
+		if h.OnGroupList != nil {
+			h.OnGroupList(f.Groups)
+		}
+	case protocol.TypeUnreadCount:
+		if h.OnUnreadCounts != nil {
+			counts := make(map[string]int)
+			if err := json.Unmarshal([]byte(f.contentString()), &counts); err != nil {
+				log.Printf("client: error decoding unread counts: %v", err)
+				return
+			}
+			h.OnUnreadCounts(counts)
+		}
+		if h.OnMentionCounts != nil {
+			counts := f.MentionCounts
+			if counts == nil {
+				counts = make(map[string]int)
+			}
+			h.OnMentionCounts(counts)
+		}
+	case protocol.TypeHistory:
+		var messages []protocol.Message
+		if err := json.Unmarshal(f.Content, &messages); err != nil {
+			log.Printf("client: error decoding history: %v", err)
+			return
+		}
+		c.resolve(historyKey(f.ChatType, f.To), &f)
+		if h.OnHistory != nil {
+			h.OnHistory(f.ChatType, f.To, messages)
+		}
+	case protocol.TypeSearchResults:
+		c.resolve(searchKey(f.Query), &f)
+		if h.OnSearchResults != nil {
+			h.OnSearchResults(f.Query, f.Results)
+		}
+	case protocol.TypeMentions:
+		c.resolve(protocol.TypeMentions, &f)
+	case protocol.TypeMessageDeleted:
+		if h.OnMessageDeleted != nil {
+			chatID := f.To
+			if f.ChatType == protocol.TypePrivate && f.To == c.cfg.Username {
+				chatID = f.From
+			}
+			h.OnMessageDeleted(f.ChatType, chatID, f.contentString(), f.From)
+		}
+	case protocol.TypeError:
+		c.rejectPending(&f)
+		if h.OnError != nil {
+			h.OnError(f.message())
+		}
+	case protocol.TypeInvitation:
+		if f.Invitation == nil {
+			return
+		}
+		inv := *f.Invitation
+		if inv.Code != "" && inv.Uses == 0 && inv.Inviter == c.cfg.Username && inv.Status == protocol.StatusPending {
+			c.resolve(inviteCodeKey(inv.Group), &f)
+		}
+		if h.OnInvitation != nil {
+			h.OnInvitation(inv)
+		}
+	case protocol.TypeJoinRequest:
+		if f.JoinRequest != nil && h.OnJoinRequest != nil {
+			h.OnJoinRequest(*f.JoinRequest)
+		}
+	case protocol.TypeInvitationList:
+		c.resolve(protocol.TypeInvitationList, &f)
+		if h.OnInvitationList != nil {
+			h.OnInvitationList(f.Invitations, f.JoinRequests)
+		}
+	case protocol.TypePublicGroups:
+		c.resolve(protocol.TypePublicGroups, &f)
+	case protocol.TypeProfile:
+		if f.Profile == nil {
+			return
+		}
+		c.resolve(protocol.TypeProfile, &f)
+		if h.OnProfile != nil {
+			h.OnProfile(*f.Profile)
+		}
+	case protocol.TypeReport:
+		if f.Report != nil && h.OnReport != nil {
+			h.OnReport(*f.Report)
+		}
+	case protocol.TypeReports:
+		c.resolve(protocol.TypeReports, &f)
+	case protocol.TypeAuditLog:
+		c.resolve(auditLogKey(f.To), &f)
+	case protocol.TypeFilters:
+		if f.Filters != nil {
+			c.resolve(filtersKey(f.To), &f)
+		}
+	case protocol.TypeRetention:
+		if f.Retention == nil {
+			return
+		}
+		c.resolve(retentionKey(f.To), &f)
+		if f.From != "" && h.OnRetention != nil {
+			h.OnRetention(f.To, *f.Retention)
+		}
+	case protocol.TypeWebhookList:
+		if h.OnWebhookList != nil {
+			h.OnWebhookList(f.To, f.Webhooks)
+		}
+	}
+}
+
+// startSession handles the session frame a connection starts with
+func (c *Client) startSession(f *frame) {
+	c.mu.Lock()
+	resumed := f.Resumed && c.token == f.Token
+	c.token, c.seq = f.Token, f.Seq
+	c.mu.Unlock()
+
+	if resumed && c.cfg.Handlers.OnResume != nil {
+		c.cfg.Handlers.OnResume()
+	}
+}
+
+// contentString returns the content of a frame whose content is a string
+func (f *frame) contentString() string {
+	var s string
+	if len(f.Content) > 0 {
+		json.Unmarshal(f.Content, &s)
+	}
+	return s
+}
+
+func (f *frame) message() protocol.Message {
+	return protocol.Message{
+		ID:          f.ID,
+		Type:        f.Type,
+		From:        f.From,
+		To:          f.To,
+		Content:     f.contentString(),
+		Timestamp:   f.Timestamp,
+		Integration: f.Integration,
+		Attachments: f.Attachments,
+		Mentions:    f.Mentions,
+		ExpiresAt:   f.ExpiresAt,
+	}
+}
+
+// Send writes a raw protocol message to the server. From and Timestamp are
+// filled in by the server.
+func (c *Client) Send(msg protocol.Message) error {
+	if c.ctx.Err() != nil {
+		return ErrClosed
+	}
+
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	messageType := websocket.TextMessage
+	if conn.Subprotocol() == protocol.SubprotocolMsgpack {
+		if data, err = protocol.JSONToMsgpack(nil, data); err != nil {
+			return err
+		}
+		messageType = websocket.BinaryMessage
+	}
+
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return conn.WriteMessage(messageType, data)
+}
+
+// SendPrivate sends a private message to a user
+func (c *Client) SendPrivate(to, content string) error {
+	return c.Send(protocol.Message{Type: protocol.TypePrivateMessage, To: to, Content: content})
+}
+
+// SendGroup sends a message to a group. Groups are addressed by their ID
+// (protocol.Group.ID) everywhere except CreateGroup and RequestJoin.
+func (c *Client) SendGroup(group, content string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeGroupMessage, To: group, Content: content})
+}
+
+// CreateGroup creates a group owned by the client's user and invites the
+// given members. The server assigns the group's ID and rejects names that
+// are already taken.
+func (c *Client) CreateGroup(name string, members ...string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeCreateGroup, To: name, Content: strings.Join(members, ",")})
+}
+
+// AddGroupMember invites a user into a group; the user joins once they
+// accept. Bots are added directly. It requires the owner, admin or
+// moderator role.
+func (c *Client) AddGroupMember(group, username string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeAddGroupMember, To: group, Content: username})
+}
+
+// RemoveGroupMember removes a member ranked below the client from a group
+func (c *Client) RemoveGroupMember(group, username string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeRemoveGroupMember, To: group, Content: username})
+}
+
+// LeaveGroup leaves a group
+func (c *Client) LeaveGroup(group string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeLeaveGroup, To: group})
+}
+
+// UpdateGroup changes the name, topic, description or avatar of a group.
+// Nil fields are left unchanged.
+func (c *Client) UpdateGroup(group string, update protocol.GroupUpdate) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	return c.Send(protocol.Message{Type: protocol.TypeUpdateGroup, To: group, Content: string(data)})
+}
+
+// RenameGroup renames a group; its ID stays the same
+func (c *Client) RenameGroup(group, name string) error {
+	return c.UpdateGroup(group, protocol.GroupUpdate{Name: &name})
+}
+
+// SetGroupRole changes the role of a group member, e.g. to
+// protocol.RoleModerator or protocol.RoleReadOnly
+func (c *Client) SetGroupRole(group, username, role string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeSetGroupRole, To: group, Content: username + "," + role})
+}
+
+// TransferOwnership makes another member the owner of a group the client
+// owns. The client becomes an admin.
+func (c *Client) TransferOwnership(group, username string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeTransferOwnership, To: group, Content: username})
+}
+
+// DeleteMessage deletes a message from a chat (a username or group ID) by
+// its ID
+func (c *Client) DeleteMessage(chatID, messageID string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeDeleteMessage, To: chatID, Content: messageID})
+}
+
+// MarkRead marks a chat (a username or group ID) as read up to now
+func (c *Client) MarkRead(chatID string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeUpdateLastSeen, To: chatID})
+}
+
+// RequestHistory asks the server for a conversation's history. The reply is
+// delivered to Handlers.OnHistory; use History to wait for it instead.
+func (c *Client) RequestHistory(chatType, chatID string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeRequestHistory, To: chatType, Content: chatID})
+}
+
+// RequestUnreadCounts asks the server for the current unread counts; the
+// reply is delivered to Handlers.OnUnreadCounts
+func (c *Client) RequestUnreadCounts() error {
+	return c.Send(protocol.Message{Type: protocol.TypeRequestUnread})
+}
+
+// CreateWebhook creates an incoming webhook in a group the client administers
+func (c *Client) CreateWebhook(group, name string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeCreateWebhook, To: group, Content: name})
+}
+
+// DeleteWebhook deletes an incoming webhook from a group
+func (c *Client) DeleteWebhook(group, webhookID string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeDeleteWebhook, To: group, Content: webhookID})
+}
+
+// ListWebhooks requests the webhooks of a group; the reply is delivered to
+// Handlers.OnWebhookList
+func (c *Client) ListWebhooks(group string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeListWebhooks, To: group})
+}
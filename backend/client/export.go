@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Export writes a conversation to w in one of the protocol.Export* formats.
+// Group members can export their groups and users their private chats.
+func (c *Client) Export(ctx context.Context, chatType, chatID, format string, w io.Writer) error {
+	endpoint, err := c.httpURL("/api/export", url.Values{
+		"chat_type": {chatType},
+		"chat_id":   {chatID},
+		"format":    {format},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("client: export failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// Import loads a JSON lines export into a conversation, keeping the original
+// authors and timestamps; messages get new IDs. chatID is the group to
+// import into and is ignored for private chats, whose messages keep their
+// own participants. Importing is part of the admin API, so adminToken must
+// be the server's CHATSYNC_ADMIN_TOKEN.
+func (c *Client) Import(ctx context.Context, adminToken, chatType, chatID string, r io.Reader) (protocol.ImportResult, error) {
+	var result protocol.ImportResult
+
+	endpoint, err := c.httpURL("/api/import", url.Values{
+		"chat_type": {chatType},
+		"chat_id":   {chatID},
+	})
+	if err != nil {
+		return result, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, r)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return result, fmt.Errorf("client: import failed: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("client: decoding import response: %w", err)
+	}
+	return result, nil
+}
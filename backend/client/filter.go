@@ -0,0 +1,35 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// SetFilters replaces the content filters of a group, which run after the
+// server default. A config without rules leaves only the server default.
+func (c *Client) SetFilters(group string, config protocol.FilterConfig) error {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return c.Send(protocol.Message{Type: protocol.TypeSetFilters, To: group, Content: string(data)})
+}
+
+// Filters returns the content filters of a group, without the server
+// default that applies before them
+func (c *Client) Filters(ctx context.Context, group string) (protocol.FilterConfig, error) {
+	reply, err := c.request(ctx, filtersKey(group), func() error {
+		return c.Send(protocol.Message{Type: protocol.TypeRequestFilters, To: group})
+	})
+	if err != nil {
+		return protocol.FilterConfig{}, err
+	}
+	return *reply.Filters, nil
+}
+
+// filtersKey identifies a pending Filters request
+func filtersKey(group string) string {
+	return protocol.TypeFilters + ":" + group
+}
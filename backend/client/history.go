@@ -0,0 +1,66 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// HistoryIterator walks the messages of a conversation, oldest first
+//
+//	it, err := c.History(ctx, protocol.TypeGroup, groupID)
+//	if err != nil {
+//		return err
+//	}
+//	for it.Next() {
+//		msg := it.Message()
+//		fmt.Println(msg.From, msg.Content)
+//	}
+type HistoryIterator struct {
+	messages []protocol.Message
+	pos      int
+}
+
+// Next advances to the next message and reports whether there is one
+func (it *HistoryIterator) Next() bool {
+	if it.pos >= len(it.messages) {
+		return false
+	}
+	it.pos++
+	return true
+}
+
+// Message returns the current message. It must only be called after Next
+// returned true.
+func (it *HistoryIterator) Message() protocol.Message {
+	return it.messages[it.pos-1]
+}
+
+// Len returns the total number of messages in the conversation
+func (it *HistoryIterator) Len() int {
+	return len(it.messages)
+}
+
+// History fetches the history of a conversation and returns an iterator over
+// it. chatType is protocol.TypePrivate with the other user's name as chatID,
+// or protocol.TypeGroup with the group ID.
+func (c *Client) History(ctx context.Context, chatType, chatID string) (*HistoryIterator, error) {
+	reply, err := c.request(ctx, historyKey(chatType, chatID), func() error {
+		return c.RequestHistory(chatType, chatID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var messages []protocol.Message
+	if err := json.Unmarshal(reply.Content, &messages); err != nil {
+		return nil, fmt.Errorf("client: decoding history: %w", err)
+	}
+	return &HistoryIterator{messages: messages}, nil
+}
+
+func historyKey(chatType, chatID string) string {
+	return protocol.TypeHistory + ":" + chatType + ":" + chatID
+}
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// CreateInviteCode creates a shareable code for a group that anyone can
+// redeem with AcceptInvitation. A zero ttl uses the server default and zero
+// maxUses allows unlimited uses. Rejections are reported to
+// Handlers.OnError, so ctx should carry a deadline.
+func (c *Client) CreateInviteCode(ctx context.Context, group string, ttl time.Duration, maxUses int) (protocol.Invitation, error) {
+	content := ""
+	if ttl > 0 {
+		content = ttl.String()
+	}
+	if maxUses > 0 {
+		content += "," + strconv.Itoa(maxUses)
+	}
+
+	reply, err := c.request(ctx, inviteCodeKey(group), func() error {
+		return c.Send(protocol.Message{Type: protocol.TypeCreateInviteCode, To: group, Content: content})
+	})
+	if err != nil {
+		return protocol.Invitation{}, err
+	}
+	return *reply.Invitation, nil
+}
+
+// AcceptInvitation joins a group through an invitation ID or invite code
+func (c *Client) AcceptInvitation(idOrCode string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeAcceptInvitation, Content: idOrCode})
+}
+
+// DeclineInvitation turns down an invitation
+func (c *Client) DeclineInvitation(id string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeDeclineInvitation, Content: id})
+}
+
+// RevokeInvitation withdraws an invitation or invite code
+func (c *Client) RevokeInvitation(id string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeRevokeInvitation, Content: id})
+}
+
+// RequestJoin asks the admins of a group to let the client in. Since the
+// client is not a member yet, group may be the name of a public group instead
+// of its ID; private groups are only found by ID. Public groups are joined
+// right away.
+func (c *Client) RequestJoin(group, note string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeRequestJoin, To: group, Content: note})
+}
+
+// ApproveJoinRequest lets the user of a join request into the group
+func (c *Client) ApproveJoinRequest(id string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeApproveJoin, Content: id})
+}
+
+// DenyJoinRequest turns down a join request
+func (c *Client) DenyJoinRequest(id string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeDenyJoin, Content: id})
+}
+
+// Invitations returns the pending invitations the client's user received or
+// sent, and the join requests they made or can decide
+func (c *Client) Invitations(ctx context.Context) ([]protocol.Invitation, []protocol.JoinRequest, error) {
+	reply, err := c.request(ctx, protocol.TypeInvitationList, func() error {
+		return c.Send(protocol.Message{Type: protocol.TypeListInvitations})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply.Invitations, reply.JoinRequests, nil
+}
+
+func inviteCodeKey(group string) string {
+	return protocol.TypeCreateInviteCode + ":" + group
+}
@@ -0,0 +1,19 @@
+package client
+
+import (
+	"context"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Mentions returns the most recent group messages that mention the client's
+// user by name, @here or @all, newest first
+func (c *Client) Mentions(ctx context.Context) ([]protocol.Message, error) {
+	reply, err := c.request(ctx, protocol.TypeMentions, func() error {
+		return c.Send(protocol.Message{Type: protocol.TypeRequestMentions})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Results, nil
+}
@@ -0,0 +1,82 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// MuteMember keeps a member from posting in a group for the given duration
+func (c *Client) MuteMember(group, username string, duration time.Duration, reason string) error {
+	content := fmt.Sprintf("%s,%s,%s", username, duration, reason)
+	return c.Send(protocol.Message{Type: protocol.TypeMuteMember, To: group, Content: content})
+}
+
+// UnmuteMember lifts the mute of a group member
+func (c *Client) UnmuteMember(group, username string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeUnmuteMember, To: group, Content: username})
+}
+
+// BanUser keeps a user off the server for the given duration, or for good
+// if it is zero. Only server moderators may ban.
+func (c *Client) BanUser(username string, duration time.Duration, reason string) error {
+	length := "permanent"
+	if duration > 0 {
+		length = duration.String()
+	}
+	content := fmt.Sprintf("%s,%s,%s", username, length, reason)
+	return c.Send(protocol.Message{Type: protocol.TypeBanUser, Content: content})
+}
+
+// UnbanUser lifts the ban of a user
+func (c *Client) UnbanUser(username string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeUnbanUser, Content: username})
+}
+
+// ReportMessage flags a message for the moderators. chatID is the group or,
+// for private messages, the other user.
+func (c *Client) ReportMessage(chatID, messageID, reason string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeReportMessage, To: chatID, Content: messageID + "," + reason})
+}
+
+// Reports returns the reports the user filed or may handle, newest first.
+// A non-empty status such as protocol.StatusPending filters them.
+func (c *Client) Reports(ctx context.Context, status string) ([]protocol.Report, error) {
+	reply, err := c.request(ctx, protocol.TypeReports, func() error {
+		return c.Send(protocol.Message{Type: protocol.TypeListReports, Content: status})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Reports, nil
+}
+
+// ResolveReport marks a pending report as acted upon
+func (c *Client) ResolveReport(id, note string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeResolveReport, Content: id + "," + note})
+}
+
+// DismissReport closes a pending report without action
+func (c *Client) DismissReport(id, note string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeDismissReport, Content: id + "," + note})
+}
+
+// AuditLog returns the latest audit entries of a group, newest first,
+// without logins or source addresses. Server moderators may pass an empty
+// group for the whole server.
+func (c *Client) AuditLog(ctx context.Context, group string) ([]protocol.AuditEntry, error) {
+	reply, err := c.request(ctx, auditLogKey(group), func() error {
+		return c.Send(protocol.Message{Type: protocol.TypeRequestAuditLog, To: group})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply.AuditLog, nil
+}
+
+// auditLogKey identifies a pending AuditLog request
+func auditLogKey(group string) string {
+	return protocol.TypeAuditLog + ":" + group
+}
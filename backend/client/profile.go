@@ -0,0 +1,41 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Profile returns the client's user profile: their block list and privacy
+// settings
+func (c *Client) Profile(ctx context.Context) (protocol.UserProfile, error) {
+	reply, err := c.request(ctx, protocol.TypeProfile, func() error {
+		return c.Send(protocol.Message{Type: protocol.TypeRequestProfile})
+	})
+	if err != nil {
+		return protocol.UserProfile{}, err
+	}
+	return *reply.Profile, nil
+}
+
+// BlockUser drops private messages and group invitations from a user. The
+// blocked user is not told.
+func (c *Client) BlockUser(username string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeBlockUser, Content: username})
+}
+
+// UnblockUser removes a user from the block list
+func (c *Client) UnblockUser(username string) error {
+	return c.Send(protocol.Message{Type: protocol.TypeUnblockUser, Content: username})
+}
+
+// UpdatePrivacy changes who may send the user private messages or invite
+// them into groups. Nil fields are left unchanged.
+func (c *Client) UpdatePrivacy(update protocol.PrivacyUpdate) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	return c.Send(protocol.Message{Type: protocol.TypeUpdatePrivacy, Content: string(data)})
+}
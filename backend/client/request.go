@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"errors"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// request sends a request with send and waits for the reply frame that
+// resolve delivers under the same key. Concurrent requests with the same key
+// are answered in order. If the server rejects the request, the error frame
+// is returned as an error.
+func (c *Client) request(ctx context.Context, key string, send func() error) (*frame, error) {
+	ch := make(chan *frame, 1)
+
+	c.mu.Lock()
+	c.waiters[key] = append(c.waiters[key], ch)
+	c.mu.Unlock()
+
+	if err := send(); err != nil {
+		c.removeWaiter(key, ch)
+		return nil, err
+	}
+
+	select {
+	case reply := <-ch:
+		if reply.Type == protocol.TypeError {
+			return nil, errors.New("client: " + reply.contentString())
+		}
+		return reply, nil
+	case <-ctx.Done():
+		c.removeWaiter(key, ch)
+		return nil, ctx.Err()
+	case <-c.done:
+		return nil, ErrClosed
+	}
+}
+
+// resolve hands a reply frame to the oldest request waiting on key
+func (c *Client) resolve(key string, reply *frame) {
+	c.mu.Lock()
+	waiters := c.waiters[key]
+	if len(waiters) == 0 {
+		c.mu.Unlock()
+		return
+	}
+	ch := waiters[0]
+	if len(waiters) == 1 {
+		delete(c.waiters, key)
+	} else {
+		c.waiters[key] = waiters[1:]
+	}
+	c.mu.Unlock()
+
+	ch <- reply
+}
+
+// rejectPending hands an error frame to every pending request. Error frames
+// do not say which request they answer, so rather than leave the rejected
+// one waiting until its context ends, all of them fail; callers may retry.
+func (c *Client) rejectPending(reply *frame) {
+	c.mu.Lock()
+	waiters := c.waiters
+	c.waiters = make(map[string][]chan *frame)
+	c.mu.Unlock()
+
+	for _, chans := range waiters {
+		for _, ch := range chans {
+			ch <- reply
+		}
+	}
+}
+
+func (c *Client) removeWaiter(key string, ch chan *frame) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	waiters := c.waiters[key]
+	for i, w := range waiters {
+		if w == ch {
+			c.waiters[key] = append(waiters[:i:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(c.waiters[key]) == 0 {
+		delete(c.waiters, key)
+	}
+}
@@ -0,0 +1,35 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// SetRetention replaces the retention policy of a chat: a group, or the
+// other user of a private chat. A zero policy removes the chat's limits.
+func (c *Client) SetRetention(chatID string, policy protocol.RetentionPolicy) error {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	return c.Send(protocol.Message{Type: protocol.TypeSetRetention, To: chatID, Content: string(data)})
+}
+
+// Retention returns the retention policy a chat sets for itself. The
+// server's own limits may be stricter.
+func (c *Client) Retention(ctx context.Context, chatID string) (protocol.RetentionPolicy, error) {
+	reply, err := c.request(ctx, retentionKey(chatID), func() error {
+		return c.Send(protocol.Message{Type: protocol.TypeRequestRetention, To: chatID})
+	})
+	if err != nil {
+		return protocol.RetentionPolicy{}, err
+	}
+	return *reply.Retention, nil
+}
+
+// retentionKey identifies a pending Retention request
+func retentionKey(chatID string) string {
+	return protocol.TypeRetention + ":" + chatID
+}
@@ -0,0 +1,29 @@
+package client
+
+import (
+	"context"
+	"errors"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Search runs a full-text search over the conversations the client's user
+// belongs to and returns the hits, newest first. The query supports words,
+// "quoted phrases" and the filters from:USER, in:USER, in:#GROUP,
+// after:DATE and before:DATE.
+func (c *Client) Search(ctx context.Context, query string) ([]protocol.Message, error) {
+	reply, err := c.request(ctx, searchKey(query), func() error {
+		return c.Send(protocol.Message{Type: protocol.TypeSearch, Content: query})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if reply.Error != "" {
+		return nil, errors.New("client: search: " + reply.Error)
+	}
+	return reply.Results, nil
+}
+
+func searchKey(query string) string {
+	return protocol.TypeSearch + ":" + query
+}
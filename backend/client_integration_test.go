@@ -0,0 +1,3048 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/client"
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+	"github.com/gorilla/websocket"
+)
+
+const testTimeout = 5 * time.Second
+
+// resetServerState clears the global server state between tests
+func resetServerState() {
+	clientsMux.Lock()
+	clients = make(map[string]*Client)
+	companions = make(map[string]map[*Client]bool)
+	clientsMux.Unlock()
+
+	groupsMux.Lock()
+	groups = make(map[string]*protocol.Group)
+	groupsMux.Unlock()
+
+	msgMux.Lock()
+	privateMessages = make(map[string][]protocol.Message)
+	groupMessages = make(map[string][]protocol.Message)
+	msgMux.Unlock()
+
+	lastSeenMux.Lock()
+	lastSeenTimestamps = make(map[string]map[string]string)
+	lastSeenMux.Unlock()
+
+	webhooksMux.Lock()
+	webhooks = make(map[string]*protocol.Webhook)
+	webhooksMux.Unlock()
+
+	attachmentsMux.Lock()
+	attachments = make(map[string]*attachmentRecord)
+	attachmentsMux.Unlock()
+
+	invitationsMux.Lock()
+	invitations = make(map[string]*protocol.Invitation)
+	inviteCodes = make(map[string]string)
+	joinRequests = make(map[string]*protocol.JoinRequest)
+	invitationsMux.Unlock()
+
+	lastPostsMux.Lock()
+	lastPosts = make(map[string]map[string]time.Time)
+	lastPostsMux.Unlock()
+
+	profilesMux.Lock()
+	profiles = make(map[string]*protocol.UserProfile)
+	profilesMux.Unlock()
+
+	moderationMux.Lock()
+	serverModerators = make(map[string]bool)
+	bans = make(map[string]*protocol.Ban)
+	reports = nil
+	auditLog = nil
+	moderationMux.Unlock()
+
+	filtersMux.Lock()
+	groupFilters = make(map[string]*groupFilter)
+	defaultFilters, defaultChain = protocol.FilterConfig{}, nil
+	filtersMux.Unlock()
+
+	retentionMux.Lock()
+	serverRetention = protocol.RetentionPolicy{}
+	dmRetention = make(map[string]protocol.RetentionPolicy)
+	retentionMux.Unlock()
+
+	rateLimiter.Configure(defaultQuotas())
+	adminToken = ""
+
+	searchIndex = NewSearchIndex()
+	stopCluster()
+}
+
+// newTestServer starts an in-process server and returns its WebSocket URL
+func newTestServer(t *testing.T) string {
+	t.Helper()
+	resetServerState()
+
+	store, err := NewBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("NewBlobStore failed: %v", err)
+	}
+	blobStore = store
+
+	if profileStore, err = NewProfileStore(t.TempDir()); err != nil {
+		t.Fatalf("NewProfileStore failed: %v", err)
+	}
+	if moderationStore, err = NewModerationStore(t.TempDir()); err != nil {
+		t.Fatalf("NewModerationStore failed: %v", err)
+	}
+
+	buildFS := fstest.MapFS{"index.html": {Data: []byte("<html></html>")}}
+	server := httptest.NewServer(newServeMux(buildFS))
+	t.Cleanup(server.Close)
+
+	return "ws" + strings.TrimPrefix(server.URL, "http") + "/ws"
+}
+
+// testUser is a connected SDK client that records what it receives
+type testUser struct {
+	*client.Client
+
+	private chan protocol.Message
+	group   chan protocol.Message
+	groups  chan []protocol.Group
+	unread  chan map[string]int
+	mention chan protocol.Message
+	errors  chan protocol.Message
+	deleted chan string
+	invites chan protocol.Invitation
+	joins   chan protocol.JoinRequest
+	hooks   chan []protocol.Webhook
+	system  chan protocol.Message
+
+	mu            sync.Mutex
+	users         []string
+	mentionCounts map[string]int
+	connects      int
+}
+
+func dialTestUser(t *testing.T, url, username string) *testUser {
+	t.Helper()
+
+	u := &testUser{
+		private: make(chan protocol.Message, 16),
+		group:   make(chan protocol.Message, 64),
+		groups:  make(chan []protocol.Group, 64),
+		unread:  make(chan map[string]int, 64),
+		mention: make(chan protocol.Message, 16),
+		errors:  make(chan protocol.Message, 16),
+		deleted: make(chan string, 16),
+		invites: make(chan protocol.Invitation, 64),
+		joins:   make(chan protocol.JoinRequest, 16),
+		hooks:   make(chan []protocol.Webhook, 16),
+		system:  make(chan protocol.Message, 64),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	c, err := client.Dial(ctx, client.Config{
+		URL:        url,
+		Username:   username,
+		MinBackoff: 10 * time.Millisecond,
+		MaxBackoff: 50 * time.Millisecond,
+		Handlers: client.Handlers{
+			OnConnect: func() {
+				u.mu.Lock()
+				u.connects++
+				u.mu.Unlock()
+			},
+			OnPrivateMessage: func(msg protocol.Message) { u.private <- msg },
+			OnGroupMessage:   func(msg protocol.Message) { u.group <- msg },
+			OnSystem:         func(msg protocol.Message) { u.system <- msg },
+			OnGroupList:      func(groups []protocol.Group) { u.groups <- groups },
+			OnUnreadCounts:   func(counts map[string]int) { u.unread <- counts },
+			OnMention:        func(msg protocol.Message) { u.mention <- msg },
+			OnError:          func(msg protocol.Message) { u.errors <- msg },
+			OnInvitation:     func(inv protocol.Invitation) { u.invites <- inv },
+			OnJoinRequest:    func(req protocol.JoinRequest) { u.joins <- req },
+			OnMessageDeleted: func(chatType, chatID, messageID, by string) { u.deleted <- messageID },
+			OnWebhookList:    func(group string, hooks []protocol.Webhook) { u.hooks <- hooks },
+			OnMentionCounts: func(counts map[string]int) {
+				u.mu.Lock()
+				u.mentionCounts = counts
+				u.mu.Unlock()
+			},
+			OnUserList: func(users, bots []string) {
+				u.mu.Lock()
+				u.users = users
+				u.mu.Unlock()
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Dial(%s) failed: %v", username, err)
+	}
+	t.Cleanup(func() { c.Close() })
+
+	u.Client = c
+	return u
+}
+
+// waitFor polls cond until it holds or the test times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (u *testUser) sees(username string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return contains(u.users, username)
+}
+
+func (u *testUser) connectCount() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.connects
+}
+
+func receive[T any](t *testing.T, ch <-chan T, what string) T {
+	t.Helper()
+	select {
+	case v := <-ch:
+		return v
+	case <-time.After(testTimeout):
+		t.Fatalf("timed out waiting for %s", what)
+		var zero T
+		return zero
+	}
+}
+
+// invitation waits for an invitation of the named group in the given state
+func (u *testUser) invitation(t *testing.T, group, status string) protocol.Invitation {
+	t.Helper()
+	for {
+		inv := receive(t, u.invites, "invitation to "+group)
+		if inv.GroupName == group && inv.Status == status {
+			return inv
+		}
+	}
+}
+
+// join accepts the user's invitation to a group and waits until they are in
+func (u *testUser) join(t *testing.T, group string) protocol.Group {
+	t.Helper()
+	inv := u.invitation(t, group, protocol.StatusPending)
+	if err := u.AcceptInvitation(inv.ID); err != nil {
+		t.Fatalf("AcceptInvitation failed: %v", err)
+	}
+	return u.waitGroup(t, group, func(g protocol.Group) bool { return contains(g.Members, u.Username()) })
+}
+
+func TestClientPrivateMessage(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	if err := alice.SendPrivate("bob", "hello bob"); err != nil {
+		t.Fatalf("SendPrivate failed: %v", err)
+	}
+
+	msg := receive(t, bob.private, "private message")
+	if msg.From != "alice" || msg.To != "bob" || msg.Content != "hello bob" {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+	if msg.Timestamp == "" {
+		t.Error("expected server to set a timestamp")
+	}
+
+	counts := receive(t, bob.unread, "unread counts")
+	if counts["alice"] != 1 {
+		t.Errorf("expected 1 unread message from alice, got %v", counts)
+	}
+}
+
+func TestClientGroupMessage(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	if err := alice.CreateGroup("ops", "bob"); err != nil {
+		t.Fatalf("CreateGroup failed: %v", err)
+	}
+
+	g := bob.join(t, "ops")
+	if g.Admin != "alice" || g.ID == "" || g.ID == g.Name {
+		t.Errorf("unexpected group: %+v", g)
+	}
+
+	if err := bob.SendGroup(g.ID, "deploying"); err != nil {
+		t.Fatalf("SendGroup failed: %v", err)
+	}
+
+	msg := receive(t, alice.group, "group message")
+	if msg.From != "bob" || msg.To != g.ID || msg.Content != "deploying" {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+}
+
+func TestClientWebhooks(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	if err := alice.CreateGroup("ops", "bob"); err != nil {
+		t.Fatalf("CreateGroup failed: %v", err)
+	}
+	g := bob.join(t, "ops")
+
+	expectError := func(u *testUser, want string) {
+		t.Helper()
+		if msg := receive(t, u.errors, "error "+want); !strings.Contains(msg.Content, want) {
+			t.Errorf("%s got error %q, want %q", u.Username(), msg.Content, want)
+		}
+	}
+
+	// Members without the permission are told so
+	bob.CreateWebhook(g.ID, "ci")
+	expectError(bob, "not allowed to manage the webhooks of ops")
+	bob.ListWebhooks(g.ID)
+	expectError(bob, "not allowed to manage the webhooks of ops")
+
+	// Webhooks cannot post as a user
+	alice.CreateWebhook(g.ID, "bob")
+	expectError(alice, "bob is the name of a user or bot")
+	alice.CreateWebhook(g.ID, " ")
+	expectError(alice, "needs a name")
+
+	alice.CreateWebhook(g.ID, "ci")
+	hooks := receive(t, alice.hooks, "webhook list")
+	if len(hooks) != 1 || hooks[0].Name != "ci" || hooks[0].Group != g.ID {
+		t.Fatalf("unexpected webhooks %+v", hooks)
+	}
+	hook := hooks[0]
+
+	post := func(path, body string) int {
+		t.Helper()
+		resp, err := http.Post(httpBase(url)+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("posting to the webhook failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := post(hook.URL, `{"content": "build passed"}`); status != http.StatusNoContent {
+		t.Fatalf("posting to the webhook answered %d", status)
+	}
+	posted := receive(t, bob.group, "webhook message")
+	if posted.From != "ci" || posted.Integration != hook.ID || posted.Content != "build passed" {
+		t.Errorf("unexpected webhook message %+v", posted)
+	}
+
+	// Nobody may connect under the name of a webhook, and its messages
+	// belong to no user, so only moderators may delete them
+	if _, resp, err := websocket.DefaultDialer.Dial(url+"?username=ci", nil); err == nil || resp.StatusCode != http.StatusConflict {
+		t.Errorf("connecting as the webhook gave %v, want 409", err)
+	}
+	deleteMessage(protocol.Message{Type: protocol.TypeDeleteMessage, From: "ci", To: g.ID, Content: posted.ID})
+	bob.DeleteMessage(g.ID, posted.ID)
+	expectError(bob, "not allowed to delete this message")
+	if _, found := findMessage(groupMessages, g.ID, posted.ID); !found {
+		t.Fatal("the webhook message was deleted by a user")
+	}
+	alice.DeleteMessage(g.ID, posted.ID)
+	if id := receive(t, bob.deleted, "deletion"); id != posted.ID {
+		t.Errorf("deleted %s, want %s", id, posted.ID)
+	}
+	if status := post("/api/webhooks/"+hook.ID+"/wrong", `{"content": "x"}`); status != http.StatusNotFound {
+		t.Errorf("posting with a wrong token answered %d, want 404", status)
+	}
+
+	bob.DeleteWebhook(g.ID, hook.ID)
+	expectError(bob, "not allowed to manage the webhooks of ops")
+	alice.DeleteWebhook(g.ID, "nope")
+	expectError(alice, "Webhook nope not found")
+	alice.DeleteWebhook(g.ID, hook.ID)
+	if hooks := receive(t, alice.hooks, "webhook list"); len(hooks) != 0 {
+		t.Errorf("webhooks left after deleting: %+v", hooks)
+	}
+	if status := post(hook.URL, `{"content": "x"}`); status != http.StatusNotFound {
+		t.Errorf("posting to a deleted webhook answered %d, want 404", status)
+	}
+}
+
+func TestParseCommandArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+		err  bool
+	}{
+		{line: "", want: nil},
+		{line: "help", want: []string{"help"}},
+		{line: "  remind \t10m   stretch ", want: []string{"remind", "10m", "stretch"}},
+		{line: `poll "Lunch?" pizza 'sushi rolls'`, want: []string{"poll", "Lunch?", "pizza", "sushi rolls"}},
+		{line: `say "it's fine"`, want: []string{"say", "it's fine"}},
+		{line: `say 'a "quoted" word'`, want: []string{"say", `a "quoted" word`}},
+		{line: `x"y z"w`, want: []string{"xy zw"}},
+		{line: `empty "" ''`, want: []string{"empty", "", ""}},
+		{line: `say "open`, err: true},
+		{line: `it's`, err: true},
+	}
+	for _, tt := range tests {
+		got, err := parseCommandArgs(tt.line)
+		if (err != nil) != tt.err {
+			t.Errorf("parseCommandArgs(%q) error = %v, want error %v", tt.line, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseCommandArgs(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestIsSlashCommand(t *testing.T) {
+	tests := []struct {
+		content string
+		want    bool
+	}{
+		{"/help", true},
+		{"/poll a b", true},
+		{"/", false},
+		{"/ help", false},
+		{"//not a command", false},
+		{"hello /help", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := isSlashCommand(tt.content); got != tt.want {
+			t.Errorf("isSlashCommand(%q) = %v, want %v", tt.content, got, tt.want)
+		}
+	}
+}
+
+func TestBotRegistration(t *testing.T) {
+	url := newTestServer(t)
+	for _, name := range []string{"zbot", "abot"} {
+		registerBot(&Bot{Name: name})
+	}
+	t.Cleanup(func() {
+		botsMux.Lock()
+		delete(bots, "zbot")
+		delete(bots, "abot")
+		botsMux.Unlock()
+	})
+
+	if names := botNames(); !reflect.DeepEqual(names, []string{"abot", "zbot"}) {
+		t.Errorf("botNames() = %v, want [abot zbot]", names)
+	}
+
+	tests := []struct {
+		name   string
+		bot    bool
+		status int // Answer to a connection attempt under the name
+	}{
+		{"abot", true, http.StatusConflict},
+		{"zbot", true, http.StatusConflict},
+		{"ABOT", false, http.StatusSwitchingProtocols},
+		{"alice", false, http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		if got := isBot(tt.name); got != tt.bot {
+			t.Errorf("isBot(%q) = %v, want %v", tt.name, got, tt.bot)
+		}
+		conn, resp, err := websocket.DefaultDialer.Dial(url+"?username="+tt.name, nil)
+		if resp == nil {
+			t.Fatalf("connecting as %s failed: %v", tt.name, err)
+		}
+		if resp.StatusCode != tt.status {
+			t.Errorf("connecting as %s answered %d, want %d", tt.name, resp.StatusCode, tt.status)
+		}
+		if conn != nil {
+			conn.Close()
+		}
+
+		clientsMux.RLock()
+		c, registered := clients[tt.name]
+		clientsMux.RUnlock()
+		if tt.bot && (!registered || c.conn != nil) {
+			t.Errorf("bot %s is not registered as a client without a connection", tt.name)
+		}
+	}
+}
+
+func TestSlashCommandDispatch(t *testing.T) {
+	url := newTestServer(t)
+	bot := &Bot{Name: "testbot", Description: "Test commands"}
+	bot.AddCommand(&BotCommand{
+		Name:    "echo",
+		Usage:   "<text>...",
+		Help:    "Repeat text",
+		MinArgs: 1,
+		Handler: func(ctx *CommandContext) error {
+			ctx.Bot.SendGroup(ctx.Group, strings.Join(ctx.Args, "|"))
+			return nil
+		},
+	})
+	bot.AddCommand(&BotCommand{
+		Name:      "secret",
+		Help:      "Admins only",
+		AdminOnly: true,
+		Handler: func(ctx *CommandContext) error {
+			return fmt.Errorf("secret run by %s", ctx.User)
+		},
+	})
+	registerBot(bot)
+	t.Cleanup(func() {
+		botsMux.Lock()
+		delete(bots, "testbot")
+		botsMux.Unlock()
+	})
+
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+	if err := alice.CreateGroup("ops", "bob"); err != nil {
+		t.Fatalf("CreateGroup failed: %v", err)
+	}
+	g := bob.join(t, "ops")
+	if err := alice.AddGroupMember(g.ID, "testbot"); err != nil {
+		t.Fatalf("AddGroupMember failed: %v", err)
+	}
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool { return contains(g.Members, "testbot") })
+
+	// Skip the announcements so far; command replies are system messages too
+	broadcastSystemMessage("marker")
+	for _, u := range []*testUser{alice, bob} {
+		for receive(t, u.system, "marker").Content != "marker" {
+		}
+	}
+
+	tests := []struct {
+		user    *testUser
+		command string
+		reply   string // Expected reply to the user, or
+		post    string // expected group message from the bot
+	}{
+		{user: alice, command: "/help", reply: "/echo <text>... - Repeat text [testbot]"},
+		{user: bob, command: "/help", reply: "/secret - Admins only (admin only) [testbot]"},
+		{user: alice, command: "/nope", reply: "Unknown command /nope"},
+		{user: alice, command: "/echo", reply: "Usage: /echo <text>... - Repeat text"},
+		{user: alice, command: `/ECHO "hello world" again`, post: "hello world|again"},
+		{user: bob, command: "/echo 'it''s' fine", post: "its|fine"},
+		{user: alice, command: `/echo "open`, reply: "Could not parse command: unterminated quote"},
+		{user: bob, command: "/secret", reply: "Only group admins can run /secret"},
+		{user: alice, command: "/secret", reply: "secret run by alice"},
+	}
+	for _, tt := range tests {
+		if err := tt.user.SendGroup(g.ID, tt.command); err != nil {
+			t.Fatalf("SendGroup failed: %v", err)
+		}
+		if tt.reply != "" {
+			if msg := receive(t, tt.user.system, "reply to "+tt.command); !strings.Contains(msg.Content, tt.reply) {
+				t.Errorf("%s %s: got reply %q, want %q", tt.user.Username(), tt.command, msg.Content, tt.reply)
+			}
+			continue
+		}
+		for {
+			msg := receive(t, tt.user.group, "post for "+tt.command)
+			if msg.From == "testbot" && msg.Content == tt.post {
+				break
+			}
+			if msg.From == tt.user.Username() && msg.Content == tt.command {
+				t.Errorf("%s %s: the command was posted to the group", tt.user.Username(), tt.command)
+			}
+		}
+	}
+}
+
+func TestBuiltinBots(t *testing.T) {
+	url := newTestServer(t)
+	registerBuiltinBots()
+	t.Cleanup(func() {
+		botsMux.Lock()
+		delete(bots, PollBotName)
+		delete(bots, RemindBotName)
+		botsMux.Unlock()
+	})
+
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+	if err := alice.CreateGroup("ops", "bob"); err != nil {
+		t.Fatalf("CreateGroup failed: %v", err)
+	}
+	g := bob.join(t, "ops")
+	for _, bot := range []string{PollBotName, RemindBotName} {
+		if err := alice.AddGroupMember(g.ID, bot); err != nil {
+			t.Fatalf("AddGroupMember failed: %v", err)
+		}
+	}
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool { return contains(g.Members, RemindBotName) })
+	broadcastSystemMessage("marker")
+	for receive(t, bob.system, "marker").Content != "marker" {
+	}
+
+	// Command errors are shown as the reason the command failed
+	bob.SendGroup(g.ID, "/vote 1")
+	if msg := receive(t, bob.system, "vote reply"); msg.Content != "/vote failed: there is no poll running in this group" {
+		t.Errorf("bob got %q", msg.Content)
+	}
+
+	// Announcements are posted when due, unless the bot left the group
+	// (nextPost skips to the next group message that is not a command)
+	nextPost := func() protocol.Message {
+		t.Helper()
+		for {
+			if msg := receive(t, bob.group, "group message"); !strings.HasPrefix(msg.Content, "/") {
+				return msg
+			}
+		}
+	}
+	alice.SendGroup(g.ID, "/announce 10ms one")
+	if msg := nextPost(); msg.From != RemindBotName || msg.Content != "Reminder: one" {
+		t.Errorf("bob got %+v, want the first announcement", msg)
+	}
+	alice.SendGroup(g.ID, "/announce 100ms two")
+	if err := alice.RemoveGroupMember(g.ID, RemindBotName); err != nil {
+		t.Fatalf("RemoveGroupMember failed: %v", err)
+	}
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool { return !contains(g.Members, RemindBotName) })
+	time.Sleep(200 * time.Millisecond)
+	alice.SendGroup(g.ID, "after the announcement was due")
+	if msg := nextPost(); msg.Content != "after the announcement was due" {
+		t.Errorf("bob got %+v after the bot left the group", msg)
+	}
+
+	// Deleting a group closes its poll
+	alice.SendGroup(g.ID, `/poll "Lunch?" yes no`)
+	if msg := nextPost(); msg.From != PollBotName {
+		t.Errorf("bob got %+v, want the poll", msg)
+	}
+	bob.LeaveGroup(g.ID)
+	alice.LeaveGroup(g.ID)
+	waitFor(t, "the poll of ops to close", func() bool {
+		pollsMux.Lock()
+		defer pollsMux.Unlock()
+		_, open := polls[g.ID]
+		return !open
+	})
+}
+
+func TestClientMentions(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	carol := dialTestUser(t, url, "carol")
+	waitFor(t, "alice to see carol", func() bool { return alice.sees("carol") })
+
+	if err := alice.CreateGroup("ops", "bob", "carol"); err != nil {
+		t.Fatalf("CreateGroup failed: %v", err)
+	}
+	bob.join(t, "ops")
+	ops := carol.join(t, "ops").ID
+
+	send := func(u *testUser, content string) {
+		t.Helper()
+		if err := u.SendGroup(ops, content); err != nil {
+			t.Fatalf("SendGroup failed: %v", err)
+		}
+		receive(t, u.group, "own group message")
+	}
+
+	send(alice, "@Bob can you check the deploy? cc dave@example.com")
+	msg := receive(t, bob.mention, "mention")
+	if msg.Type != protocol.TypeGroupMessage || msg.To != ops || strings.Join(msg.Mentions, ",") != "bob" {
+		t.Errorf("unexpected mention: %+v", msg)
+	}
+
+	// @all expands to every member except the sender
+	send(bob, "@all standup in 5")
+	msg = receive(t, alice.mention, "mention")
+	if got := strings.Join(msg.Mentions, ","); got != "alice,carol" {
+		t.Errorf("@all mentioned %q, want alice,carol", got)
+	}
+
+	// Names that are not members are ignored
+	send(alice, "see above, @carol. and @nobody")
+	receive(t, carol.mention, "mention")
+	msg = receive(t, carol.mention, "mention")
+	if got := strings.Join(msg.Mentions, ","); got != "carol" {
+		t.Errorf("mentioned %q, want carol", got)
+	}
+
+	waitFor(t, "carol's mention count", func() bool {
+		carol.mu.Lock()
+		defer carol.mu.Unlock()
+		return carol.mentionCounts[ops] == 2
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	results, err := carol.Mentions(ctx)
+	if err != nil {
+		t.Fatalf("Mentions failed: %v", err)
+	}
+	var contents []string
+	for _, msg := range results {
+		contents = append(contents, msg.Content)
+	}
+	if got, want := strings.Join(contents, "|"), "see above, @carol. and @nobody|@all standup in 5"; got != want {
+		t.Errorf("Mentions() = %q, want %q", got, want)
+	}
+
+	// Reading the group clears the mention count
+	if err := carol.MarkRead(ops); err != nil {
+		t.Fatalf("MarkRead failed: %v", err)
+	}
+	waitFor(t, "carol's mention count to clear", func() bool {
+		carol.mu.Lock()
+		defer carol.mu.Unlock()
+		return carol.mentionCounts[ops] == 0
+	})
+}
+
+// waitGroup reads group lists until the named group satisfies cond
+func (u *testUser) waitGroup(t *testing.T, name string, cond func(g protocol.Group) bool) protocol.Group {
+	t.Helper()
+	for {
+		for _, g := range receive(t, u.groups, "group list") {
+			if g.Name == name && cond(g) {
+				return g
+			}
+		}
+	}
+}
+
+func TestClientGroupRoles(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	carol := dialTestUser(t, url, "carol")
+	dave := dialTestUser(t, url, "dave")
+	waitFor(t, "alice to see dave", func() bool { return alice.sees("dave") })
+
+	expectError := func(u *testUser, what string) {
+		t.Helper()
+		msg := receive(t, u.errors, what+" to be rejected")
+		if msg.Type != protocol.TypeError || msg.Content == "" {
+			t.Errorf("unexpected error frame: %+v", msg)
+		}
+	}
+
+	alice.CreateGroup("ops", "bob", "carol", "dave")
+	bob.join(t, "ops")
+	carol.join(t, "ops")
+	dave.join(t, "ops")
+	g := alice.waitGroup(t, "ops", func(g protocol.Group) bool { return len(g.Members) == 4 })
+	if g.Roles["alice"] != protocol.RoleOwner {
+		t.Errorf("creator role = %q, want owner", g.Roles["alice"])
+	}
+	ops := g.ID
+
+	// Plain members cannot manage the group
+	bob.AddGroupMember(ops, "erin")
+	expectError(bob, "member adding")
+
+	alice.SetGroupRole(ops, "bob", protocol.RoleModerator)
+	alice.SetGroupRole(ops, "carol", protocol.RoleReadOnly)
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool {
+		return g.Roles["bob"] == protocol.RoleModerator && g.Roles["carol"] == protocol.RoleReadOnly
+	})
+
+	// Read-only members cannot post
+	carol.SendGroup(ops, "hello?")
+	expectError(carol, "read-only post")
+
+	// Moderators remove members below them, but not the owner, and cannot
+	// promote anyone to their own rank
+	bob.RemoveGroupMember(ops, "dave")
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool { return !contains(g.Members, "dave") })
+	bob.RemoveGroupMember(ops, "alice")
+	expectError(bob, "removing the owner")
+	bob.SetGroupRole(ops, "carol", protocol.RoleModerator)
+	expectError(bob, "moderator changing roles")
+
+	// Moderators delete messages of members below them
+	alice.SetGroupRole(ops, "carol", protocol.RoleMember)
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool { return g.Roles["carol"] == "" })
+	carol.SendGroup(ops, "spam")
+	msg := receive(t, bob.group, "group message")
+	if msg.ID == "" {
+		t.Fatalf("group message has no ID: %+v", msg)
+	}
+	bob.DeleteMessage(ops, msg.ID)
+	if got := receive(t, carol.deleted, "deletion"); got != msg.ID {
+		t.Errorf("deleted %q, want %q", got, msg.ID)
+	}
+
+	alice.SendGroup(ops, "owner message")
+	msg = receive(t, bob.group, "group message")
+	bob.DeleteMessage(ops, msg.ID)
+	expectError(bob, "deleting the owner's message")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	history, err := alice.History(ctx, protocol.TypeGroup, ops)
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if history.Len() != 1 {
+		t.Errorf("history has %d messages after deletion, want 1", history.Len())
+	}
+
+	// Ownership moves explicitly, and on leave to the highest-ranked member
+	alice.TransferOwnership(ops, "carol")
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool {
+		return g.Admin == "carol" && g.Roles["alice"] == protocol.RoleAdmin
+	})
+	carol.LeaveGroup(ops)
+	g = bob.waitGroup(t, "ops", func(g protocol.Group) bool { return g.Admin != "carol" })
+	if g.Admin != "alice" || g.Roles["alice"] != protocol.RoleOwner {
+		t.Errorf("after the owner left: admin %q, roles %v; want alice as owner", g.Admin, g.Roles)
+	}
+}
+
+func TestOwnerSuccession(t *testing.T) {
+	url := newTestServer(t)
+	registerBot(&Bot{Name: "helper"})
+	t.Cleanup(func() {
+		botsMux.Lock()
+		delete(bots, "helper")
+		botsMux.Unlock()
+	})
+
+	tests := []struct {
+		name    string
+		members []string
+		roles   map[string]string
+		want    string
+	}{
+		{"first to join", []string{"alice", "bob", "carol"}, nil, "bob"},
+		{"highest rank", []string{"alice", "bob", "carol"}, map[string]string{"carol": protocol.RoleModerator}, "carol"},
+		{"bots are skipped", []string{"alice", "helper", "bob"}, map[string]string{"helper": protocol.RoleAdmin}, "bob"},
+		{"only bots", []string{"alice", "helper"}, nil, ""},
+		{"alone", []string{"alice"}, nil, ""},
+	}
+	for _, tt := range tests {
+		group := &protocol.Group{Admin: "alice", Members: tt.members, Roles: tt.roles}
+		if got := nextOwner(group); got != tt.want {
+			t.Errorf("%s: nextOwner = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// A group whose owner leaves it to bots is deleted
+	alice := dialTestUser(t, url, "alice")
+	alice.CreateGroup("ops")
+	ops := alice.waitGroup(t, "ops", func(g protocol.Group) bool { return true }).ID
+	alice.AddGroupMember(ops, "helper")
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool { return contains(g.Members, "helper") })
+	alice.LeaveGroup(ops)
+	waitFor(t, "the group to be deleted", func() bool {
+		groupsMux.RLock()
+		defer groupsMux.RUnlock()
+		_, exists := groups[ops]
+		return !exists
+	})
+}
+
+func TestClientInvitations(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	carol := dialTestUser(t, url, "carol")
+	dave := dialTestUser(t, url, "dave")
+	waitFor(t, "alice to see dave", func() bool { return alice.sees("dave") })
+
+	// Creating a group only invites the members
+	alice.CreateGroup("ops", "bob")
+	inv := bob.invitation(t, "ops", protocol.StatusPending)
+	if inv.Inviter != "alice" || inv.Invitee != "bob" {
+		t.Errorf("unexpected invitation: %+v", inv)
+	}
+	g := alice.waitGroup(t, "ops", func(protocol.Group) bool { return true })
+	if len(g.Members) != 1 {
+		t.Errorf("members before accepting: %v", g.Members)
+	}
+	ops := g.ID
+	bob.DeclineInvitation(inv.ID)
+	alice.invitation(t, "ops", protocol.StatusDeclined)
+
+	alice.AddGroupMember(ops, "bob")
+	bob.join(t, "ops")
+	alice.invitation(t, "ops", protocol.StatusAccepted)
+
+	// A single-use invite code
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	code, err := alice.CreateInviteCode(ctx, ops, time.Hour, 1)
+	if err != nil {
+		t.Fatalf("CreateInviteCode failed: %v", err)
+	}
+	if code.Code == "" || code.MaxUses != 1 {
+		t.Fatalf("unexpected invite code: %+v", code)
+	}
+	carol.AcceptInvitation(code.Code)
+	carol.waitGroup(t, "ops", func(g protocol.Group) bool { return contains(g.Members, "carol") })
+	dave.AcceptInvitation(code.Code)
+	receive(t, dave.errors, "used up invite code to be rejected")
+
+	// Outsiders cannot find private groups by name
+	dave.RequestJoin("ops", "on call this week")
+	if msg := receive(t, dave.errors, "request by name to be rejected"); msg.Content != "Group ops not found" {
+		t.Errorf("request by name answered %q", msg.Content)
+	}
+	dave.JoinGroup(ops)
+	if msg := receive(t, dave.errors, "joining a private group to be rejected"); msg.Content != "Group "+ops+" not found" {
+		t.Errorf("joining a private group answered %q", msg.Content)
+	}
+
+	// Join requests are decided by members who may add members
+	dave.RequestJoin(ops, "on call this week")
+	req := receive(t, alice.joins, "join request")
+	if req.User != "dave" || req.Note != "on call this week" || req.Status != protocol.StatusPending {
+		t.Errorf("unexpected join request: %+v", req)
+	}
+	bob.ApproveJoinRequest(req.ID)
+	receive(t, bob.errors, "member approving to be rejected")
+	alice.ApproveJoinRequest(req.ID)
+	dave.waitGroup(t, "ops", func(g protocol.Group) bool { return contains(g.Members, "dave") })
+
+	// Invitations lapse when the inviter may no longer add members
+	frank := dialTestUser(t, url, "frank")
+	alice.SetGroupRole(ops, "bob", protocol.RoleAdmin)
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool { return g.Roles["bob"] == protocol.RoleAdmin })
+	bob.AddGroupMember(ops, "frank")
+	inv = frank.invitation(t, "ops", protocol.StatusPending)
+	alice.SetGroupRole(ops, "bob", protocol.RoleMember)
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool { return g.Roles["bob"] == "" })
+	frank.AcceptInvitation(inv.ID)
+	receive(t, frank.errors, "invitation of a demoted inviter to be rejected")
+	frank.invitation(t, "ops", protocol.StatusRevoked)
+	if isGroupMember(ops, "frank") {
+		t.Error("frank joined through the invitation of a demoted member")
+	}
+
+	// Users who are offline see their invitations when they connect
+	alice.AddGroupMember(ops, "erin")
+	for alice.invitation(t, "ops", protocol.StatusPending).Invitee != "erin" {
+	}
+	erin := dialTestUser(t, url, "erin")
+	invites, _, err := erin.Invitations(ctx)
+	if err != nil {
+		t.Fatalf("Invitations failed: %v", err)
+	}
+	if len(invites) != 1 || invites[0].Group != ops || invites[0].Invitee != "erin" {
+		t.Errorf("erin's invitations: %+v", invites)
+	}
+}
+
+func TestClientGroupMetadata(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	alice.CreateGroup("ops", "bob")
+	g := bob.join(t, "ops")
+	bob.SendGroup(g.ID, "before the rename")
+	receive(t, alice.group, "group message")
+
+	// Names are unique regardless of case
+	bob.CreateGroup("OPS")
+	receive(t, bob.errors, "duplicate group name to be rejected")
+
+	// Members cannot rename the group
+	bob.RenameGroup(g.ID, "platform")
+	receive(t, bob.errors, "member renaming to be rejected")
+
+	name, topic := "platform", "Deploys and incidents"
+	alice.UpdateGroup(g.ID, protocol.GroupUpdate{Name: &name, Topic: &topic})
+	renamed := bob.waitGroup(t, "platform", func(g protocol.Group) bool { return g.Topic == topic })
+	if renamed.ID != g.ID {
+		t.Errorf("group ID changed from %q to %q on rename", g.ID, renamed.ID)
+	}
+
+	// History and search follow the ID, not the name
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	it, err := bob.History(ctx, protocol.TypeGroup, g.ID)
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if it.Len() != 1 {
+		t.Errorf("history has %d messages after rename, want 1", it.Len())
+	}
+	results, err := bob.Search(ctx, "in:#platform rename")
+	if err != nil {
+		t.Fatalf("Search failed: %v", err)
+	}
+	if len(results) != 1 || results[0].To != g.ID {
+		t.Errorf("search after rename: %+v", results)
+	}
+
+	// The old name is free again
+	bob.CreateGroup("ops")
+	bob.waitGroup(t, "ops", func(g protocol.Group) bool { return g.Admin == "bob" })
+}
+
+func TestClientPublicGroups(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	carol := dialTestUser(t, url, "carol")
+	waitFor(t, "alice to see carol", func() bool { return alice.sees("carol") })
+
+	alice.CreateGroup("ops")
+	ops := alice.waitGroup(t, "ops", func(protocol.Group) bool { return true }).ID
+	alice.CreateGroup("town-square")
+	square := alice.waitGroup(t, "town-square", func(g protocol.Group) bool {
+		return g.Visibility == protocol.VisibilityPrivate
+	}).ID
+	alice.SetGroupVisibility(square, protocol.VisibilityPublic)
+	alice.waitGroup(t, "town-square", func(g protocol.Group) bool { return g.Visibility == protocol.VisibilityPublic })
+
+	alice.SendGroup(ops, "private plans")
+	receive(t, alice.group, "own group message")
+	alice.SendGroup(square, "welcome everyone")
+	receive(t, alice.group, "own group message")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	// Only public groups are listed
+	directory, err := carol.PublicGroups(ctx)
+	if err != nil {
+		t.Fatalf("PublicGroups failed: %v", err)
+	}
+	if len(directory) != 1 || directory[0].ID != square || directory[0].MemberCount != 1 {
+		t.Errorf("unexpected directory: %+v", directory)
+	}
+
+	// Non-members preview public groups but not private ones
+	history := func(u *testUser, group string) int {
+		t.Helper()
+		it, err := u.History(ctx, protocol.TypeGroup, group)
+		if err != nil {
+			t.Fatalf("History failed: %v", err)
+		}
+		return it.Len()
+	}
+	if n := history(carol, square); n != 1 {
+		t.Errorf("preview of the public group has %d messages, want 1", n)
+	}
+	if n := history(carol, ops); n != 0 {
+		t.Errorf("non-member read %d messages of a private group", n)
+	}
+
+	// Anyone joins public groups, by name or through request_join
+	carol.JoinGroup("Town-Square")
+	carol.waitGroup(t, "town-square", func(g protocol.Group) bool { return contains(g.Members, "carol") })
+	bob.RequestJoin(square, "")
+	bob.waitGroup(t, "town-square", func(g protocol.Group) bool { return contains(g.Members, "bob") })
+
+	carol.JoinGroup(ops)
+	receive(t, carol.errors, "joining a private group to be rejected")
+	carol.SetGroupVisibility(square, protocol.VisibilityPrivate)
+	receive(t, carol.errors, "member changing the visibility to be rejected")
+}
+
+func TestClientPostingPolicy(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	alice.CreateGroup("company", "bob")
+	company := bob.join(t, "company").ID
+
+	post := func(u *testUser, content string) {
+		t.Helper()
+		u.SendGroup(company, content)
+		for receive(t, u.group, "own group message").Content != content {
+		}
+	}
+	rejected := func(u *testUser, content, what string) {
+		t.Helper()
+		u.SendGroup(company, content)
+		receive(t, u.errors, what+" to be rejected")
+	}
+	policy := func(update protocol.GroupUpdate, cond func(g protocol.Group) bool) {
+		t.Helper()
+		alice.UpdateGroup(company, update)
+		bob.waitGroup(t, "company", cond)
+	}
+	on, off, zero := true, false, 0
+
+	// Only admins post in announcement mode
+	policy(protocol.GroupUpdate{AnnouncementOnly: &on}, func(g protocol.Group) bool { return g.AnnouncementOnly })
+	rejected(bob, "can I post?", "post in announcement mode")
+	rejected(bob, "/help", "command in announcement mode")
+	post(alice, "All hands at 3pm")
+	policy(protocol.GroupUpdate{AnnouncementOnly: &off}, func(g protocol.Group) bool { return !g.AnnouncementOnly })
+
+	limit := 10
+	policy(protocol.GroupUpdate{MaxMessageLength: &limit}, func(g protocol.Group) bool { return g.MaxMessageLength == 10 })
+	rejected(bob, "this is far too long", "overlong message")
+	post(bob, "short")
+	policy(protocol.GroupUpdate{MaxMessageLength: &zero}, func(g protocol.Group) bool { return g.MaxMessageLength == 0 })
+
+	// Slow mode throttles members but not admins
+	interval := 60
+	policy(protocol.GroupUpdate{SlowModeSeconds: &interval}, func(g protocol.Group) bool { return g.SlowModeSeconds == 60 })
+	// Messages that filters reject do not start the interval
+	alice.SetFilters(company, protocol.FilterConfig{Rules: []protocol.FilterRule{
+		{Kind: protocol.FilterWords, Action: protocol.FilterReject, Words: []string{"spam"}},
+	}})
+	waitFor(t, "the group's filters", func() bool {
+		filtersMux.RLock()
+		defer filtersMux.RUnlock()
+		return groupFilters[company] != nil
+	})
+	rejected(bob, "spam", "filtered message")
+	post(bob, "first")
+	rejected(bob, "second", "message within the slow mode interval")
+	rejected(bob, "/help", "command within the slow mode interval")
+	post(alice, "one")
+	post(alice, "two")
+
+	// Members cannot change the policy
+	bob.UpdateGroup(company, protocol.GroupUpdate{SlowModeSeconds: &zero})
+	receive(t, bob.errors, "member changing the policy to be rejected")
+}
+
+func TestClientPrivacy(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	carol := dialTestUser(t, url, "carol")
+	waitFor(t, "alice to see carol", func() bool { return alice.sees("carol") })
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	// Blocked users are dropped without telling them
+	alice.BlockUser("bob")
+	waitFor(t, "alice's block list", func() bool {
+		profile, err := alice.Profile(ctx)
+		return err == nil && contains(profile.Blocked, "bob")
+	})
+	bob.SendPrivate("alice", "are you there?")
+	bob.CreateGroup("bobs-group", "alice")
+	carol.SendPrivate("alice", "hi alice")
+	if msg := receive(t, alice.private, "private message"); msg.From != "carol" {
+		t.Errorf("alice received %+v from a blocked user", msg)
+	}
+	select {
+	case msg := <-bob.errors:
+		t.Errorf("blocked user was told: %+v", msg)
+	default:
+	}
+
+	// Only people who share a group may message alice
+	groupMembers := protocol.PrivacyGroupMembers
+	alice.UpdatePrivacy(protocol.PrivacyUpdate{DMPolicy: &groupMembers, GroupInvitePolicy: &groupMembers})
+	waitFor(t, "alice's privacy settings", func() bool {
+		profile, err := alice.Profile(ctx)
+		return err == nil && profile.DMPolicy == groupMembers && profile.GroupInvitePolicy == groupMembers
+	})
+	carol.SendPrivate("alice", "hello again")
+	receive(t, carol.errors, "private message from a stranger to be rejected")
+	carol.CreateGroup("carols-group", "alice")
+	receive(t, carol.errors, "invitation from a stranger to be rejected")
+
+	alice.UnblockUser("bob")
+	alice.CreateGroup("ops", "carol")
+	carol.join(t, "ops")
+	carol.SendPrivate("alice", "now we share a group")
+	if msg := receive(t, alice.private, "private message"); msg.Content != "now we share a group" {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	// Settings survive a restart of the server
+	profilesMux.Lock()
+	profiles = make(map[string]*protocol.UserProfile)
+	profilesMux.Unlock()
+	if err := loadProfiles(); err != nil {
+		t.Fatalf("loadProfiles failed: %v", err)
+	}
+	profile, err := alice.Profile(ctx)
+	if err != nil {
+		t.Fatalf("Profile failed: %v", err)
+	}
+	if profile.DMPolicy != groupMembers || len(profile.Blocked) != 0 {
+		t.Errorf("profile after reload: %+v", profile)
+	}
+}
+
+func TestClientModeration(t *testing.T) {
+	url := newTestServer(t)
+	setServerModerators("alice")
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	carol := dialTestUser(t, url, "carol")
+	waitFor(t, "alice to see carol", func() bool { return alice.sees("carol") })
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	alice.CreateGroup("company", "bob", "carol")
+	company := bob.join(t, "company").ID
+	carol.join(t, "company")
+
+	// Muted members cannot post, and members cannot mute
+	alice.MuteMember(company, "bob", time.Minute, "flooding")
+	bob.waitGroup(t, "company", func(g protocol.Group) bool { return g.Muted["bob"] != "" })
+	bob.SendGroup(company, "let me talk")
+	receive(t, bob.errors, "muted member's message to be rejected")
+	carol.MuteMember(company, "bob", time.Minute, "")
+	receive(t, carol.errors, "member muting to be rejected")
+
+	// Reports are queued for the moderators
+	carol.SendGroup(company, "buy cheap watches")
+	var spam protocol.Message
+	for spam.Content != "buy cheap watches" {
+		spam = receive(t, carol.group, "own group message")
+	}
+	bob.ReportMessage(company, spam.ID, "spam")
+	var queued []protocol.Report
+	waitFor(t, "the report to be queued", func() bool {
+		var err error
+		queued, err = alice.Reports(ctx, protocol.StatusPending)
+		return err == nil && len(queued) == 1
+	})
+	if queued[0].Message.ID != spam.ID || queued[0].Reporter != "bob" || queued[0].Group != company {
+		t.Errorf("unexpected report: %+v", queued[0])
+	}
+	if visible, err := carol.Reports(ctx, ""); err != nil || len(visible) != 0 {
+		t.Errorf("reported member sees reports %+v (err %v)", visible, err)
+	}
+	alice.ResolveReport(queued[0].ID, "warned carol")
+	waitFor(t, "the report to be resolved", func() bool {
+		filed, err := bob.Reports(ctx, "")
+		return err == nil && len(filed) == 1 && filed[0].Status == protocol.StatusResolved
+	})
+
+	// Every action ends up in the audit log
+	entries, err := alice.AuditLog(ctx, company)
+	if err != nil {
+		t.Fatalf("AuditLog failed: %v", err)
+	}
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	want := []string{protocol.ActionResolveReport, protocol.ActionReport, protocol.ActionMute,
+		protocol.ActionJoinGroup, protocol.ActionJoinGroup, protocol.ActionCreateGroup}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Errorf("audit log actions %v, want %v", actions, want)
+	}
+	bob.Send(protocol.Message{Type: protocol.TypeRequestAuditLog, To: company})
+	receive(t, bob.errors, "member reading the audit log to be rejected")
+
+	// Banned users are disconnected and refused, also after a restart
+	alice.BanUser("carol", time.Hour, "spam")
+	connected := func() bool {
+		clientsMux.RLock()
+		defer clientsMux.RUnlock()
+		_, ok := clients["carol"]
+		return ok
+	}
+	waitFor(t, "carol to be disconnected", func() bool { return !connected() })
+	moderationMux.Lock()
+	bans = make(map[string]*protocol.Ban)
+	moderationMux.Unlock()
+	if err := loadModeration(); err != nil {
+		t.Fatalf("loadModeration failed: %v", err)
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?username=carol", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("banned user connecting: err %v, response %+v", err, resp)
+	}
+
+	// The HTTP API refuses banned users too, and webhooks they created
+	webhooksMux.Lock()
+	webhooks["hook"] = &protocol.Webhook{ID: "hook", Name: "ci", Group: company, Token: "secret", Creator: "carol"}
+	webhooksMux.Unlock()
+	requests := []struct {
+		method, path, body string
+	}{
+		{http.MethodGet, "/api/search?username=carol&q=watches", ""},
+		{http.MethodPost, "/api/attachments?username=carol&chat_type=group&chat_id=" + company, ""},
+		{http.MethodGet, "/api/attachments/any?username=carol", ""},
+		{http.MethodGet, "/api/export?username=carol&chat_type=group&chat_id=" + company, ""},
+		{http.MethodPost, "/api/webhooks/hook/secret", `{"content": "deployed"}`},
+	}
+	attachmentsMux.Lock()
+	attachments["any"] = &attachmentRecord{Attachment: protocol.Attachment{ID: "any"}, ChatType: protocol.TypeGroup, ChatID: company}
+	attachmentsMux.Unlock()
+	for _, req := range requests {
+		httpReq, _ := http.NewRequest(req.method, httpBase(url)+req.path, strings.NewReader(req.body))
+		resp, err := http.DefaultClient.Do(httpReq)
+		if err != nil {
+			t.Fatalf("%s %s failed: %v", req.method, req.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s for a banned user answered %d, want 403", req.method, req.path, resp.StatusCode)
+		}
+	}
+
+	alice.UnbanUser("carol")
+	waitFor(t, "carol to reconnect", connected)
+}
+
+func TestClientContentFilters(t *testing.T) {
+	url := newTestServer(t)
+	if err := setDefaultFilters(protocol.FilterConfig{Rules: []protocol.FilterRule{
+		{Kind: protocol.FilterWords, Action: protocol.FilterReject, Words: []string{"scam"}},
+	}}); err != nil {
+		t.Fatalf("setDefaultFilters failed: %v", err)
+	}
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	// The server default applies to private messages
+	bob.SendPrivate("alice", "this is a SCAM")
+	receive(t, bob.errors, "filtered private message to be rejected")
+
+	alice.CreateGroup("company", "bob")
+	company := bob.join(t, "company").ID
+	config := protocol.FilterConfig{Rules: []protocol.FilterRule{
+		{Kind: protocol.FilterRepeat, Action: protocol.FilterRedact, MaxRepeat: 3},
+		{Kind: protocol.FilterWords, Action: protocol.FilterRedact, Words: []string{"darn", "heck"}},
+		{Name: "card numbers", Kind: protocol.FilterRegex, Action: protocol.FilterReject, Pattern: `\b\d{16}\b`},
+		{Kind: protocol.FilterLinks, Action: protocol.FilterFlag, DenyDomains: []string{"evil.example"}},
+	}}
+	alice.SetFilters(company, config)
+	waitFor(t, "the group's filters", func() bool {
+		got, err := alice.Filters(ctx, company)
+		return err == nil && len(got.Rules) == len(config.Rules)
+	})
+
+	posted := func(content string) protocol.Message {
+		t.Helper()
+		bob.SendGroup(company, content)
+		return receive(t, alice.group, "filtered group message")
+	}
+	if msg := posted("Darn it, what the heck"); msg.Content != "**** it, what the ****" {
+		t.Errorf("words were not masked: %q", msg.Content)
+	}
+	if msg := posted("nooooooo"); msg.Content != "nooo" {
+		t.Errorf("repeated characters were not shortened: %q", msg.Content)
+	}
+	bob.SendGroup(company, "my card is 1234567812345678")
+	if msg := receive(t, bob.errors, "message with a card number to be rejected"); !strings.Contains(msg.Content, "card numbers") {
+		t.Errorf("rejection does not name the rule: %q", msg.Content)
+	}
+
+	// The server default still applies in groups with filters of their own
+	bob.SendGroup(company, "not a scam")
+	receive(t, bob.errors, "group message rejected by the server default")
+
+	// Flagged messages are delivered and reported to the moderators
+	flagged := posted("see https://www.evil.example/prize")
+	waitFor(t, "the flagged message to be reported", func() bool {
+		queued, err := alice.Reports(ctx, protocol.StatusPending)
+		return err == nil && len(queued) == 1 && queued[0].Message.ID == flagged.ID && queued[0].Reporter == systemReporter
+	})
+
+	// Members can neither see nor change the filters
+	bob.SetFilters(company, protocol.FilterConfig{})
+	receive(t, bob.errors, "member changing the filters to be rejected")
+	bob.Send(protocol.Message{Type: protocol.TypeRequestFilters, To: company})
+	receive(t, bob.errors, "member reading the filters to be rejected")
+
+	// Invalid rules are refused
+	alice.SetFilters(company, protocol.FilterConfig{Rules: []protocol.FilterRule{
+		{Kind: protocol.FilterRegex, Action: protocol.FilterReject, Pattern: "("},
+	}})
+	receive(t, alice.errors, "invalid pattern to be rejected")
+}
+
+func TestWordFilter(t *testing.T) {
+	filter, err := newWordFilter([]string{"darn", "café", "foo bar", "foo", "ü"})
+	if err != nil {
+		t.Fatalf("newWordFilter failed: %v", err)
+	}
+
+	tests := []struct {
+		content string
+		want    string
+	}{
+		{"Darn it, darn", "**** it, ****"},
+		{"darning needles", "darning needles"},
+		{"un café noir", "un **** noir"},
+		{"CAFÉ", "****"},
+		{"cafés", "cafés"},
+		{"le cafécrème", "le cafécrème"},
+		{"darnß", "darnß"},
+		{"foo barn", "*** barn"},
+		{"foo bar", "*******"},
+		{"foo foo_x foo", "*** foo_x ***"},
+		{"Müller ü", "Müller *"},
+	}
+	for _, tt := range tests {
+		got, matched := filter.Filter(tt.content)
+		if got != tt.want || matched != (tt.want != tt.content) {
+			t.Errorf("Filter(%q) = %q, %v; want %q", tt.content, got, matched, tt.want)
+		}
+	}
+}
+
+func TestClientRetention(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	// Members hear of policy changes in groups and private chats
+	type change struct {
+		chatID string
+		policy protocol.RetentionPolicy
+	}
+	changes := make(chan change, 16)
+	watcher, err := client.Dial(ctx, client.Config{
+		URL:       url,
+		Username:  "bob",
+		Companion: true,
+		Handlers: client.Handlers{
+			OnRetention: func(chatID string, policy protocol.RetentionPolicy) { changes <- change{chatID, policy} },
+		},
+	})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer watcher.Close()
+
+	// Groups can keep only their latest messages
+	alice.CreateGroup("company", "bob")
+	company := bob.join(t, "company").ID
+	alice.SetRetention(company, protocol.RetentionPolicy{MaxCount: 2})
+	bob.waitGroup(t, "company", func(g protocol.Group) bool { return g.Retention != nil && g.Retention.MaxCount == 2 })
+	if got := receive(t, changes, "group policy change"); got.chatID != company || got.policy.MaxCount != 2 {
+		t.Errorf("bob was told of %+v, want the group's new policy", got)
+	}
+	for _, content := range []string{"alpha", "beta", "gamma"} {
+		alice.SendGroup(company, content)
+		receive(t, bob.group, "group message")
+	}
+	if dropped := compactMessages(time.Now()); dropped != 1 {
+		t.Errorf("compactor dropped %d messages, want 1", dropped)
+	}
+	it, err := bob.History(ctx, protocol.TypeGroup, company)
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if it.Len() != 2 {
+		t.Errorf("history has %d messages after compaction, want 2", it.Len())
+	}
+	if hits, err := bob.Search(ctx, "alpha"); err != nil || len(hits) != 0 {
+		t.Errorf("pruned message still found by search: %v (err %v)", hits, err)
+	}
+	bob.SetRetention(company, protocol.RetentionPolicy{})
+	receive(t, bob.errors, "member changing the retention policy to be rejected")
+
+	// Disappearing private messages expire and are withdrawn
+	bob.SetRetention("alice", protocol.RetentionPolicy{DisappearSeconds: 60})
+	waitFor(t, "the private chat's policy", func() bool {
+		policy, err := alice.Retention(ctx, "bob")
+		return err == nil && policy.DisappearSeconds == 60
+	})
+	if got := receive(t, changes, "private chat policy change"); got.chatID != "alice" || got.policy.DisappearSeconds != 60 {
+		t.Errorf("bob was told of %+v, want the private chat's new policy", got)
+	}
+	alice.SendPrivate("bob", "this message will self-destruct")
+	msg := receive(t, bob.private, "disappearing message")
+	if msg.ExpiresAt == "" {
+		t.Fatalf("disappearing message has no expiry: %+v", msg)
+	}
+	if dropped := compactMessages(time.Now()); dropped != 0 {
+		t.Errorf("compactor dropped %d messages before they expired", dropped)
+	}
+	compactMessages(time.Now().Add(2 * time.Minute))
+	if id := receive(t, bob.deleted, "disappeared message to be withdrawn"); id != msg.ID {
+		t.Errorf("withdrawn message %s, want %s", id, msg.ID)
+	}
+
+	// The server-wide maximum age applies everywhere
+	retentionMux.Lock()
+	serverRetention.MaxAgeSeconds = 3600
+	retentionMux.Unlock()
+	compactMessages(time.Now().Add(2 * time.Hour))
+	if it, err := bob.History(ctx, protocol.TypeGroup, company); err != nil || it.Len() != 0 {
+		t.Errorf("old group messages survived the server maximum age (err %v)", err)
+	}
+
+	alice.SetRetention("bob", protocol.RetentionPolicy{DisappearSeconds: -1})
+	receive(t, alice.errors, "negative retention to be rejected")
+}
+
+func TestClientExportImport(t *testing.T) {
+	url := newTestServer(t)
+	adminToken = "s3cret"
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	admin := dialTestUser(t, url, "admin")
+	carol := dialTestUser(t, url, "carol")
+	waitFor(t, "alice to see carol", func() bool { return alice.sees("carol") })
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	alice.CreateGroup("ops", "bob")
+	ops := bob.join(t, "ops").ID
+	for _, content := range []string{"deploy <started>", "deploy finished"} {
+		alice.SendGroup(ops, content)
+		receive(t, bob.group, "group message")
+	}
+
+	var jsonl, html, text strings.Builder
+	for format, out := range map[string]*strings.Builder{
+		protocol.ExportJSONL: &jsonl,
+		protocol.ExportHTML:  &html,
+		protocol.ExportText:  &text,
+	} {
+		if err := bob.Export(ctx, protocol.TypeGroup, ops, format, out); err != nil {
+			t.Fatalf("Export as %s failed: %v", format, err)
+		}
+	}
+	lines := strings.Split(strings.TrimSpace(jsonl.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], `"chat_name":"ops"`) || !strings.Contains(lines[1], "deploy \\u003cstarted\\u003e") {
+		t.Errorf("unexpected JSON lines export:\n%s", jsonl.String())
+	}
+	if !strings.Contains(html.String(), "deploy &lt;started&gt;") || !strings.Contains(html.String(), "<h1>#ops</h1>") {
+		t.Errorf("unexpected HTML export:\n%s", html.String())
+	}
+	if !strings.Contains(text.String(), "alice: deploy finished") || !strings.Contains(text.String(), "Members: alice, bob") {
+		t.Errorf("unexpected text export:\n%s", text.String())
+	}
+	if err := carol.Export(ctx, protocol.TypeGroup, ops, protocol.ExportJSONL, io.Discard); err == nil {
+		t.Error("expected an outsider's export to be refused")
+	}
+
+	// Imports need the admin token and keep authors and timestamps but
+	// not IDs, nor mentions of users outside the group
+	admin.CreateGroup("archive", "")
+	archive := admin.waitGroup(t, "archive", func(protocol.Group) bool { return true }).ID
+	for _, token := range []string{"", "guess"} {
+		if _, err := alice.Import(ctx, token, protocol.TypeGroup, archive, strings.NewReader(jsonl.String())); err == nil {
+			t.Errorf("expected an import with token %q to be refused", token)
+		}
+	}
+	older := `{"from": "dave", "content": "from the old tool @bob @admin", "mentions": ["bob", "admin"], "timestamp": "2020-01-02T03:04:05Z"}` + "\n" + "not json\n"
+	result, err := admin.Import(ctx, "s3cret", protocol.TypeGroup, archive, strings.NewReader(jsonl.String()+older))
+	if err != nil {
+		t.Fatalf("Import failed: %v", err)
+	}
+	if result.Imported != 3 || result.Skipped != 1 {
+		t.Errorf("unexpected import result: %+v", result)
+	}
+	it, err := admin.History(ctx, protocol.TypeGroup, archive)
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	var imported []protocol.Message
+	for it.Next() {
+		imported = append(imported, it.Message())
+	}
+	original := getGroupHistory(ops)
+	if len(imported) != 3 || imported[0].From != "dave" || !reflect.DeepEqual(imported[0].Mentions, []string{"admin"}) || imported[1].From != "alice" ||
+		imported[1].Timestamp != original[0].Timestamp || imported[1].ID == original[0].ID || imported[1].To != archive {
+		t.Errorf("unexpected imported history: %+v", imported)
+	}
+	if hits, err := admin.Search(ctx, "old tool"); err != nil || len(hits) != 1 {
+		t.Errorf("imported message not found by search: %v (err %v)", hits, err)
+	}
+}
+
+// adminCall makes an admin API request with token and decodes the JSON
+// response into out, if given. It returns the status code.
+func adminCall(t *testing.T, url, token, method, path string, body io.Reader, out interface{}) int {
+	t.Helper()
+	req, err := http.NewRequest(method, httpBase(url)+path, body)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			t.Fatalf("decoding the response of %s %s: %v", method, path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestAdminAuditLog(t *testing.T) {
+	url := newTestServer(t)
+	setServerModerators("alice")
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	alice.CreateGroup("ops", "bob")
+	ops := bob.join(t, "ops").ID
+	alice.LeaveGroup(ops)
+	bob.waitGroup(t, "ops", func(g protocol.Group) bool { return g.Admin == "bob" })
+
+	query := func(token, params string) (int, []protocol.AuditEntry) {
+		t.Helper()
+		var reply struct {
+			AuditLog []protocol.AuditEntry `json:"audit_log"`
+		}
+		status := adminCall(t, url, token, http.MethodGet, "/api/admin/audit?"+params, nil, &reply)
+		return status, reply.AuditLog
+	}
+
+	if status, _ := query("secret", ""); status != http.StatusNotFound {
+		t.Errorf("admin API without a configured token answered %d, want 404", status)
+	}
+	adminToken = "secret"
+	if status, _ := query("wrong", ""); status != http.StatusUnauthorized {
+		t.Errorf("admin API with a wrong token answered %d, want 401", status)
+	}
+
+	status, logins := query("secret", "action=login&actor=alice")
+	if status != http.StatusOK || len(logins) != 1 || logins[0].IP != "127.0.0.1" {
+		t.Errorf("unexpected logins of alice (status %d): %+v", status, logins)
+	}
+	_, entries := query("secret", "group="+ops)
+	var actions []string
+	for _, entry := range entries {
+		actions = append(actions, entry.Action)
+	}
+	want := []string{protocol.ActionTransferOwnership, protocol.ActionLeaveGroup, protocol.ActionJoinGroup, protocol.ActionCreateGroup}
+	if strings.Join(actions, ",") != strings.Join(want, ",") {
+		t.Errorf("group audit trail is %v, want %v", actions, want)
+	}
+	if _, latest := query("secret", "limit=1"); len(latest) != 1 {
+		t.Errorf("limit=1 returned %d entries", len(latest))
+	}
+	if status, _ := query("secret", "limit=0"); status != http.StatusBadRequest {
+		t.Errorf("invalid limit answered %d, want 400", status)
+	}
+
+	// Moderators see group actions over WebSocket, but not logins or addresses
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	moderation, err := alice.AuditLog(ctx, "")
+	if err != nil {
+		t.Fatalf("AuditLog failed: %v", err)
+	}
+	for _, entry := range moderation {
+		if entry.IP != "" || isSessionAction(entry.Action) {
+			t.Errorf("moderators were shown %+v", entry)
+		}
+	}
+}
+
+func TestAdminConsole(t *testing.T) {
+	url := newTestServer(t)
+	adminToken = "secret"
+	registerBot(&Bot{Name: "testbot"})
+	t.Cleanup(func() {
+		botsMux.Lock()
+		delete(bots, "testbot")
+		botsMux.Unlock()
+	})
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	if status := adminCall(t, url, "", http.MethodGet, "/api/admin/stats", nil, nil); status != http.StatusUnauthorized {
+		t.Errorf("stats without a token answered %d, want 401", status)
+	}
+
+	var connected struct {
+		Clients []protocol.ConnectedClient `json:"clients"`
+	}
+	adminCall(t, url, "secret", http.MethodGet, "/api/admin/clients", nil, &connected)
+	found := make(map[string]protocol.ConnectedClient)
+	for _, c := range connected.Clients {
+		found[c.Username] = c
+	}
+	if c := found["alice"]; c.IP != "127.0.0.1" || c.ConnectedAt == "" || c.QueueCapacity == 0 || c.Bot {
+		t.Errorf("unexpected listing of alice: %+v", c)
+	}
+	if !found["testbot"].Bot {
+		t.Errorf("testbot is not listed as a bot: %+v", connected.Clients)
+	}
+
+	// Groups can be edited regardless of roles
+	alice.CreateGroup("ops", "bob")
+	ops := bob.join(t, "ops").ID
+	var groupList struct {
+		Groups []protocol.Group `json:"groups"`
+	}
+	adminCall(t, url, "secret", http.MethodGet, "/api/admin/groups", nil, &groupList)
+	if len(groupList.Groups) != 1 || groupList.Groups[0].ID != ops {
+		t.Errorf("unexpected group list: %+v", groupList.Groups)
+	}
+	var edited protocol.Group
+	status := adminCall(t, url, "secret", http.MethodPatch, "/api/admin/groups/"+ops, strings.NewReader(`{"name": "operations", "slow_mode_seconds": 30}`), &edited)
+	if status != http.StatusOK || edited.Name != "operations" || edited.SlowModeSeconds != 30 {
+		t.Errorf("group edit answered %d: %+v", status, edited)
+	}
+	bob.waitGroup(t, "operations", func(g protocol.Group) bool { return g.ID == ops })
+	if status := adminCall(t, url, "secret", http.MethodPatch, "/api/admin/groups/"+ops, strings.NewReader(`{"visibility": "secret"}`), nil); status != http.StatusBadRequest {
+		t.Errorf("invalid group edit answered %d, want 400", status)
+	}
+	if status := adminCall(t, url, "secret", http.MethodGet, "/api/admin/groups/nope", nil, nil); status != http.StatusNotFound {
+		t.Errorf("unknown group answered %d, want 404", status)
+	}
+
+	// Announcements reach everyone
+	announcements := make(chan protocol.Message, 16)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	carol, err := client.Dial(ctx, client.Config{URL: url, Username: "carol", Handlers: client.Handlers{
+		OnSystem: func(msg protocol.Message) { announcements <- msg },
+	}})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer carol.Close()
+	if status := adminCall(t, url, "secret", http.MethodPost, "/api/admin/broadcast", strings.NewReader(`{"content": "Maintenance at noon"}`), nil); status != http.StatusNoContent {
+		t.Errorf("broadcast answered %d, want 204", status)
+	}
+	for msg := receive(t, announcements, "announcement"); msg.Content != "Maintenance at noon"; {
+		msg = receive(t, announcements, "announcement")
+	}
+
+	// Disconnected users are told why
+	before := bob.connectCount()
+	if status := adminCall(t, url, "secret", http.MethodDelete, "/api/admin/clients/bob", nil, nil); status != http.StatusNoContent {
+		t.Errorf("disconnect answered %d, want 204", status)
+	}
+	waitFor(t, "bob to reconnect", func() bool { return bob.connectCount() > before })
+	if status := adminCall(t, url, "secret", http.MethodDelete, "/api/admin/clients/testbot", nil, nil); status != http.StatusBadRequest {
+		t.Errorf("disconnecting a bot answered %d, want 400", status)
+	}
+
+	var stats protocol.ServerStats
+	adminCall(t, url, "secret", http.MethodGet, "/api/admin/stats", nil, &stats)
+	if stats.Clients != 3 || stats.Groups != 1 || stats.Bots != 1 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestClientRateLimits(t *testing.T) {
+	url := newTestServer(t)
+	quotas := defaultQuotas()
+	if err := parseQuotas("private_message=2/m", quotas); err != nil {
+		t.Fatalf("parseQuotas failed: %v", err)
+	}
+	rateLimiter.Configure(quotas)
+
+	alice := dialTestUser(t, url, "alice")
+
+	// A raw connection, so nothing reconnects behind the test's back
+	conn, _, err := websocket.DefaultDialer.Dial(url+"?username=mallory", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(testTimeout))
+
+	send := func(content string) {
+		t.Helper()
+		msg := protocol.Message{Type: protocol.TypePrivateMessage, To: "alice", Content: content}
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatalf("WriteJSON failed: %v", err)
+		}
+	}
+	for _, content := range []string{"one", "two", "three"} {
+		send(content)
+	}
+	receive(t, alice.private, "first message")
+	receive(t, alice.private, "second message")
+	for {
+		var frame protocol.Message
+		if err := conn.ReadJSON(&frame); err != nil {
+			t.Fatalf("ReadJSON failed: %v", err)
+		}
+		if frame.Type == protocol.TypeError {
+			if !strings.Contains(frame.Content, "try again") {
+				t.Errorf("unexpected error frame: %+v", frame)
+			}
+			break
+		}
+	}
+
+	// Sustained abuse gets the connection closed and refused for a while
+	for i := 0; i < 40; i++ {
+		send("spam")
+	}
+	// The close frame can be lost to a reset when spam is still unread on
+	// the server, so only wait for the connection to end
+	for {
+		var frame protocol.Message
+		if err := conn.ReadJSON(&frame); err != nil {
+			break
+		}
+	}
+	_, resp, err := websocket.DefaultDialer.Dial(url+"?username=mallory", nil)
+	if err == nil || resp == nil || resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("reconnect after abuse: err %v, response %+v", err, resp)
+	}
+
+	// Others behind the same address are not cut off
+	conn, _, err = websocket.DefaultDialer.Dial(url+"?username=trent", nil)
+	if err != nil {
+		t.Fatalf("connecting from the abuser's address failed: %v", err)
+	}
+	conn.Close()
+
+	// The HTTP API is limited per address
+	if err := parseQuotas("http=2/m", quotas); err != nil {
+		t.Fatalf("parseQuotas failed: %v", err)
+	}
+	rateLimiter.Configure(quotas)
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := http.Get(httpBase(url) + "/api/search?username=alice&q=hello")
+		if err != nil {
+			t.Fatalf("search failed: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Errorf("search %d answered %d, want %d", i+1, resp.StatusCode, want)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") == "" {
+			t.Error("rate limited search has no Retry-After header")
+		}
+	}
+}
+
+func TestRateLimiterTakesAllOrNothing(t *testing.T) {
+	limiter := NewRateLimiter(map[string]Quota{
+		QuotaDefault: {Rate: 0.001, Burst: 1},
+		QuotaUser:    {Rate: 0.001, Burst: 1},
+		QuotaIP:      {Rate: 0.001, Burst: 10},
+	})
+
+	if ok, _, _ := limiter.Allow("alice", "10.0.0.1", "a"); !ok {
+		t.Fatal("first message rejected")
+	}
+	ok, wait, _ := limiter.Allow("alice", "10.0.0.1", "b")
+	if ok || wait <= 0 {
+		t.Fatalf("message over the user quota: ok %v, wait %v", ok, wait)
+	}
+	// The rejected message used up neither its type's quota nor the IP's
+	if tokens := limiter.buckets["type:alice:b"].tokens; tokens < 1 {
+		t.Errorf("type bucket has %.2f tokens after a rejection, want 1", tokens)
+	}
+	if tokens := limiter.buckets["ip:10.0.0.1"].tokens; tokens < 9 {
+		t.Errorf("IP bucket has %.2f tokens after one message, want 9", tokens)
+	}
+}
+
+func TestParseQuotas(t *testing.T) {
+	tests := []struct {
+		spec    string
+		key     string
+		want    Quota
+		wantErr bool
+	}{
+		{spec: "group_message=5/s:10", key: "group_message", want: Quota{Rate: 5, Burst: 10}},
+		{spec: "create_group=12/m", key: "create_group", want: Quota{Rate: 0.2, Burst: 12}},
+		{spec: "create_group=0.5/m", key: "create_group", want: Quota{Rate: 0.5 / 60, Burst: 1}},
+		{spec: "search=0.5/m:0.5", wantErr: true},
+		{spec: "search=0/s", wantErr: true},
+		{spec: "search=5/d", wantErr: true},
+		{spec: "search", wantErr: true},
+	}
+	for _, tt := range tests {
+		quotas := make(map[string]Quota)
+		err := parseQuotas(tt.spec, quotas)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseQuotas(%q) error = %v, want error %v", tt.spec, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && quotas[tt.key] != tt.want {
+			t.Errorf("parseQuotas(%q) = %+v, want %+v", tt.spec, quotas[tt.key], tt.want)
+		}
+	}
+}
+
+func TestClientHistory(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	for _, content := range []string{"one", "two", "three"} {
+		if err := alice.SendPrivate("bob", content); err != nil {
+			t.Fatalf("SendPrivate failed: %v", err)
+		}
+		receive(t, bob.private, "private message")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	it, err := bob.History(ctx, protocol.TypePrivate, "alice")
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if it.Len() != 3 {
+		t.Fatalf("expected 3 messages, got %d", it.Len())
+	}
+
+	var got []string
+	for it.Next() {
+		got = append(got, it.Message().Content)
+	}
+	if strings.Join(got, ",") != "one,two,three" {
+		t.Errorf("unexpected history order: %v", got)
+	}
+
+	it, err = bob.History(ctx, protocol.TypeGroup, "missing")
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if it.Next() {
+		t.Error("expected empty history for unknown group")
+	}
+}
+
+func TestClientSearch(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	carol := dialTestUser(t, url, "carol")
+	waitFor(t, "alice to see carol", func() bool { return alice.sees("carol") })
+
+	alice.SendPrivate("bob", "The release notes are ready")
+	receive(t, bob.private, "private message")
+	alice.SendPrivate("carol", "Notes on the release party")
+	receive(t, carol.private, "private message")
+	bob.SendPrivate("alice", "RELEASE tomorrow?")
+	receive(t, alice.private, "private message")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	search := func(u *testUser, query string) []string {
+		t.Helper()
+		results, err := u.Search(ctx, query)
+		if err != nil {
+			t.Fatalf("Search(%q) failed: %v", query, err)
+		}
+		var contents []string
+		for _, msg := range results {
+			contents = append(contents, msg.Content)
+		}
+		return contents
+	}
+
+	cases := []struct {
+		user  *testUser
+		query string
+		want  string
+	}{
+		// Case folding, newest first
+		{alice, "release", "RELEASE tomorrow?|Notes on the release party|The release notes are ready"},
+		// Phrase queries respect word order
+		{alice, `"release notes"`, "The release notes are ready"},
+		{alice, "from:bob release", "RELEASE tomorrow?"},
+		{alice, "in:carol notes", "Notes on the release party"},
+		// Only conversations the caller takes part in
+		{bob, "release", "RELEASE tomorrow?|The release notes are ready"},
+		{carol, "notes", "Notes on the release party"},
+		{carol, "after:2000-01-01 before:2001-01-01", ""},
+	}
+	for _, tc := range cases {
+		if got := strings.Join(search(tc.user, tc.query), "|"); got != tc.want {
+			t.Errorf("%s searching %q: got %q, want %q", tc.user.Username(), tc.query, got, tc.want)
+		}
+	}
+}
+
+func TestClientAttachments(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	carol := dialTestUser(t, url, "carol")
+	waitFor(t, "alice to see carol", func() bool { return alice.sees("carol") })
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	attachment, err := alice.UploadAttachment(ctx, protocol.TypePrivate, "bob", "notes.txt", strings.NewReader("meeting notes"))
+	if err != nil {
+		t.Fatalf("UploadAttachment failed: %v", err)
+	}
+	if attachment.Name != "notes.txt" || attachment.Size != 13 || !strings.HasPrefix(attachment.MIMEType, "text/plain") {
+		t.Errorf("unexpected attachment metadata: %+v", attachment)
+	}
+
+	if err := alice.SendPrivateWithAttachments("bob", "see attached", attachment); err != nil {
+		t.Fatalf("SendPrivateWithAttachments failed: %v", err)
+	}
+	msg := receive(t, bob.private, "message with attachment")
+	if len(msg.Attachments) != 1 || msg.Attachments[0].ID != attachment.ID || msg.Attachments[0].Name != "notes.txt" {
+		t.Fatalf("unexpected attachments: %+v", msg.Attachments)
+	}
+
+	download := func(u *testUser) (int, string) {
+		t.Helper()
+		link, err := u.AttachmentURL(attachment)
+		if err != nil {
+			t.Fatalf("AttachmentURL failed: %v", err)
+		}
+		resp, err := http.Get(link)
+		if err != nil {
+			t.Fatalf("GET %s failed: %v", link, err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, body := download(bob); status != http.StatusOK || body != "meeting notes" {
+		t.Errorf("participant download: got %d %q", status, body)
+	}
+	if status, _ := download(carol); status != http.StatusForbidden {
+		t.Errorf("expected non-participant download to be forbidden, got %d", status)
+	}
+
+	// Attachments cannot be forwarded into another conversation by ID
+	if err := carol.SendPrivateWithAttachments("bob", "forwarded", attachment); err != nil {
+		t.Fatalf("SendPrivateWithAttachments failed: %v", err)
+	}
+	msg = receive(t, bob.private, "forwarded message")
+	if len(msg.Attachments) != 0 {
+		t.Errorf("expected foreign attachment to be dropped, got %+v", msg.Attachments)
+	}
+}
+
+func TestClientReconnect(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	// Drop bob's connection from the server side
+	clientsMux.RLock()
+	serverSide := clients["bob"]
+	clientsMux.RUnlock()
+	serverSide.conn.Close()
+
+	waitFor(t, "bob to reconnect", func() bool { return bob.connectCount() == 2 })
+	waitFor(t, "bob to be registered again", func() bool {
+		clientsMux.RLock()
+		defer clientsMux.RUnlock()
+		c, ok := clients["bob"]
+		return ok && c != serverSide
+	})
+
+	if err := alice.SendPrivate("bob", "still there?"); err != nil {
+		t.Fatalf("SendPrivate failed: %v", err)
+	}
+	msg := receive(t, bob.private, "private message after reconnect")
+	if msg.Content != "still there?" {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+
+	if err := alice.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	select {
+	case <-alice.Done():
+	case <-time.After(testTimeout):
+		t.Fatal("client did not stop after Close")
+	}
+
+	if err := alice.SendPrivate("bob", "hi"); err != client.ErrClosed {
+		t.Errorf("expected ErrClosed after Close, got %v", err)
+	}
+}
+
+func TestClientRejectedRequest(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	// The server answers with an error frame, which must end the request
+	// rather than leave it waiting for the context
+	if _, err := alice.Filters(ctx, "no-such-group"); err == nil || ctx.Err() != nil {
+		t.Errorf("expected the rejected request to fail before its deadline, got %v", err)
+	}
+	receive(t, alice.errors, "error frame")
+}
+
+func TestClientRejectsReservedUsername(t *testing.T) {
+	url := newTestServer(t)
+
+	botsMux.Lock()
+	bots["testbot"] = &Bot{Name: "testbot"}
+	botsMux.Unlock()
+	t.Cleanup(func() {
+		botsMux.Lock()
+		delete(bots, "testbot")
+		botsMux.Unlock()
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+
+	if _, err := client.Dial(ctx, client.Config{URL: url, Username: "testbot"}); err == nil {
+		t.Fatal("expected dialing as a bot name to fail")
+	}
+}
+
+// sseEvent is one event of an /api/events stream
+type sseEvent struct {
+	name, data string
+}
+
+// openEventStream connects username over the SSE transport and returns its
+// events, beginning with the session event
+func openEventStream(t *testing.T, url, username string) <-chan sseEvent {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, httpBase(url)+"/api/events?username="+username, nil)
+	if err != nil {
+		t.Fatalf("NewRequest failed: %v", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("opening the event stream failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("event stream answered %s (%s)", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	events := make(chan sseEvent, 64)
+	go func() {
+		defer resp.Body.Close()
+		defer close(events)
+		var event sseEvent
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				if event.data != "" {
+					events <- event
+				}
+				event = sseEvent{}
+			case strings.HasPrefix(line, "event: "):
+				event.name = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event.data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events
+}
+
+// httpBase turns the WebSocket URL of a test server into its HTTP base URL
+func httpBase(url string) string {
+	return "http" + strings.TrimPrefix(strings.TrimSuffix(url, "/ws"), "ws")
+}
+
+func TestSSETransport(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+
+	events := openEventStream(t, url, "bob")
+	session := receive(t, events, "session event")
+	if session.name != protocol.EventSession || session.data == "" {
+		t.Fatalf("expected a session event first, got %+v", session)
+	}
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	post := func(session, body string) int {
+		t.Helper()
+		resp, err := http.Post(httpBase(url)+"/api/events?session="+session, "application/x-ndjson", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("posting frames failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Frames posted by bob go through the same dispatch as WebSocket frames
+	status := post(session.data, `{"type": "private_message", "to": "alice", "content": "hi over sse"}
+{"type": "private_message", "to": "alice", "content": "and again"}`)
+	if status != http.StatusAccepted {
+		t.Fatalf("posting frames answered %d, want 202", status)
+	}
+	for _, want := range []string{"hi over sse", "and again"} {
+		if msg := receive(t, alice.private, "message from bob"); msg.From != "bob" || msg.Content != want {
+			t.Errorf("alice got %+v, want %q from bob", msg, want)
+		}
+	}
+	if status := post("nope", `{"type": "request_profile"}`); status != http.StatusNotFound {
+		t.Errorf("posting to an unknown session answered %d, want 404", status)
+	}
+
+	// Frames for bob arrive as unnamed events
+	if err := alice.SendPrivate("bob", "hi back"); err != nil {
+		t.Fatalf("SendPrivate failed: %v", err)
+	}
+	for {
+		event := receive(t, events, "message to bob")
+		var msg protocol.Message
+		if err := json.Unmarshal([]byte(event.data), &msg); err != nil {
+			t.Fatalf("undecodable frame %q: %v", event.data, err)
+		}
+		if msg.Type == protocol.TypePrivateMessage && msg.From == "alice" {
+			if event.name != "" || msg.Content != "hi back" {
+				t.Errorf("unexpected message event %+v", event)
+			}
+			break
+		}
+	}
+
+	// The stream ends with a close event, and bob is gone
+	disconnectUser("bob", "maintenance")
+	var closed protocol.CloseEvent
+	for event := range events {
+		if event.name == protocol.EventClose {
+			if err := json.Unmarshal([]byte(event.data), &closed); err != nil {
+				t.Fatalf("undecodable close event %q: %v", event.data, err)
+			}
+		}
+	}
+	if closed.Code != websocket.ClosePolicyViolation || closed.Reason != "maintenance" {
+		t.Errorf("unexpected close event %+v", closed)
+	}
+	waitFor(t, "bob to be unregistered", func() bool {
+		clientsMux.RLock()
+		defer clientsMux.RUnlock()
+		_, ok := clients["bob"]
+		return !ok
+	})
+	if status := post(session.data, `{"type": "request_profile"}`); status != http.StatusNotFound {
+		t.Errorf("posting to a closed session answered %d, want 404", status)
+	}
+}
+
+func TestLongPollTransport(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+
+	// poll makes a GET of /api/events and splits the response into events
+	poll := func(query string) (int, []sseEvent) {
+		t.Helper()
+		resp, err := http.Get(httpBase(url) + "/api/events?" + query)
+		if err != nil {
+			t.Fatalf("polling failed: %v", err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		var events []sseEvent
+		for _, block := range strings.Split(string(body), "\n\n") {
+			var event sseEvent
+			for _, line := range strings.Split(block, "\n") {
+				if name, ok := strings.CutPrefix(line, "event: "); ok {
+					event.name = name
+				} else if data, ok := strings.CutPrefix(line, "data: "); ok {
+					event.data = data
+				}
+			}
+			if event.data != "" {
+				events = append(events, event)
+			}
+		}
+		return resp.StatusCode, events
+	}
+
+	// Opening a session answers at once, beginning with the session event
+	status, events := poll("username=bob&poll=true")
+	if status != http.StatusOK || len(events) == 0 || events[0].name != protocol.EventSession {
+		t.Fatalf("opening a poll session answered %d with %+v", status, events)
+	}
+	session := "session=" + events[0].data
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	// Frames are POSTed as with the event stream
+	resp, err := http.Post(httpBase(url)+"/api/events?"+session, "application/x-ndjson",
+		strings.NewReader(`{"type": "private_message", "to": "alice", "content": "hi by polling"}`))
+	if err != nil {
+		t.Fatalf("posting frames failed: %v", err)
+	}
+	resp.Body.Close()
+	if msg := receive(t, alice.private, "message from bob"); msg.From != "bob" || msg.Content != "hi by polling" {
+		t.Errorf("alice got %+v", msg)
+	}
+
+	// A poll waits for the next frames
+	polled := make(chan []sseEvent)
+	go func() {
+		defer close(polled)
+		for {
+			status, events := poll(session)
+			if status != http.StatusOK {
+				return
+			}
+			polled <- events
+		}
+	}()
+	if err := alice.SendPrivate("bob", "hi back"); err != nil {
+		t.Fatalf("SendPrivate failed: %v", err)
+	}
+	found := false
+	for !found {
+		for _, event := range receive(t, polled, "polled frames") {
+			var msg protocol.Message
+			json.Unmarshal([]byte(event.data), &msg)
+			found = found || (msg.From == "alice" && msg.Content == "hi back")
+		}
+	}
+
+	// The last poll gets the close event, after which the session is gone
+	disconnectUser("bob", "maintenance")
+	var closed protocol.CloseEvent
+	for events := range polled {
+		for _, event := range events {
+			if event.name == protocol.EventClose {
+				json.Unmarshal([]byte(event.data), &closed)
+			}
+		}
+	}
+	if closed.Code != websocket.ClosePolicyViolation || closed.Reason != "maintenance" {
+		t.Errorf("unexpected close event %+v", closed)
+	}
+	if status, _ := poll(session); status != http.StatusNotFound {
+		t.Errorf("polling a closed session answered %d, want 404", status)
+	}
+}
+
+func TestClientBinaryFrames(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+
+	private := make(chan protocol.Message, 16)
+	groupLists := make(chan []protocol.Group, 16)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	bob, err := client.Dial(ctx, client.Config{URL: url, Username: "bob", Binary: true, Handlers: client.Handlers{
+		OnPrivateMessage: func(msg protocol.Message) { private <- msg },
+		OnGroupList:      func(groups []protocol.Group) { groupLists <- groups },
+	}})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer bob.Close()
+
+	clientsMux.RLock()
+	conn, ok := clients["bob"].conn.(*wsTransport)
+	clientsMux.RUnlock()
+	if !ok || !conn.binary {
+		t.Fatal("bob did not negotiate MessagePack frames")
+	}
+
+	// Binary and JSON clients talk to each other
+	if err := bob.SendPrivate("alice", "packed <hello> & \"bye\""); err != nil {
+		t.Fatalf("SendPrivate failed: %v", err)
+	}
+	if msg := receive(t, alice.private, "message from bob"); msg.Content != "packed <hello> & \"bye\"" {
+		t.Errorf("alice got %q", msg.Content)
+	}
+	if err := alice.SendPrivate("bob", "plain ünïcode 😀"); err != nil {
+		t.Fatalf("SendPrivate failed: %v", err)
+	}
+	if msg := receive(t, private, "message from alice"); msg.From != "alice" || msg.Content != "plain ünïcode 😀" {
+		t.Errorf("bob got %+v", msg)
+	}
+
+	if err := bob.CreateGroup("ops"); err != nil {
+		t.Fatalf("CreateGroup failed: %v", err)
+	}
+	for {
+		groups := receive(t, groupLists, "group list with ops")
+		if len(groups) == 1 && groups[0].Name == "ops" && groups[0].Roles["bob"] == protocol.RoleOwner {
+			break
+		}
+	}
+}
+
+// countingConn counts the bytes read from a connection
+type countingConn struct {
+	net.Conn
+	read *atomic.Int64
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(int64(n))
+	return n, err
+}
+
+func TestWebSocketCompression(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+
+	// Bob reads over a compressed connection and counts the wire bytes
+	var read atomic.Int64
+	dialer := websocket.Dialer{
+		EnableCompression: true,
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return countingConn{Conn: conn, read: &read}, nil
+		},
+	}
+	conn, resp, err := dialer.Dial(url+"?username=bob", nil)
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer conn.Close()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("server did not negotiate compression: %q", ext)
+	}
+
+	// readUntil returns the first frame of bob's of the given type
+	readUntil := func(frameType string) (protocol.Message, int64) {
+		t.Helper()
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		for {
+			before := read.Load()
+			var msg protocol.Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				t.Fatalf("reading a %s frame failed: %v", frameType, err)
+			}
+			if msg.Type == frameType {
+				return msg, read.Load() - before
+			}
+		}
+	}
+
+	content := strings.Repeat("the quick brown fox jumps over the lazy dog. ", 400)
+	if err := alice.SendPrivate("bob", content); err != nil {
+		t.Fatalf("SendPrivate failed: %v", err)
+	}
+	msg, wire := readUntil(protocol.TypePrivateMessage)
+	if msg.Content != content {
+		t.Fatalf("bob got a message of %d bytes, want %d", len(msg.Content), len(content))
+	}
+	if wire > int64(len(content)/4) {
+		t.Errorf("a %d byte message took %d bytes on the wire", len(content), wire)
+	}
+
+	// Broadcasts share one compressed frame and still reach every client
+	broadcastSystemMessage(content)
+	if msg, _ := readUntil(protocol.TypeSystem); msg.Content != content {
+		t.Errorf("bob got a broadcast of %d bytes, want %d", len(msg.Content), len(content))
+	}
+}
+
+func TestConfigureCompression(t *testing.T) {
+	t.Cleanup(func() {
+		upgrader.EnableCompression = true
+		compressionLevel, compressionThreshold = flate.BestSpeed, 512
+	})
+
+	if err := configureCompression("", "9", "4096"); err != nil {
+		t.Fatalf("configureCompression failed: %v", err)
+	}
+	if !upgrader.EnableCompression || compressionLevel != 9 || compressionThreshold != 4096 {
+		t.Errorf("unexpected settings: %v, level %d, threshold %d", upgrader.EnableCompression, compressionLevel, compressionThreshold)
+	}
+	if err := configureCompression("off", "", ""); err != nil || upgrader.EnableCompression {
+		t.Errorf("compression is still enabled (%v)", err)
+	}
+	for _, bad := range [][3]string{{"maybe", "", ""}, {"", "10", ""}, {"", "-3", ""}, {"", "", "-1"}, {"", "", "1k"}} {
+		if err := configureCompression(bad[0], bad[1], bad[2]); err == nil {
+			t.Errorf("configureCompression(%q, %q, %q) succeeded", bad[0], bad[1], bad[2])
+		}
+	}
+}
+
+func TestTCPBus(t *testing.T) {
+	listen := func() net.Listener {
+		t.Helper()
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Listen failed: %v", err)
+		}
+		return listener
+	}
+
+	// A mesh of three nodes
+	listeners := []net.Listener{listen(), listen(), listen()}
+	buses := make([]*TCPBus, len(listeners))
+	for i := range listeners {
+		var peers []string
+		for j, listener := range listeners {
+			if j != i {
+				peers = append(peers, listener.Addr().String())
+			}
+		}
+		buses[i] = NewTCPBus(fmt.Sprintf("node-%d", i), listeners[i], peers, "s3cret")
+	}
+	defer func() {
+		for _, bus := range buses {
+			bus.Close()
+		}
+	}()
+
+	// next skips to the next event of a kind
+	next := func(bus *TCPBus, kind string) ClusterEvent {
+		t.Helper()
+		for {
+			if event := receive(t, bus.Events(), kind+" event"); event.Kind == kind {
+				return event
+			}
+		}
+	}
+	for _, bus := range buses {
+		next(bus, clusterPeerJoined)
+		next(bus, clusterPeerJoined)
+	}
+
+	// Events reach every other node, marked with the sender
+	buses[0].Publish(ClusterEvent{Kind: clusterPresence, Users: []string{"alice"}})
+	for _, bus := range buses[1:] {
+		event := next(bus, clusterPresence)
+		if event.Node != "node-0" || len(event.Users) != 1 || event.Users[0] != "alice" {
+			t.Errorf("%s got %+v", bus.node, event)
+		}
+	}
+
+	// Nodes with another secret are refused
+	intruder := NewTCPBus("intruder", listen(), []string{listeners[0].Addr().String()}, "guess")
+	next(intruder, clusterPeerJoined)
+	intruder.Publish(ClusterEvent{Kind: clusterPresence, Users: []string{"mallory"}})
+	intruder.Close()
+	buses[1].Publish(ClusterEvent{Kind: clusterPresence, Users: []string{"bob"}})
+	if event := next(buses[0], clusterPresence); event.Node != "node-1" {
+		t.Errorf("node-0 accepted an event from %s: %+v", event.Node, event)
+	}
+
+	// Peers without a secret are refused, even by nodes without one
+	open := NewTCPBus("open", listen(), nil, "")
+	defer open.Close()
+	for _, addr := range []string{listeners[0].Addr().String(), open.Addr().String()} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		fmt.Fprintf(conn, "{\"node\":\"intruder\"}\n{\"kind\":%q,\"users\":[\"mallory\"]}\n", clusterPresence)
+		conn.SetReadDeadline(time.Now().Add(testTimeout))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("%s kept the connection of a peer without a secret open: %v", addr, err)
+		}
+		conn.Close()
+	}
+
+	// Close ends Events
+	for _, bus := range append(buses, open) {
+		bus.Close()
+		for range bus.Events() {
+		}
+	}
+}
+
+func TestClusterRouting(t *testing.T) {
+	url := newTestServer(t)
+
+	// node-b is played by the test
+	hub := NewLoopbackHub()
+	peer := hub.Join("node-b")
+	startCluster(hub.Join("node-a"), "node-a")
+	t.Cleanup(func() {
+		stopCluster()
+		peer.Close()
+	})
+
+	// next skips to the next event that matches
+	next := func(what string, match func(ClusterEvent) bool) ClusterEvent {
+		t.Helper()
+		for {
+			if event := receive(t, peer.Events(), what); match(event) {
+				return event
+			}
+		}
+	}
+	publish := func(event ClusterEvent) {
+		event.Node = "node-b"
+		peer.Publish(event)
+	}
+
+	// Presence goes both ways, and remote users are listed
+	alice := dialTestUser(t, url, "alice")
+	next("presence of alice", func(e ClusterEvent) bool {
+		return e.Kind == clusterPresence && contains(e.Users, "alice")
+	})
+	publish(ClusterEvent{Kind: clusterPresence, Users: []string{"carol"}})
+	waitFor(t, "alice to see carol", func() bool { return alice.sees("carol") })
+	if !isOnline("carol") || isOnline("dave") {
+		t.Error("isOnline does not follow the presence of node-b")
+	}
+
+	// Messages to remote users are forwarded and replicated
+	if err := alice.SendPrivate("carol", "hi carol"); err != nil {
+		t.Fatalf("SendPrivate failed: %v", err)
+	}
+	var delivered, replicated bool
+	var sent protocol.Message
+	for !delivered || !replicated {
+		event := next("message to carol", func(e ClusterEvent) bool {
+			return (e.Kind == clusterDeliver && !e.All) || e.Kind == clusterMessage
+		})
+		switch event.Kind {
+		case clusterDeliver:
+			var msg protocol.Message
+			json.Unmarshal(event.Frame, &msg)
+			if event.Node != "node-a" || len(event.Users) != 1 || event.Users[0] != "carol" || msg.Content != "hi carol" {
+				t.Errorf("unexpected deliver event %+v", event)
+			}
+			delivered = true
+		case clusterMessage:
+			if event.Message.To != "carol" || event.Message.Content != "hi carol" {
+				t.Errorf("unexpected message event %+v", event.Message)
+			}
+			sent = *event.Message
+			replicated = true
+		}
+	}
+
+	// Frames from node-b reach local users
+	frame, _ := json.Marshal(protocol.Message{Type: protocol.TypePrivateMessage, From: "carol", To: "alice", Content: "hi alice"})
+	publish(ClusterEvent{Kind: clusterDeliver, Users: []string{"alice"}, Frame: frame})
+	if msg := receive(t, alice.private, "message from carol"); msg.From != "carol" || msg.Content != "hi alice" {
+		t.Errorf("alice got %+v", msg)
+	}
+
+	// Group changes are replicated both ways
+	if err := alice.CreateGroup("ops"); err != nil {
+		t.Fatalf("CreateGroup failed: %v", err)
+	}
+	event := next("group ops", func(e ClusterEvent) bool {
+		return e.Kind == clusterGroup && e.Group.Name == "ops"
+	})
+	group := *event.Group
+	if group.Version != 1 {
+		t.Errorf("new group has version %d, want 1", group.Version)
+	}
+	group.Description = "changed on node-b"
+	group.Version++
+	publish(ClusterEvent{Kind: clusterGroup, Group: &group})
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool { return g.Description == "changed on node-b" })
+
+	// Local changes continue from the newest version, and concurrent
+	// changes with the same version are settled the same way on every node
+	topic := "from node-a"
+	if err := alice.UpdateGroup(group.ID, protocol.GroupUpdate{Topic: &topic}); err != nil {
+		t.Fatalf("UpdateGroup failed: %v", err)
+	}
+	event = next("topic change", func(e ClusterEvent) bool {
+		return e.Kind == clusterGroup && e.Group.Topic == "from node-a"
+	})
+	if event.Group.Version != 3 {
+		t.Errorf("topic change has version %d, want 3", event.Group.Version)
+	}
+	concurrent := group
+	concurrent.Version = 3
+	concurrent.Topic = "from node-b"
+	publish(ClusterEvent{Kind: clusterGroup, Group: &concurrent})
+	alice.waitGroup(t, "ops", func(g protocol.Group) bool { return g.Topic == "from node-b" })
+	stale := concurrent
+	stale.Version = 2
+	stale.Topic = "stale"
+	publish(ClusterEvent{Kind: clusterGroup, Group: &stale, Origin: "node-z"})
+	relayed := concurrent
+	relayed.Topic = "relayed from node-0"
+	publish(ClusterEvent{Kind: clusterGroup, Group: &relayed, Origin: "node-0"})
+
+	// settle waits until node-a has applied the events published so far
+	settle := func() {
+		t.Helper()
+		frame, _ := json.Marshal(protocol.Message{Type: protocol.TypePrivateMessage, From: "carol", To: "alice", Content: "sync"})
+		publish(ClusterEvent{Kind: clusterDeliver, Users: []string{"alice"}, Frame: frame})
+		receive(t, alice.private, "sync message")
+	}
+	settle()
+	groupsMux.RLock()
+	topic = groups[group.ID].Topic
+	groupsMux.RUnlock()
+	if topic != "from node-b" {
+		t.Errorf("topic is %q after older snapshots, want %q", topic, "from node-b")
+	}
+
+	// Deleted groups stay deleted
+	publish(ClusterEvent{Kind: clusterGroupDeleted, GroupID: group.ID})
+	for {
+		groups := receive(t, alice.groups, "group list without ops")
+		if len(groups) == 0 {
+			break
+		}
+	}
+	late := concurrent
+	late.Version = 10
+	publish(ClusterEvent{Kind: clusterGroup, Group: &late})
+	settle()
+	groupsMux.RLock()
+	_, revived := groups[group.ID]
+	groupsMux.RUnlock()
+	if revived {
+		t.Error("a snapshot sent after the deletion brought the group back")
+	}
+
+	// System messages go to every node
+	broadcastSystemMessage("maintenance at noon")
+	next("system message", func(e ClusterEvent) bool {
+		return e.Kind == clusterDeliver && e.All && strings.Contains(string(e.Frame), "maintenance at noon")
+	})
+
+	// Deletions, private chat retention, profiles and bans are replicated
+	// both ways
+	if err := alice.DeleteMessage("carol", sent.ID); err != nil {
+		t.Fatalf("DeleteMessage failed: %v", err)
+	}
+	if event := next("deletion", func(e ClusterEvent) bool { return e.Kind == clusterMessageDeleted }); event.Message.ID != sent.ID {
+		t.Errorf("node-a published the deletion of %+v, want %s", event.Message, sent.ID)
+	}
+	if err := alice.SetRetention("carol", protocol.RetentionPolicy{MaxCount: 5}); err != nil {
+		t.Fatalf("SetRetention failed: %v", err)
+	}
+	if event := next("retention", func(e ClusterEvent) bool { return e.Kind == clusterRetention }); event.ChatID != getConversationKey("alice", "carol") || event.Retention.MaxCount != 5 {
+		t.Errorf("node-a published retention %+v", event)
+	}
+	if err := alice.BlockUser("mallory"); err != nil {
+		t.Fatalf("BlockUser failed: %v", err)
+	}
+	if event := next("profile", func(e ClusterEvent) bool { return e.Kind == clusterProfile }); !contains(event.Profile.Blocked, "mallory") {
+		t.Errorf("node-a published profile %+v", event.Profile)
+	}
+	setServerModerators("alice")
+	if err := alice.BanUser("mallory", 0, "spam"); err != nil {
+		t.Fatalf("BanUser failed: %v", err)
+	}
+	if event := next("ban", func(e ClusterEvent) bool { return e.Kind == clusterBan }); event.Ban.User != "mallory" || event.Ban.Reason != "spam" {
+		t.Errorf("node-a published ban %+v", event.Ban)
+	}
+	if err := alice.UnbanUser("mallory"); err != nil {
+		t.Fatalf("UnbanUser failed: %v", err)
+	}
+	if event := next("unban", func(e ClusterEvent) bool { return e.Kind == clusterUnban }); !reflect.DeepEqual(event.Users, []string{"mallory"}) {
+		t.Errorf("node-a published unban %+v", event)
+	}
+
+	storeMessage(sent)
+	publish(ClusterEvent{Kind: clusterMessageDeleted, Message: &sent})
+	publish(ClusterEvent{Kind: clusterRetention, ChatID: getConversationKey("alice", "dave"), Retention: &protocol.RetentionPolicy{MaxCount: 3}})
+	profile := getProfile("carol")
+	profile.Blocked = []string{"alice"}
+	publish(ClusterEvent{Kind: clusterProfile, Profile: &profile})
+	settle()
+	for _, msg := range getConversationHistory("alice", "carol") {
+		if msg.ID == sent.ID {
+			t.Error("a message deleted on node-b is still in node-a's history")
+		}
+	}
+	retentionMux.RLock()
+	policy := dmRetention[getConversationKey("alice", "dave")]
+	retentionMux.RUnlock()
+	if policy.MaxCount != 3 {
+		t.Errorf("retention of alice and dave is %+v, want the policy set on node-b", policy)
+	}
+	if !hasBlocked("carol", "alice") {
+		t.Error("carol's block list from node-b was not applied")
+	}
+
+	// A user banned on node-b loses their connection to node-a
+	clientsMux.RLock()
+	connected := clients["alice"]
+	clientsMux.RUnlock()
+	publish(ClusterEvent{Kind: clusterBan, Ban: &protocol.Ban{User: "alice", By: "moderator", Reason: "spam"}})
+	waitFor(t, "alice to be disconnected", func() bool {
+		clientsMux.RLock()
+		defer clientsMux.RUnlock()
+		return clients["alice"] != connected
+	})
+	if _, banned := activeBan("alice"); !banned {
+		t.Error("the ban from node-b was not applied")
+	}
+	publish(ClusterEvent{Kind: clusterUnban, Users: []string{"alice"}})
+	waitFor(t, "alice to be unbanned", func() bool {
+		_, banned := activeBan("alice")
+		return !banned
+	})
+}
+
+func TestClientResume(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+
+	// bob waits long enough before reconnecting to miss frames
+	private := make(chan protocol.Message, 16)
+	system := make(chan protocol.Message, 64)
+	var resumes atomic.Int32
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	bob, err := client.Dial(ctx, client.Config{
+		URL:        url,
+		Username:   "bob",
+		MinBackoff: 200 * time.Millisecond,
+		MaxBackoff: 200 * time.Millisecond,
+		Handlers: client.Handlers{
+			OnPrivateMessage: func(msg protocol.Message) { private <- msg },
+			OnSystem:         func(msg protocol.Message) { system <- msg },
+			OnResume:         func() { resumes.Add(1) },
+		},
+	})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	defer bob.Close()
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+
+	// Frames sent while bob is away are replayed once, in order
+	clientsMux.RLock()
+	serverSide := clients["bob"]
+	clientsMux.RUnlock()
+	serverSide.conn.Close()
+	for _, content := range []string{"one", "two", "three"} {
+		if err := alice.SendPrivate("bob", content); err != nil {
+			t.Fatalf("SendPrivate failed: %v", err)
+		}
+	}
+	waitFor(t, "bob to resume", func() bool { return resumes.Load() == 1 })
+	if err := alice.SendPrivate("bob", "four"); err != nil {
+		t.Fatalf("SendPrivate failed: %v", err)
+	}
+	for _, want := range []string{"one", "two", "three", "four"} {
+		if msg := receive(t, private, "message "+want); msg.Content != want {
+			t.Fatalf("bob got %q, want %q", msg.Content, want)
+		}
+	}
+	clientsMux.RLock()
+	resumed := clients["bob"]
+	clientsMux.RUnlock()
+	if resumed == serverSide || resumed.session != serverSide.session {
+		t.Error("bob did not take over the session of the dropped connection")
+	}
+
+	// Resuming does not announce bob again
+	broadcastSystemMessage("marker")
+	joins := 0
+	for {
+		msg := receive(t, system, "marker")
+		if msg.Content == "marker" {
+			break
+		}
+		if msg.Content == "bob joined the chat" {
+			joins++
+		}
+	}
+	if joins != 1 {
+		t.Errorf("bob was announced %d times, want once", joins)
+	}
+
+	// A raw connection: dropped, resumed from too far back, and closed
+	dial := func(query string) (*websocket.Conn, map[string]interface{}) {
+		t.Helper()
+		conn, _, err := websocket.DefaultDialer.Dial(url+"?username=carol"+query, nil)
+		if err != nil {
+			t.Fatalf("Dial failed: %v", err)
+		}
+		var session map[string]interface{}
+		if err := conn.ReadJSON(&session); err != nil || session[protocol.KeyType] != protocol.TypeSession {
+			t.Fatalf("expected a session frame first, got %v (%v)", session, err)
+		}
+		return conn, session
+	}
+	conn, session := dial("")
+	token, _ := session[protocol.KeyToken].(string)
+	if token == "" || session[protocol.KeyResumed] != false || session[protocol.KeySeq] != 0.0 {
+		t.Errorf("unexpected session frame %v", session)
+	}
+	waitFor(t, "alice to see carol", func() bool { return alice.sees("carol") })
+	conn.UnderlyingConn().Close()
+
+	// The admin API lists the dropped client as detached
+	adminToken = "secret"
+	waitFor(t, "carol to be listed as detached", func() bool {
+		var connected struct {
+			Clients []protocol.ConnectedClient `json:"clients"`
+		}
+		adminCall(t, url, "secret", http.MethodGet, "/api/admin/clients", nil, &connected)
+		for _, c := range connected.Clients {
+			if c.Username == "carol" {
+				return c.Detached
+			}
+		}
+		return false
+	})
+
+	conn, session = dial("&resume=" + token + "&seq=100000")
+	if session[protocol.KeyResumed] != false || session[protocol.KeyToken] == token {
+		t.Errorf("resuming from an unknown frame gave %v, want a new session", session)
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	conn.Close()
+	waitFor(t, "carol to leave", func() bool {
+		clientsMux.RLock()
+		defer clientsMux.RUnlock()
+		_, ok := clients["carol"]
+		return !ok
+	})
+
+	// Kicked users cannot resume
+	disconnectUser("bob", "maintenance")
+	waitFor(t, "bob to reconnect", func() bool {
+		clientsMux.RLock()
+		defer clientsMux.RUnlock()
+		c, ok := clients["bob"]
+		return ok && c.session != resumed.session
+	})
+	if resumes.Load() != 1 {
+		t.Errorf("bob resumed %d times, want 1", resumes.Load())
+	}
+}
+
+func TestClientCompanion(t *testing.T) {
+	url := newTestServer(t)
+	alice := dialTestUser(t, url, "alice")
+	bob := dialTestUser(t, url, "bob")
+	waitFor(t, "alice to see bob", func() bool { return alice.sees("bob") })
+	clientsMux.RLock()
+	primary := clients["alice"]
+	clientsMux.RUnlock()
+
+	private := make(chan protocol.Message, 16)
+	errs := make(chan protocol.Message, 16)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	companion, err := client.Dial(ctx, client.Config{
+		URL:       url,
+		Username:  "alice",
+		Companion: true,
+		Handlers: client.Handlers{
+			OnPrivateMessage: func(msg protocol.Message) { private <- msg },
+			OnError:          func(msg protocol.Message) { errs <- msg },
+		},
+	})
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	waitFor(t, "the companion to register", func() bool { return len(companionsOf("alice")) == 1 })
+
+	// Alice is told about the companion, and the admin API lists it
+	for {
+		msg := receive(t, alice.system, "companion notice")
+		if msg.Content == "A companion connection for your account was opened from 127.0.0.1" {
+			break
+		}
+	}
+	adminToken = "secret"
+	var connected struct {
+		Clients []protocol.ConnectedClient `json:"clients"`
+	}
+	adminCall(t, url, "secret", http.MethodGet, "/api/admin/clients", nil, &connected)
+	var listed []bool
+	for _, c := range connected.Clients {
+		if c.Username == "alice" {
+			listed = append(listed, c.Companion)
+		}
+	}
+	if len(listed) != 2 || listed[0] == listed[1] {
+		t.Errorf("alice is listed as %v, want her client and a companion", listed)
+	}
+
+	// The companion neither replaces alice's connection nor announces her
+	clientsMux.RLock()
+	current := clients["alice"]
+	clientsMux.RUnlock()
+	if current != primary {
+		t.Error("the companion connection replaced alice's client")
+	}
+	broadcastSystemMessage("marker")
+	for {
+		msg := receive(t, bob.system, "marker")
+		if msg.Content == "marker" {
+			break
+		}
+		if msg.Content == "alice joined the chat" {
+			t.Error("the companion connection announced alice")
+		}
+	}
+
+	// Messages sent by the companion come from alice, and frames sent to
+	// alice reach both connections, errors included
+	if err := companion.SendPrivate("bob", "from the companion"); err != nil {
+		t.Fatalf("SendPrivate failed: %v", err)
+	}
+	if msg := receive(t, bob.private, "companion message"); msg.From != "alice" || msg.Content != "from the companion" {
+		t.Errorf("bob got %+v", msg)
+	}
+	if err := bob.SendPrivate("alice", "hi alice"); err != nil {
+		t.Fatalf("SendPrivate failed: %v", err)
+	}
+	for _, ch := range []chan protocol.Message{alice.private, private} {
+		for {
+			if msg := receive(t, ch, "bob's message"); msg.Content == "hi alice" {
+				break
+			}
+		}
+	}
+	sendError("alice", "oops")
+	for _, ch := range []chan protocol.Message{alice.errors, errs} {
+		if msg := receive(t, ch, "error"); msg.Content != "oops" {
+			t.Errorf("got error %q, want oops", msg.Content)
+		}
+	}
+
+	// Closing the companion leaves alice online
+	companion.Close()
+	waitFor(t, "the companion to unregister", func() bool { return len(companionsOf("alice")) == 0 })
+	clientsMux.RLock()
+	current = clients["alice"]
+	clientsMux.RUnlock()
+	if current != primary || !bob.sees("alice") {
+		t.Error("closing the companion connection took alice offline")
+	}
+}
@@ -0,0 +1,540 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Kinds of cluster events
+const (
+	// clusterPeerJoined is reported by a bus when another node connects,
+	// so the node can bring it up to date
+	clusterPeerJoined = "peer_joined"
+	// clusterPresence lists the users connected to the sending node
+	clusterPresence = "presence"
+	// clusterDeliver carries a frame for users on other nodes
+	clusterDeliver = "deliver"
+	// clusterGroup and clusterGroupDeleted replicate group changes
+	clusterGroup        = "group"
+	clusterGroupDeleted = "group_deleted"
+	// clusterMessage replicates a new message into the history of every node
+	clusterMessage = "message"
+	// clusterLastSeen replicates what a user has read
+	clusterLastSeen = "last_seen"
+	// clusterMessageDeleted removes a deleted message from every node
+	clusterMessageDeleted = "message_deleted"
+	// clusterBan and clusterUnban replicate bans, so banned users are kept
+	// off every node
+	clusterBan   = "ban"
+	clusterUnban = "unban"
+	// clusterRetention replicates the retention policy of a private chat
+	clusterRetention = "retention"
+	// clusterProfile replicates a user's block list and privacy settings
+	clusterProfile = "profile"
+)
+
+const (
+	// presenceInterval is how often nodes announce their users
+	presenceInterval = 5 * time.Second
+	// Users of nodes that stay silent for presenceTimeout are offline
+	presenceTimeout = 3 * presenceInterval
+	// clusterQueueSize bounds the events waiting for a node or peer
+	clusterQueueSize = 1024
+)
+
+// ClusterEvent is a message between the nodes of a cluster
+type ClusterEvent struct {
+	Node      string            `json:"node"`             // Set by the bus to the sender
+	Origin    string            `json:"origin,omitempty"` // The node that changed Group, if not the sender
+	Kind      string            `json:"kind"`
+	Users     []string          `json:"users,omitempty"` // Online users, or the recipients of Frame
+	All       bool              `json:"all,omitempty"`   // Deliver Frame to every user
+	Frame     json.RawMessage   `json:"frame,omitempty"`
+	Group     *protocol.Group   `json:"group,omitempty"`
+	GroupID   string            `json:"group_id,omitempty"`
+	Message   *protocol.Message `json:"message,omitempty"`
+	ChatID    string            `json:"chat_id,omitempty"`
+	Timestamp string            `json:"timestamp,omitempty"`
+
+	Ban       *protocol.Ban             `json:"ban,omitempty"`
+	Retention *protocol.RetentionPolicy `json:"retention,omitempty"`
+	Profile   *protocol.UserProfile     `json:"profile,omitempty"`
+}
+
+// ClusterBus carries events between the nodes of a cluster, so users on
+// different nodes can talk to each other
+type ClusterBus interface {
+	// Publish sends an event to every other node. It does not block; events
+	// for peers that cannot keep up are dropped.
+	Publish(event ClusterEvent)
+	// Events delivers the events of the other nodes. It is closed by Close.
+	Events() <-chan ClusterEvent
+	Close() error
+}
+
+var (
+	cluster    ClusterBus // nil when running a single node
+	nodeID     string
+	clusterMux sync.RWMutex
+
+	// Users connected to the other nodes
+	remoteUsers    = make(map[string]*remotePresence) // key: node ID
+	remoteUsersMux sync.RWMutex
+
+	// publishedGroups is the group state the other nodes know about, so
+	// only changes are published. Lock it before groupsMux.
+	publishedGroups    = make(map[string]publishedGroup) // key: group ID
+	publishedGroupsMux sync.Mutex
+)
+
+// publishedGroup is the last known version of a group. Deleted groups are
+// kept, so snapshots that cross the deletion do not bring them back.
+type publishedGroup struct {
+	group   protocol.Group
+	node    string // The node that made the change
+	deleted bool
+}
+
+// supersedes reports whether a snapshot made by node replaces p. Versions
+// grow with every change; concurrent changes with the same version are
+// ordered by node ID, so every node keeps the same one.
+func (p publishedGroup) supersedes(group *protocol.Group, node string) bool {
+	if p.deleted {
+		return false
+	}
+	return group.Version > p.group.Version || (group.Version == p.group.Version && node > p.node)
+}
+
+// remotePresence is the last presence announcement of a node
+type remotePresence struct {
+	users map[string]bool
+	seen  time.Time
+}
+
+// startCluster joins the cluster of bus as node and applies the events of
+// the other nodes until the bus is closed
+func startCluster(bus ClusterBus, node string) {
+	clusterMux.Lock()
+	cluster, nodeID = bus, node
+	clusterMux.Unlock()
+
+	log.Printf("Joined the cluster as node %s", node)
+	go runCluster(bus)
+	publishPresence()
+	resyncGroups()
+}
+
+// stopCluster leaves the cluster and forgets the users of the other nodes
+func stopCluster() error {
+	clusterMux.Lock()
+	bus := cluster
+	cluster, nodeID = nil, ""
+	clusterMux.Unlock()
+
+	remoteUsersMux.Lock()
+	remoteUsers = make(map[string]*remotePresence)
+	remoteUsersMux.Unlock()
+
+	publishedGroupsMux.Lock()
+	publishedGroups = make(map[string]publishedGroup)
+	publishedGroupsMux.Unlock()
+
+	if bus == nil {
+		return nil
+	}
+	return bus.Close()
+}
+
+// inCluster reports whether this node is part of a cluster
+func inCluster() bool {
+	clusterMux.RLock()
+	defer clusterMux.RUnlock()
+	return cluster != nil
+}
+
+// publishCluster sends an event to the other nodes, if there are any
+func publishCluster(event ClusterEvent) {
+	clusterMux.RLock()
+	bus := cluster
+	clusterMux.RUnlock()
+	if bus != nil {
+		bus.Publish(event)
+	}
+}
+
+func runCluster(bus ClusterBus) {
+	ticker := time.NewTicker(presenceInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case event, ok := <-bus.Events():
+			if !ok {
+				return
+			}
+			applyClusterEvent(event)
+		case <-ticker.C:
+			publishPresence()
+			expirePresence()
+		}
+	}
+}
+
+// applyClusterEvent applies an event of another node. Nothing it does is
+// published again.
+func applyClusterEvent(event ClusterEvent) {
+	switch event.Kind {
+	case clusterPeerJoined:
+		publishPresence()
+		resyncGroups()
+	case clusterPresence:
+		users := make(map[string]bool, len(event.Users))
+		for _, user := range event.Users {
+			users[user] = true
+		}
+		remoteUsersMux.Lock()
+		previous, known := remoteUsers[event.Node]
+		changed := !known || !reflect.DeepEqual(previous.users, users)
+		remoteUsers[event.Node] = &remotePresence{users: users, seen: time.Now()}
+		remoteUsersMux.Unlock()
+		if changed {
+			sendUserList()
+		}
+	case clusterDeliver:
+		frame := shareFrame(event.Frame)
+		if event.All {
+			clientsMux.RLock()
+			for username := range clients {
+				event.Users = append(event.Users, username)
+			}
+			clientsMux.RUnlock()
+		}
+		for _, username := range event.Users {
+			queueLocal(username, frame)
+		}
+	case clusterGroup:
+		if event.Group == nil {
+			return
+		}
+		origin := event.Origin
+		if origin == "" {
+			origin = event.Node
+		}
+		publishedGroupsMux.Lock()
+		if published, ok := publishedGroups[event.Group.ID]; ok && !published.supersedes(event.Group, origin) {
+			publishedGroupsMux.Unlock()
+			return
+		}
+		groupsMux.Lock()
+		group := cloneGroup(event.Group)
+		groups[group.ID] = &group
+		publishedGroups[group.ID] = publishedGroup{group: cloneGroup(&group), node: origin}
+		groupsMux.Unlock()
+		publishedGroupsMux.Unlock()
+		sendGroupList()
+	case clusterGroupDeleted:
+		publishedGroupsMux.Lock()
+		groupsMux.Lock()
+		delete(groups, event.GroupID)
+		publishedGroups[event.GroupID] = publishedGroup{node: event.Node, deleted: true}
+		groupsMux.Unlock()
+		publishedGroupsMux.Unlock()
+		sendGroupList()
+	case clusterMessage:
+		if event.Message != nil {
+			storeMessage(*event.Message)
+		}
+	case clusterLastSeen:
+		if len(event.Users) == 1 {
+			updateLastSeen(event.Users[0], event.ChatID, event.Timestamp)
+		}
+	case clusterMessageDeleted:
+		if event.Message != nil {
+			unstoreMessage(*event.Message)
+		}
+	case clusterBan:
+		if event.Ban != nil {
+			storeBan(*event.Ban)
+			disconnectUser(event.Ban.User, "banned")
+		}
+	case clusterUnban:
+		if len(event.Users) == 1 {
+			removeBan(event.Users[0])
+		}
+	case clusterRetention:
+		if event.Retention != nil {
+			storeDMRetention(event.ChatID, *event.Retention)
+		}
+	case clusterProfile:
+		if event.Profile != nil {
+			storeProfile(*event.Profile)
+		}
+	default:
+		log.Printf("Unknown cluster event from node %s: %s", event.Node, event.Kind)
+	}
+}
+
+// publishPresence announces the users connected to this node. Bots run on
+// every node, so they are left out.
+func publishPresence() {
+	if !inCluster() {
+		return
+	}
+	clientsMux.RLock()
+	users := make([]string, 0, len(clients))
+	for username, client := range clients {
+		if client.conn != nil {
+			users = append(users, username)
+		}
+	}
+	clientsMux.RUnlock()
+	sort.Strings(users)
+	publishCluster(ClusterEvent{Kind: clusterPresence, Users: users})
+}
+
+// expirePresence forgets the users of nodes that stopped announcing them
+func expirePresence() {
+	remoteUsersMux.Lock()
+	expired := false
+	for node, presence := range remoteUsers {
+		if time.Since(presence.seen) > presenceTimeout {
+			log.Printf("Node %s stopped announcing its users", node)
+			delete(remoteUsers, node)
+			expired = true
+		}
+	}
+	remoteUsersMux.Unlock()
+	if expired {
+		sendUserList()
+	}
+}
+
+// remoteOnline reports whether username is connected to another node
+func remoteOnline(username string) bool {
+	remoteUsersMux.RLock()
+	defer remoteUsersMux.RUnlock()
+	for _, presence := range remoteUsers {
+		if presence.users[username] {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteUserNames returns the users connected to other nodes
+func remoteUserNames() []string {
+	remoteUsersMux.RLock()
+	defer remoteUsersMux.RUnlock()
+	var names []string
+	for _, presence := range remoteUsers {
+		for username := range presence.users {
+			names = append(names, username)
+		}
+	}
+	return names
+}
+
+// isOnline reports whether username is connected to any node
+func isOnline(username string) bool {
+	clientsMux.RLock()
+	_, local := clients[username]
+	clientsMux.RUnlock()
+	return local || remoteOnline(username)
+}
+
+// forwardFrame sends a frame to those of users who are connected to other
+// nodes. It reports whether there were any.
+func forwardFrame(users []string, frame []byte) bool {
+	var remote []string
+	for _, username := range users {
+		if remoteOnline(username) {
+			remote = append(remote, username)
+		}
+	}
+	if len(remote) == 0 {
+		return false
+	}
+	publishCluster(ClusterEvent{Kind: clusterDeliver, Users: remote, Frame: frame})
+	return true
+}
+
+// forwardBroadcast sends a frame to the users of every other node
+func forwardBroadcast(frame []byte) {
+	publishCluster(ClusterEvent{Kind: clusterDeliver, All: true, Frame: frame})
+}
+
+// publishMessage adds a new message to the history of the other nodes
+func publishMessage(msg protocol.Message) {
+	publishCluster(ClusterEvent{Kind: clusterMessage, Message: &msg})
+}
+
+// publishLastSeen tells the other nodes what a user has read, so all nodes
+// count the same unread messages
+func publishLastSeen(username, chatID, timestamp string) {
+	publishCluster(ClusterEvent{Kind: clusterLastSeen, Users: []string{username}, ChatID: chatID, Timestamp: timestamp})
+}
+
+// publishMessageDeleted removes a deleted message from the history of the
+// other nodes
+func publishMessageDeleted(msg protocol.Message) {
+	publishCluster(ClusterEvent{Kind: clusterMessageDeleted, Message: &msg})
+}
+
+// publishBan bans a user on the other nodes, disconnecting them there
+func publishBan(ban protocol.Ban) {
+	publishCluster(ClusterEvent{Kind: clusterBan, Ban: &ban})
+}
+
+// publishUnban lifts the ban of a user on the other nodes
+func publishUnban(username string) {
+	publishCluster(ClusterEvent{Kind: clusterUnban, Users: []string{username}})
+}
+
+// publishDMRetention sets the retention policy of the private chat with the
+// given conversation key on the other nodes
+func publishDMRetention(key string, policy protocol.RetentionPolicy) {
+	publishCluster(ClusterEvent{Kind: clusterRetention, ChatID: key, Retention: &policy})
+}
+
+// publishProfile replaces a user's profile on the other nodes
+func publishProfile(profile protocol.UserProfile) {
+	publishCluster(ClusterEvent{Kind: clusterProfile, Profile: &profile})
+}
+
+// syncGroups publishes the groups that changed since they were last
+// published, each with the next version. sendGroupList calls it after every
+// group change.
+func syncGroups() {
+	if !inCluster() {
+		return
+	}
+	clusterMux.RLock()
+	node := nodeID
+	clusterMux.RUnlock()
+
+	publishedGroupsMux.Lock()
+	defer publishedGroupsMux.Unlock()
+	groupsMux.Lock()
+	var changed []protocol.Group
+	for id, group := range groups {
+		published, ok := publishedGroups[id]
+		if ok && reflect.DeepEqual(published.group, cloneGroup(group)) {
+			continue
+		}
+		group.Version = published.group.Version + 1
+		snapshot := cloneGroup(group)
+		publishedGroups[id] = publishedGroup{group: snapshot, node: node}
+		changed = append(changed, snapshot)
+	}
+	var deleted []string
+	for id, published := range publishedGroups {
+		if _, ok := groups[id]; !ok && !published.deleted {
+			publishedGroups[id] = publishedGroup{node: node, deleted: true}
+			deleted = append(deleted, id)
+		}
+	}
+	groupsMux.Unlock()
+
+	for i := range changed {
+		publishCluster(ClusterEvent{Kind: clusterGroup, Group: &changed[i]})
+	}
+	for _, id := range deleted {
+		publishCluster(ClusterEvent{Kind: clusterGroupDeleted, GroupID: id})
+	}
+}
+
+// resyncGroups publishes every group and deletion, for nodes that just
+// joined
+func resyncGroups() {
+	if !inCluster() {
+		return
+	}
+	syncGroups()
+
+	publishedGroupsMux.Lock()
+	defer publishedGroupsMux.Unlock()
+	for id, published := range publishedGroups {
+		if published.deleted {
+			publishCluster(ClusterEvent{Kind: clusterGroupDeleted, GroupID: id})
+			continue
+		}
+		group := cloneGroup(&published.group)
+		publishCluster(ClusterEvent{Kind: clusterGroup, Group: &group, Origin: published.node})
+	}
+}
+
+// LoopbackHub connects the nodes of a cluster that run in one process
+type LoopbackHub struct {
+	mu    sync.Mutex
+	buses map[string]*loopbackBus // key: node ID
+}
+
+// NewLoopbackHub returns an empty hub
+func NewLoopbackHub() *LoopbackHub {
+	return &LoopbackHub{buses: make(map[string]*loopbackBus)}
+}
+
+// Join connects a node to the hub. It and the nodes already connected
+// receive clusterPeerJoined events.
+func (h *LoopbackHub) Join(node string) ClusterBus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	bus := &loopbackBus{hub: h, node: node, events: make(chan ClusterEvent, clusterQueueSize)}
+	for _, other := range h.buses {
+		other.deliver(ClusterEvent{Node: node, Kind: clusterPeerJoined})
+		bus.deliver(ClusterEvent{Node: other.node, Kind: clusterPeerJoined})
+	}
+	h.buses[node] = bus
+	return bus
+}
+
+// loopbackBus is a node's connection to a LoopbackHub
+type loopbackBus struct {
+	hub    *LoopbackHub
+	node   string
+	events chan ClusterEvent
+}
+
+func (b *loopbackBus) Publish(event ClusterEvent) {
+	event.Node = b.node
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	if b.hub.buses[b.node] != b {
+		return
+	}
+	for _, other := range b.hub.buses {
+		if other != b {
+			other.deliver(event)
+		}
+	}
+}
+
+// deliver queues an event for the node. The caller holds hub.mu.
+func (b *loopbackBus) deliver(event ClusterEvent) {
+	select {
+	case b.events <- event:
+	default:
+		log.Printf("Dropped cluster event %s for node %s: queue full", event.Kind, b.node)
+	}
+}
+
+func (b *loopbackBus) Events() <-chan ClusterEvent {
+	return b.events
+}
+
+func (b *loopbackBus) Close() error {
+	b.hub.mu.Lock()
+	defer b.hub.mu.Unlock()
+	if b.hub.buses[b.node] == b {
+		delete(b.hub.buses, b.node)
+		close(b.events)
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// maxClusterEvent bounds the size of one event on the wire, which is
+	// mostly a frame of at most maxMessageSize
+	maxClusterEvent = 4 << 20 // 4MB
+
+	clusterDialTimeout = 5 * time.Second
+	clusterMinBackoff  = 100 * time.Millisecond
+	clusterMaxBackoff  = 5 * time.Second
+)
+
+// clusterHello is the first line of every connection between nodes
+type clusterHello struct {
+	Node   string `json:"node"`
+	Secret string `json:"secret,omitempty"`
+}
+
+// TCPBus connects the nodes of a cluster with a full mesh of TCP
+// connections. Every node dials every peer and publishes on the connections
+// it dialed; it reads the events of the others from the connections it
+// accepts. Events are JSON lines, after a hello line with the node ID and
+// the shared secret.
+type TCPBus struct {
+	node     string
+	secret   string
+	listener net.Listener
+	events   chan ClusterEvent
+	done     chan struct{}
+	wg       sync.WaitGroup
+
+	mu       sync.Mutex
+	outbound map[string]chan []byte // key: peer address
+	conns    map[net.Conn]bool      // Every open connection, for Close
+	closed   bool
+}
+
+// NewTCPBus accepts peers on listener and keeps connections to every
+// address in peers. Nodes only accept peers with the same secret, and a bus
+// without a secret accepts none.
+func NewTCPBus(node string, listener net.Listener, peers []string, secret string) *TCPBus {
+	b := &TCPBus{
+		node:     node,
+		secret:   secret,
+		listener: listener,
+		events:   make(chan ClusterEvent, clusterQueueSize),
+		done:     make(chan struct{}),
+		outbound: make(map[string]chan []byte),
+		conns:    make(map[net.Conn]bool),
+	}
+	b.wg.Add(1)
+	go b.accept()
+	for _, peer := range peers {
+		b.wg.Add(1)
+		go b.dial(peer)
+	}
+	return b
+}
+
+// Addr returns the address the bus listens on
+func (b *TCPBus) Addr() net.Addr {
+	return b.listener.Addr()
+}
+
+func (b *TCPBus) Events() <-chan ClusterEvent {
+	return b.events
+}
+
+// Publish queues an event on the connection to every peer
+func (b *TCPBus) Publish(event ClusterEvent) {
+	event.Node = b.node
+	data, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Error marshaling cluster event %s: %v", event.Kind, err)
+		return
+	}
+	data = append(data, '\n')
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for peer, queue := range b.outbound {
+		select {
+		case queue <- data:
+		default:
+			log.Printf("Dropped cluster event %s for peer %s: queue full", event.Kind, peer)
+		}
+	}
+}
+
+// Close disconnects from all peers and closes Events
+func (b *TCPBus) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	for conn := range b.conns {
+		conn.Close()
+	}
+	b.mu.Unlock()
+
+	err := b.listener.Close()
+	b.wg.Wait()
+	close(b.events)
+	return err
+}
+
+// track registers a connection for Close. It returns false once the bus is
+// closed.
+func (b *TCPBus) track(conn net.Conn) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false
+	}
+	b.conns[conn] = true
+	return true
+}
+
+func (b *TCPBus) untrack(conn net.Conn) {
+	b.mu.Lock()
+	delete(b.conns, conn)
+	b.mu.Unlock()
+	conn.Close()
+}
+
+func (b *TCPBus) accept() {
+	defer b.wg.Done()
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			select {
+			case <-b.done:
+			default:
+				log.Printf("Error accepting cluster peer: %v", err)
+			}
+			return
+		}
+		if !b.track(conn) {
+			conn.Close()
+			return
+		}
+		b.wg.Add(1)
+		go b.read(conn)
+	}
+}
+
+// read checks the hello of an accepted connection and then delivers its
+// events
+func (b *TCPBus) read(conn net.Conn) {
+	defer b.wg.Done()
+	defer b.untrack(conn)
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 0, 4096), maxClusterEvent)
+
+	conn.SetReadDeadline(time.Now().Add(clusterDialTimeout))
+	var hello clusterHello
+	if !scanner.Scan() || json.Unmarshal(scanner.Bytes(), &hello) != nil {
+		log.Printf("Cluster peer %s sent no hello", conn.RemoteAddr())
+		return
+	}
+	if hello.Secret == "" || subtle.ConstantTimeCompare([]byte(hello.Secret), []byte(b.secret)) != 1 {
+		log.Printf("Refused cluster peer %s (%s): wrong secret", hello.Node, conn.RemoteAddr())
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	log.Printf("Cluster peer %s connected from %s", hello.Node, conn.RemoteAddr())
+
+	for scanner.Scan() {
+		var event ClusterEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			log.Printf("Error decoding cluster event from %s: %v", hello.Node, err)
+			continue
+		}
+		event.Node = hello.Node
+		select {
+		case b.events <- event:
+		case <-b.done:
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, net.ErrClosed) {
+		log.Printf("Error reading from cluster peer %s: %v", hello.Node, err)
+	}
+}
+
+// dial keeps a connection to peer open, reconnecting with exponential
+// backoff
+func (b *TCPBus) dial(peer string) {
+	defer b.wg.Done()
+
+	delay := clusterMinBackoff
+	for {
+		conn, err := net.DialTimeout("tcp", peer, clusterDialTimeout)
+		if err == nil {
+			if !b.track(conn) {
+				conn.Close()
+				return
+			}
+			delay = clusterMinBackoff
+			b.write(peer, conn)
+			b.untrack(conn)
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-b.done:
+			return
+		}
+		delay *= 2
+		if delay > clusterMaxBackoff {
+			delay = clusterMaxBackoff
+		}
+	}
+}
+
+// write sends the hello and then the published events to peer until the
+// connection fails or the bus is closed
+func (b *TCPBus) write(peer string, conn net.Conn) {
+	hello, err := json.Marshal(clusterHello{Node: b.node, Secret: b.secret})
+	if err != nil {
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := conn.Write(append(hello, '\n')); err != nil {
+		return
+	}
+
+	queue := make(chan []byte, clusterQueueSize)
+	b.mu.Lock()
+	b.outbound[peer] = queue
+	b.mu.Unlock()
+	defer func() {
+		b.mu.Lock()
+		delete(b.outbound, peer)
+		b.mu.Unlock()
+	}()
+
+	// Let the node bring the peer up to date
+	select {
+	case b.events <- ClusterEvent{Node: peer, Kind: clusterPeerJoined}:
+	case <-b.done:
+		return
+	}
+
+	for {
+		select {
+		case data := <-queue:
+			conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if _, err := conn.Write(data); err != nil {
+				log.Printf("Lost the connection to cluster peer %s: %v", peer, err)
+				return
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,1039 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/client"
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// historyLines is how many messages /open shows from a conversation
+const historyLines = 20
+
+const interactiveHelp = `Commands:
+  /open USER | /open #GROUP   switch to a chat and show recent history
+  /msg USER TEXT              send a private message
+  /gmsg GROUP TEXT            send a group message
+  /history [N]                show the last N messages of the current chat
+  /users                      list online users
+  /groups                     list your groups
+  /channels                   list public groups
+  /preview GROUP              show recent messages of a public group
+  /unread                     show unread message counts
+  /search QUERY               search messages ("phrases", from:, in:, after:, before:)
+  /mentions                   show recent group messages that mention you
+  /create GROUP USER,USER...  create a group
+  /add GROUP USER             add a member to a group you moderate
+  /remove GROUP USER          remove a member ranked below you from a group
+  /role GROUP USER ROLE       set a member's role (admin, moderator, member, read_only)
+  /transfer GROUP USER        make another member the owner of your group
+  /leave GROUP                leave a group
+  /rename GROUP NAME          rename a group
+  /topic GROUP [TEXT]         set or clear the topic of a group
+  /invites                    list pending invitations and join requests
+  /accept ID|CODE             accept an invitation or redeem an invite code
+  /decline ID                 decline an invitation
+  /invite-code GROUP [TTL] [USES]
+                              create a shareable invite code
+  /join GROUP [NOTE]          join a public group, or ask the admins of a
+                              private group (by ID) to let you in
+  /visibility GROUP public|private
+                              make a group public or private
+  /policy GROUP announce on|off | slow SECONDS | maxlen N
+                              set the posting policy of a group
+  /approve ID | /deny ID      decide a join request
+  /block USER | /unblock USER drop or allow private messages and invitations
+  /privacy dm|invites everyone|group_members|nobody
+                              choose who may message you or invite you
+  /profile                    show your block list and privacy settings
+  /mute GROUP USER DURATION [REASON] | /unmute GROUP USER
+                              keep a member from posting for a while
+  /report USER [REASON]       report USER's latest message in the current chat
+  /reports [STATUS]           list reports you filed or may handle
+  /resolve ID [NOTE] | /dismiss ID [NOTE]
+                              close a report
+  /audit [GROUP]              show recent moderation actions
+  /retention USER|#GROUP [off | maxage DURATION | maxcount N | disappear DURATION]...
+                              show or set how long a chat keeps its messages
+  /filters GROUP [clear]      show or remove the content filters of a group
+  /filters GROUP add KIND reject|redact|flag ARGS
+                              add a filter: words WORD,WORD... | regex PATTERN |
+                              links allow|deny DOMAIN,DOMAIN... | repeat N
+  /ban USER DURATION|permanent [REASON] | /unban USER
+                              keep a user off the server (server moderators)
+  /quit                       exit
+Any other line is sent to the current chat. In a group, unknown /commands
+are passed through to the group's bots (try /help-bots).`
+
+// session is the state of an interactive chat
+type session struct {
+	c   *client.Client
+	out io.Writer
+
+	mu       sync.Mutex
+	users    []string
+	bots     []string
+	groups   []protocol.Group
+	unread   map[string]int
+	chatType string // protocol.TypePrivate or protocol.TypeGroup
+	chatID   string
+}
+
+// runInteractive starts a line-based chat session on in and out
+func runInteractive(server, user string, in io.Reader, out io.Writer) error {
+	s := &session{out: out, unread: make(map[string]int)}
+
+	ctx, cancel := waitContext()
+	defer cancel()
+
+	c, err := client.Dial(ctx, client.Config{
+		URL:      server,
+		Username: user,
+		Handlers: client.Handlers{
+			OnConnect:        func() { s.printf("* connected as %s", user) },
+			OnDisconnect:     func(err error) { s.printf("* disconnected (%v), reconnecting...", err) },
+			OnPrivateMessage: s.onMessage,
+			OnGroupMessage:   s.onMessage,
+			OnSystem:         func(msg protocol.Message) { s.printf("%s", formatMessage(msg, false)) },
+			OnError:          func(msg protocol.Message) { s.printf("! %s", msg.Content) },
+			OnInvitation:     func(inv protocol.Invitation) { s.printf("* %s", formatInvitation(inv, user)) },
+			OnJoinRequest:    func(req protocol.JoinRequest) { s.printf("* %s", formatJoinRequest(req, user)) },
+			OnReport:         func(report protocol.Report) { s.printf("* %s", formatReport(report, user)) },
+			OnRetention: func(chatID string, policy protocol.RetentionPolicy) {
+				if name, ok := s.groupNames()[chatID]; ok {
+					s.printf("* retention of #%s: %s", name, formatRetention(policy))
+					return
+				}
+				s.printf("* retention of your chat with %s: %s", chatID, formatRetention(policy))
+			},
+			OnUserList: func(users, bots []string) {
+				s.mu.Lock()
+				s.users, s.bots = users, bots
+				s.mu.Unlock()
+			},
+			OnGroupList: func(groups []protocol.Group) {
+				s.mu.Lock()
+				s.groups = groups
+				s.mu.Unlock()
+			},
+			OnUnreadCounts: func(counts map[string]int) {
+				s.mu.Lock()
+				s.unread = counts
+				s.mu.Unlock()
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	s.c = c
+
+	s.printf("Type /help for commands")
+	prompt := isTerminal(os.Stdin) && in == os.Stdin
+
+	scanner := bufio.NewScanner(in)
+	for {
+		if prompt {
+			fmt.Fprintf(out, "%s> ", s.currentChat())
+		}
+		if !scanner.Scan() {
+			return scanner.Err()
+		}
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line == "/quit" || line == "/exit" {
+			return nil
+		}
+		if err := s.handleLine(line); err != nil {
+			s.printf("! %v", err)
+		}
+	}
+}
+
+func (s *session) printf(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(s.out, "\r"+format+"\n", args...)
+}
+
+// groupID resolves a group typed as NAME or #NAME to the ID of one of the
+// user's groups
+func (s *session) groupID(ref string) (string, error) {
+	ref = strings.TrimPrefix(ref, "#")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if id, ok := findGroup(s.groups, ref); ok {
+		return id, nil
+	}
+	return "", fmt.Errorf("you are not a member of a group named %s", ref)
+}
+
+// groupNames maps the IDs of the user's groups to their current names
+func (s *session) groupNames() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return groupNames(s.groups)
+}
+
+// currentChat returns the display name of the current chat
+func (s *session) currentChat() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch s.chatType {
+	case protocol.TypeGroup:
+		if name, ok := groupNames(s.groups)[s.chatID]; ok {
+			return "#" + name
+		}
+		return "#" + s.chatID
+	case protocol.TypePrivate:
+		return s.chatID
+	}
+	return ""
+}
+
+// onMessage prints an incoming chat message and marks the current chat read
+func (s *session) onMessage(msg protocol.Message) {
+	chatType, chatID := protocol.TypeGroup, msg.To
+	label := "#" + msg.To
+	if name, ok := s.groupNames()[msg.To]; ok {
+		label = "#" + name
+	}
+	if msg.Type == protocol.TypePrivateMessage {
+		chatType, chatID = protocol.TypePrivate, msg.From
+		label = msg.From + " -> you"
+	}
+
+	s.mu.Lock()
+	current := s.chatType == chatType && s.chatID == chatID
+	s.mu.Unlock()
+
+	if current {
+		s.printf("%s", formatMessage(msg, false))
+		s.c.MarkRead(chatID)
+		return
+	}
+	s.printf("(%s) %s", label, formatMessage(msg, false))
+}
+
+// formatInvitation describes an invitation from the point of view of user
+func formatInvitation(inv protocol.Invitation, user string) string {
+	switch {
+	case inv.Code != "":
+		return fmt.Sprintf("invite code %s for #%s: %s, used %d times (expires %s)", inv.Code, inv.GroupName, inv.Status, inv.Uses, inv.ExpiresAt)
+	case inv.Status == protocol.StatusPending && inv.Invitee == user:
+		return fmt.Sprintf("%s invited you to #%s; /accept %s or /decline %s", inv.Inviter, inv.GroupName, inv.ID, inv.ID)
+	case inv.Invitee == user:
+		return fmt.Sprintf("invitation to #%s from %s: %s", inv.GroupName, inv.Inviter, inv.Status)
+	}
+	return fmt.Sprintf("invitation of %s to #%s: %s", inv.Invitee, inv.GroupName, inv.Status)
+}
+
+// formatJoinRequest describes a join request from the point of view of user
+func formatJoinRequest(req protocol.JoinRequest, user string) string {
+	if req.User == user {
+		return fmt.Sprintf("your request to join #%s: %s", req.GroupName, req.Status)
+	}
+	text := fmt.Sprintf("%s asked to join #%s", req.User, req.GroupName)
+	if req.Note != "" {
+		text += fmt.Sprintf(" (%q)", req.Note)
+	}
+	if req.Status == protocol.StatusPending {
+		return text + fmt.Sprintf("; /approve %s or /deny %s", req.ID, req.ID)
+	}
+	return text + fmt.Sprintf(": %s by %s", req.Status, req.DecidedBy)
+}
+
+// formatReport describes a report from the point of view of user
+func formatReport(report protocol.Report, user string) string {
+	chat := "a private chat"
+	if report.GroupName != "" {
+		chat = "#" + report.GroupName
+	}
+	text := fmt.Sprintf("report %s by %s of %s's message in %s (%q)", report.ID, report.Reporter,
+		report.Message.From, chat, report.Message.Content)
+	if report.Reason != "" {
+		text += ": " + report.Reason
+	}
+	switch {
+	case report.Status != protocol.StatusPending:
+		text += fmt.Sprintf(" [%s by %s]", report.Status, report.HandledBy)
+	case report.Reporter != user:
+		text += fmt.Sprintf("; /resolve %s or /dismiss %s", report.ID, report.ID)
+	}
+	return text
+}
+
+// formatAuditEntry describes a moderation action. names maps group IDs to
+// names.
+func formatAuditEntry(entry protocol.AuditEntry, names map[string]string) string {
+	text := fmt.Sprintf("%s %s %s %s", entry.Time, entry.Actor, entry.Action, entry.Target)
+	if entry.Group != "" {
+		group := entry.Group
+		if name, ok := names[group]; ok {
+			group = name
+		}
+		text += " in #" + group
+	}
+	if entry.Reason != "" {
+		text += fmt.Sprintf(" (%s)", entry.Reason)
+	}
+	return text
+}
+
+// formatRetention describes a retention policy
+func formatRetention(policy protocol.RetentionPolicy) string {
+	var parts []string
+	if policy.MaxAgeSeconds > 0 {
+		parts = append(parts, fmt.Sprintf("messages for %s", time.Duration(policy.MaxAgeSeconds)*time.Second))
+	}
+	if policy.MaxCount > 0 {
+		parts = append(parts, fmt.Sprintf("the latest %d messages", policy.MaxCount))
+	}
+	if policy.DisappearSeconds > 0 {
+		parts = append(parts, fmt.Sprintf("new messages disappear after %s", time.Duration(policy.DisappearSeconds)*time.Second))
+	}
+	if len(parts) == 0 {
+		return "everything (subject to server limits)"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// parseRetention reads the settings of /retention
+func parseRetention(args []string) (protocol.RetentionPolicy, error) {
+	var policy protocol.RetentionPolicy
+	if len(args) == 1 && args[0] == "off" {
+		return policy, nil
+	}
+	if len(args)%2 != 0 {
+		return policy, fmt.Errorf("settings come in pairs, e.g. maxage 720h maxcount 1000")
+	}
+	for i := 0; i < len(args); i += 2 {
+		switch args[i] {
+		case "maxage", "disappear":
+			d, err := time.ParseDuration(args[i+1])
+			if err != nil {
+				return policy, fmt.Errorf("invalid %s: %v", args[i], err)
+			}
+			if args[i] == "maxage" {
+				policy.MaxAgeSeconds = int(d / time.Second)
+			} else {
+				policy.DisappearSeconds = int(d / time.Second)
+			}
+		case "maxcount":
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil {
+				return policy, fmt.Errorf("invalid maxcount: %v", err)
+			}
+			policy.MaxCount = n
+		default:
+			return policy, fmt.Errorf("unknown setting %s; use maxage, maxcount or disappear", args[i])
+		}
+	}
+	return policy, nil
+}
+
+// formatFilterRule describes a content filter rule
+func formatFilterRule(rule protocol.FilterRule) string {
+	var what string
+	switch rule.Kind {
+	case protocol.FilterWords:
+		what = strings.Join(rule.Words, ", ")
+	case protocol.FilterRegex:
+		what = rule.Pattern
+	case protocol.FilterLinks:
+		what = "deny " + strings.Join(rule.DenyDomains, ", ")
+		if len(rule.AllowDomains) > 0 {
+			what = "allow only " + strings.Join(rule.AllowDomains, ", ")
+		}
+	case protocol.FilterRepeat:
+		what = fmt.Sprintf("more than %d in a row", rule.MaxRepeat)
+	}
+	return fmt.Sprintf("%s %s: %s", rule.Action, rule.Kind, what)
+}
+
+// parseFilterRule builds a rule from the arguments of /filters GROUP add.
+// text is the raw text of the arguments, for patterns containing spaces.
+func parseFilterRule(kind, action string, args []string, text string) (protocol.FilterRule, error) {
+	rule := protocol.FilterRule{Kind: kind, Action: action}
+	switch kind {
+	case protocol.FilterWords:
+		rule.Words = strings.Split(strings.Join(args, ""), ",")
+	case protocol.FilterRegex:
+		rule.Pattern = text
+	case protocol.FilterLinks:
+		if len(args) != 2 || (args[0] != "allow" && args[0] != "deny") {
+			return rule, fmt.Errorf("usage: /filters GROUP add links ACTION allow|deny DOMAIN,DOMAIN...")
+		}
+		if args[0] == "allow" {
+			rule.AllowDomains = strings.Split(args[1], ",")
+		} else {
+			rule.DenyDomains = strings.Split(args[1], ",")
+		}
+	case protocol.FilterRepeat:
+		n, err := strconv.Atoi(args[0])
+		if err != nil {
+			return rule, fmt.Errorf("invalid N: %v", err)
+		}
+		rule.MaxRepeat = n
+	default:
+		return rule, fmt.Errorf("unknown filter kind %s; use words, regex, links or repeat", kind)
+	}
+	return rule, nil
+}
+
+// handleLine runs a command or sends text to the current chat
+func (s *session) handleLine(line string) error {
+	if !strings.HasPrefix(line, "/") {
+		return s.sendCurrent(line)
+	}
+
+	fields := strings.Fields(line)
+	command, args := fields[0], fields[1:]
+	rest := func(n int) string {
+		// Text after the first n arguments, with its spacing preserved
+		text := strings.TrimSpace(strings.TrimPrefix(line, command))
+		for i := 0; i < n; i++ {
+			text = strings.TrimSpace(strings.TrimPrefix(text, args[i]))
+		}
+		return text
+	}
+
+	switch command {
+	case "/help":
+		s.printf("%s", interactiveHelp)
+	case "/open":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: /open USER or /open #GROUP")
+		}
+		return s.open(args[0])
+	case "/msg":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: /msg USER TEXT")
+		}
+		return s.c.SendPrivate(args[0], rest(1))
+	case "/gmsg":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: /gmsg GROUP TEXT")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		return s.c.SendGroup(group, rest(1))
+	case "/history":
+		n := historyLines
+		if len(args) > 0 {
+			v, err := strconv.Atoi(args[0])
+			if err != nil || v <= 0 {
+				return fmt.Errorf("usage: /history [N]")
+			}
+			n = v
+		}
+		return s.showHistory(n)
+	case "/users":
+		s.mu.Lock()
+		users, bots := s.users, s.bots
+		s.mu.Unlock()
+		var b strings.Builder
+		for _, u := range users {
+			if contains(bots, u) {
+				u += " (bot)"
+			}
+			b.WriteString("  " + u + "\n")
+		}
+		s.printf("Online users:\n%s", strings.TrimRight(b.String(), "\n"))
+	case "/groups":
+		s.mu.Lock()
+		groups := append([]protocol.Group(nil), s.groups...)
+		s.mu.Unlock()
+		if len(groups) == 0 {
+			s.printf("You are not in any groups")
+			return nil
+		}
+		sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+		var b strings.Builder
+		for _, g := range groups {
+			fmt.Fprintf(&b, "  #%s (owner %s): %s\n", g.Name, g.Admin, strings.Join(g.Members, ", "))
+			if g.Topic != "" {
+				fmt.Fprintf(&b, "    %s\n", g.Topic)
+			}
+		}
+		s.printf("Groups:\n%s", strings.TrimRight(b.String(), "\n"))
+	case "/channels":
+		ctx, cancel := waitContext()
+		defer cancel()
+		directory, err := s.c.PublicGroups(ctx)
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		for _, g := range directory {
+			fmt.Fprintf(&b, "  #%s (%d members)", g.Name, g.MemberCount)
+			if g.Topic != "" {
+				fmt.Fprintf(&b, ": %s", g.Topic)
+			}
+			b.WriteString("\n")
+		}
+		if b.Len() == 0 {
+			b.WriteString("No public groups\n")
+		}
+		s.printf("%s", strings.TrimRight(b.String(), "\n"))
+	case "/preview":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: /preview GROUP")
+		}
+		ctx, cancel := waitContext()
+		defer cancel()
+		directory, err := s.c.PublicGroups(ctx)
+		if err != nil {
+			return err
+		}
+		group, ok := findPublicGroup(directory, strings.TrimPrefix(args[0], "#"))
+		if !ok {
+			return fmt.Errorf("no public group named %s", strings.TrimPrefix(args[0], "#"))
+		}
+		it, err := s.c.History(ctx, protocol.TypeGroup, group)
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		for it.Next() {
+			b.WriteString(formatMessage(it.Message(), true) + "\n")
+		}
+		if b.Len() == 0 {
+			b.WriteString("(no messages)\n")
+		}
+		s.printf("%s", strings.TrimRight(b.String(), "\n"))
+	case "/visibility":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: /visibility GROUP public|private")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		return s.c.SetGroupVisibility(group, args[1])
+	case "/policy":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: /policy GROUP announce on|off | slow SECONDS | maxlen N")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		var update protocol.GroupUpdate
+		switch args[1] {
+		case "announce":
+			on := args[2] == "on"
+			if !on && args[2] != "off" {
+				return fmt.Errorf("usage: /policy GROUP announce on|off")
+			}
+			update.AnnouncementOnly = &on
+		case "slow", "maxlen":
+			n, err := strconv.Atoi(args[2])
+			if err != nil {
+				return fmt.Errorf("usage: /policy GROUP %s N", args[1])
+			}
+			if args[1] == "slow" {
+				update.SlowModeSeconds = &n
+			} else {
+				update.MaxMessageLength = &n
+			}
+		default:
+			return fmt.Errorf("unknown policy %s; use announce, slow or maxlen", args[1])
+		}
+		return s.c.UpdateGroup(group, update)
+	case "/unread":
+		s.mu.Lock()
+		unread := s.unread
+		s.mu.Unlock()
+		var b strings.Builder
+		printUnread(&b, unread, s.groupNames())
+		s.printf("%s", strings.TrimRight(b.String(), "\n"))
+	case "/search":
+		if len(args) == 0 {
+			return fmt.Errorf("usage: /search QUERY")
+		}
+		ctx, cancel := waitContext()
+		defer cancel()
+		results, err := s.c.Search(ctx, rest(0))
+		if err != nil {
+			return err
+		}
+		names := s.groupNames()
+		var b strings.Builder
+		for _, msg := range results {
+			b.WriteString(formatSearchHit(msg, names) + "\n")
+		}
+		if b.Len() == 0 {
+			b.WriteString("No matches\n")
+		}
+		s.printf("%s", strings.TrimRight(b.String(), "\n"))
+	case "/mentions":
+		ctx, cancel := waitContext()
+		defer cancel()
+		results, err := s.c.Mentions(ctx)
+		if err != nil {
+			return err
+		}
+		names := s.groupNames()
+		var b strings.Builder
+		for _, msg := range results {
+			b.WriteString(formatSearchHit(msg, names) + "\n")
+		}
+		if b.Len() == 0 {
+			b.WriteString("No mentions\n")
+		}
+		s.printf("%s", strings.TrimRight(b.String(), "\n"))
+	case "/create":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: /create GROUP USER,USER...")
+		}
+		return s.c.CreateGroup(args[0], strings.Split(strings.Join(args[1:], ""), ",")...)
+	case "/add":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: /add GROUP USER")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		return s.c.AddGroupMember(group, args[1])
+	case "/remove":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: /remove GROUP USER")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		return s.c.RemoveGroupMember(group, args[1])
+	case "/leave":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: /leave GROUP")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		return s.c.LeaveGroup(group)
+	case "/rename":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: /rename GROUP NAME")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		return s.c.RenameGroup(group, rest(1))
+	case "/topic":
+		if len(args) < 1 {
+			return fmt.Errorf("usage: /topic GROUP [TEXT]")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		topic := rest(1)
+		return s.c.UpdateGroup(group, protocol.GroupUpdate{Topic: &topic})
+	case "/role":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: /role GROUP USER ROLE")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		return s.c.SetGroupRole(group, args[1], args[2])
+	case "/transfer":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: /transfer GROUP USER")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		return s.c.TransferOwnership(group, args[1])
+	case "/invites":
+		ctx, cancel := waitContext()
+		defer cancel()
+		invites, requests, err := s.c.Invitations(ctx)
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		for _, inv := range invites {
+			b.WriteString("  " + formatInvitation(inv, s.c.Username()) + "\n")
+		}
+		for _, req := range requests {
+			b.WriteString("  " + formatJoinRequest(req, s.c.Username()) + "\n")
+		}
+		if b.Len() == 0 {
+			b.WriteString("No pending invitations\n")
+		}
+		s.printf("%s", strings.TrimRight(b.String(), "\n"))
+	case "/accept", "/decline", "/approve", "/deny":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s ID", command)
+		}
+		switch command {
+		case "/accept":
+			return s.c.AcceptInvitation(args[0])
+		case "/decline":
+			return s.c.DeclineInvitation(args[0])
+		case "/approve":
+			return s.c.ApproveJoinRequest(args[0])
+		}
+		return s.c.DenyJoinRequest(args[0])
+	case "/invite-code":
+		if len(args) < 1 || len(args) > 3 {
+			return fmt.Errorf("usage: /invite-code GROUP [TTL] [USES]")
+		}
+		var ttl time.Duration
+		var uses int
+		var err error
+		if len(args) > 1 {
+			if ttl, err = time.ParseDuration(args[1]); err != nil {
+				return fmt.Errorf("invalid TTL: %v", err)
+			}
+		}
+		if len(args) > 2 {
+			if uses, err = strconv.Atoi(args[2]); err != nil {
+				return fmt.Errorf("invalid USES: %v", err)
+			}
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		ctx, cancel := waitContext()
+		defer cancel()
+		inv, err := s.c.CreateInviteCode(ctx, group, ttl, uses)
+		if err != nil {
+			return err
+		}
+		s.printf("Invite code for #%s: %s (expires %s)", inv.GroupName, inv.Code, inv.ExpiresAt)
+	case "/join":
+		if len(args) < 1 {
+			return fmt.Errorf("usage: /join GROUP [NOTE]")
+		}
+		return s.c.RequestJoin(strings.TrimPrefix(args[0], "#"), rest(1))
+	case "/block", "/unblock":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: %s USER", command)
+		}
+		if command == "/block" {
+			return s.c.BlockUser(args[0])
+		}
+		return s.c.UnblockUser(args[0])
+	case "/privacy":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: /privacy dm|invites everyone|group_members|nobody")
+		}
+		var update protocol.PrivacyUpdate
+		switch args[0] {
+		case "dm":
+			update.DMPolicy = &args[1]
+		case "invites":
+			update.GroupInvitePolicy = &args[1]
+		default:
+			return fmt.Errorf("unknown setting %s; use dm or invites", args[0])
+		}
+		return s.c.UpdatePrivacy(update)
+	case "/profile":
+		ctx, cancel := waitContext()
+		defer cancel()
+		profile, err := s.c.Profile(ctx)
+		if err != nil {
+			return err
+		}
+		blocked := strings.Join(profile.Blocked, ", ")
+		if blocked == "" {
+			blocked = "nobody"
+		}
+		s.printf("Private messages from: %s\nGroup invitations from: %s\nBlocked: %s",
+			profile.DMPolicy, profile.GroupInvitePolicy, blocked)
+	case "/mute":
+		if len(args) < 3 {
+			return fmt.Errorf("usage: /mute GROUP USER DURATION [REASON]")
+		}
+		duration, err := time.ParseDuration(args[2])
+		if err != nil {
+			return fmt.Errorf("invalid DURATION: %v", err)
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		return s.c.MuteMember(group, args[1], duration, rest(3))
+	case "/unmute":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: /unmute GROUP USER")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		return s.c.UnmuteMember(group, args[1])
+	case "/ban":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: /ban USER DURATION|permanent [REASON]")
+		}
+		var duration time.Duration
+		if args[1] != "permanent" {
+			var err error
+			if duration, err = time.ParseDuration(args[1]); err != nil {
+				return fmt.Errorf("invalid DURATION: %v", err)
+			}
+		}
+		return s.c.BanUser(args[0], duration, rest(2))
+	case "/unban":
+		if len(args) != 1 {
+			return fmt.Errorf("usage: /unban USER")
+		}
+		return s.c.UnbanUser(args[0])
+	case "/report":
+		if len(args) < 1 {
+			return fmt.Errorf("usage: /report USER [REASON]")
+		}
+		return s.report(args[0], rest(1))
+	case "/reports":
+		ctx, cancel := waitContext()
+		defer cancel()
+		reports, err := s.c.Reports(ctx, rest(0))
+		if err != nil {
+			return err
+		}
+		var b strings.Builder
+		for _, report := range reports {
+			b.WriteString("  " + formatReport(report, s.c.Username()) + "\n")
+		}
+		if b.Len() == 0 {
+			b.WriteString("No reports\n")
+		}
+		s.printf("%s", strings.TrimRight(b.String(), "\n"))
+	case "/resolve", "/dismiss":
+		if len(args) < 1 {
+			return fmt.Errorf("usage: %s ID [NOTE]", command)
+		}
+		if command == "/resolve" {
+			return s.c.ResolveReport(args[0], rest(1))
+		}
+		return s.c.DismissReport(args[0], rest(1))
+	case "/audit":
+		group := ""
+		if len(args) > 0 {
+			var err error
+			if group, err = s.groupID(args[0]); err != nil {
+				return err
+			}
+		}
+		ctx, cancel := waitContext()
+		defer cancel()
+		entries, err := s.c.AuditLog(ctx, group)
+		if err != nil {
+			return err
+		}
+		names := s.groupNames()
+		var b strings.Builder
+		for _, entry := range entries {
+			b.WriteString("  " + formatAuditEntry(entry, names) + "\n")
+		}
+		if b.Len() == 0 {
+			b.WriteString("No moderation actions\n")
+		}
+		s.printf("%s", strings.TrimRight(b.String(), "\n"))
+	case "/retention":
+		if len(args) < 1 {
+			return fmt.Errorf("usage: /retention USER|#GROUP [off | maxage DURATION | maxcount N | disappear DURATION]...")
+		}
+		chatID := args[0]
+		if strings.HasPrefix(chatID, "#") {
+			var err error
+			if chatID, err = s.groupID(chatID); err != nil {
+				return err
+			}
+		}
+		if len(args) == 1 {
+			ctx, cancel := waitContext()
+			defer cancel()
+			policy, err := s.c.Retention(ctx, chatID)
+			if err != nil {
+				return err
+			}
+			s.printf("%s keeps %s", args[0], formatRetention(policy))
+			return nil
+		}
+		policy, err := parseRetention(args[1:])
+		if err != nil {
+			return err
+		}
+		return s.c.SetRetention(chatID, policy)
+	case "/filters":
+		if len(args) < 1 {
+			return fmt.Errorf("usage: /filters GROUP [clear | add KIND ACTION ARGS]")
+		}
+		group, err := s.groupID(args[0])
+		if err != nil {
+			return err
+		}
+		if len(args) > 1 && args[1] == "clear" {
+			return s.c.SetFilters(group, protocol.FilterConfig{})
+		}
+		ctx, cancel := waitContext()
+		defer cancel()
+		config, err := s.c.Filters(ctx, group)
+		if err != nil {
+			return err
+		}
+		if len(args) == 1 {
+			var b strings.Builder
+			for i, rule := range config.Rules {
+				b.WriteString(fmt.Sprintf("  %d. %s\n", i+1, formatFilterRule(rule)))
+			}
+			if b.Len() == 0 {
+				b.WriteString("No content filters\n")
+			}
+			s.printf("%s", strings.TrimRight(b.String(), "\n"))
+			return nil
+		}
+		if args[1] != "add" || len(args) < 5 {
+			return fmt.Errorf("usage: /filters GROUP add KIND reject|redact|flag ARGS")
+		}
+		rule, err := parseFilterRule(args[2], args[3], args[4:], rest(4))
+		if err != nil {
+			return err
+		}
+		config.Rules = append(config.Rules, rule)
+		return s.c.SetFilters(group, config)
+	case "/help-bots":
+		return s.sendCurrentGroup("/help")
+	default:
+		// Pass unknown commands through to the current group's bots
+		return s.sendCurrentGroup(line)
+	}
+	return nil
+}
+
+// open switches to a chat, shows its recent history and marks it read
+func (s *session) open(name string) error {
+	chatType, chatID := protocol.TypePrivate, name
+	if strings.HasPrefix(name, "#") {
+		group, err := s.groupID(name)
+		if err != nil {
+			return err
+		}
+		chatType, chatID = protocol.TypeGroup, group
+	}
+
+	s.mu.Lock()
+	s.chatType, s.chatID = chatType, chatID
+	s.mu.Unlock()
+
+	if err := s.showHistory(historyLines); err != nil {
+		return err
+	}
+	return s.c.MarkRead(chatID)
+}
+
+// showHistory prints the last n messages of the current chat
+func (s *session) showHistory(n int) error {
+	s.mu.Lock()
+	chatType, chatID := s.chatType, s.chatID
+	s.mu.Unlock()
+	if chatID == "" {
+		return fmt.Errorf("no chat open, use /open first")
+	}
+
+	ctx, cancel := waitContext()
+	defer cancel()
+
+	it, err := s.c.History(ctx, chatType, chatID)
+	if err != nil {
+		return err
+	}
+
+	skip := 0
+	if it.Len() > n {
+		skip = it.Len() - n
+	}
+	var b strings.Builder
+	for i := 0; it.Next(); i++ {
+		if i >= skip {
+			b.WriteString(formatMessage(it.Message(), true) + "\n")
+		}
+	}
+	if b.Len() == 0 {
+		b.WriteString("(no messages)\n")
+	}
+	s.printf("%s", strings.TrimRight(b.String(), "\n"))
+	return nil
+}
+
+// report reports the latest message of author in the current chat
+func (s *session) report(author, reason string) error {
+	s.mu.Lock()
+	chatType, chatID := s.chatType, s.chatID
+	s.mu.Unlock()
+	if chatID == "" {
+		return fmt.Errorf("no chat open, use /open first")
+	}
+
+	ctx, cancel := waitContext()
+	defer cancel()
+
+	it, err := s.c.History(ctx, chatType, chatID)
+	if err != nil {
+		return err
+	}
+	var latest protocol.Message
+	for it.Next() {
+		if msg := it.Message(); msg.From == author {
+			latest = msg
+		}
+	}
+	if latest.ID == "" {
+		return fmt.Errorf("no message from %s in this chat", author)
+	}
+	return s.c.ReportMessage(chatID, latest.ID, reason)
+}
+
+// sendCurrent sends text to the current chat
+func (s *session) sendCurrent(text string) error {
+	s.mu.Lock()
+	chatType, chatID := s.chatType, s.chatID
+	s.mu.Unlock()
+
+	switch chatType {
+	case protocol.TypePrivate:
+		return s.c.SendPrivate(chatID, text)
+	case protocol.TypeGroup:
+		return s.c.SendGroup(chatID, text)
+	}
+	return fmt.Errorf("no chat open, use /open USER or /open #GROUP")
+}
+
+// sendCurrentGroup sends a slash command to the current group
+func (s *session) sendCurrentGroup(line string) error {
+	s.mu.Lock()
+	chatType := s.chatType
+	s.mu.Unlock()
+
+	if chatType != protocol.TypeGroup {
+		return fmt.Errorf("unknown command %s, type /help", strings.Fields(line)[0])
+	}
+	return s.sendCurrent(line)
+}
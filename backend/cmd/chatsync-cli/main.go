@@ -0,0 +1,162 @@
+// Command chatsync-cli is a terminal client for ChatSync.
+//
+// Without a subcommand it starts an interactive session. The subcommands
+// perform a single action and exit, which makes them usable from scripts:
+//
+//	chatsync-cli -user alice                      # interactive chat
+//	chatsync-cli -user ci send -group ops "Build #42 passed"
+//	make test 2>&1 | chatsync-cli -user ci send -to alice
+//	tail -f app.log | chatsync-cli -user ci send -group ops -lines
+//	chatsync-cli -user alice users
+//	chatsync-cli -user alice groups
+//	chatsync-cli -user alice history -group ops
+//	chatsync-cli -user alice unread
+//	chatsync-cli -user alice mentions
+//	chatsync-cli -user alice search 'from:bob "release notes" after:2024-01-01'
+//	chatsync-cli -user alice export -group ops -format html -o ops.html
+//	CHATSYNC_ADMIN_TOKEN=... chatsync-cli -user admin import -group ops ops.jsonl
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Timeouts of one-shot commands
+const (
+	waitTimeout     = 10 * time.Second // For a server reply
+	transferTimeout = 10 * time.Minute // For an export or import
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: chatsync-cli [flags] [command] [args]
+
+Commands:
+  (none)                          start an interactive session
+  send -to USER|-group NAME [-lines] [MESSAGE...]
+                                  send MESSAGE, or stdin if no MESSAGE is given
+  users                           list online users
+  groups                          list your groups
+  channels                        list public groups anyone can join
+  history -to USER|-group NAME [-n N]
+                                  print conversation history (a preview for
+                                  public groups you have not joined)
+  unread                          print unread message counts
+  mentions                        print recent group messages that mention you
+  search QUERY                    search messages; QUERY supports "phrases",
+                                  from:USER, in:USER, in:#GROUP,
+                                  after:DATE and before:DATE
+  export -to USER|-group NAME [-format jsonl|html|text] [-o FILE]
+                                  export a conversation with its metadata
+  import -group NAME|-private [-token TOKEN] [FILE]
+                                  load a JSON lines export, or stdin, into a
+                                  group or the private chats it contains
+                                  (needs the admin API token, also read from
+                                  CHATSYNC_ADMIN_TOKEN)
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("chatsync-cli: ")
+
+	server := flag.String("server", envOr("CHATSYNC_SERVER", "ws://localhost:8080/ws"), "server WebSocket URL (env CHATSYNC_SERVER)")
+	user := flag.String("user", os.Getenv("CHATSYNC_USER"), "username to log in as (env CHATSYNC_USER)")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *user == "" {
+		fmt.Fprintln(os.Stderr, "chatsync-cli: -user is required")
+		usage()
+		os.Exit(2)
+	}
+
+	args := flag.Args()
+	command := ""
+	if len(args) > 0 {
+		command, args = args[0], args[1:]
+	}
+
+	var err error
+	switch command {
+	case "", "chat":
+		err = runInteractive(*server, *user, os.Stdin, os.Stdout)
+	case "send":
+		err = runSend(*server, *user, args, os.Stdin)
+	case "users":
+		err = runUsers(*server, *user, os.Stdout)
+	case "groups":
+		err = runGroups(*server, *user, os.Stdout)
+	case "channels":
+		err = runChannels(*server, *user, os.Stdout)
+	case "history":
+		err = runHistory(*server, *user, args, os.Stdout)
+	case "unread":
+		err = runUnread(*server, *user, os.Stdout)
+	case "mentions":
+		err = runMentions(*server, *user, os.Stdout)
+	case "search":
+		err = runSearch(*server, *user, args, os.Stdout)
+	case "export":
+		err = runExport(*server, *user, args, os.Stdout)
+	case "import":
+		err = runImport(*server, *user, args, os.Stdin, os.Stdout)
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "chatsync-cli: unknown command %q\n", command)
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func envOr(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// target is the destination chosen with -to or -group
+type target struct {
+	user  string
+	group string
+}
+
+func (t *target) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.user, "to", "", "username of a private chat")
+	fs.StringVar(&t.group, "group", "", "group name or ID")
+}
+
+func (t *target) validate() error {
+	if (t.user == "") == (t.group == "") {
+		return fmt.Errorf("exactly one of -to or -group is required")
+	}
+	return nil
+}
+
+func waitContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), waitTimeout)
+}
+
+// readAll reads r and trims the trailing newline added by most producers
+func readAll(r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// fakeServer answers one-shot commands like the chat server: it sends the
+// user and group lists on connect, rejects messages whose content is
+// "rejected" and answers directory and mention requests
+type fakeServer struct {
+	*httptest.Server
+	t      *testing.T
+	groups []protocol.Group
+
+	mu       sync.Mutex
+	received []map[string]interface{}
+}
+
+func newFakeServer(t *testing.T, groups []protocol.Group) *fakeServer {
+	s := &fakeServer{t: t, groups: groups}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *fakeServer) url() string {
+	return "ws" + strings.TrimPrefix(s.URL, "http")
+}
+
+func (s *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("companion") != "true" {
+		s.t.Errorf("one-shot command connected without companion=true: %s", r.URL.RawQuery)
+	}
+	upgrader := websocket.Upgrader{}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		s.t.Errorf("upgrade: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	conn.WriteJSON(map[string]interface{}{
+		protocol.KeyType:  protocol.TypeUserList,
+		protocol.KeyUsers: map[string]string{"alice": "online", "bob": "online", "echo": "online"},
+		protocol.KeyBots:  []string{"echo"},
+	})
+	conn.WriteJSON(map[string]interface{}{
+		protocol.KeyType:   protocol.TypeGroupList,
+		protocol.KeyGroups: s.groups,
+	})
+
+	for {
+		var f map[string]interface{}
+		if err := conn.ReadJSON(&f); err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.received = append(s.received, f)
+		s.mu.Unlock()
+
+		switch f[protocol.KeyType] {
+		case protocol.TypePrivateMessage, protocol.TypeGroupMessage:
+			if f[protocol.KeyContent] == "rejected" {
+				conn.WriteJSON(map[string]interface{}{
+					protocol.KeyType:    protocol.TypeError,
+					protocol.KeyContent: "Message rejected",
+				})
+			}
+		case protocol.TypeListPublicGroups:
+			conn.WriteJSON(map[string]interface{}{
+				protocol.KeyType: protocol.TypePublicGroups,
+			})
+		case protocol.TypeRequestMentions:
+			conn.WriteJSON(map[string]interface{}{
+				protocol.KeyType:    protocol.TypeMentions,
+				protocol.KeyResults: []protocol.Message{},
+			})
+		}
+	}
+}
+
+// messages returns the contents of the messages the server received
+func (s *fakeServer) messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var contents []string
+	for _, f := range s.received {
+		if f[protocol.KeyType] == protocol.TypePrivateMessage || f[protocol.KeyType] == protocol.TypeGroupMessage {
+			contents = append(contents, f[protocol.KeyContent].(string))
+		}
+	}
+	return contents
+}
+
+func TestRunSend(t *testing.T) {
+	groups := []protocol.Group{{ID: "g1", Name: "ops", Admin: "alice", Members: []string{"alice"}}}
+
+	tests := []struct {
+		name    string
+		args    []string
+		stdin   string
+		sent    []string
+		wantErr string
+	}{
+		{name: "arguments", args: []string{"-to", "bob", "hello", "there"}, sent: []string{"hello there"}},
+		{name: "stdin", args: []string{"-group", "ops"}, stdin: "line one\nline two\n", sent: []string{"line one\nline two"}},
+		{name: "lines", args: []string{"-group", "ops", "-lines"}, stdin: "one\n\ntwo\r\n", sent: []string{"one", "two"}},
+		{name: "rejected", args: []string{"-to", "bob", "rejected"}, sent: []string{"rejected"}, wantErr: "the server rejected 1 message(s): Message rejected"},
+		{name: "empty stdin", args: []string{"-to", "bob"}, stdin: "\n", wantErr: "nothing to send"},
+		{name: "unknown group", args: []string{"-group", "dev", "hi"}, wantErr: "no group named dev"},
+		{name: "no target", args: []string{"hi"}, wantErr: "exactly one of -to or -group is required"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := newFakeServer(t, groups)
+			err := runSend(server.url(), "alice", tt.args, strings.NewReader(tt.stdin))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("runSend error = %v, want %q", err, tt.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("runSend: %v", err)
+			}
+
+			if got := server.messages(); strings.Join(got, "|") != strings.Join(tt.sent, "|") {
+				t.Errorf("server received %q, want %q", got, tt.sent)
+			}
+		})
+	}
+}
+
+func TestRunUsers(t *testing.T) {
+	server := newFakeServer(t, nil)
+
+	var out bytes.Buffer
+	if err := runUsers(server.url(), "alice", &out); err != nil {
+		t.Fatalf("runUsers: %v", err)
+	}
+	if want := "alice\nbob\necho (bot)\n"; out.String() != want {
+		t.Errorf("runUsers printed %q, want %q", out.String(), want)
+	}
+}
+
+func TestFindGroup(t *testing.T) {
+	groups := []protocol.Group{
+		{ID: "g1", Name: "ops"},
+		{ID: "g2", Name: "Dev"},
+		{ID: "ops-id", Name: "g1"},
+	}
+
+	tests := []struct {
+		ref    string
+		wantID string
+		wantOK bool
+	}{
+		{"g1", "g1", true}, // IDs win over names
+		{"ops", "g1", true},
+		{"OPS", "g1", true},
+		{"dev", "g2", true},
+		{"ops-id", "ops-id", true},
+		{"design", "", false},
+	}
+	for _, tt := range tests {
+		id, ok := findGroup(groups, tt.ref)
+		if id != tt.wantID || ok != tt.wantOK {
+			t.Errorf("findGroup(%q) = %q, %v, want %q, %v", tt.ref, id, ok, tt.wantID, tt.wantOK)
+		}
+	}
+}
+
+func TestTargetValidate(t *testing.T) {
+	tests := []struct {
+		target  target
+		wantErr bool
+	}{
+		{target{user: "bob"}, false},
+		{target{group: "ops"}, false},
+		{target{}, true},
+		{target{user: "bob", group: "ops"}, true},
+	}
+	for _, tt := range tests {
+		if err := tt.target.validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%+v.validate() = %v, want error %v", tt.target, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/client"
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// dialOnce connects for a one-shot command. One-shot commands retry a
+// dropped connection at most once, and connect as companions so they do not
+// take over a session the user has open elsewhere.
+func dialOnce(server, user string, handlers client.Handlers) (*client.Client, error) {
+	ctx, cancel := waitContext()
+	defer cancel()
+
+	return client.Dial(ctx, client.Config{
+		URL:        server,
+		Username:   user,
+		MaxRetries: 1,
+		Companion:  true,
+		Handlers:   handlers,
+	})
+}
+
+// dialGroups connects for a one-shot command and waits for the list of the
+// user's groups, which the server sends on connect
+func dialGroups(server, user string, handlers client.Handlers) (*client.Client, []protocol.Group, error) {
+	lists := make(chan []protocol.Group, 1)
+	handlers.OnGroupList = func(groups []protocol.Group) {
+		select {
+		case lists <- groups:
+		default:
+		}
+	}
+
+	c, err := dialOnce(server, user, handlers)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	select {
+	case groups := <-lists:
+		return c, groups, nil
+	case <-time.After(waitTimeout):
+		c.Close()
+		return nil, nil, fmt.Errorf("timed out waiting for the group list")
+	}
+}
+
+// dialTarget connects for a command aimed at to. The server addresses
+// groups by ID, so a -group name is resolved to the ID of one of the user's
+// groups or, failing that, of a public group.
+func dialTarget(server, user string, to *target, handlers client.Handlers) (*client.Client, error) {
+	if to.group == "" {
+		return dialOnce(server, user, handlers)
+	}
+
+	c, groups, err := dialGroups(server, user, handlers)
+	if err != nil {
+		return nil, err
+	}
+	if id, ok := findGroup(groups, to.group); ok {
+		to.group = id
+		return c, nil
+	}
+
+	ctx, cancel := waitContext()
+	defer cancel()
+	directory, err := c.PublicGroups(ctx)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	if id, ok := findPublicGroup(directory, to.group); ok {
+		to.group = id
+		return c, nil
+	}
+	c.Close()
+	return nil, fmt.Errorf("no group named %s among your groups or the public ones", to.group)
+}
+
+// findGroup returns the ID of the group whose ID or name is ref
+func findGroup(groups []protocol.Group, ref string) (string, bool) {
+	for _, g := range groups {
+		if g.ID == ref {
+			return g.ID, true
+		}
+	}
+	for _, g := range groups {
+		if strings.EqualFold(g.Name, ref) {
+			return g.ID, true
+		}
+	}
+	return "", false
+}
+
+// findPublicGroup returns the ID of the public group whose ID or name is ref
+func findPublicGroup(directory []protocol.PublicGroup, ref string) (string, bool) {
+	for _, g := range directory {
+		if g.ID == ref || strings.EqualFold(g.Name, ref) {
+			return g.ID, true
+		}
+	}
+	return "", false
+}
+
+// groupNames maps group IDs to names for display
+func groupNames(groups []protocol.Group) map[string]string {
+	names := make(map[string]string, len(groups))
+	for _, g := range groups {
+		names[g.ID] = g.Name
+	}
+	return names
+}
+
+// runSend sends a message from the arguments or stdin
+func runSend(server, user string, args []string, stdin io.Reader) error {
+	fs := flag.NewFlagSet("send", flag.ExitOnError)
+	var to target
+	to.register(fs)
+	lines := fs.Bool("lines", false, "send each line of stdin as a separate message as it arrives, reporting rejected ones")
+	fs.Parse(args)
+
+	if err := to.validate(); err != nil {
+		return err
+	}
+
+	// The server does not acknowledge messages; it reports the ones it
+	// rejects with error frames. With -lines they are printed as they
+	// arrive, since a long stream can run into the rate limits.
+	var mu sync.Mutex
+	var rejected []string
+	c, err := dialTarget(server, user, &to, client.Handlers{
+		OnError: func(msg protocol.Message) {
+			if *lines {
+				log.Printf("message rejected: %s", msg.Content)
+			}
+			mu.Lock()
+			rejected = append(rejected, msg.Content)
+			mu.Unlock()
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	send := func(content string) error {
+		if to.group != "" {
+			return c.SendGroup(to.group, content)
+		}
+		return c.SendPrivate(to.user, content)
+	}
+
+	if err := sendInput(send, fs.Args(), *lines, stdin); err != nil {
+		return err
+	}
+
+	// Requests are answered in order, so once one is answered every
+	// rejection of the messages sent before it has arrived
+	ctx, cancel := waitContext()
+	defer cancel()
+	_, err = c.Mentions(ctx)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(rejected) > 0 {
+		return fmt.Errorf("the server rejected %d message(s): %s", len(rejected), strings.Join(rejected, "; "))
+	}
+	return err
+}
+
+// sendInput sends args as one message or, without args, stdin as one
+// message or as one message per line
+func sendInput(send func(string) error, args []string, lines bool, stdin io.Reader) error {
+	if len(args) > 0 {
+		return send(strings.Join(args, " "))
+	}
+
+	if lines {
+		scanner := bufio.NewScanner(stdin)
+		for scanner.Scan() {
+			line := strings.TrimRight(scanner.Text(), "\r")
+			if line == "" {
+				continue
+			}
+			if err := send(line); err != nil {
+				return err
+			}
+		}
+		return scanner.Err()
+	}
+
+	content, err := readAll(stdin)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(content) == "" {
+		return fmt.Errorf("nothing to send")
+	}
+	return send(content)
+}
+
+// runUsers prints the online users
+func runUsers(server, user string, out io.Writer) error {
+	type userList struct{ users, bots []string }
+	lists := make(chan userList, 1)
+
+	c, err := dialOnce(server, user, client.Handlers{
+		OnUserList: func(users, bots []string) {
+			select {
+			case lists <- userList{users, bots}:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	select {
+	case list := <-lists:
+		for _, u := range list.users {
+			if contains(list.bots, u) {
+				fmt.Fprintf(out, "%s (bot)\n", u)
+			} else {
+				fmt.Fprintln(out, u)
+			}
+		}
+		return nil
+	case <-time.After(waitTimeout):
+		return fmt.Errorf("timed out waiting for the user list")
+	}
+}
+
+// runGroups prints the groups the user belongs to
+func runGroups(server, user string, out io.Writer) error {
+	c, groups, err := dialGroups(server, user, client.Handlers{})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Name < groups[j].Name })
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tID\tOWNER\tTOPIC\tMEMBERS")
+	for _, g := range groups {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", g.Name, g.ID, g.Admin, g.Topic, strings.Join(g.Members, ","))
+	}
+	return w.Flush()
+}
+
+// runChannels prints the directory of public groups
+func runChannels(server, user string, out io.Writer) error {
+	c, err := dialOnce(server, user, client.Handlers{})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx, cancel := waitContext()
+	defer cancel()
+
+	directory, err := c.PublicGroups(ctx)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "GROUP\tID\tMEMBERS\tTOPIC")
+	for _, g := range directory {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", g.Name, g.ID, g.MemberCount, g.Topic)
+	}
+	return w.Flush()
+}
+
+// runHistory prints the history of a conversation
+func runHistory(server, user string, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	var to target
+	to.register(fs)
+	last := fs.Int("n", 0, "only print the last N messages")
+	fs.Parse(args)
+
+	if err := to.validate(); err != nil {
+		return err
+	}
+
+	c, err := dialTarget(server, user, &to, client.Handlers{})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx, cancel := waitContext()
+	defer cancel()
+
+	chatType, chatID := protocol.TypePrivate, to.user
+	if to.group != "" {
+		chatType, chatID = protocol.TypeGroup, to.group
+	}
+
+	it, err := c.History(ctx, chatType, chatID)
+	if err != nil {
+		return err
+	}
+
+	skip := 0
+	if *last > 0 && it.Len() > *last {
+		skip = it.Len() - *last
+	}
+	for i := 0; it.Next(); i++ {
+		if i >= skip {
+			fmt.Fprintln(out, formatMessage(it.Message(), true))
+		}
+	}
+	return nil
+}
+
+// runUnread prints the unread message counts per chat
+func runUnread(server, user string, out io.Writer) error {
+	counts := make(chan map[string]int, 1)
+
+	c, groups, err := dialGroups(server, user, client.Handlers{
+		OnUnreadCounts: func(c map[string]int) {
+			select {
+			case counts <- c:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.RequestUnreadCounts(); err != nil {
+		return err
+	}
+
+	select {
+	case unread := <-counts:
+		printUnread(out, unread, groupNames(groups))
+		return nil
+	case <-time.After(waitTimeout):
+		return fmt.Errorf("timed out waiting for unread counts")
+	}
+}
+
+// runSearch prints the messages matching a search query
+func runSearch(server, user string, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: search QUERY")
+	}
+
+	c, groups, err := dialGroups(server, user, client.Handlers{})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx, cancel := waitContext()
+	defer cancel()
+
+	results, err := c.Search(ctx, strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+	names := groupNames(groups)
+	for _, msg := range results {
+		fmt.Fprintln(out, formatSearchHit(msg, names))
+	}
+	return nil
+}
+
+// runExport writes a conversation to a file or stdout
+func runExport(server, user string, args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	var to target
+	to.register(fs)
+	format := fs.String("format", protocol.ExportJSONL, "jsonl, html or text")
+	output := fs.String("o", "", "write to FILE instead of stdout")
+	fs.Parse(args)
+
+	if err := to.validate(); err != nil {
+		return err
+	}
+
+	c, err := dialTarget(server, user, &to, client.Handlers{})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	chatType, chatID := protocol.TypePrivate, to.user
+	if to.group != "" {
+		chatType, chatID = protocol.TypeGroup, to.group
+	}
+
+	out := stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+	return c.Export(ctx, chatType, chatID, *format, out)
+}
+
+// runImport loads a JSON lines export from a file or stdin
+func runImport(server, user string, args []string, stdin io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	var to target
+	fs.StringVar(&to.group, "group", "", "group name or ID to import into")
+	private := fs.Bool("private", false, "import private messages, which keep their participants")
+	token := fs.String("token", os.Getenv("CHATSYNC_ADMIN_TOKEN"), "the server's admin API token (env CHATSYNC_ADMIN_TOKEN)")
+	fs.Parse(args)
+
+	if (to.group == "") == !*private {
+		return fmt.Errorf("exactly one of -group or -private is required")
+	}
+	if *token == "" {
+		return fmt.Errorf("importing needs the admin API token; set -token or CHATSYNC_ADMIN_TOKEN")
+	}
+
+	in := stdin
+	if fs.NArg() > 0 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	var c *client.Client
+	var err error
+	chatType := protocol.TypePrivate
+	if to.group != "" {
+		chatType = protocol.TypeGroup
+		c, err = dialTarget(server, user, &to, client.Handlers{})
+	} else {
+		c, err = dialOnce(server, user, client.Handlers{})
+	}
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), transferTimeout)
+	defer cancel()
+	result, err := c.Import(ctx, *token, chatType, to.group, in)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Imported %d messages, skipped %d\n", result.Imported, result.Skipped)
+	for _, problem := range result.Problems {
+		fmt.Fprintf(out, "  %s\n", problem)
+	}
+	return nil
+}
+
+func runMentions(server, user string, out io.Writer) error {
+	c, groups, err := dialGroups(server, user, client.Handlers{})
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx, cancel := waitContext()
+	defer cancel()
+
+	results, err := c.Mentions(ctx)
+	if err != nil {
+		return err
+	}
+	names := groupNames(groups)
+	for _, msg := range results {
+		fmt.Fprintln(out, formatSearchHit(msg, names))
+	}
+	return nil
+}
+
+// formatSearchHit renders a search result with the chat it came from.
+// names maps group IDs to names.
+func formatSearchHit(msg protocol.Message, names map[string]string) string {
+	chat := "#" + msg.To
+	if name, ok := names[msg.To]; ok {
+		chat = "#" + name
+	}
+	if msg.Type == protocol.TypePrivateMessage {
+		chat = msg.From + " -> " + msg.To
+	}
+	return fmt.Sprintf("(%s) %s", chat, formatMessage(msg, true))
+}
+
+// printUnread prints unread counts, showing groups as #NAME. names maps
+// group IDs to names.
+func printUnread(out io.Writer, unread map[string]int, names map[string]string) {
+	if len(unread) == 0 {
+		fmt.Fprintln(out, "No unread messages")
+		return
+	}
+
+	chats := make([]string, 0, len(unread))
+	labels := make(map[string]string, len(unread))
+	for chat := range unread {
+		labels[chat] = chat
+		if name, ok := names[chat]; ok {
+			labels[chat] = "#" + name
+		}
+		chats = append(chats, chat)
+	}
+	sort.Slice(chats, func(i, j int) bool { return labels[chats[i]] < labels[chats[j]] })
+	for _, chat := range chats {
+		fmt.Fprintf(out, "%s\t%d\n", labels[chat], unread[chat])
+	}
+}
+
+// formatMessage renders a message as a single line
+func formatMessage(msg protocol.Message, withDate bool) string {
+	layout := "15:04"
+	if withDate {
+		layout = "2006-01-02 15:04"
+	}
+
+	stamp := msg.Timestamp
+	if t, err := time.Parse(time.RFC3339, msg.Timestamp); err == nil {
+		stamp = t.Local().Format(layout)
+	}
+
+	if msg.From == "" {
+		return fmt.Sprintf("[%s] * %s", stamp, msg.Content)
+	}
+	return fmt.Sprintf("[%s] %s: %s", stamp, msg.From, msg.Content)
+}
+
+func contains(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// isTerminal reports whether f looks like an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Companion connections are opened with companion=true by tools that act
+// for a user while the user may be chatting elsewhere, like the one-shot
+// commands of chatsync-cli. They receive everything sent to the user, but
+// they neither replace the user's connection nor announce the user, and
+// they end without a trace in the user list. Since anyone who names the user
+// can open one, the user is told about every companion, and the admin API
+// lists them.
+var companions = make(map[string]map[*Client]bool) // key: username; guarded by clientsMux
+
+// registerClient registers a new connection as a companion, as the
+// resumption of a dropped session or as a new client, according to the
+// parameters of the connection request. The caller starts the pumps.
+func registerClient(username, ip string, conn transport, params url.Values) *Client {
+	if params.Get("companion") == "true" {
+		return newCompanion(username, ip, conn)
+	}
+	if client := resumeClient(username, ip, conn, params); client != nil {
+		return client
+	}
+	return newClient(username, ip, conn)
+}
+
+// newCompanion registers a companion connection and queues its initial data
+func newCompanion(username, ip string, conn transport) *Client {
+	client := &Client{
+		Username:  username,
+		ip:        ip,
+		conn:      conn,
+		send:      make(chan outFrame, 256),
+		companion: true,
+		done:      make(chan struct{}),
+
+		connectedAt: time.Now(),
+	}
+
+	clientsMux.Lock()
+	if companions[username] == nil {
+		companions[username] = make(map[*Client]bool)
+	}
+	companions[username][client] = true
+	clientsMux.Unlock()
+
+	log.Printf("Registering companion connection for user: %s", username)
+	recordSession(protocol.ActionLogin, username, ip, "companion")
+	sendInitialData(client)
+
+	notice := protocol.Message{
+		Type:      protocol.TypeSystem,
+		From:      "system",
+		To:        username,
+		Content:   fmt.Sprintf("A companion connection for your account was opened from %s", ip),
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	msgBytes, _ := json.Marshal(notice)
+	sendToUser(username, msgBytes)
+	return client
+}
+
+// removeCompanion unregisters a companion connection and closes its send
+// channel, once
+func removeCompanion(client *Client) {
+	clientsMux.Lock()
+	registered := companions[client.Username][client]
+	if registered {
+		delete(companions[client.Username], client)
+		if len(companions[client.Username]) == 0 {
+			delete(companions, client.Username)
+		}
+		close(client.send)
+	}
+	clientsMux.Unlock()
+
+	if registered {
+		recordSession(protocol.ActionLogout, client.Username, client.ip, "companion")
+	}
+}
+
+// companionsOf returns the companion connections of a user
+func companionsOf(username string) []*Client {
+	clientsMux.RLock()
+	defer clientsMux.RUnlock()
+	list := make([]*Client, 0, len(companions[username]))
+	for client := range companions[username] {
+		list = append(list, client)
+	}
+	return list
+}
+
+// localClients returns every client of this node, companions included, so
+// broadcasts can be sent without holding clientsMux
+func localClients() []*Client {
+	clientsMux.RLock()
+	defer clientsMux.RUnlock()
+	list := make([]*Client, 0, len(clients))
+	for _, client := range clients {
+		list = append(list, client)
+	}
+	for _, set := range companions {
+		for client := range set {
+			list = append(list, client)
+		}
+	}
+	return list
+}
+
+// dropClient unregisters a client that cannot keep up with its frames
+func dropClient(client *Client) {
+	if client.companion {
+		removeCompanion(client)
+		return
+	}
+	clientsMux.Lock()
+	delete(clients, client.Username)
+	clientsMux.Unlock()
+	close(client.send)
+}
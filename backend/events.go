@@ -0,0 +1,349 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+const (
+	// sseQueueSize is how many POSTed frames may wait for readPump
+	sseQueueSize = 16
+
+	// pollWait is how long a poll waits for frames before it returns
+	// empty; it stays below the timeouts of common proxies
+	pollWait = 25 * time.Second
+	// maxPollQueue bounds the events waiting for the next poll, in bytes.
+	// Clients that fall further behind are disconnected.
+	maxPollQueue = 4 << 20 // 4MB
+)
+
+var (
+	errSessionClosed = errors.New("session closed")
+
+	sseSessions    = make(map[string]*sseTransport) // key: session token
+	sseSessionsMux sync.RWMutex
+)
+
+// sseTransport is the transport of clients whose proxies break WebSocket
+// upgrades. Frames stream to the client as Server-Sent Events on a GET of
+// /api/events, and the client POSTs its frames to /api/events with the
+// session token of the stream.
+//
+// Where proxies buffer streams too, clients long-poll instead: the events
+// are queued, and each GET with the session token returns the queued ones,
+// waiting up to pollWait for the first.
+type sseTransport struct {
+	token    string
+	incoming chan []byte
+	done     chan struct{}
+
+	mu     sync.Mutex // Guards writes to the stream, the poll queue and closed
+	rc     *http.ResponseController
+	w      http.ResponseWriter
+	closed bool
+
+	// Long polling
+	poll     bool
+	queue    []byte        // Events waiting for the next poll
+	ready    chan struct{} // Signaled when queue fills
+	polls    int           // Polls waiting for events
+	lastPoll time.Time     // When the last poll returned
+}
+
+func (t *sseTransport) readFrame() ([]byte, error) {
+	select {
+	case message := <-t.incoming:
+		return message, nil
+	case <-t.done:
+		return nil, errSessionClosed
+	}
+}
+
+func (t *sseTransport) writeFrame(f outFrame) error {
+	return t.writeEvent("", f.data)
+}
+
+// ping sends a comment, which keeps proxies from timing out the stream.
+// Long-polling clients have nothing to ping; they are gone once they stop
+// polling for pongWait, like a WebSocket client that stops answering pings.
+func (t *sseTransport) ping() error {
+	if !t.poll {
+		return t.write([]byte(": ping\n\n"))
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.polls == 0 && time.Since(t.lastPoll) > pongWait {
+		return errors.New("client stopped polling")
+	}
+	return nil
+}
+
+func (t *sseTransport) closeWith(code int, reason string) {
+	data, err := json.Marshal(protocol.CloseEvent{Code: code, Reason: reason})
+	if err != nil {
+		return
+	}
+	t.writeEvent(protocol.EventClose, data)
+}
+
+// Close ends the stream. Once it returns nothing writes to the response
+// any more, so handleEvents may return. Long-polling sessions with events
+// left, such as the close event, are kept until the next poll takes them,
+// or for pongWait if none comes.
+func (t *sseTransport) Close() error {
+	t.mu.Lock()
+	if !t.closed {
+		t.closed = true
+		close(t.done)
+	}
+	pending := t.poll && len(t.queue) > 0
+	t.mu.Unlock()
+
+	if pending {
+		time.AfterFunc(pongWait, t.forget)
+		return nil
+	}
+	t.forget()
+	return nil
+}
+
+// forget removes the session, so its token is no longer accepted
+func (t *sseTransport) forget() {
+	sseSessionsMux.Lock()
+	defer sseSessionsMux.Unlock()
+	if sseSessions[t.token] == t {
+		delete(sseSessions, t.token)
+	}
+}
+
+// writeEvent sends one event. JSON frames never contain newlines, so data
+// fits on a single data line.
+func (t *sseTransport) writeEvent(event string, data []byte) error {
+	var buf bytes.Buffer
+	if event != "" {
+		fmt.Fprintf(&buf, "event: %s\n", event)
+	}
+	buf.WriteString("data: ")
+	buf.Write(data)
+	buf.WriteString("\n\n")
+	return t.write(buf.Bytes())
+}
+
+func (t *sseTransport) write(p []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed {
+		return errSessionClosed
+	}
+
+	if t.poll {
+		if len(t.queue)+len(p) > maxPollQueue {
+			return errors.New("poll queue full")
+		}
+		t.queue = append(t.queue, p...)
+		select {
+		case t.ready <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	t.rc.SetWriteDeadline(time.Now().Add(writeWait))
+	if _, err := t.w.Write(p); err != nil {
+		return err
+	}
+	return t.rc.Flush()
+}
+
+// take returns the queued events, waiting up to wait for the first. It
+// returns early once the session is closed, with the close event if there
+// is one.
+func (t *sseTransport) take(r *http.Request, wait time.Duration) []byte {
+	t.mu.Lock()
+	t.polls++
+	empty := len(t.queue) == 0 && !t.closed
+	t.mu.Unlock()
+
+	if empty && wait > 0 {
+		timer := time.NewTimer(wait)
+		select {
+		case <-t.ready:
+		case <-t.done:
+		case <-timer.C:
+		case <-r.Context().Done():
+		}
+		timer.Stop()
+	}
+
+	t.mu.Lock()
+	t.polls--
+	t.lastPoll = time.Now()
+	events, closed := t.queue, t.closed
+	t.queue = nil
+	t.mu.Unlock()
+
+	if closed {
+		t.forget()
+	}
+	return events
+}
+
+// handleEvents serves the SSE transport: GET opens a stream for the
+// username parameter and POST delivers frames to the stream named by the
+// session parameter. With poll=true, GET opens a long-polling session
+// instead, which is then polled with GETs that name it.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		switch {
+		case r.URL.Query().Get("session") != "":
+			pollEvents(w, r)
+		case r.URL.Query().Get("poll") == "true":
+			openPoll(w, r)
+		default:
+			streamEvents(w, r)
+		}
+	case http.MethodPost:
+		postEvents(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// streamEvents registers an SSE client and streams its frames until either
+// side ends the connection
+func streamEvents(w http.ResponseWriter, r *http.Request) {
+	username, ip, ok := admitConnection(w, r)
+	if !ok {
+		return
+	}
+
+	t := &sseTransport{
+		token:    generateID(16),
+		incoming: make(chan []byte, sseQueueSize),
+		done:     make(chan struct{}),
+		rc:       http.NewResponseController(w),
+		w:        w,
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Keep nginx from buffering the stream
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := t.writeEvent(protocol.EventSession, []byte(t.token)); err != nil {
+		log.Printf("Error opening event stream for user %s: %v", username, err)
+		return
+	}
+
+	sseSessionsMux.Lock()
+	sseSessions[t.token] = t
+	sseSessionsMux.Unlock()
+
+	log.Printf("Event stream established for user: %s", username)
+
+	client := registerClient(username, ip, t, r.URL.Query())
+	go client.writePump()
+	go client.readPump()
+
+	select {
+	case <-t.done:
+	case <-r.Context().Done():
+	}
+	t.Close()
+}
+
+// openPoll registers a long-polling client. The response holds the session
+// event and whatever was queued for the client by then.
+func openPoll(w http.ResponseWriter, r *http.Request) {
+	username, ip, ok := admitConnection(w, r)
+	if !ok {
+		return
+	}
+
+	t := &sseTransport{
+		token:    generateID(16),
+		incoming: make(chan []byte, sseQueueSize),
+		done:     make(chan struct{}),
+		poll:     true,
+		ready:    make(chan struct{}, 1),
+		lastPoll: time.Now(),
+	}
+	t.writeEvent(protocol.EventSession, []byte(t.token))
+
+	sseSessionsMux.Lock()
+	sseSessions[t.token] = t
+	sseSessionsMux.Unlock()
+
+	log.Printf("Long-polling session established for user: %s", username)
+
+	client := registerClient(username, ip, t, r.URL.Query())
+	go client.writePump()
+	go client.readPump()
+
+	writePoll(w, t.take(r, 0))
+}
+
+// pollEvents answers a poll of a long-polling session
+func pollEvents(w http.ResponseWriter, r *http.Request) {
+	sseSessionsMux.RLock()
+	t, exists := sseSessions[r.URL.Query().Get("session")]
+	sseSessionsMux.RUnlock()
+	if !exists || !t.poll {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+	writePoll(w, t.take(r, pollWait))
+}
+
+// writePoll sends the events of a poll in the format of an event stream,
+// which ends with them
+func writePoll(w http.ResponseWriter, events []byte) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(events)
+}
+
+// postEvents queues the frames of a POST body, one JSON frame per line, for
+// the readPump of the session
+func postEvents(w http.ResponseWriter, r *http.Request) {
+	sseSessionsMux.RLock()
+	t, exists := sseSessions[r.URL.Query().Get("session")]
+	sseSessionsMux.RUnlock()
+	if !exists {
+		http.Error(w, "Unknown session", http.StatusNotFound)
+		return
+	}
+
+	scanner := bufio.NewScanner(http.MaxBytesReader(w, r.Body, maxMessageSize))
+	scanner.Buffer(make([]byte, 0, 4096), int(maxMessageSize))
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		frame := append([]byte(nil), line...)
+		select {
+		case t.incoming <- frame:
+		case <-t.done:
+			http.Error(w, "Session closed", http.StatusGone)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
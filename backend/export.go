@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Export and import limits
+const (
+	exportVersion           = 1
+	maxImportSize     int64 = 64 * 1024 * 1024 // 64MB
+	maxImportLine           = 1024 * 1024
+	maxImportProblems       = 20
+)
+
+// exportLine wraps the header of a JSON lines export so it can be told apart
+// from the message lines
+type exportLine struct {
+	Export *protocol.ExportHeader `json:"export,omitempty"`
+}
+
+// transcriptTemplate renders the HTML export of a conversation
+var transcriptTemplate = template.Must(template.New("transcript").Funcs(template.FuncMap{
+	"stamp": transcriptTime,
+	"join":  strings.Join,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+dl { color: #555; }
+.message { margin: 0.5em 0; }
+.time { color: #888; font-size: 0.9em; }
+.from { font-weight: bold; }
+.content { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<dl>
+{{- with .Header.Topic}}
+<dt>Topic</dt><dd>{{.}}</dd>{{end}}
+<dt>Members</dt><dd>{{join .Header.Members ", "}}</dd>
+<dt>Exported by</dt><dd>{{.Header.ExportedBy}} at {{stamp .Header.ExportedAt}}</dd>
+<dt>Messages</dt><dd>{{.Header.Messages}}</dd>
+</dl>
+{{- range .Messages}}
+<div class="message"><span class="time">{{stamp .Timestamp}}</span> <span class="from">{{.From}}</span>{{with .Integration}} (integration){{end}}: <span class="content">{{.Content}}</span>
+{{- range .Attachments}} [attachment: {{.Name}}]{{end}}</div>
+{{- end}}
+</body>
+</html>
+`))
+
+// transcriptTime formats an RFC 3339 timestamp for transcripts, leaving
+// unparsable values as they are
+func transcriptTime(timestamp string) string {
+	t, err := time.Parse(time.RFC3339, timestamp)
+	if err != nil {
+		return timestamp
+	}
+	return t.UTC().Format("2006-01-02 15:04:05 MST")
+}
+
+// canExport reports whether username may export a conversation. Group
+// members and server moderators may export groups; private chats can only
+// be exported by their participants.
+func canExport(username, chatType, chatID string) bool {
+	if chatType == protocol.TypeGroup {
+		return isGroupMember(chatID, username) || (isServerModerator(username) && groupExists(chatID))
+	}
+	return chatID != username
+}
+
+// groupExists reports whether a group with the ID exists
+func groupExists(groupID string) bool {
+	groupsMux.RLock()
+	defer groupsMux.RUnlock()
+
+	_, exists := groups[groupID]
+	return exists
+}
+
+// exportConversation returns the header and messages of a conversation
+func exportConversation(username, chatType, chatID string) (protocol.ExportHeader, []protocol.Message) {
+	header := protocol.ExportHeader{
+		Version:    exportVersion,
+		ChatType:   chatType,
+		ChatID:     chatID,
+		ExportedBy: username,
+		ExportedAt: time.Now().Format(time.RFC3339),
+	}
+
+	var messages []protocol.Message
+	if chatType == protocol.TypeGroup {
+		groupsMux.RLock()
+		if group, exists := groups[chatID]; exists {
+			header.ChatName = group.Name
+			header.Topic = group.Topic
+			header.Members = append([]string(nil), group.Members...)
+		}
+		groupsMux.RUnlock()
+		messages = getGroupHistory(chatID)
+	} else {
+		header.Members = []string{username, chatID}
+		messages = getConversationHistory(username, chatID)
+	}
+	header.Messages = len(messages)
+	return header, messages
+}
+
+// writeExport writes a conversation in one of the export formats
+func writeExport(w io.Writer, format string, header protocol.ExportHeader, messages []protocol.Message) error {
+	title := "Conversation with " + header.ChatID
+	if header.ChatType == protocol.TypeGroup {
+		title = "#" + header.ChatName
+	}
+
+	switch format {
+	case protocol.ExportJSONL:
+		enc := json.NewEncoder(w)
+		if err := enc.Encode(exportLine{Export: &header}); err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			if err := enc.Encode(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case protocol.ExportHTML:
+		return transcriptTemplate.Execute(w, map[string]interface{}{
+			"Title":    title,
+			"Header":   header,
+			"Messages": messages,
+		})
+
+	case protocol.ExportText:
+		bw := bufio.NewWriter(w)
+		fmt.Fprintln(bw, title)
+		if header.Topic != "" {
+			fmt.Fprintf(bw, "Topic: %s\n", header.Topic)
+		}
+		fmt.Fprintf(bw, "Members: %s\n", strings.Join(header.Members, ", "))
+		fmt.Fprintf(bw, "Exported by %s at %s, %d messages\n\n", header.ExportedBy, transcriptTime(header.ExportedAt), header.Messages)
+		for _, msg := range messages {
+			from := msg.From
+			if msg.Integration != "" {
+				from += " (integration)"
+			}
+			fmt.Fprintf(bw, "[%s] %s: %s\n", transcriptTime(msg.Timestamp), from, msg.Content)
+			for _, attachment := range msg.Attachments {
+				fmt.Fprintf(bw, "    [attachment: %s]\n", attachment.Name)
+			}
+		}
+		return bw.Flush()
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// handleExport serves a conversation as a download. Query parameters:
+// username, chat_type (private or group), chat_id and format (jsonl, html
+// or text; jsonl by default).
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	username := query.Get("username")
+	chatType := query.Get("chat_type")
+	chatID := query.Get("chat_id")
+	format := query.Get("format")
+	if format == "" {
+		format = protocol.ExportJSONL
+	}
+	if username == "" || chatID == "" {
+		http.Error(w, "username and chat_id are required", http.StatusBadRequest)
+		return
+	}
+	if chatType != protocol.TypePrivate && chatType != protocol.TypeGroup {
+		http.Error(w, "chat_type must be private or group", http.StatusBadRequest)
+		return
+	}
+	if refuseBanned(w, r, username) {
+		return
+	}
+
+	contentType, extension := "application/x-ndjson", "jsonl"
+	switch format {
+	case protocol.ExportJSONL:
+	case protocol.ExportHTML:
+		contentType, extension = "text/html; charset=utf-8", "html"
+	case protocol.ExportText:
+		contentType, extension = "text/plain; charset=utf-8", "txt"
+	default:
+		http.Error(w, "format must be jsonl, html or text", http.StatusBadRequest)
+		return
+	}
+
+	if !canExport(username, chatType, chatID) {
+		log.Printf("User %s denied export of %s chat %s", username, chatType, chatID)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	header, messages := exportConversation(username, chatType, chatID)
+	log.Printf("User %s exported %d messages of %s chat %s as %s", username, len(messages), chatType, chatID, format)
+
+	filename := fmt.Sprintf("chatsync-%s-%s.%s", chatType, chatID, extension)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if err := writeExport(w, format, header, messages); err != nil {
+		log.Printf("Error writing export of %s chat %s: %v", chatType, chatID, err)
+	}
+}
+
+// readImport parses a JSON lines export. The header line is optional, so
+// history converted from other tools can be one message per line. Lines
+// that cannot be imported are skipped and described in the result.
+func readImport(r io.Reader, chatType, chatID string) ([]protocol.Message, protocol.ImportResult, error) {
+	var result protocol.ImportResult
+	skip := func(line int, problem string) {
+		result.Skipped++
+		if len(result.Problems) < maxImportProblems {
+			result.Problems = append(result.Problems, fmt.Sprintf("line %d: %s", line, problem))
+		}
+	}
+
+	messageType := protocol.TypePrivateMessage
+	var members []string
+	if chatType == protocol.TypeGroup {
+		messageType = protocol.TypeGroupMessage
+		groupsMux.RLock()
+		if group, exists := groups[chatID]; exists {
+			members = append(members, group.Members...)
+		}
+		groupsMux.RUnlock()
+	}
+
+	var messages []protocol.Message
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), maxImportLine)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+
+		var header exportLine
+		if err := json.Unmarshal([]byte(text), &header); err == nil && header.Export != nil {
+			if header.Export.ChatType != chatType {
+				return nil, result, fmt.Errorf("the export is of a %s chat, not a %s chat", header.Export.ChatType, chatType)
+			}
+			continue
+		}
+
+		var msg protocol.Message
+		if err := json.Unmarshal([]byte(text), &msg); err != nil {
+			skip(line, "not a JSON message")
+			continue
+		}
+		if msg.Type == "" {
+			msg.Type = messageType
+		}
+		switch {
+		case msg.Type != messageType:
+			skip(line, fmt.Sprintf("a %s cannot be imported into a %s chat", msg.Type, chatType))
+			continue
+		case msg.From == "":
+			skip(line, "no author")
+			continue
+		case chatType == protocol.TypePrivate && (msg.To == "" || msg.To == msg.From):
+			skip(line, "a private message needs a recipient other than its author")
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339, msg.Timestamp); err != nil {
+			skip(line, fmt.Sprintf("invalid timestamp %q", msg.Timestamp))
+			continue
+		}
+
+		// Imported messages get new IDs and join the destination group,
+		// mentioning only its members. Attachment blobs are not part of an
+		// export, so only their names survive, in the content.
+		msg.ID = generateID(8)
+		if chatType == protocol.TypeGroup {
+			msg.To = chatID
+			var mentions []string
+			for _, mentioned := range msg.Mentions {
+				if contains(members, mentioned) && !contains(mentions, mentioned) {
+					mentions = append(mentions, mentioned)
+				}
+			}
+			msg.Mentions = mentions
+		} else {
+			msg.Mentions = nil
+		}
+		for _, attachment := range msg.Attachments {
+			msg.Content += fmt.Sprintf(" [attachment: %s]", attachment.Name)
+		}
+		msg.Attachments = nil
+		msg.ExpiresAt = ""
+		messages = append(messages, msg)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, result, err
+	}
+	result.Imported = len(messages)
+	return messages, result, nil
+}
+
+// importMessages merges messages into the message store in timestamp order
+// and indexes them for search
+func importMessages(messages []protocol.Message) {
+	chats := make(map[string][]protocol.Message)
+	for _, msg := range messages {
+		key := msg.To
+		if msg.Type == protocol.TypePrivateMessage {
+			key = getConversationKey(msg.From, msg.To)
+		}
+		chats[key] = append(chats[key], msg)
+	}
+
+	msgMux.Lock()
+	for key, imported := range chats {
+		store := groupMessages
+		if imported[0].Type == protocol.TypePrivateMessage {
+			store = privateMessages
+		}
+		// Replace rather than append in place; history replies share the old slice
+		merged := make([]protocol.Message, 0, len(store[key])+len(imported))
+		merged = append(append(merged, store[key]...), imported...)
+		sort.SliceStable(merged, func(i, j int) bool {
+			a, _ := time.Parse(time.RFC3339, merged[i].Timestamp)
+			b, _ := time.Parse(time.RFC3339, merged[j].Timestamp)
+			return a.Before(b)
+		})
+		store[key] = merged
+	}
+	msgMux.Unlock()
+
+	for _, msg := range messages {
+		searchIndex.Add(msg)
+	}
+}
+
+// handleImport loads a JSON lines export into the message store, keeping the
+// original authors and timestamps. Since it writes messages in other users'
+// names, it is part of the admin API and needs the admin token. Query
+// parameters: chat_type (private or group) and, for groups, chat_id, the
+// existing group to import into. Private messages keep their own
+// participants.
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !requireAdmin(w, r) {
+		return
+	}
+
+	query := r.URL.Query()
+	chatType := query.Get("chat_type")
+	chatID := query.Get("chat_id")
+	switch chatType {
+	case protocol.TypePrivate:
+	case protocol.TypeGroup:
+		if !groupExists(chatID) {
+			http.Error(w, "Group not found", http.StatusNotFound)
+			return
+		}
+	default:
+		http.Error(w, "chat_type must be private or group", http.StatusBadRequest)
+		return
+	}
+
+	messages, result, err := readImport(http.MaxBytesReader(w, r.Body, maxImportSize), chatType, chatID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid import: %v", err), http.StatusBadRequest)
+		return
+	}
+	importMessages(messages)
+
+	log.Printf("Admin at %s imported %d messages into %s chat %s, skipping %d", clientIP(r), result.Imported, chatType, chatID, result.Skipped)
+	groupID := ""
+	if chatType == protocol.TypeGroup {
+		groupID = chatID
+	}
+	writeAudit(protocol.AuditEntry{
+		Actor:  adminActor,
+		Action: protocol.ActionImport,
+		Group:  groupID,
+		Reason: fmt.Sprintf("%d messages", result.Imported),
+		IP:     clientIP(r),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
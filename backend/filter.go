@@ -0,0 +1,439 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Content filter limits
+const (
+	maxFilterRules    = 50
+	maxFilterWords    = 1000
+	maxFilterPattern  = 512
+	linkRedactionText = "[link removed]"
+)
+
+var (
+	// defaultFilters apply to every message, before the filters of a group.
+	// They are read from the file named by CHATSYNC_FILTERS.
+	defaultFilters protocol.FilterConfig
+	defaultChain   FilterChain
+
+	groupFilters = make(map[string]*groupFilter) // key: group ID
+	filtersMux   sync.RWMutex
+
+	// linkPattern finds links in message content
+	linkPattern = regexp.MustCompile(`(?i)\b(?:https?://|www\.)[^\s<>"]+`)
+)
+
+// groupFilter is the filter configuration of a group with its compiled chain
+type groupFilter struct {
+	config protocol.FilterConfig
+	chain  FilterChain
+}
+
+// MessageFilter is one stage of a content filter chain
+type MessageFilter interface {
+	// Filter inspects content and reports whether it matched, along with the
+	// content with the matching parts redacted
+	Filter(content string) (redacted string, matched bool)
+}
+
+// filterStage is a filter with what to do when it matches
+type filterStage struct {
+	name   string
+	action string
+	filter MessageFilter
+}
+
+// FilterChain runs message content through filters in order
+type FilterChain []filterStage
+
+// FilterVerdict is the outcome of running a filter chain
+type FilterVerdict struct {
+	Content  string   // The content after redactions
+	Rejected string   // Name of the rule that rejected the message, if any
+	Flagged  []string // Names of the rules that flagged the message
+}
+
+// Apply runs content through the chain. It stops at the first rule that
+// rejects the message.
+func (chain FilterChain) Apply(content string) FilterVerdict {
+	verdict := FilterVerdict{Content: content}
+	for _, stage := range chain {
+		redacted, matched := stage.filter.Filter(verdict.Content)
+		if !matched {
+			continue
+		}
+		switch stage.action {
+		case protocol.FilterReject:
+			verdict.Rejected = stage.name
+			return verdict
+		case protocol.FilterRedact:
+			verdict.Content = redacted
+		case protocol.FilterFlag:
+			verdict.Flagged = append(verdict.Flagged, stage.name)
+		}
+	}
+	return verdict
+}
+
+// mask replaces every character of s with an asterisk
+func mask(s string) string {
+	return strings.Repeat("*", utf8.RuneCountInString(s))
+}
+
+// regexFilter matches a regular expression and masks its matches
+type regexFilter struct {
+	re *regexp.Regexp
+}
+
+func (f regexFilter) Filter(content string) (string, bool) {
+	if !f.re.MatchString(content) {
+		return content, false
+	}
+	return f.re.ReplaceAllStringFunc(content, mask), true
+}
+
+// wordFilter matches whole words of a list, ignoring case, and masks them
+type wordFilter struct {
+	re *regexp.Regexp // The words, in group 1, between word boundaries
+}
+
+// newWordFilter matches whole words of a list, ignoring case. \b only knows
+// ASCII letters, so words are instead delimited by the start or end of the
+// content or by anything but letters, marks, digits and underscores.
+func newWordFilter(words []string) (MessageFilter, error) {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		if word = strings.TrimSpace(word); word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+	if len(quoted) == 0 {
+		return nil, fmt.Errorf("a words rule needs at least one word")
+	}
+	if len(quoted) > maxFilterWords {
+		return nil, fmt.Errorf("a words rule can have at most %d words", maxFilterWords)
+	}
+	re, err := regexp.Compile(`(?i)(?:^|[^\p{L}\p{M}\p{N}_])(` + strings.Join(quoted, "|") + `)(?:$|[^\p{L}\p{M}\p{N}_])`)
+	if err != nil {
+		return nil, err
+	}
+	return wordFilter{re: re}, nil
+}
+
+func (f wordFilter) Filter(content string) (string, bool) {
+	var b strings.Builder
+	last := 0
+	// Searching again from the end of each word, rather than of the whole
+	// match, leaves the delimiter after it to the next word
+	for pos := 0; pos < len(content); {
+		loc := f.re.FindStringSubmatchIndex(content[pos:])
+		if loc == nil {
+			break
+		}
+		start, end := pos+loc[2], pos+loc[3]
+		b.WriteString(content[last:start])
+		b.WriteString(mask(content[start:end]))
+		last, pos = end, end
+	}
+	if last == 0 {
+		return content, false
+	}
+	b.WriteString(content[last:])
+	return b.String(), true
+}
+
+// linkFilter matches links to denied domains, or to domains outside the
+// allow list when there is one. Subdomains count as their parent domain.
+type linkFilter struct {
+	allow []string
+	deny  []string
+}
+
+// domainIn reports whether host is one of domains or a subdomain of one
+func domainIn(host string, domains []string) bool {
+	for _, domain := range domains {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// forbidden reports whether a link may not be posted
+func (f linkFilter) forbidden(link string) bool {
+	if !strings.Contains(link, "://") {
+		link = "http://" + link
+	}
+	parsed, err := url.Parse(link)
+	if err != nil {
+		return true
+	}
+	host := strings.ToLower(parsed.Hostname())
+	if domainIn(host, f.deny) {
+		return true
+	}
+	return len(f.allow) > 0 && !domainIn(host, f.allow)
+}
+
+func (f linkFilter) Filter(content string) (string, bool) {
+	matched := false
+	redacted := linkPattern.ReplaceAllStringFunc(content, func(link string) string {
+		if !f.forbidden(link) {
+			return link
+		}
+		matched = true
+		return linkRedactionText
+	})
+	return redacted, matched
+}
+
+// repeatFilter matches runs of the same character longer than max and
+// shortens them to max
+type repeatFilter struct {
+	max int
+}
+
+func (f repeatFilter) Filter(content string) (string, bool) {
+	var b strings.Builder
+	matched := false
+	var last rune
+	run := 0
+	for _, r := range content {
+		if r == last {
+			run++
+		} else {
+			last, run = r, 1
+		}
+		if run > f.max {
+			matched = true
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String(), matched
+}
+
+// lowerDomains normalizes a domain list
+func lowerDomains(domains []string) []string {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		if domain = strings.Trim(strings.ToLower(strings.TrimSpace(domain)), "."); domain != "" {
+			normalized = append(normalized, domain)
+		}
+	}
+	return normalized
+}
+
+// newFilter builds the filter of a rule
+func newFilter(rule protocol.FilterRule) (MessageFilter, error) {
+	switch rule.Kind {
+	case protocol.FilterWords:
+		return newWordFilter(rule.Words)
+	case protocol.FilterRegex:
+		if rule.Pattern == "" || len(rule.Pattern) > maxFilterPattern {
+			return nil, fmt.Errorf("a regex rule needs a pattern of at most %d bytes", maxFilterPattern)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %v", err)
+		}
+		return regexFilter{re: re}, nil
+	case protocol.FilterLinks:
+		f := linkFilter{allow: lowerDomains(rule.AllowDomains), deny: lowerDomains(rule.DenyDomains)}
+		if len(f.allow) == 0 && len(f.deny) == 0 {
+			return nil, fmt.Errorf("a links rule needs allowed or denied domains")
+		}
+		return f, nil
+	case protocol.FilterRepeat:
+		if rule.MaxRepeat < 1 {
+			return nil, fmt.Errorf("a repeat rule needs a max_repeat of at least 1")
+		}
+		return repeatFilter{max: rule.MaxRepeat}, nil
+	}
+	return nil, fmt.Errorf("unknown kind %q; use %s, %s, %s or %s", rule.Kind,
+		protocol.FilterWords, protocol.FilterRegex, protocol.FilterLinks, protocol.FilterRepeat)
+}
+
+// compileFilters validates a filter configuration and builds its chain
+func compileFilters(config protocol.FilterConfig) (FilterChain, error) {
+	if len(config.Rules) > maxFilterRules {
+		return nil, fmt.Errorf("at most %d rules are allowed", maxFilterRules)
+	}
+	chain := make(FilterChain, 0, len(config.Rules))
+	for i, rule := range config.Rules {
+		switch rule.Action {
+		case protocol.FilterReject, protocol.FilterRedact, protocol.FilterFlag:
+		default:
+			return nil, fmt.Errorf("rule %d: unknown action %q; use %s, %s or %s", i+1, rule.Action,
+				protocol.FilterReject, protocol.FilterRedact, protocol.FilterFlag)
+		}
+		filter, err := newFilter(rule)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %v", i+1, err)
+		}
+		name := rule.Name
+		if name == "" {
+			name = rule.Kind
+		}
+		chain = append(chain, filterStage{name: name, action: rule.Action, filter: filter})
+	}
+	return chain, nil
+}
+
+// loadDefaultFilters reads the server-wide filter configuration from a JSON
+// file
+func loadDefaultFilters(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var config protocol.FilterConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	return setDefaultFilters(config)
+}
+
+// setDefaultFilters replaces the server-wide filter configuration
+func setDefaultFilters(config protocol.FilterConfig) error {
+	chain, err := compileFilters(config)
+	if err != nil {
+		return err
+	}
+
+	filtersMux.Lock()
+	defer filtersMux.Unlock()
+	defaultFilters, defaultChain = config, chain
+	log.Printf("Loaded %d default content filter rules", len(chain))
+	return nil
+}
+
+// applyFilters runs a message through the server default filters and then,
+// in groups, the group's own, so groups can add rules but not drop the
+// server's. Redactions are applied to msg. It returns why the message is
+// rejected, or "" and the rules that flagged it.
+func applyFilters(msg *protocol.Message) (reason string, flagged []string) {
+	filtersMux.RLock()
+	chain := defaultChain
+	if msg.Type == protocol.TypeGroupMessage {
+		if filter, exists := groupFilters[msg.To]; exists {
+			chain = append(append(FilterChain(nil), defaultChain...), filter.chain...)
+		}
+	}
+	filtersMux.RUnlock()
+
+	verdict := chain.Apply(msg.Content)
+	if verdict.Rejected != "" {
+		log.Printf("Content filter %q rejected a message from %s to %s", verdict.Rejected, msg.From, msg.To)
+		return fmt.Sprintf("Your message was blocked by the %q content filter", verdict.Rejected), nil
+	}
+	if verdict.Content != msg.Content {
+		log.Printf("Content filters redacted a message from %s to %s", msg.From, msg.To)
+		msg.Content = verdict.Content
+	}
+	return "", verdict.Flagged
+}
+
+// flagMessage reports a delivered message that content filters flagged
+func flagMessage(msg protocol.Message, flagged []string) {
+	if len(flagged) == 0 {
+		return
+	}
+
+	report := protocol.Report{
+		Reporter: systemReporter,
+		ChatType: protocol.TypePrivate,
+		Message:  msg,
+		Reason:   "Flagged by content filters: " + strings.Join(flagged, ", "),
+		Status:   protocol.StatusPending,
+	}
+	if msg.Type == protocol.TypeGroupMessage {
+		report.ChatType, report.Group, report.GroupName = protocol.TypeGroup, msg.To, groupLabel(msg.To)
+	}
+	log.Printf("Content filters flagged message %s from %s: %v", msg.ID, msg.From, flagged)
+	fileReport(report)
+}
+
+// setFilters replaces the content filters of a group. The content is a JSON
+// protocol.FilterConfig; no rules leaves only the server default.
+func setFilters(msg protocol.Message) {
+	if !hasGroupPermission(msg.To, msg.From, PermSetPolicy) {
+		sendError(msg.From, fmt.Sprintf("You are not allowed to change the content filters of %s", groupLabel(msg.To)))
+		return
+	}
+	var config protocol.FilterConfig
+	if err := json.Unmarshal([]byte(msg.Content), &config); err != nil {
+		sendError(msg.From, fmt.Sprintf("Invalid content filters: %v", err))
+		return
+	}
+	chain, err := compileFilters(config)
+	if err != nil {
+		sendError(msg.From, fmt.Sprintf("Invalid content filters: %v", err))
+		return
+	}
+
+	filtersMux.Lock()
+	if len(chain) == 0 {
+		delete(groupFilters, msg.To)
+	} else {
+		groupFilters[msg.To] = &groupFilter{config: config, chain: chain}
+	}
+	filtersMux.Unlock()
+
+	log.Printf("User %s set %d content filter rules in group %s", msg.From, len(chain), msg.To)
+	recordAudit(msg.From, protocol.ActionSetFilters, msg.To, "", fmt.Sprintf("%d rules", len(chain)))
+	sendGroupNotice(msg.To, fmt.Sprintf("%s updated the content filters", msg.From))
+}
+
+// sendFilters answers a request_filters message with the filters of a
+// group. The server default, which applies before them, is not included.
+func sendFilters(client *Client, groupID string) {
+	if !hasGroupPermission(groupID, client.Username, PermSetPolicy) {
+		sendError(client.Username, fmt.Sprintf("You are not allowed to see the content filters of %s", groupLabel(groupID)))
+		return
+	}
+
+	var config protocol.FilterConfig
+	filtersMux.RLock()
+	if filter, exists := groupFilters[groupID]; exists {
+		config = filter.config
+	}
+	filtersMux.RUnlock()
+	if config.Rules == nil {
+		config.Rules = []protocol.FilterRule{}
+	}
+
+	message := map[string]interface{}{
+		protocol.KeyType:      protocol.TypeFilters,
+		protocol.KeyTo:        groupID,
+		protocol.KeyFilters:   config,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	}
+	msgBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling content filters of group %s: %v", groupID, err)
+		return
+	}
+	sendToUser(client.Username, msgBytes)
+}
+
+// deleteGroupFilters forgets the content filters of a deleted group
+func deleteGroupFilters(groupID string) {
+	filtersMux.Lock()
+	defer filtersMux.Unlock()
+
+	delete(groupFilters, groupID)
+}
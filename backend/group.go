@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Group metadata limits, in characters
+const (
+	maxGroupNameLength        = 64
+	maxGroupTopicLength       = 256
+	maxGroupDescriptionLength = 2048
+	maxGroupAvatarLength      = 1024
+)
+
+// findGroupByName returns the ID of the group with the given name, compared
+// case-insensitively. The caller must hold groupsMux.
+func findGroupByName(name string) (string, bool) {
+	for id, group := range groups {
+		if strings.EqualFold(group.Name, name) {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// lookupGroup resolves a group ID, or failing that the name of a group
+// username may see, to an ID. Only members find a private group by name, so
+// outsiders cannot probe for the names of private groups. It is only used
+// where people type groups by hand; the protocol addresses groups by ID.
+func lookupGroup(ref, username string) (string, bool) {
+	groupsMux.RLock()
+	defer groupsMux.RUnlock()
+
+	if _, exists := groups[ref]; exists {
+		return ref, true
+	}
+	id, found := findGroupByName(ref)
+	if !found {
+		return "", false
+	}
+	if group := groups[id]; group.Visibility != protocol.VisibilityPublic && !contains(group.Members, username) {
+		return "", false
+	}
+	return id, true
+}
+
+// groupLabel returns the display name of a group for notices and errors
+func groupLabel(groupID string) string {
+	groupsMux.RLock()
+	defer groupsMux.RUnlock()
+
+	if group, exists := groups[groupID]; exists {
+		return group.Name
+	}
+	return groupID
+}
+
+// cloneGroup copies a group so it can be used after groupsMux is released.
+// The caller must hold groupsMux.
+func cloneGroup(group *protocol.Group) protocol.Group {
+	clone := *group
+	clone.Members = append([]string(nil), group.Members...)
+	if group.Roles != nil {
+		clone.Roles = make(map[string]string, len(group.Roles))
+		for member, role := range group.Roles {
+			clone.Roles[member] = role
+		}
+	}
+	if group.Retention != nil {
+		retention := *group.Retention
+		clone.Retention = &retention
+	}
+	if group.Muted != nil {
+		clone.Muted = make(map[string]string, len(group.Muted))
+		for member, until := range group.Muted {
+			clone.Muted[member] = until
+		}
+	}
+	return clone
+}
+
+// validateGroupName checks a new group name. The caller must hold groupsMux;
+// groupID is the group being renamed, or "" for a new group.
+func validateGroupName(name, groupID string) error {
+	if name == "" {
+		return fmt.Errorf("Group names cannot be empty")
+	}
+	if utf8.RuneCountInString(name) > maxGroupNameLength {
+		return fmt.Errorf("Group names can be at most %d characters", maxGroupNameLength)
+	}
+	if id, taken := findGroupByName(name); taken && id != groupID {
+		return fmt.Errorf("A group named %s already exists", name)
+	}
+	return nil
+}
+
+// validAvatar reports whether an avatar is empty, an http(s) URL or an
+// uploaded attachment
+func validAvatar(avatar string) bool {
+	return avatar == "" ||
+		strings.HasPrefix(avatar, "https://") ||
+		strings.HasPrefix(avatar, "http://") ||
+		strings.HasPrefix(avatar, "/api/attachments/")
+}
+
+// updateGroup changes the name, topic, description, avatar, visibility or
+// posting policy of a group. The content is a JSON protocol.GroupUpdate.
+// Renaming requires PermRename, changing the visibility PermSetVisibility,
+// the posting policy PermSetPolicy and the other fields PermEditInfo.
+func updateGroup(msg protocol.Message) {
+	var update protocol.GroupUpdate
+	if err := json.Unmarshal([]byte(msg.Content), &update); err != nil {
+		sendError(msg.From, fmt.Sprintf("Invalid group update: %v", err))
+		return
+	}
+	if problems := checkGroupUpdate(&update); len(problems) > 0 {
+		sendError(msg.From, strings.Join(problems, "; "))
+		return
+	}
+
+	groupsMux.Lock()
+	group, exists := groups[msg.To]
+	if !exists {
+		groupsMux.Unlock()
+		log.Printf("Group %s not found", msg.To)
+		sendError(msg.From, fmt.Sprintf("Group %s not found", msg.To))
+		return
+	}
+
+	role := groupRole(group, msg.From)
+	editsInfo := update.Topic != nil || update.Description != nil || update.Avatar != nil
+	editsPolicy := update.AnnouncementOnly != nil || update.SlowModeSeconds != nil || update.MaxMessageLength != nil
+	if (update.Name != nil && !roleAllows(role, PermRename)) ||
+		(update.Visibility != nil && !roleAllows(role, PermSetVisibility)) ||
+		(editsPolicy && !roleAllows(role, PermSetPolicy)) ||
+		(editsInfo && !roleAllows(role, PermEditInfo)) {
+		name := group.Name
+		groupsMux.Unlock()
+		log.Printf("User %s is not authorized to update group %s", msg.From, msg.To)
+		sendError(msg.From, fmt.Sprintf("You are not allowed to change these details of %s", name))
+		return
+	}
+	notices, err := applyGroupUpdate(group, update, msg.From)
+	groupsMux.Unlock()
+	if err != nil {
+		sendError(msg.From, err.Error())
+		return
+	}
+
+	if len(notices) == 0 {
+		return
+	}
+	log.Printf("User %s updated group %s", msg.From, msg.To)
+	recordAudit(msg.From, protocol.ActionUpdateGroup, msg.To, "", strings.Join(notices, "; "))
+	announceGroupUpdate(msg.To, notices)
+}
+
+// checkGroupUpdate trims the fields of a group update and returns what is
+// wrong with them
+func checkGroupUpdate(update *protocol.GroupUpdate) []string {
+	var problems []string
+	check := func(field *string, label string, max int) {
+		if field == nil {
+			return
+		}
+		*field = strings.TrimSpace(*field)
+		if utf8.RuneCountInString(*field) > max {
+			problems = append(problems, fmt.Sprintf("%s can be at most %d characters", label, max))
+		}
+	}
+	check(update.Topic, "The topic", maxGroupTopicLength)
+	check(update.Description, "The description", maxGroupDescriptionLength)
+	check(update.Avatar, "The avatar", maxGroupAvatarLength)
+	if update.Avatar != nil && !validAvatar(*update.Avatar) {
+		problems = append(problems, "The avatar must be an http(s) URL or an uploaded attachment")
+	}
+	if update.Name != nil {
+		*update.Name = strings.TrimSpace(*update.Name)
+	}
+	if v := update.Visibility; v != nil && *v != protocol.VisibilityPrivate && *v != protocol.VisibilityPublic {
+		problems = append(problems, fmt.Sprintf("The visibility must be %s or %s", protocol.VisibilityPrivate, protocol.VisibilityPublic))
+	}
+	return append(problems, validatePolicyUpdate(*update)...)
+}
+
+// applyGroupUpdate makes the changes of a checked update to a group and
+// returns a notice per change, or an error if the new name is taken. The
+// caller must hold groupsMux and have checked that by may make them.
+func applyGroupUpdate(group *protocol.Group, update protocol.GroupUpdate, by string) ([]string, error) {
+	if update.Name != nil {
+		if err := validateGroupName(*update.Name, group.ID); err != nil {
+			return nil, err
+		}
+	}
+
+	var notices []string
+	if update.Name != nil && *update.Name != group.Name {
+		notices = append(notices, fmt.Sprintf("%s renamed the group from %s to %s", by, group.Name, *update.Name))
+		group.Name = *update.Name
+	}
+	if update.Topic != nil && *update.Topic != group.Topic {
+		group.Topic = *update.Topic
+		notices = append(notices, fmt.Sprintf("%s changed the topic to: %s", by, group.Topic))
+	}
+	if update.Description != nil && *update.Description != group.Description {
+		group.Description = *update.Description
+		notices = append(notices, fmt.Sprintf("%s updated the description", by))
+	}
+	if update.Avatar != nil && *update.Avatar != group.Avatar {
+		group.Avatar = *update.Avatar
+		notices = append(notices, fmt.Sprintf("%s changed the group picture", by))
+	}
+	if update.Visibility != nil && *update.Visibility != group.Visibility {
+		group.Visibility = *update.Visibility
+		notices = append(notices, fmt.Sprintf("%s made the group %s", by, group.Visibility))
+	}
+	return append(notices, applyPolicyUpdate(group, update, by)...), nil
+}
+
+// announceGroupUpdate tells the members of a group what changed and sends
+// everyone the new group list
+func announceGroupUpdate(groupID string, notices []string) {
+	for _, notice := range notices {
+		sendGroupNotice(groupID, notice)
+	}
+	sendGroupList()
+}
+
+// newGroupID returns an unused group ID. The caller must hold groupsMux.
+func newGroupID() string {
+	for {
+		id := generateID(8)
+		if _, taken := groups[id]; !taken {
+			return id
+		}
+	}
+}
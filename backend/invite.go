@@ -0,0 +1,474 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Invitation lifetimes
+const (
+	defaultInviteTTL = 7 * 24 * time.Hour
+	maxInviteTTL     = 30 * 24 * time.Hour
+)
+
+var (
+	// Pending invitations and join requests; settled ones are dropped
+	invitations    = make(map[string]*protocol.Invitation)  // key: invitation ID
+	inviteCodes    = make(map[string]string)                // key: invite code, value: invitation ID
+	joinRequests   = make(map[string]*protocol.JoinRequest) // key: request ID
+	invitationsMux sync.Mutex
+)
+
+// sendInvitation notifies users of the state of an invitation
+func sendInvitation(inv protocol.Invitation, usernames ...string) {
+	message := map[string]interface{}{
+		protocol.KeyType:       protocol.TypeInvitation,
+		protocol.KeyInvitation: inv,
+		protocol.KeyTimestamp:  time.Now().Format(time.RFC3339),
+	}
+	msgBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling invitation %s: %v", inv.ID, err)
+		return
+	}
+	for _, username := range usernames {
+		sendToUser(username, msgBytes)
+	}
+}
+
+// sendJoinRequest notifies users of the state of a join request
+func sendJoinRequest(req protocol.JoinRequest, usernames ...string) {
+	message := map[string]interface{}{
+		protocol.KeyType:        protocol.TypeJoinRequest,
+		protocol.KeyJoinRequest: req,
+		protocol.KeyTimestamp:   time.Now().Format(time.RFC3339),
+	}
+	msgBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling join request %s: %v", req.ID, err)
+		return
+	}
+	for _, username := range usernames {
+		sendToUser(username, msgBytes)
+	}
+}
+
+// groupApprovers returns the members of a group who may let others in
+func groupApprovers(groupID string) []string {
+	groupsMux.RLock()
+	defer groupsMux.RUnlock()
+
+	group, exists := groups[groupID]
+	if !exists {
+		return nil
+	}
+	var approvers []string
+	for _, member := range group.Members {
+		if roleAllows(groupRole(group, member), PermAddMember) && !isBot(member) {
+			approvers = append(approvers, member)
+		}
+	}
+	return approvers
+}
+
+// addMember makes username a member of a group. It reports false if the
+// group no longer exists.
+func addMember(groupID, username string) bool {
+	groupsMux.Lock()
+	defer groupsMux.Unlock()
+
+	group, exists := groups[groupID]
+	if !exists {
+		return false
+	}
+	if !contains(group.Members, username) {
+		group.Members = append(group.Members, username)
+	}
+	return true
+}
+
+// newInvitation creates a pending invitation that expires after ttl. The
+// caller must hold invitationsMux and store it.
+func newInvitation(groupID, inviter string, ttl time.Duration) *protocol.Invitation {
+	now := time.Now()
+	inv := &protocol.Invitation{
+		ID:        generateID(8),
+		Group:     groupID,
+		GroupName: groupLabel(groupID),
+		Inviter:   inviter,
+		Status:    protocol.StatusPending,
+		CreatedAt: now.Format(time.RFC3339),
+		ExpiresAt: now.Add(ttl).Format(time.RFC3339),
+	}
+	id := inv.ID
+	time.AfterFunc(ttl, func() { expireInvitation(id) })
+	return inv
+}
+
+// removeInvitation drops a settled invitation. The caller must hold
+// invitationsMux.
+func removeInvitation(inv *protocol.Invitation) {
+	delete(invitations, inv.ID)
+	if inv.Code != "" {
+		delete(inviteCodes, inv.Code)
+	}
+}
+
+// recipients returns the users to notify about an invitation
+func recipients(inv protocol.Invitation, others ...string) []string {
+	users := []string{inv.Inviter}
+	if inv.Invitee != "" {
+		users = append(users, inv.Invitee)
+	}
+	for _, other := range others {
+		if !contains(users, other) {
+			users = append(users, other)
+		}
+	}
+	return users
+}
+
+// inviteToGroup invites a user into a group. The caller has checked that
+// the inviter may add members.
+func inviteToGroup(inviter, groupID, invitee string) {
+	if isGroupMember(groupID, invitee) {
+		sendError(inviter, fmt.Sprintf("%s is already a member of %s", invitee, groupLabel(groupID)))
+		return
+	}
+	if reason, silent := checkGroupInvite(inviter, invitee); reason != "" {
+		log.Printf("Dropped invitation of %s to group %s by %s: %s", invitee, groupID, inviter, reason)
+		if !silent {
+			sendError(inviter, reason)
+		}
+		return
+	}
+
+	invitationsMux.Lock()
+	for _, inv := range invitations {
+		if inv.Group == groupID && inv.Invitee == invitee {
+			invitationsMux.Unlock()
+			sendError(inviter, fmt.Sprintf("%s already has a pending invitation to %s", invitee, inv.GroupName))
+			return
+		}
+	}
+	inv := newInvitation(groupID, inviter, defaultInviteTTL)
+	inv.Invitee = invitee
+	invitations[inv.ID] = inv
+	invite := *inv
+	invitationsMux.Unlock()
+
+	log.Printf("User %s invited %s to group %s", inviter, invitee, groupID)
+	sendInvitation(invite, recipients(invite)...)
+}
+
+// createInviteCode creates a shareable invite code for a group. The content
+// is "[DURATION][,MAX_USES]", e.g. "24h,10".
+func createInviteCode(msg protocol.Message) {
+	if !hasGroupPermission(msg.To, msg.From, PermAddMember) {
+		log.Printf("User %s is not authorized to create invite codes for group %s", msg.From, msg.To)
+		sendError(msg.From, fmt.Sprintf("You are not allowed to invite members to %s", groupLabel(msg.To)))
+		return
+	}
+
+	ttl, maxUses := defaultInviteTTL, 0
+	durationArg, usesArg, _ := strings.Cut(msg.Content, ",")
+	if arg := strings.TrimSpace(durationArg); arg != "" {
+		d, err := time.ParseDuration(arg)
+		if err != nil || d <= 0 || d > maxInviteTTL {
+			sendError(msg.From, fmt.Sprintf("Invite codes must expire within %s", maxInviteTTL))
+			return
+		}
+		ttl = d
+	}
+	if arg := strings.TrimSpace(usesArg); arg != "" {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			sendError(msg.From, fmt.Sprintf("Invalid number of uses %q", arg))
+			return
+		}
+		maxUses = n
+	}
+
+	invitationsMux.Lock()
+	inv := newInvitation(msg.To, msg.From, ttl)
+	inv.Code = generateID(6)
+	inv.MaxUses = maxUses
+	invitations[inv.ID] = inv
+	inviteCodes[inv.Code] = inv.ID
+	invite := *inv
+	invitationsMux.Unlock()
+
+	log.Printf("User %s created invite code %s for group %s", msg.From, invite.ID, msg.To)
+	sendInvitation(invite, msg.From)
+}
+
+// acceptInvitation joins a group through an invitation. The content is the
+// invitation ID or an invite code.
+func acceptInvitation(msg protocol.Message) {
+	key := strings.TrimSpace(msg.Content)
+
+	invitationsMux.Lock()
+	inv, ok := invitations[key]
+	if !ok {
+		if id, isCode := inviteCodes[key]; isCode {
+			inv, ok = invitations[id]
+		}
+	}
+	if !ok || (inv.Code == "" && inv.Invitee != msg.From) {
+		invitationsMux.Unlock()
+		sendError(msg.From, "Invitation not found or no longer valid")
+		return
+	}
+	if isGroupMember(inv.Group, msg.From) {
+		invitationsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("You are already a member of %s", inv.GroupName))
+		return
+	}
+	// The inviter may have been demoted or removed since inviting
+	if !hasGroupPermission(inv.Group, inv.Inviter, PermAddMember) {
+		inv.Status = protocol.StatusRevoked
+		removeInvitation(inv)
+		invite := *inv
+		invitationsMux.Unlock()
+		log.Printf("Revoked invitation %s to group %s: %s may no longer add members", invite.ID, invite.Group, invite.Inviter)
+		sendInvitation(invite, recipients(invite, msg.From)...)
+		sendError(msg.From, "Invitation not found or no longer valid")
+		return
+	}
+
+	if inv.Code == "" {
+		inv.Status = protocol.StatusAccepted
+		removeInvitation(inv)
+	} else {
+		inv.Uses++
+		if inv.MaxUses > 0 && inv.Uses >= inv.MaxUses {
+			inv.Status = protocol.StatusExpired
+			removeInvitation(inv)
+		}
+	}
+	invite := *inv
+	// Join while holding the invitation so a last use cannot be taken twice
+	joined := addMember(inv.Group, msg.From)
+	invitationsMux.Unlock()
+
+	if !joined {
+		sendError(msg.From, fmt.Sprintf("Group %s no longer exists", invite.GroupName))
+		return
+	}
+
+	log.Printf("User %s joined group %s through invitation %s", msg.From, invite.Group, invite.ID)
+	recordAudit(msg.From, protocol.ActionJoinGroup, invite.Group, msg.From, "invited by "+invite.Inviter)
+	sendInvitation(invite, recipients(invite, msg.From)...)
+	sendGroupNotice(invite.Group, fmt.Sprintf("%s joined the group (invited by %s)", msg.From, invite.Inviter))
+	sendGroupList()
+}
+
+// declineInvitation turns down an invitation addressed to the sender
+func declineInvitation(msg protocol.Message) {
+	invitationsMux.Lock()
+	inv, ok := invitations[strings.TrimSpace(msg.Content)]
+	if !ok || inv.Invitee != msg.From {
+		invitationsMux.Unlock()
+		sendError(msg.From, "Invitation not found or no longer valid")
+		return
+	}
+	inv.Status = protocol.StatusDeclined
+	removeInvitation(inv)
+	invite := *inv
+	invitationsMux.Unlock()
+
+	log.Printf("User %s declined the invitation to group %s", msg.From, invite.Group)
+	sendInvitation(invite, recipients(invite)...)
+}
+
+// revokeInvitation withdraws an invitation or invite code. The inviter and
+// members who may add members can revoke it.
+func revokeInvitation(msg protocol.Message) {
+	invitationsMux.Lock()
+	inv, ok := invitations[strings.TrimSpace(msg.Content)]
+	if !ok {
+		invitationsMux.Unlock()
+		sendError(msg.From, "Invitation not found or no longer valid")
+		return
+	}
+	if inv.Inviter != msg.From && !hasGroupPermission(inv.Group, msg.From, PermAddMember) {
+		invitationsMux.Unlock()
+		log.Printf("User %s is not authorized to revoke invitation %s", msg.From, inv.ID)
+		sendError(msg.From, "You are not allowed to revoke this invitation")
+		return
+	}
+	inv.Status = protocol.StatusRevoked
+	removeInvitation(inv)
+	invite := *inv
+	invitationsMux.Unlock()
+
+	log.Printf("User %s revoked invitation %s to group %s", msg.From, invite.ID, invite.Group)
+	sendInvitation(invite, recipients(invite, msg.From)...)
+}
+
+// expireInvitation marks an invitation expired once its lifetime is over
+func expireInvitation(id string) {
+	invitationsMux.Lock()
+	inv, ok := invitations[id]
+	if !ok {
+		invitationsMux.Unlock()
+		return
+	}
+	inv.Status = protocol.StatusExpired
+	removeInvitation(inv)
+	invite := *inv
+	invitationsMux.Unlock()
+
+	log.Printf("Invitation %s to group %s expired", invite.ID, invite.Group)
+	sendInvitation(invite, recipients(invite)...)
+}
+
+// requestJoin asks the admins of a group to let the sender in. msg.To is
+// the group's ID or, for public groups, its name. The content is an
+// optional note for the admins.
+func requestJoin(msg protocol.Message) {
+	groupID, exists := lookupGroup(msg.To, msg.From)
+	if !exists {
+		sendError(msg.From, fmt.Sprintf("Group %s not found", msg.To))
+		return
+	}
+	if isPublicGroup(groupID) {
+		// Anyone may join a public group, so there is nobody to ask
+		msg.To = groupID
+		joinGroup(msg)
+		return
+	}
+	name := groupLabel(groupID)
+	if isGroupMember(groupID, msg.From) {
+		sendError(msg.From, fmt.Sprintf("You are already a member of %s", name))
+		return
+	}
+
+	invitationsMux.Lock()
+	for _, req := range joinRequests {
+		if req.Group == groupID && req.User == msg.From {
+			invitationsMux.Unlock()
+			sendError(msg.From, fmt.Sprintf("You already asked to join %s", name))
+			return
+		}
+	}
+	req := &protocol.JoinRequest{
+		ID:        generateID(8),
+		Group:     groupID,
+		GroupName: name,
+		User:      msg.From,
+		Note:      strings.TrimSpace(msg.Content),
+		Status:    protocol.StatusPending,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	joinRequests[req.ID] = req
+	request := *req
+	invitationsMux.Unlock()
+
+	log.Printf("User %s asked to join group %s", msg.From, groupID)
+	sendJoinRequest(request, append(groupApprovers(groupID), msg.From)...)
+}
+
+// decideJoinRequest approves or denies a join request. The content is the
+// request ID.
+func decideJoinRequest(msg protocol.Message, approve bool) {
+	invitationsMux.Lock()
+	req, ok := joinRequests[strings.TrimSpace(msg.Content)]
+	if !ok {
+		invitationsMux.Unlock()
+		sendError(msg.From, "Join request not found or already decided")
+		return
+	}
+	if !hasGroupPermission(req.Group, msg.From, PermAddMember) {
+		invitationsMux.Unlock()
+		log.Printf("User %s is not authorized to decide join requests for group %s", msg.From, req.Group)
+		sendError(msg.From, fmt.Sprintf("You are not allowed to let members into %s", req.GroupName))
+		return
+	}
+
+	delete(joinRequests, req.ID)
+	req.DecidedBy = msg.From
+	req.Status = protocol.StatusDenied
+	joined := false
+	if approve {
+		req.Status = protocol.StatusApproved
+		joined = addMember(req.Group, req.User)
+	}
+	request := *req
+	invitationsMux.Unlock()
+
+	log.Printf("User %s %s the request of %s to join group %s", msg.From, request.Status, request.User, request.Group)
+	notify := groupApprovers(request.Group)
+	if !contains(notify, request.User) {
+		notify = append(notify, request.User)
+	}
+	sendJoinRequest(request, notify...)
+
+	if joined {
+		recordAudit(msg.From, protocol.ActionJoinGroup, request.Group, request.User, "join request approved")
+		sendGroupNotice(request.Group, fmt.Sprintf("%s joined the group (approved by %s)", request.User, msg.From))
+		sendGroupList()
+	}
+}
+
+// sendInvitationList sends a user their pending invitations, the invitations
+// and codes they created, and the join requests they made or can decide
+func sendInvitationList(client *Client) {
+	username := client.Username
+
+	invitationsMux.Lock()
+	invites := make([]protocol.Invitation, 0)
+	for _, inv := range invitations {
+		if inv.Invitee == username || inv.Inviter == username {
+			invites = append(invites, *inv)
+		}
+	}
+	requests := make([]protocol.JoinRequest, 0)
+	for _, req := range joinRequests {
+		if req.User == username || hasGroupPermission(req.Group, username, PermAddMember) {
+			requests = append(requests, *req)
+		}
+	}
+	invitationsMux.Unlock()
+
+	sort.Slice(invites, func(i, j int) bool { return invites[i].CreatedAt < invites[j].CreatedAt })
+	sort.Slice(requests, func(i, j int) bool { return requests[i].CreatedAt < requests[j].CreatedAt })
+
+	message := map[string]interface{}{
+		protocol.KeyType:         protocol.TypeInvitationList,
+		protocol.KeyInvitations:  invites,
+		protocol.KeyJoinRequests: requests,
+		protocol.KeyTimestamp:    time.Now().Format(time.RFC3339),
+	}
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling invitations for client %s: %v", username, err)
+		return
+	}
+	sendToUser(username, messageBytes)
+}
+
+// deleteGroupInvitations drops the invitations and join requests of a group
+func deleteGroupInvitations(groupID string) {
+	invitationsMux.Lock()
+	defer invitationsMux.Unlock()
+
+	for _, inv := range invitations {
+		if inv.Group == groupID {
+			removeInvitation(inv)
+		}
+	}
+	for id, req := range joinRequests {
+		if req.Group == groupID {
+			delete(joinRequests, id)
+		}
+	}
+}
@@ -1,61 +1,26 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
 	"github.com/CpBruceMeena/Go-Chatsync/static"
 	"github.com/gorilla/websocket"
 )
 
-// Message types
-const (
-	// Frontend to Backend
-	TypePrivateMessage    = "private_message"
-	TypeGroupMessage      = "group_message"
-	TypeCreateGroup       = "create_group"
-	TypeAddGroupMember    = "add_group_member"
-	TypeRemoveGroupMember = "remove_group_member"
-	TypeLeaveGroup        = "leave_group"
-	TypeRequestHistory    = "request_history"
-	TypeUpdateLastSeen    = "update_last_seen" // New type for updating last seen timestamp
-
-	// Backend Storage
-	TypePrivate = "private"
-	TypeGroup   = "group"
-
-	// Backend to Frontend
-	TypeUserList    = "user_list"
-	TypeGroupList   = "group_list"
-	TypeSystem      = "system"
-	TypeHistory     = "history"
-	TypeUnreadCount = "unread_count" // New type for sending unread message counts
-)
-
-// Message keys
-const (
-	KeyType      = "type"
-	KeyFrom      = "from"
-	KeyTo        = "to"
-	KeyContent   = "content"
-	KeyTimestamp = "timestamp"
-	KeyUsers     = "users"
-	KeyGroups    = "groups"
-)
-
-// Group keys
-const (
-	KeyName    = "name"
-	KeyAdmin   = "admin"
-	KeyMembers = "members"
-)
-
 var (
 	upgrader = websocket.Upgrader{
 		ReadBufferSize:  1024,
@@ -63,47 +28,45 @@ var (
 		CheckOrigin: func(r *http.Request) bool {
 			return true // Allow all origins for development
 		},
+		EnableCompression: true,
+		Subprotocols:      []string{protocol.SubprotocolMsgpack, protocol.SubprotocolJSON},
 	}
 
 	// WebSocket configuration
 	maxMessageSize int64 = 512 * 1024 // 512KB
 	pongWait             = 60 * time.Second
+	pingPeriod           = (pongWait * 9) / 10
 	writeWait            = 10 * time.Second
 )
 
-// Client represents a connected WebSocket client
+// Client is a user registered with the server: a WebSocket or SSE
+// connection served by readPump and writePump, or a bot. Bots have no conn;
+// Bot.run consumes their send channel instead of writePump.
 type Client struct {
 	Username string
-	conn     *websocket.Conn
-	send     chan []byte
-}
+	ip       string    // Remote address, for per-IP rate limits
+	conn     transport // WebSocket or SSE connection; nil for bots
+	send     chan outFrame
+	session  *session      // Survives dropped connections; nil for bots and companions
+	pending  []outFrame    // Written by writePump before anything from send
+	done     chan struct{} // Closed when writePump returns
 
-// Message represents a chat message
-type Message struct {
-	Type      string `json:"type"`
-	From      string `json:"from"`
-	To        string `json:"to"`
-	Content   string `json:"content"`
-	Timestamp string `json:"timestamp"`
-}
+	companion bool // Connected alongside the user's client, see companion.go
+	detached  bool // Dropped and waiting to be resumed; guarded by clientsMux
 
-// Group represents a chat group
-type Group struct {
-	Name    string   `json:"name"`
-	Admin   string   `json:"admin"`   // Group admin
-	Members []string `json:"members"` // List of member usernames
+	connectedAt time.Time
 }
 
 var (
 	// Global variables
 	clients    = make(map[string]*Client)
 	clientsMux sync.RWMutex
-	groups     = make(map[string]*Group)
+	groups     = make(map[string]*protocol.Group)
 	groupsMux  sync.RWMutex
 
 	// Message storage
-	privateMessages = make(map[string][]Message) // key: "user1:user2"
-	groupMessages   = make(map[string][]Message) // key: "group_name"
+	privateMessages = make(map[string][]protocol.Message) // key: "user1:user2"
+	groupMessages   = make(map[string][]protocol.Message) // key: group ID
 	msgMux          sync.RWMutex
 
 	// Last seen tracking
@@ -120,27 +83,51 @@ func getConversationKey(user1, user2 string) string {
 }
 
 // storeMessage stores a message in the appropriate message history
-func storeMessage(msg Message) {
+func storeMessage(msg protocol.Message) {
 	msgMux.Lock()
 	defer msgMux.Unlock()
 
-	if msg.Type == TypePrivateMessage {
+	if msg.Type == protocol.TypePrivateMessage {
 		key := getConversationKey(msg.From, msg.To)
 		privateMessages[key] = append(privateMessages[key], msg)
 		log.Printf("Stored private message: from=%s, to=%s, key=%s, total_messages=%d",
 			msg.From, msg.To, key, len(privateMessages[key]))
 	}
 
-	if msg.Type == TypeGroupMessage {
-		key := msg.To // Use group name as key
+	if msg.Type == protocol.TypeGroupMessage {
+		key := msg.To // Groups are keyed by ID, which survives renames
 		groupMessages[key] = append(groupMessages[key], msg)
 		log.Printf("Stored group message: group=%s, key=%s, total_messages=%d",
 			msg.To, key, len(groupMessages[key]))
 	}
+
+	searchIndex.Add(msg)
+}
+
+// unstoreMessage removes a stored message, found by the ID, sender and
+// recipient of msg
+func unstoreMessage(msg protocol.Message) {
+	store, key := privateMessages, getConversationKey(msg.From, msg.To)
+	if msg.Type == protocol.TypeGroupMessage {
+		store, key = groupMessages, msg.To
+	}
+
+	msgMux.Lock()
+	messages := make([]protocol.Message, 0, len(store[key]))
+	for _, stored := range store[key] {
+		if stored.ID != msg.ID {
+			messages = append(messages, stored)
+		}
+	}
+	// Replace rather than splice in place; history replies share the old slice
+	store[key] = messages
+	msgMux.Unlock()
+
+	searchIndex.Remove(msg.ID)
 }
 
 // getConversationHistory returns the message history for a conversation
-func getConversationHistory(user1, user2 string) []Message {
+func getConversationHistory(user1, user2 string) []protocol.Message {
 	key := getConversationKey(user1, user2)
 	msgMux.RLock()
 	store, exists := privateMessages[key]
@@ -148,7 +135,7 @@ func getConversationHistory(user1, user2 string) []Message {
 
 	if !exists {
 		log.Printf("No message history found for conversation %s between %s and %s", key, user1, user2)
-		return []Message{}
+		return []protocol.Message{}
 	}
 
 	log.Printf("Retrieved %d messages for conversation %s between %s and %s",
@@ -157,14 +144,14 @@ func getConversationHistory(user1, user2 string) []Message {
 }
 
 // getGroupHistory returns the message history for a group
-func getGroupHistory(groupID string) []Message {
+func getGroupHistory(groupID string) []protocol.Message {
 	msgMux.RLock()
 	store, exists := groupMessages[groupID]
 	msgMux.RUnlock()
 
 	if !exists {
 		log.Printf("No message history found for group %s", groupID)
-		return []Message{}
+		return []protocol.Message{}
 	}
 
 	log.Printf("Retrieved %d messages for group %s", len(store), groupID)
@@ -174,16 +161,140 @@ func getGroupHistory(groupID string) []Message {
 func main() {
 	// Clear messages when server starts
 	msgMux.Lock()
-	privateMessages = make(map[string][]Message)
-	groupMessages = make(map[string][]Message)
+	privateMessages = make(map[string][]protocol.Message)
+	groupMessages = make(map[string][]protocol.Message)
 	msgMux.Unlock()
 
+	// Register the built-in bots
+	registerBuiltinBots()
+
+	// Open the attachment blob store
+	if dir := os.Getenv("CHATSYNC_BLOB_DIR"); dir != "" {
+		blobDir = dir
+	}
+	store, err := NewBlobStore(blobDir)
+	if err != nil {
+		log.Fatal("Failed to open blob store:", err)
+	}
+	blobStore = store
+
+	// Configure rate limits
+	if spec := os.Getenv("CHATSYNC_RATE_LIMITS"); spec != "" {
+		quotas := defaultQuotas()
+		if err := parseQuotas(spec, quotas); err != nil {
+			log.Fatal("Invalid CHATSYNC_RATE_LIMITS:", err)
+		}
+		rateLimiter.Configure(quotas)
+	}
+
+	// Configure WebSocket compression
+	if err := configureCompression(os.Getenv("CHATSYNC_COMPRESSION"), os.Getenv("CHATSYNC_COMPRESSION_LEVEL"),
+		os.Getenv("CHATSYNC_COMPRESSION_THRESHOLD")); err != nil {
+		log.Fatal("Invalid compression settings: ", err)
+	}
+
+	// Configure session resumption
+	if err := configureResume(os.Getenv("CHATSYNC_RESUME_GRACE")); err != nil {
+		log.Fatal("Invalid resume settings: ", err)
+	}
+
+	// Configure message retention and start the compactor
+	if age := os.Getenv("CHATSYNC_RETENTION_MAX_AGE"); age != "" {
+		maxAge, err := time.ParseDuration(age)
+		if err != nil || maxAge < time.Second {
+			log.Fatal("Invalid CHATSYNC_RETENTION_MAX_AGE:", age)
+		}
+		serverRetention.MaxAgeSeconds = int(maxAge / time.Second)
+	}
+	if count := os.Getenv("CHATSYNC_RETENTION_MAX_COUNT"); count != "" {
+		if serverRetention.MaxCount, err = strconv.Atoi(count); err != nil || serverRetention.MaxCount < 0 {
+			log.Fatal("Invalid CHATSYNC_RETENTION_MAX_COUNT:", count)
+		}
+	}
+	startCompactor(compactInterval)
+
+	// Load the server-wide content filters
+	if path := os.Getenv("CHATSYNC_FILTERS"); path != "" {
+		if err := loadDefaultFilters(path); err != nil {
+			log.Fatal("Failed to load content filters:", err)
+		}
+	}
+
+	// Load the user profiles
+	if dir := os.Getenv("CHATSYNC_PROFILE_DIR"); dir != "" {
+		profileDir = dir
+	}
+	if profileStore, err = NewProfileStore(profileDir); err != nil {
+		log.Fatal("Failed to open profile store:", err)
+	}
+	if err := loadProfiles(); err != nil {
+		log.Fatal("Failed to load profiles:", err)
+	}
+
+	// Load bans, reports and the audit log
+	if dir := os.Getenv("CHATSYNC_MODERATION_DIR"); dir != "" {
+		moderationDir = dir
+	}
+	if moderationStore, err = NewModerationStore(moderationDir); err != nil {
+		log.Fatal("Failed to open moderation store:", err)
+	}
+	if err := loadModeration(); err != nil {
+		log.Fatal("Failed to load moderation data:", err)
+	}
+	setServerModerators(os.Getenv("CHATSYNC_MODERATORS"))
+
+	// Enable the admin API
+	adminToken = os.Getenv("CHATSYNC_ADMIN_TOKEN")
+	if adminToken == "" {
+		log.Println("CHATSYNC_ADMIN_TOKEN is not set; the admin API is disabled")
+	}
+
+	// Join a cluster of nodes
+	if addr := os.Getenv("CHATSYNC_CLUSTER_ADDR"); addr != "" {
+		secret := os.Getenv("CHATSYNC_CLUSTER_SECRET")
+		if secret == "" {
+			log.Fatal("CHATSYNC_CLUSTER_SECRET must be set when CHATSYNC_CLUSTER_ADDR is; peers are trusted with every user's messages")
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			log.Fatal("Failed to listen for cluster peers:", err)
+		}
+		node := os.Getenv("CHATSYNC_NODE_ID")
+		if node == "" {
+			hostname, _ := os.Hostname()
+			node = hostname + "-" + generateID(4)
+		}
+		var peers []string
+		for _, peer := range strings.Split(os.Getenv("CHATSYNC_CLUSTER_PEERS"), ",") {
+			if peer = strings.TrimSpace(peer); peer != "" {
+				peers = append(peers, peer)
+			}
+		}
+		startCluster(NewTCPBus(node, listener, peers, secret), node)
+	}
+
 	// Get the embedded filesystem
 	buildFS, err := static.GetBuildFS()
 	if err != nil {
 		log.Fatal("Failed to get build filesystem:", err)
 	}
 
+	mux := newServeMux(buildFS)
+
+	// Start the server
+	addr := os.Getenv("CHATSYNC_ADDR")
+	if addr == "" {
+		addr = ":8080"
+	}
+	log.Println("Server starting on", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Fatal("Error starting server:", err)
+	}
+}
+
+// newServeMux builds the HTTP routes: the WebSocket endpoint, the API and the
+// React app served from buildFS
+func newServeMux(buildFS fs.FS) *http.ServeMux {
 	// Create a file server for the React app
 	fileServer := http.FileServer(http.FS(buildFS))
 
@@ -191,50 +302,36 @@ func main() {
 	mux := http.NewServeMux()
 
 	// Handle WebSocket connections
-	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
-		username := r.URL.Query().Get("username")
-		if username == "" {
-			http.Error(w, "Username is required", http.StatusBadRequest)
-			return
-		}
+	mux.HandleFunc("/ws", handleWebSocket)
 
-		log.Printf("New WebSocket connection request from user: %s", username)
+	// Handle the SSE transport for clients that cannot use WebSockets
+	mux.HandleFunc("/api/events", handleEvents)
 
-		conn, err := upgrader.Upgrade(w, r, nil)
-		if err != nil {
-			log.Printf("Error upgrading connection for user %s: %v", username, err)
-			return
-		}
+	// The HTTP API below is rate limited per IP address; the WebSocket and
+	// SSE endpoints limit connections and messages themselves
 
-		log.Printf("WebSocket connection established for user: %s", username)
+	// Handle incoming webhooks from external integrations
+	mux.HandleFunc("/api/webhooks/", limitRequests(handleWebhook))
 
-		client := &Client{
-			Username: username,
-			conn:     conn,
-			send:     make(chan []byte, 256),
-		}
+	// Handle message search
+	mux.HandleFunc("/api/search", limitRequests(handleSearch))
 
-		clientsMux.Lock()
-		if existingClient, exists := clients[username]; exists {
-			log.Printf("Closing existing connection for user %s", username)
-			close(existingClient.send)
-		}
-		clients[username] = client
-		clientsMux.Unlock()
+	// Handle the admin API
+	mux.HandleFunc("/api/admin/audit", limitRequests(handleAdminAudit))
+	mux.HandleFunc("/api/admin/clients", limitRequests(handleAdminClients))
+	mux.HandleFunc("/api/admin/clients/", limitRequests(handleAdminClient))
+	mux.HandleFunc("/api/admin/groups", limitRequests(handleAdminGroups))
+	mux.HandleFunc("/api/admin/groups/", limitRequests(handleAdminGroup))
+	mux.HandleFunc("/api/admin/broadcast", limitRequests(handleAdminBroadcast))
+	mux.HandleFunc("/api/admin/stats", limitRequests(handleAdminStats))
 
-		log.Printf("Registering new client for user: %s", username)
+	// Handle conversation export and import
+	mux.HandleFunc("/api/export", limitRequests(handleExport))
+	mux.HandleFunc("/api/import", limitRequests(handleImport))
 
-		// Send initial user list and group list
-		log.Printf("Sending initial data to user: %s", username)
-		sendUserList()
-		sendGroupList()
-
-		// Broadcast system message about new user
-		broadcastSystemMessage(fmt.Sprintf("%s joined the chat", username))
-
-		go client.writePump()
-		go client.readPump()
-	})
+	// Handle attachment uploads and downloads
+	mux.HandleFunc("/api/attachments", limitRequests(handleAttachmentUpload))
+	mux.HandleFunc("/api/attachments/", limitRequests(handleAttachment))
 
 	// Serve static files for the React app
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -267,38 +364,156 @@ func main() {
 		http.ServeContent(w, r, "index.html", time.Now(), indexFile.(io.ReadSeeker))
 	})
 
-	// Start the server
-	log.Println("Server starting on :8080")
-	if err := http.ListenAndServe(":8080", mux); err != nil {
-		log.Fatal("Error starting server:", err)
+	return mux
+}
+
+// handleWebSocket upgrades a /ws request and registers the connected client
+func handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	username, ip, ok := admitConnection(w, r)
+	if !ok {
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Printf("Error upgrading connection for user %s: %v", username, err)
+		return
+	}
+
+	log.Printf("WebSocket connection established for user: %s", username)
+
+	client := registerClient(username, ip, newWSTransport(conn), r.URL.Query())
+	go client.writePump()
+	go client.readPump()
+}
+
+// admitConnection checks whether the user of a connection request may
+// connect, answering the request if not
+func admitConnection(w http.ResponseWriter, r *http.Request) (username, ip string, ok bool) {
+	username = r.URL.Query().Get("username")
+	if username == "" {
+		http.Error(w, "Username is required", http.StatusBadRequest)
+		return "", "", false
+	}
+
+	log.Printf("New connection request from user: %s", username)
+
+	if isBot(username) || isWebhookName(username) {
+		http.Error(w, "Username is reserved", http.StatusConflict)
+		return "", "", false
+	}
+
+	ip = clientIP(r)
+	if ban, banned := activeBan(username); banned {
+		log.Printf("Refused connection of banned user %s", username)
+		recordSession(protocol.ActionLoginDenied, username, ip, "banned")
+		http.Error(w, banDescription(ban), http.StatusForbidden)
+		return "", "", false
 	}
+
+	if ok, wait := rateLimiter.AllowConnect(username, ip); !ok {
+		log.Printf("Refused connection of %s from %s: rate limited", username, ip)
+		recordSession(protocol.ActionLoginDenied, username, ip, "rate limited")
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter(wait)))
+		http.Error(w, "Too many connections, try again later", http.StatusTooManyRequests)
+		return "", "", false
+	}
+	return username, ip, true
+}
+
+// newClient registers a connected client, replacing any earlier connection
+// of the same user, and queues its initial data. The caller starts the
+// pumps.
+func newClient(username, ip string, conn transport) *Client {
+	client := &Client{
+		Username: username,
+		ip:       ip,
+		conn:     conn,
+		send:     make(chan outFrame, 256),
+		session:  newSession(),
+		done:     make(chan struct{}),
+
+		connectedAt: time.Now(),
+	}
+	client.pending = []outFrame{client.session.frame(false, 0)}
+
+	clientsMux.Lock()
+	existingClient, replaced := clients[username]
+	if replaced {
+		log.Printf("Closing existing connection for user %s", username)
+		close(existingClient.send)
+	}
+	clients[username] = client
+	clientsMux.Unlock()
+
+	if replaced {
+		recordSession(protocol.ActionDisconnect, username, existingClient.ip, "replaced by a new connection")
+	}
+	recordSession(protocol.ActionLogin, username, ip, "")
+	publishPresence()
+
+	log.Printf("Registering new client for user: %s", username)
+
+	sendInitialData(client)
+
+	// Broadcast system message about new user
+	broadcastSystemMessage(fmt.Sprintf("%s joined the chat", username))
+
+	return client
+}
+
+// sendInitialData queues what a client needs to start: the user and group
+// lists, its invitations and its profile
+func sendInitialData(client *Client) {
+	log.Printf("Sending initial data to user: %s", client.Username)
+	sendUserList()
+	sendGroupList()
+	sendInvitationList(client)
+	sendProfile(client.Username)
 }
 
 func (c *Client) readPump() {
 	defer func() {
+		if c.companion {
+			removeCompanion(c)
+			c.conn.Close()
+			return
+		}
+
 		clientsMux.Lock()
-		delete(clients, c.Username)
+		// Only unregister if the user has not reconnected in the meantime,
+		// and keep dropped clients for a while so they can resume
+		current := clients[c.Username] == c
+		detached := current && c.session.resumable()
+		if current && !detached {
+			delete(clients, c.Username)
+			close(c.send)
+		}
+		c.detached = detached
 		clientsMux.Unlock()
 		c.conn.Close()
+		if detached {
+			c.detach()
+		} else if current {
+			recordSession(protocol.ActionLogout, c.Username, c.ip, "")
+			publishPresence()
+		}
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
-	})
-
 	for {
-		_, message, err := c.conn.ReadMessage()
+		message, err := c.conn.readFrame()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
 				log.Printf("Error reading message from client %s: %v", c.Username, err)
 			}
+			// Clients that close the connection themselves are leaving
+			if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				c.session.end()
+			}
 			break
 		}
 
-		var msg Message
+		var msg protocol.Message
 		if err := json.Unmarshal(message, &msg); err != nil {
 			log.Printf("Error unmarshaling message from client %s: %v", c.Username, err)
 			continue
@@ -307,68 +522,200 @@ func (c *Client) readPump() {
 		msg.From = c.Username
 		msg.Timestamp = time.Now().Format(time.RFC3339)
 
+		if ok, wait, abusive := rateLimiter.Allow(c.Username, c.ip, msg.Type); !ok {
+			if abusive {
+				log.Printf("Disconnecting %s (%s) for exceeding rate limits", c.Username, c.ip)
+				c.session.end()
+				c.conn.closeWith(websocket.ClosePolicyViolation, "rate limit exceeded")
+				break
+			}
+			sendError(c.Username, fmt.Sprintf("Too many %s requests, try again in %ds", msg.Type, retryAfter(wait)))
+			continue
+		}
+
 		switch msg.Type {
-		case TypePrivateMessage:
-			// Store message
-			storeMessage(msg)
-			// Send to recipient
-			msgBytes, _ := json.Marshal(msg)
-			sendToUser(msg.To, msgBytes)
-			// Send unread counts to recipient
-			sendUnreadCounts(msg.To)
-		case TypeGroupMessage:
-			// Store message
-			storeMessage(msg)
-			// Send to group members
-			msgBytes, _ := json.Marshal(msg)
-			sendToGroup(msg.To, msgBytes)
-			// Send unread counts to all group members
-			groupsMux.RLock()
-			if group, ok := groups[msg.To]; ok {
-				for _, member := range group.Members {
-					if member != msg.From {
-						sendUnreadCounts(member)
-					}
+		case protocol.TypePrivateMessage:
+			if reason, silent := checkPrivateMessage(msg); reason != "" {
+				log.Printf("Dropped private message from %s to %s: %s", msg.From, msg.To, reason)
+				if !silent {
+					sendError(msg.From, reason)
 				}
+				break
 			}
-			groupsMux.RUnlock()
-		case TypeUpdateLastSeen:
+			reason, flagged := applyFilters(&msg)
+			if reason != "" {
+				sendError(msg.From, reason)
+				break
+			}
+			resolveAttachments(&msg)
+			flagMessage(deliverPrivateMessage(msg), flagged)
+		case protocol.TypeGroupMessage:
+			if !hasGroupPermission(msg.To, msg.From, PermPost) {
+				log.Printf("User %s is not allowed to post in group %s", msg.From, msg.To)
+				sendError(msg.From, fmt.Sprintf("You are not allowed to post in %s", groupLabel(msg.To)))
+				break
+			}
+			if reason := checkMute(msg); reason != "" {
+				sendError(msg.From, reason)
+				break
+			}
+			if reason := checkPostingPolicy(msg); reason != "" {
+				log.Printf("Rejected message from %s in group %s: %s", msg.From, msg.To, reason)
+				sendError(msg.From, reason)
+				break
+			}
+			reason, flagged := applyFilters(&msg)
+			if reason != "" {
+				sendError(msg.From, reason)
+				break
+			}
+			// Slash commands are dispatched to bots instead of being posted,
+			// after the checks of messages so bots cannot be used to get
+			// around them
+			if isSlashCommand(msg.Content) {
+				handleSlashCommand(msg)
+				flagMessage(msg, flagged)
+			} else {
+				resolveAttachments(&msg)
+				flagMessage(deliverGroupMessage(msg), flagged)
+			}
+			recordPost(msg)
+		case protocol.TypeUpdateLastSeen:
 			// Update last seen timestamp
 			updateLastSeen(c.Username, msg.To, msg.Timestamp)
+			publishLastSeen(c.Username, msg.To, msg.Timestamp)
 			// Send updated unread counts
 			sendUnreadCounts(c.Username)
-		case TypeRequestHistory:
+		case protocol.TypeRequestHistory:
 			// Send message history
 			sendMessageHistory(c, msg.To, msg.Content)
-		case TypeCreateGroup:
+		case protocol.TypeSearch:
+			sendSearchResults(c, msg.Content)
+		case protocol.TypeRequestUnread:
+			// Send current unread counts without touching last seen
+			sendUnreadCounts(c.Username)
+		case protocol.TypeRequestMentions:
+			sendMentionedMessages(c)
+		case protocol.TypeCreateGroup:
 			createGroup(msg)
-		case TypeAddGroupMember:
+		case protocol.TypeAddGroupMember:
 			addGroupMember(msg)
-		case TypeRemoveGroupMember:
+		case protocol.TypeRemoveGroupMember:
 			removeGroupMember(msg)
-		case TypeLeaveGroup:
+		case protocol.TypeLeaveGroup:
 			leaveGroup(msg)
+		case protocol.TypeSetGroupRole:
+			setGroupRole(msg)
+		case protocol.TypeTransferOwnership:
+			transferOwnership(msg)
+		case protocol.TypeDeleteMessage:
+			deleteMessage(msg)
+		case protocol.TypeCreateInviteCode:
+			createInviteCode(msg)
+		case protocol.TypeAcceptInvitation:
+			acceptInvitation(msg)
+		case protocol.TypeDeclineInvitation:
+			declineInvitation(msg)
+		case protocol.TypeRevokeInvitation:
+			revokeInvitation(msg)
+		case protocol.TypeRequestJoin:
+			requestJoin(msg)
+		case protocol.TypeApproveJoin:
+			decideJoinRequest(msg, true)
+		case protocol.TypeDenyJoin:
+			decideJoinRequest(msg, false)
+		case protocol.TypeListInvitations:
+			sendInvitationList(c)
+		case protocol.TypeUpdateGroup:
+			updateGroup(msg)
+		case protocol.TypeListPublicGroups:
+			sendPublicGroups(c)
+		case protocol.TypeJoinGroup:
+			joinGroup(msg)
+		case protocol.TypeBlockUser:
+			blockUser(msg)
+		case protocol.TypeUnblockUser:
+			unblockUser(msg)
+		case protocol.TypeUpdatePrivacy:
+			updatePrivacy(msg)
+		case protocol.TypeRequestProfile:
+			sendProfile(c.Username)
+		case protocol.TypeMuteMember:
+			muteMember(msg)
+		case protocol.TypeUnmuteMember:
+			unmuteMember(msg)
+		case protocol.TypeBanUser:
+			banUser(msg)
+		case protocol.TypeUnbanUser:
+			unbanUser(msg)
+		case protocol.TypeReportMessage:
+			reportMessage(msg)
+		case protocol.TypeListReports:
+			sendReports(c, msg.Content)
+		case protocol.TypeResolveReport:
+			handleReport(msg, true)
+		case protocol.TypeDismissReport:
+			handleReport(msg, false)
+		case protocol.TypeRequestAuditLog:
+			sendAuditLog(c, msg.To)
+		case protocol.TypeSetFilters:
+			setFilters(msg)
+		case protocol.TypeRequestFilters:
+			sendFilters(c, msg.To)
+		case protocol.TypeSetRetention:
+			setRetention(msg)
+		case protocol.TypeRequestRetention:
+			requestRetention(c, msg.To)
+		case protocol.TypeCreateWebhook:
+			createWebhook(c, msg)
+		case protocol.TypeDeleteWebhook:
+			deleteWebhook(c, msg)
+		case protocol.TypeListWebhooks:
+			sendWebhookList(c, msg.To)
 		default:
 			log.Printf("Unknown message type from client %s: %s", c.Username, msg.Type)
 		}
 	}
 }
 
+// writePump writes the pending frames and then everything queued on send.
+// Once the connection fails it keeps numbering frames for the session, so
+// a resumed connection can replay them, until send is closed.
 func (c *Client) writePump() {
+	ticker := time.NewTicker(pingPeriod)
 	defer func() {
+		ticker.Stop()
 		c.conn.Close()
+		close(c.done)
 	}()
 
+	connected := true
+	write := func(f outFrame) {
+		if connected && c.conn.writeFrame(f) != nil {
+			connected = false
+			c.conn.Close()
+		}
+	}
+
+	for _, f := range c.pending {
+		write(f)
+	}
 	for {
 		select {
-		case message, ok := <-c.send:
+		case f, ok := <-c.send:
 			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				if connected {
+					c.conn.closeWith(websocket.CloseNormalClosure, "")
+				}
 				return
 			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				return
+			c.session.record(f)
+			write(f)
+		case <-ticker.C:
+			// Ping so the client's pongs keep extending the read deadline
+			if connected && c.conn.ping() != nil {
+				connected = false
+				c.conn.Close()
 			}
 		}
 	}
@@ -382,11 +729,15 @@ func sendUserList() {
 		userList[username] = username
 	}
 	clientsMux.RUnlock()
+	for _, username := range remoteUserNames() {
+		userList[username] = username
+	}
 
 	message := map[string]interface{}{
-		KeyType:      TypeUserList,
-		KeyUsers:     userList,
-		KeyTimestamp: time.Now().Format(time.RFC3339),
+		protocol.KeyType:      protocol.TypeUserList,
+		protocol.KeyUsers:     userList,
+		protocol.KeyBots:      botNames(),
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
 	}
 
 	messageBytes, err := json.Marshal(message)
@@ -396,60 +747,60 @@ func sendUserList() {
 	}
 
 	// Get a copy of clients to minimize lock time
-	clientsMux.RLock()
-	clientsCopy := make(map[string]*Client, len(clients))
-	for username, client := range clients {
-		clientsCopy[username] = client
-	}
-	clientsMux.RUnlock()
+	clientsCopy := localClients()
 
 	log.Printf("Broadcasting user list to %d clients: %v", len(clientsCopy), userList)
-	for username, client := range clientsCopy {
+	frame := shareFrame(messageBytes)
+	for _, client := range clientsCopy {
 		select {
-		case client.send <- messageBytes:
-			log.Printf("User list sent to client: %s", username)
+		case client.send <- frame:
+			log.Printf("User list sent to client: %s", client.Username)
 		default:
-			log.Printf("Failed to send user list to client: %s", username)
-			// Remove client
-			clientsMux.Lock()
-			delete(clients, username)
-			clientsMux.Unlock()
-			close(client.send)
+			log.Printf("Failed to send user list to client: %s", client.Username)
+			dropClient(client)
 		}
 	}
 	log.Printf("Finished sending user list")
 }
 
 func sendToUser(username string, message []byte) {
+	if !queueLocal(username, outFrame{data: message}) && !forwardFrame([]string{username}, message) {
+		log.Printf("User %s not found", username)
+	}
+}
+
+// queueLocal queues a frame for a user connected to this node and their
+// companion connections here, dropping connections that cannot keep up. It
+// reports whether the user is connected here; companions alone do not count,
+// so the frame is still forwarded to the node the user is connected to.
+func queueLocal(username string, f outFrame) bool {
 	clientsMux.RLock()
 	client, exists := clients[username]
 	clientsMux.RUnlock()
 
-	if !exists {
-		log.Printf("User %s not found", username)
-		return
+	targets := companionsOf(username)
+	if exists {
+		targets = append(targets, client)
 	}
-
-	select {
-	case client.send <- message:
-		log.Printf("Message sent to user %s", username)
-	default:
-		log.Printf("Failed to send message to user %s", username)
-		// Remove client
-		clientsMux.Lock()
-		delete(clients, username)
-		clientsMux.Unlock()
-		close(client.send)
+	for _, target := range targets {
+		select {
+		case target.send <- f:
+			log.Printf("Message sent to user %s", username)
+		default:
+			log.Printf("Failed to send message to user %s", username)
+			dropClient(target)
+		}
 	}
+	return exists
 }
 
-func sendToGroup(groupName string, message []byte) {
+func sendToGroup(groupID string, message []byte) {
 	groupsMux.RLock()
-	group, exists := groups[groupName]
+	group, exists := groups[groupID]
 	groupsMux.RUnlock()
 
 	if !exists {
-		log.Printf("Group %s not found", groupName)
+		log.Printf("Group %s not found", groupID)
 		return
 	}
 
@@ -457,42 +808,169 @@ func sendToGroup(groupName string, message []byte) {
 	members := make([]string, len(group.Members))
 	copy(members, group.Members)
 
+	frame := shareFrame(message)
+	var remote []string
 	for _, member := range members {
-		sendToUser(member, message)
+		if !queueLocal(member, frame) {
+			remote = append(remote, member)
+		}
+	}
+	forwardFrame(remote, message)
+}
+
+// deliverPrivateMessage stores a private message, sends it to the recipient
+// and refreshes the recipient's unread counts. It returns the message as
+// stored.
+func deliverPrivateMessage(msg protocol.Message) protocol.Message {
+	msg.ID = generateID(8)
+	msg.ExpiresAt = messageExpiry(msg)
+	// Mentions only apply to group messages
+	msg.Mentions = nil
+	// Store message
+	storeMessage(msg)
+	publishMessage(msg)
+	// Send to recipient
+	msgBytes, _ := json.Marshal(msg)
+	sendToUser(msg.To, msgBytes)
+	// Send unread counts to recipient
+	sendUnreadCounts(msg.To)
+	return msg
+}
+
+// deliverGroupMessage stores a group message, fans it out to the group members
+// and refreshes their unread counts. It returns the message as stored.
+func deliverGroupMessage(msg protocol.Message) protocol.Message {
+	msg.ID = generateID(8)
+	msg.ExpiresAt = messageExpiry(msg)
+	// Resolve mentions against the group members; never trust the client's list
+	msg.Mentions = resolveMentions(msg)
+	// Store message
+	storeMessage(msg)
+	publishMessage(msg)
+	// Send to group members
+	msgBytes, _ := json.Marshal(msg)
+	sendToGroup(msg.To, msgBytes)
+	// Notify mentioned members
+	notifyMentions(msg)
+	// Send unread counts to all group members
+	groupsMux.RLock()
+	if group, ok := groups[msg.To]; ok {
+		for _, member := range group.Members {
+			if member != msg.From {
+				sendUnreadCounts(member)
+			}
+		}
 	}
+	groupsMux.RUnlock()
+	return msg
+}
+
+// deleteMessage removes a stored message. msg.To is the group or the other
+// user of a private chat and msg.Content the message ID. Authors may delete
+// their own messages; in groups, members with PermDeleteMessages may delete
+// the messages of members ranked below them.
+func deleteMessage(msg protocol.Message) {
+	groupsMux.RLock()
+	_, isGroup := groups[msg.To]
+	groupsMux.RUnlock()
+
+	chatType, key, store := protocol.TypePrivate, getConversationKey(msg.From, msg.To), privateMessages
+	if isGroup {
+		chatType, key, store = protocol.TypeGroup, msg.To, groupMessages
+	}
+
+	target, found := findMessage(store, key, msg.Content)
+	if !found {
+		sendError(msg.From, fmt.Sprintf("Message %s not found", msg.Content))
+		return
+	}
+
+	// Messages of webhooks belong to no user, even one of the same name
+	own := target.From == msg.From && target.Integration == ""
+	if !own {
+		allowed := false
+		if isGroup {
+			groupsMux.RLock()
+			if group, exists := groups[msg.To]; exists {
+				actorRole := groupRole(group, msg.From)
+				allowed = roleAllows(actorRole, PermDeleteMessages) &&
+					roleRank[groupRole(group, target.From)] < roleRank[actorRole]
+			}
+			groupsMux.RUnlock()
+		}
+		if !allowed {
+			log.Printf("User %s is not authorized to delete message %s", msg.From, msg.Content)
+			sendError(msg.From, "You are not allowed to delete this message")
+			return
+		}
+	}
+
+	unstoreMessage(target)
+	publishMessageDeleted(target)
+	log.Printf("User %s deleted message %s in %s", msg.From, target.ID, msg.To)
+	if !own {
+		recordAudit(msg.From, protocol.ActionDeleteMessage, msg.To, target.ID, "from "+target.From)
+	}
+
+	notification := map[string]interface{}{
+		protocol.KeyType:      protocol.TypeMessageDeleted,
+		protocol.KeyFrom:      msg.From,
+		protocol.KeyTo:        target.To,
+		protocol.KeyChatType:  chatType,
+		protocol.KeyContent:   target.ID,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	}
+	msgBytes, _ := json.Marshal(notification)
+	if isGroup {
+		sendToGroup(msg.To, msgBytes)
+	} else {
+		sendToUser(target.From, msgBytes)
+		sendToUser(target.To, msgBytes)
+	}
+}
+
+// findMessage looks up a stored message by ID
+func findMessage(store map[string][]protocol.Message, key, id string) (protocol.Message, bool) {
+	msgMux.RLock()
+	defer msgMux.RUnlock()
+
+	for _, stored := range store[key] {
+		if stored.ID == id {
+			return stored, true
+		}
+	}
+	return protocol.Message{}, false
 }
 
 func sendGroupList() {
 	log.Printf("Starting sendGroupList()")
+	syncGroups()
+
 	groupsMux.RLock()
-	groupsCopy := make(map[string]*Group, len(groups))
-	for id, group := range groups {
-		groupsCopy[id] = group
+	groupsCopy := make([]protocol.Group, 0, len(groups))
+	for _, group := range groups {
+		groupsCopy = append(groupsCopy, cloneGroup(group))
 	}
 	groupsMux.RUnlock()
 
 	// Get a copy of clients to minimize lock time
-	clientsMux.RLock()
-	clientsCopy := make(map[string]*Client, len(clients))
-	for username, client := range clients {
-		clientsCopy[username] = client
-	}
-	clientsMux.RUnlock()
+	clientsCopy := localClients()
 
 	// Send filtered group list to each user
-	for username, client := range clientsCopy {
+	for _, client := range clientsCopy {
+		username := client.Username
 		// Filter groups for this user
-		userGroups := make([]Group, 0)
+		userGroups := make([]protocol.Group, 0)
 		for _, group := range groupsCopy {
 			if contains(group.Members, username) {
-				userGroups = append(userGroups, *group)
+				userGroups = append(userGroups, group)
 			}
 		}
 
 		message := map[string]interface{}{
-			KeyType:      TypeGroupList,
-			KeyGroups:    userGroups,
-			KeyTimestamp: time.Now().Format(time.RFC3339),
+			protocol.KeyType:      protocol.TypeGroupList,
+			protocol.KeyGroups:    userGroups,
+			protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
 		}
 
 		messageBytes, err := json.Marshal(message)
@@ -502,20 +980,25 @@ func sendGroupList() {
 		}
 
 		select {
-		case client.send <- messageBytes:
+		case client.send <- outFrame{data: messageBytes}:
 			log.Printf("Group list sent to client: %s", username)
 		default:
 			log.Printf("Failed to send group list to client: %s", username)
-			// Remove client
-			clientsMux.Lock()
-			delete(clients, username)
-			clientsMux.Unlock()
-			close(client.send)
+			dropClient(client)
 		}
 	}
 	log.Printf("Finished sending group list")
 }
 
+// generateID returns a random hex identifier of n bytes
+func generateID(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		log.Printf("Error generating random ID: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
 // Helper function to check if a slice contains a string
 func contains(slice []string, str string) bool {
 	for _, v := range slice {
@@ -530,33 +1013,26 @@ func broadcastMessage(message []byte) {
 	log.Printf("Starting broadcastMessage()")
 
 	// Get a copy of clients to minimize lock time
-	clientsMux.RLock()
-	clientsCopy := make(map[string]*Client, len(clients))
-	for username, client := range clients {
-		clientsCopy[username] = client
-	}
-	clientsMux.RUnlock()
+	clientsCopy := localClients()
 
 	log.Printf("Broadcasting message to %d clients", len(clientsCopy))
-	for username, client := range clientsCopy {
+	frame := shareFrame(message)
+	for _, client := range clientsCopy {
 		select {
-		case client.send <- message:
-			log.Printf("Message sent successfully to client %s", username)
+		case client.send <- frame:
+			log.Printf("Message sent successfully to client %s", client.Username)
 		default:
-			log.Printf("Failed to send message to client %s: channel full or closed", username)
-			// Remove client
-			clientsMux.Lock()
-			delete(clients, username)
-			clientsMux.Unlock()
-			close(client.send)
+			log.Printf("Failed to send message to client %s: channel full or closed", client.Username)
+			dropClient(client)
 		}
 	}
+	forwardBroadcast(message)
 	log.Printf("Finished broadcasting message")
 }
 
 func broadcastSystemMessage(content string) {
-	message := Message{
-		Type:      TypeSystem,
+	message := protocol.Message{
+		Type:      protocol.TypeSystem,
 		Content:   content,
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
@@ -564,9 +1040,11 @@ func broadcastSystemMessage(content string) {
 	broadcastMessage(messageBytes)
 }
 
-// createGroup creates a new group
-func createGroup(msg Message) {
+// createGroup creates a new group. msg.To is the name of the group; the
+// server assigns its ID.
+func createGroup(msg protocol.Message) {
 	log.Printf("Creating group: %s by user: %s", msg.To, msg.From)
+	name := strings.TrimSpace(msg.To)
 
 	// Parse members from content
 	members := strings.Split(msg.Content, ",")
@@ -575,33 +1053,60 @@ func createGroup(msg Message) {
 		return
 	}
 
-	// Create new group
-	group := &Group{
-		Name:    msg.To,
-		Admin:   msg.From,
-		Members: append([]string{msg.From}, members...), // Add creator as first member
+	// Create new group. Bots join right away; everyone else is invited.
+	group := &protocol.Group{
+		Name:       name,
+		Visibility: protocol.VisibilityPrivate,
+		Admin:      msg.From,
+		Members:    []string{msg.From}, // Add creator as first member
+		Roles:      map[string]string{msg.From: protocol.RoleOwner},
+		CreatedAt:  time.Now().Format(time.RFC3339),
+	}
+	var invitees []string
+	for _, member := range members {
+		member = strings.TrimSpace(member)
+		switch {
+		case member == "" || contains(group.Members, member) || contains(invitees, member):
+		case isBot(member):
+			group.Members = append(group.Members, member)
+		default:
+			invitees = append(invitees, member)
+		}
 	}
 
-	// Store group
+	// Store group, refusing to replace an existing one
 	groupsMux.Lock()
-	groups[msg.To] = group
+	if err := validateGroupName(name, ""); err != nil {
+		groupsMux.Unlock()
+		log.Printf("Rejected group %q from %s: %v", name, msg.From, err)
+		sendError(msg.From, err.Error())
+		return
+	}
+	group.ID = newGroupID()
+	groups[group.ID] = group
 	groupsMux.Unlock()
+	recordAudit(msg.From, protocol.ActionCreateGroup, group.ID, "", name)
 
 	// Notify group members
-	notification := Message{
-		Type:      TypeSystem,
-		Content:   fmt.Sprintf("Group '%s' created by %s", msg.To, msg.From),
+	notification := protocol.Message{
+		Type:      protocol.TypeSystem,
+		Content:   fmt.Sprintf("Group '%s' created by %s", name, msg.From),
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
 	msgBytes, _ := json.Marshal(notification)
-	sendToGroup(msg.To, msgBytes)
+	sendToGroup(group.ID, msgBytes)
+
+	for _, invitee := range invitees {
+		inviteToGroup(msg.From, group.ID, invitee)
+	}
 
 	// Update group list for all users
 	sendGroupList()
 }
 
-// addGroupMember adds a member to a group
-func addGroupMember(msg Message) {
+// addGroupMember invites a user into a group. Bots have no one to accept on
+// their behalf and are added directly.
+func addGroupMember(msg protocol.Message) {
 	log.Printf("Adding member %s to group %s", msg.Content, msg.To)
 
 	groupsMux.Lock()
@@ -612,20 +1117,32 @@ func addGroupMember(msg Message) {
 		return
 	}
 
-	// Check if user is admin
-	if group.Admin != msg.From {
+	// Check if user may add members
+	if !roleAllows(groupRole(group, msg.From), PermAddMember) {
 		groupsMux.Unlock()
 		log.Printf("User %s is not authorized to add members", msg.From)
+		sendError(msg.From, fmt.Sprintf("You are not allowed to add members to %s", groupLabel(msg.To)))
+		return
+	}
+	if contains(group.Members, msg.Content) {
+		groupsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("%s is already a member of %s", msg.Content, groupLabel(msg.To)))
+		return
+	}
+	if !isBot(msg.Content) {
+		groupsMux.Unlock()
+		inviteToGroup(msg.From, msg.To, msg.Content)
 		return
 	}
 
 	// Add new member
 	group.Members = append(group.Members, msg.Content)
 	groupsMux.Unlock()
+	recordAudit(msg.From, protocol.ActionAddMember, msg.To, msg.Content, "")
 
 	// Notify group members
-	notification := Message{
-		Type:      TypeSystem,
+	notification := protocol.Message{
+		Type:      protocol.TypeSystem,
 		Content:   fmt.Sprintf("%s added %s to the group", msg.From, msg.Content),
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
@@ -637,7 +1154,7 @@ func addGroupMember(msg Message) {
 }
 
 // removeGroupMember removes a member from a group
-func removeGroupMember(msg Message) {
+func removeGroupMember(msg protocol.Message) {
 	log.Printf("Removing member %s from group %s", msg.Content, msg.To)
 
 	groupsMux.Lock()
@@ -648,10 +1165,23 @@ func removeGroupMember(msg Message) {
 		return
 	}
 
-	// Check if user is admin
-	if group.Admin != msg.From {
+	// Check if user may remove this member
+	actorRole, targetRole := groupRole(group, msg.From), groupRole(group, msg.Content)
+	if !roleAllows(actorRole, PermRemoveMember) {
 		groupsMux.Unlock()
 		log.Printf("User %s is not authorized to remove members", msg.From)
+		sendError(msg.From, fmt.Sprintf("You are not allowed to remove members from %s", groupLabel(msg.To)))
+		return
+	}
+	if targetRole == "" {
+		groupsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("%s is not a member of %s", msg.Content, groupLabel(msg.To)))
+		return
+	}
+	if roleRank[targetRole] >= roleRank[actorRole] {
+		groupsMux.Unlock()
+		log.Printf("User %s may not remove %s (%s) from group %s", msg.From, msg.Content, targetRole, msg.To)
+		sendError(msg.From, fmt.Sprintf("You can only remove members ranked below you from %s", groupLabel(msg.To)))
 		return
 	}
 
@@ -663,11 +1193,13 @@ func removeGroupMember(msg Message) {
 		}
 	}
 	group.Members = newMembers
+	delete(group.Roles, msg.Content)
 	groupsMux.Unlock()
+	recordAudit(msg.From, protocol.ActionKick, msg.To, msg.Content, "")
 
 	// Notify group members
-	notification := Message{
-		Type:      TypeSystem,
+	notification := protocol.Message{
+		Type:      protocol.TypeSystem,
 		Content:   fmt.Sprintf("%s removed %s from the group", msg.From, msg.Content),
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
@@ -679,7 +1211,7 @@ func removeGroupMember(msg Message) {
 }
 
 // leaveGroup allows a user to leave a group
-func leaveGroup(msg Message) {
+func leaveGroup(msg protocol.Message) {
 	log.Printf("User %s leaving group %s", msg.From, msg.To)
 
 	groupsMux.Lock()
@@ -698,24 +1230,48 @@ func leaveGroup(msg Message) {
 		}
 	}
 	group.Members = newMembers
+	delete(group.Roles, msg.From)
+
+	// If the owner left, hand the group to the highest-ranked member. Bots
+	// cannot own groups, so a group left with only bots is deleted as if it
+	// were empty.
+	newOwner := ""
+	if group.Admin == msg.From {
+		newOwner = nextOwner(group)
+	}
 
 	// If group is empty, delete it
-	if len(group.Members) == 0 {
+	if len(group.Members) == 0 || (group.Admin == msg.From && newOwner == "") {
+		reason := "the last member left"
+		if len(group.Members) > 0 {
+			reason = "only bots were left"
+		}
 		delete(groups, msg.To)
 		groupsMux.Unlock()
-		log.Printf("Group %s deleted as it's empty", msg.To)
+		log.Printf("Group %s deleted as %s", msg.To, reason)
+		recordAudit(msg.From, protocol.ActionLeaveGroup, msg.To, msg.From, "")
+		recordAudit(msg.From, protocol.ActionDeleteGroup, msg.To, "", reason)
+		deleteGroupWebhooks(msg.To)
+		deleteGroupInvitations(msg.To)
+		deleteGroupPostTimes(msg.To)
+		deleteGroupFilters(msg.To)
+		deleteGroupPolls(msg.To)
 	} else {
-		// If admin left, assign new admin
-		if group.Admin == msg.From {
-			group.Admin = group.Members[0]
-			log.Printf("New admin for group %s: %s", msg.To, group.Admin)
+		if newOwner != "" {
+			group.Admin = newOwner
+			setMemberRole(group, newOwner, protocol.RoleOwner)
+			log.Printf("New owner for group %s: %s", msg.To, newOwner)
 		}
 		groupsMux.Unlock()
+		recordAudit(msg.From, protocol.ActionLeaveGroup, msg.To, msg.From, "")
+		if newOwner != "" {
+			recordAudit(msg.From, protocol.ActionTransferOwnership, msg.To, newOwner, "the owner left")
+		}
 	}
 
 	// Notify group members
-	notification := Message{
-		Type:      TypeSystem,
+	notification := protocol.Message{
+		Type:      protocol.TypeSystem,
 		Content:   fmt.Sprintf("%s left the group", msg.From),
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
@@ -728,18 +1284,20 @@ func leaveGroup(msg Message) {
 
 // sendMessageHistory sends the message history to a client
 func sendMessageHistory(client *Client, chatType, chatID string) {
-	var history []Message
+	var history []protocol.Message
 
-	if chatType == "private" {
+	if chatType == protocol.TypePrivate {
 		history = getConversationHistory(client.Username, chatID)
-	} else if chatType == "group" {
-		history = getGroupHistory(chatID)
+	} else if chatType == protocol.TypeGroup {
+		history = groupHistoryFor(client.Username, chatID)
 	}
 
 	message := map[string]interface{}{
-		KeyType:      TypeHistory,
-		KeyContent:   history,
-		KeyTimestamp: time.Now().Format(time.RFC3339),
+		protocol.KeyType:      protocol.TypeHistory,
+		protocol.KeyChatType:  chatType,
+		protocol.KeyTo:        chatID,
+		protocol.KeyContent:   history,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
 	}
 
 	messageBytes, err := json.Marshal(message)
@@ -749,7 +1307,7 @@ func sendMessageHistory(client *Client, chatType, chatID string) {
 	}
 
 	select {
-	case client.send <- messageBytes:
+	case client.send <- outFrame{data: messageBytes}:
 		log.Printf("Message history sent to client: %s", client.Username)
 	default:
 		log.Printf("Failed to send message history to client: %s", client.Username)
@@ -898,13 +1456,17 @@ func sendUnreadCounts(username string) {
 	}
 	clientsMux.RUnlock()
 
-	// Get unread counts for groups
+	// Get unread counts and mention counts for groups
+	mentionCounts := make(map[string]int)
 	groupsMux.RLock()
-	for groupName, group := range groups {
+	for groupID, group := range groups {
 		if contains(group.Members, username) {
-			count := getUnreadCount(username, groupName)
+			count := getUnreadCount(username, groupID)
 			if count > 0 {
-				unreadCounts[groupName] = count
+				unreadCounts[groupID] = count
+			}
+			if mentioned := getMentionCount(username, groupID); mentioned > 0 {
+				mentionCounts[groupID] = mentioned
 			}
 		}
 	}
@@ -917,13 +1479,15 @@ func sendUnreadCounts(username string) {
 		return
 	}
 
-	// Send unread counts to user
-	message := Message{
-		Type:      TypeUnreadCount,
-		From:      "system",
-		To:        username,
-		Content:   string(countsJSON),
-		Timestamp: time.Now().Format(time.RFC3339),
+	// Send unread counts to user. Content keeps its original encoding for
+	// existing clients; mention counts travel alongside it.
+	message := map[string]interface{}{
+		protocol.KeyType:          protocol.TypeUnreadCount,
+		protocol.KeyFrom:          "system",
+		protocol.KeyTo:            username,
+		protocol.KeyContent:       string(countsJSON),
+		protocol.KeyMentionCounts: mentionCounts,
+		protocol.KeyTimestamp:     time.Now().Format(time.RFC3339),
 	}
 
 	messageBytes, err := json.Marshal(message)
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Special mentions
+const (
+	MentionAll  = "all"  // Every member of the group
+	MentionHere = "here" // Every member of the group who is online
+)
+
+// maxMentionResults caps the reply to a request_mentions message
+const maxMentionResults = 100
+
+// parseMentions returns the names mentioned as @name in content, lowercased
+// and without duplicates, in order of appearance
+func parseMentions(content string) []string {
+	var names []string
+	seen := make(map[string]bool)
+
+	runes := []rune(content)
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '@' {
+			continue
+		}
+		// Ignore the @ in e-mail addresses such as bob@example.com
+		if i > 0 && isNameChar(runes[i-1]) {
+			continue
+		}
+
+		end := i + 1
+		for end < len(runes) && isNameChar(runes[end]) {
+			end++
+		}
+		// Trailing dots end the sentence rather than the name
+		for end > i+1 && runes[end-1] == '.' {
+			end--
+		}
+		if end == i+1 {
+			continue
+		}
+
+		name := strings.ToLower(string(runes[i+1 : end]))
+		if !seen[name] {
+			seen[name] = true
+			names = append(names, name)
+		}
+		i = end - 1
+	}
+	return names
+}
+
+// resolveMentions returns the group members mentioned in a group message,
+// expanding @all and @here. Names that are not members are ignored and the
+// sender is never included.
+func resolveMentions(msg protocol.Message) []string {
+	names := parseMentions(msg.Content)
+	if len(names) == 0 {
+		return nil
+	}
+
+	groupsMux.RLock()
+	group, exists := groups[msg.To]
+	var members []string
+	if exists {
+		members = append(members, group.Members...)
+	}
+	groupsMux.RUnlock()
+	if !exists {
+		return nil
+	}
+
+	mentioned := make(map[string]bool)
+	for _, name := range names {
+		switch name {
+		case MentionAll:
+			for _, member := range members {
+				mentioned[member] = true
+			}
+		case MentionHere:
+			for _, member := range members {
+				if isOnline(member) {
+					mentioned[member] = true
+				}
+			}
+		default:
+			for _, member := range members {
+				if strings.ToLower(member) == name {
+					mentioned[member] = true
+				}
+			}
+		}
+	}
+	delete(mentioned, msg.From)
+
+	// Keep the group's member order so the result is stable
+	result := make([]string, 0, len(mentioned))
+	for _, member := range members {
+		if mentioned[member] {
+			result = append(result, member)
+			delete(mentioned, member)
+		}
+	}
+	return result
+}
+
+// notifyMentions sends a targeted mention notification to everyone
+// mentioned in a group message
+func notifyMentions(msg protocol.Message) {
+	if len(msg.Mentions) == 0 {
+		return
+	}
+
+	notification := msg
+	notification.Type = protocol.TypeMention
+	msgBytes, err := json.Marshal(notification)
+	if err != nil {
+		log.Printf("Error marshaling mention notification: %v", err)
+		return
+	}
+
+	for _, username := range msg.Mentions {
+		sendToUser(username, msgBytes)
+	}
+}
+
+// getMentionCount returns the number of unread messages in a group that
+// mention the user
+func getMentionCount(username, groupID string) int {
+	lastSeenMux.RLock()
+	lastSeen, seen := lastSeenTimestamps[username][groupID]
+	lastSeenMux.RUnlock()
+
+	var lastSeenTime time.Time
+	if seen {
+		var err error
+		if lastSeenTime, err = time.Parse(time.RFC3339, lastSeen); err != nil {
+			return 0
+		}
+	}
+
+	msgMux.RLock()
+	defer msgMux.RUnlock()
+
+	count := 0
+	for _, msg := range groupMessages[groupID] {
+		if !contains(msg.Mentions, username) {
+			continue
+		}
+		if seen {
+			msgTime, err := time.Parse(time.RFC3339, msg.Timestamp)
+			if err != nil || !msgTime.After(lastSeenTime) {
+				continue
+			}
+		}
+		count++
+	}
+	return count
+}
+
+// getMentionedMessages returns the newest group messages that mention the
+// user, limited to groups the user still belongs to
+func getMentionedMessages(username string) []protocol.Message {
+	groupsMux.RLock()
+	var memberOf []string
+	for groupID, group := range groups {
+		if contains(group.Members, username) {
+			memberOf = append(memberOf, groupID)
+		}
+	}
+	groupsMux.RUnlock()
+
+	msgMux.RLock()
+	var mentioned []protocol.Message
+	for _, groupID := range memberOf {
+		for _, msg := range groupMessages[groupID] {
+			if contains(msg.Mentions, username) {
+				mentioned = append(mentioned, msg)
+			}
+		}
+	}
+	msgMux.RUnlock()
+
+	// Newest first; timestamps have second precision, so ties keep the
+	// reverse of storage order
+	for i, j := 0, len(mentioned)-1; i < j; i, j = i+1, j-1 {
+		mentioned[i], mentioned[j] = mentioned[j], mentioned[i]
+	}
+	sort.SliceStable(mentioned, func(i, j int) bool {
+		return mentioned[i].Timestamp > mentioned[j].Timestamp
+	})
+	if len(mentioned) > maxMentionResults {
+		mentioned = mentioned[:maxMentionResults]
+	}
+	return mentioned
+}
+
+// sendMentionedMessages answers a request_mentions message
+func sendMentionedMessages(client *Client) {
+	results := getMentionedMessages(client.Username)
+	if results == nil {
+		results = []protocol.Message{}
+	}
+
+	message := map[string]interface{}{
+		protocol.KeyType:      protocol.TypeMentions,
+		protocol.KeyResults:   results,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	}
+
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling mentions for client %s: %v", client.Username, err)
+		return
+	}
+
+	log.Printf("Sending %d mentions to %s", len(results), client.Username)
+	sendToUser(client.Username, messageBytes)
+}
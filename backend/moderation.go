@@ -0,0 +1,850 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+	"github.com/gorilla/websocket"
+)
+
+// systemReporter files the reports of messages flagged by content filters
+const systemReporter = "system"
+
+// Moderation limits
+const (
+	maxMuteDuration  = 30 * 24 * time.Hour
+	maxAuditInMemory = 1000 // Latest audit entries kept for request_audit_log
+	maxAuditReply    = 200
+)
+
+var (
+	// moderationDir is where bans, reports and the audit log are persisted
+	moderationDir = filepath.Join("data", "moderation")
+
+	moderationStore *ModerationStore
+
+	// serverModerators may ban users and handle every report. They are set
+	// with CHATSYNC_MODERATORS.
+	serverModerators = make(map[string]bool)
+	bans             = make(map[string]*protocol.Ban) // key: username
+	reports          []*protocol.Report               // Oldest first
+	auditLog         []protocol.AuditEntry            // Oldest first
+	moderationMux    sync.RWMutex
+)
+
+// ModerationStore persists bans and reports as JSON files and the audit log
+// as JSON lines, one entry per line
+type ModerationStore struct {
+	dir string
+
+	auditMu sync.Mutex // Guards audit, so appends need not hold moderationMux
+	audit   *os.File   // Opened by the first append and kept open
+}
+
+// NewModerationStore creates the moderation directory if needed and returns
+// the store
+func NewModerationStore(dir string) (*ModerationStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating moderation directory: %w", err)
+	}
+	return &ModerationStore{dir: dir}, nil
+}
+
+// SaveBans replaces the stored bans
+func (s *ModerationStore) SaveBans(bans []protocol.Ban) error {
+	data, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, "bans.json"), data)
+}
+
+// SaveReports replaces the stored reports
+func (s *ModerationStore) SaveReports(reports []protocol.Report) error {
+	data, err := json.MarshalIndent(reports, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, "reports.json"), data)
+}
+
+// AppendAudit adds an entry to the audit log
+func (s *ModerationStore) AppendAudit(entry protocol.AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if s.audit == nil {
+		f, err := os.OpenFile(s.AuditPath(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		s.audit = f
+	}
+	_, err = s.audit.Write(append(data, '\n'))
+	return err
+}
+
+// AuditPath returns the path of the audit log
+func (s *ModerationStore) AuditPath() string {
+	return filepath.Join(s.dir, "audit.jsonl")
+}
+
+// Load reads the stored bans and reports and the latest audit entries,
+// leaving out session events
+func (s *ModerationStore) Load() ([]protocol.Ban, []protocol.Report, []protocol.AuditEntry, error) {
+	var loadedBans []protocol.Ban
+	if err := readJSONFile(filepath.Join(s.dir, "bans.json"), &loadedBans); err != nil {
+		return nil, nil, nil, err
+	}
+	var loadedReports []protocol.Report
+	if err := readJSONFile(filepath.Join(s.dir, "reports.json"), &loadedReports); err != nil {
+		return nil, nil, nil, err
+	}
+
+	var entries []protocol.AuditEntry
+	err := s.ScanAudit(func(entry protocol.AuditEntry) {
+		if isSessionAction(entry.Action) {
+			return
+		}
+		entries = append(entries, entry)
+		if len(entries) > maxAuditInMemory {
+			entries = entries[1:]
+		}
+	})
+	return loadedBans, loadedReports, entries, err
+}
+
+// ScanAudit calls fn with every entry of the audit log, oldest first
+func (s *ModerationStore) ScanAudit(fn func(entry protocol.AuditEntry)) error {
+	f, err := os.Open(s.AuditPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry protocol.AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Printf("Skipping unreadable audit entry: %v", err)
+			continue
+		}
+		fn(entry)
+	}
+	return scanner.Err()
+}
+
+// readJSONFile decodes a JSON file into v, leaving v alone if the file does
+// not exist
+func readJSONFile(path string, v interface{}) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// loadModeration fills the bans, reports and audit log from the store
+func loadModeration() error {
+	loadedBans, loadedReports, entries, err := moderationStore.Load()
+	if err != nil {
+		return err
+	}
+
+	moderationMux.Lock()
+	defer moderationMux.Unlock()
+	bans = make(map[string]*protocol.Ban, len(loadedBans))
+	for i := range loadedBans {
+		bans[loadedBans[i].User] = &loadedBans[i]
+	}
+	reports = make([]*protocol.Report, 0, len(loadedReports))
+	for i := range loadedReports {
+		reports = append(reports, &loadedReports[i])
+	}
+	auditLog = entries
+	log.Printf("Loaded %d bans, %d reports and %d audit entries", len(loadedBans), len(loadedReports), len(entries))
+	return nil
+}
+
+// setServerModerators parses a comma separated list of usernames
+func setServerModerators(list string) {
+	moderationMux.Lock()
+	defer moderationMux.Unlock()
+
+	serverModerators = make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			serverModerators[name] = true
+		}
+	}
+}
+
+// isServerModerator reports whether username may moderate the whole server
+func isServerModerator(username string) bool {
+	moderationMux.RLock()
+	defer moderationMux.RUnlock()
+
+	return serverModerators[username]
+}
+
+// isSessionAction reports whether an audit action is a login, logout or
+// disconnect, which are only written to the audit log file
+func isSessionAction(action string) bool {
+	switch action {
+	case protocol.ActionLogin, protocol.ActionLoginDenied, protocol.ActionLogout, protocol.ActionDisconnect:
+		return true
+	}
+	return false
+}
+
+// connectionIP returns the address username is connected from, or ""
+func connectionIP(username string) string {
+	clientsMux.RLock()
+	defer clientsMux.RUnlock()
+
+	if client, exists := clients[username]; exists {
+		return client.ip
+	}
+	return ""
+}
+
+// recordAudit appends an action to the audit log. The source address is
+// that of the actor's connection.
+func recordAudit(actor, action, groupID, target, reason string) {
+	writeAudit(protocol.AuditEntry{
+		Actor:  actor,
+		Action: action,
+		Group:  groupID,
+		Target: target,
+		Reason: reason,
+		IP:     connectionIP(actor),
+	})
+}
+
+// recordSession appends a session event about username, coming from ip, to
+// the audit log. The server is the actor of disconnects, the user of the
+// other events.
+func recordSession(action, username, ip, reason string) {
+	actor := username
+	if action == protocol.ActionDisconnect {
+		actor = "system"
+	}
+	writeAudit(protocol.AuditEntry{
+		Actor:  actor,
+		Action: action,
+		Target: username,
+		Reason: reason,
+		IP:     ip,
+	})
+}
+
+// writeAudit stamps an audit entry and appends it to the log. The file is
+// written without holding moderationMux, which every connection takes to
+// check for bans.
+func writeAudit(entry protocol.AuditEntry) {
+	entry.ID = generateID(8)
+	entry.Time = time.Now().Format(time.RFC3339)
+
+	if !isSessionAction(entry.Action) {
+		moderationMux.Lock()
+		auditLog = append(auditLog, entry)
+		if len(auditLog) > maxAuditInMemory {
+			auditLog = auditLog[len(auditLog)-maxAuditInMemory:]
+		}
+		moderationMux.Unlock()
+	}
+	if moderationStore != nil {
+		if err := moderationStore.AppendAudit(entry); err != nil {
+			log.Printf("Error writing audit entry %s: %v", entry.ID, err)
+		}
+	}
+}
+
+// parseModerationDuration reads durations such as "90s", "10m", "2h" or
+// "7d". Empty, "0" and "permanent" mean no expiry and return zero.
+func parseModerationDuration(text string) (time.Duration, error) {
+	switch text {
+	case "", "0", "permanent":
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(text, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid duration %q", text)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(text)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", text)
+	}
+	return d, nil
+}
+
+// parseModerationContent splits "USER,DURATION,REASON" content. The duration
+// and reason are optional, and the reason may contain commas.
+func parseModerationContent(content string) (target string, duration time.Duration, reason string, err error) {
+	target, rest, _ := strings.Cut(content, ",")
+	durationText, reason, _ := strings.Cut(rest, ",")
+	target, reason = strings.TrimSpace(target), strings.TrimSpace(reason)
+	if target == "" {
+		return "", 0, "", errors.New("content must be USER,DURATION,REASON")
+	}
+	duration, err = parseModerationDuration(strings.TrimSpace(durationText))
+	return target, duration, reason, err
+}
+
+// activeBan returns the ban keeping username off the server, if any
+func activeBan(username string) (protocol.Ban, bool) {
+	moderationMux.RLock()
+	defer moderationMux.RUnlock()
+
+	ban, exists := bans[username]
+	if !exists {
+		return protocol.Ban{}, false
+	}
+	if ban.ExpiresAt != "" {
+		if expires, err := time.Parse(time.RFC3339, ban.ExpiresAt); err == nil && time.Now().After(expires) {
+			return protocol.Ban{}, false
+		}
+	}
+	return *ban, true
+}
+
+// refuseBanned answers an HTTP API request of a banned user with 403
+// Forbidden. It reports whether the user is banned.
+func refuseBanned(w http.ResponseWriter, r *http.Request, username string) bool {
+	ban, banned := activeBan(username)
+	if !banned {
+		return false
+	}
+	log.Printf("Refused %s %s of banned user %s", r.Method, r.URL.Path, username)
+	http.Error(w, banDescription(ban), http.StatusForbidden)
+	return true
+}
+
+// banDescription explains a ban to the banned user
+func banDescription(ban protocol.Ban) string {
+	text := "You are banned from this server"
+	if ban.ExpiresAt != "" {
+		text += " until " + ban.ExpiresAt
+	}
+	if ban.Reason != "" {
+		text += ": " + ban.Reason
+	}
+	return text
+}
+
+// saveBans persists the bans, dropping expired ones. The caller must hold
+// moderationMux.
+func saveBans() {
+	now := time.Now()
+	saved := make([]protocol.Ban, 0, len(bans))
+	for user, ban := range bans {
+		if expires, err := time.Parse(time.RFC3339, ban.ExpiresAt); err == nil && now.After(expires) {
+			delete(bans, user)
+			continue
+		}
+		saved = append(saved, *ban)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].User < saved[j].User })
+
+	if moderationStore != nil {
+		if err := moderationStore.SaveBans(saved); err != nil {
+			log.Printf("Error saving bans: %v", err)
+		}
+	}
+}
+
+// saveReports persists the reports. The caller must hold moderationMux.
+func saveReports() {
+	saved := make([]protocol.Report, 0, len(reports))
+	for _, report := range reports {
+		saved = append(saved, *report)
+	}
+	if moderationStore != nil {
+		if err := moderationStore.SaveReports(saved); err != nil {
+			log.Printf("Error saving reports: %v", err)
+		}
+	}
+}
+
+// disconnectUser closes the connections of a user, companions included,
+// with a policy violation
+func disconnectUser(username, reason string) {
+	clientsMux.RLock()
+	client, exists := clients[username]
+	clientsMux.RUnlock()
+
+	for _, companion := range companionsOf(username) {
+		companion.conn.closeWith(websocket.ClosePolicyViolation, reason)
+		companion.conn.Close()
+	}
+	if !exists {
+		return
+	}
+
+	client.session.end()
+	client.conn.closeWith(websocket.ClosePolicyViolation, reason)
+	client.conn.Close()
+	log.Printf("Disconnected %s: %s", username, reason)
+	recordSession(protocol.ActionDisconnect, username, client.ip, reason)
+}
+
+// banUser keeps a user off the server. Only server moderators may ban. The
+// content is "USER,DURATION,REASON"; without a duration the ban is
+// permanent.
+func banUser(msg protocol.Message) {
+	if !isServerModerator(msg.From) {
+		sendError(msg.From, "Only server moderators can ban users")
+		return
+	}
+	target, duration, reason, err := parseModerationContent(msg.Content)
+	if err != nil {
+		sendError(msg.From, fmt.Sprintf("Invalid ban: %v", err))
+		return
+	}
+	if target == msg.From || isServerModerator(target) || isBot(target) {
+		sendError(msg.From, fmt.Sprintf("%s cannot be banned", target))
+		return
+	}
+
+	now := time.Now()
+	ban := protocol.Ban{
+		User:      target,
+		Reason:    reason,
+		By:        msg.From,
+		CreatedAt: now.Format(time.RFC3339),
+	}
+	if duration > 0 {
+		ban.ExpiresAt = now.Add(duration).Format(time.RFC3339)
+	}
+
+	storeBan(ban)
+	publishBan(ban)
+
+	log.Printf("User %s banned %s until %q: %s", msg.From, target, ban.ExpiresAt, reason)
+	recordAudit(msg.From, protocol.ActionBan, "", target, reason)
+	disconnectUser(target, "banned")
+
+	until := "permanently"
+	if ban.ExpiresAt != "" {
+		until = "until " + ban.ExpiresAt
+	}
+	sendCommandReply(msg.From, "system", fmt.Sprintf("Banned %s %s", target, until))
+}
+
+// storeBan records and persists a ban
+func storeBan(ban protocol.Ban) {
+	moderationMux.Lock()
+	defer moderationMux.Unlock()
+	bans[ban.User] = &ban
+	saveBans()
+}
+
+// removeBan lifts the ban of a user. It reports whether they were banned.
+func removeBan(username string) bool {
+	moderationMux.Lock()
+	defer moderationMux.Unlock()
+	_, banned := bans[username]
+	delete(bans, username)
+	saveBans()
+	return banned
+}
+
+// unbanUser lifts the ban of the user named in the content
+func unbanUser(msg protocol.Message) {
+	if !isServerModerator(msg.From) {
+		sendError(msg.From, "Only server moderators can unban users")
+		return
+	}
+	target := strings.TrimSpace(msg.Content)
+
+	if !removeBan(target) {
+		sendError(msg.From, fmt.Sprintf("%s is not banned", target))
+		return
+	}
+	publishUnban(target)
+	log.Printf("User %s unbanned %s", msg.From, target)
+	recordAudit(msg.From, protocol.ActionUnban, "", target, "")
+	sendCommandReply(msg.From, "system", fmt.Sprintf("Unbanned %s", target))
+}
+
+// muteMember keeps a member from posting in a group for a while. msg.To is
+// the group and the content "USER,DURATION,REASON". Members who may mute can
+// only mute members ranked below them.
+func muteMember(msg protocol.Message) {
+	target, duration, reason, err := parseModerationContent(msg.Content)
+	if err == nil && (duration <= 0 || duration > maxMuteDuration) {
+		err = fmt.Errorf("mutes must last between 1s and %s", maxMuteDuration)
+	}
+	if err != nil {
+		sendError(msg.From, fmt.Sprintf("Invalid mute: %v", err))
+		return
+	}
+
+	groupsMux.Lock()
+	group, exists := groups[msg.To]
+	if !exists {
+		groupsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("Group %s not found", msg.To))
+		return
+	}
+	name := group.Name
+	actorRole, targetRole := groupRole(group, msg.From), groupRole(group, target)
+	switch {
+	case !roleAllows(actorRole, PermMuteMembers):
+		groupsMux.Unlock()
+		log.Printf("User %s is not authorized to mute members of group %s", msg.From, msg.To)
+		sendError(msg.From, fmt.Sprintf("You are not allowed to mute members of %s", name))
+		return
+	case targetRole == "":
+		groupsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("%s is not a member of %s", target, name))
+		return
+	case roleRank[targetRole] >= roleRank[actorRole]:
+		groupsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("You can only mute members ranked below you in %s", name))
+		return
+	}
+
+	until := time.Now().Add(duration).Format(time.RFC3339)
+	if group.Muted == nil {
+		group.Muted = make(map[string]string)
+	}
+	group.Muted[target] = until
+	groupsMux.Unlock()
+
+	time.AfterFunc(duration, func() { expireMute(msg.To, target, until) })
+
+	log.Printf("User %s muted %s in group %s until %s", msg.From, target, msg.To, until)
+	recordAudit(msg.From, protocol.ActionMute, msg.To, target, reason)
+	notice := fmt.Sprintf("%s muted %s for %s", msg.From, target, duration)
+	if reason != "" {
+		notice += ": " + reason
+	}
+	sendGroupNotice(msg.To, notice)
+	sendGroupList()
+}
+
+// unmuteMember lifts the mute of the member named in the content
+func unmuteMember(msg protocol.Message) {
+	target := strings.TrimSpace(msg.Content)
+
+	groupsMux.Lock()
+	group, exists := groups[msg.To]
+	if !exists {
+		groupsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("Group %s not found", msg.To))
+		return
+	}
+	name := group.Name
+	if !roleAllows(groupRole(group, msg.From), PermMuteMembers) {
+		groupsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("You are not allowed to unmute members of %s", name))
+		return
+	}
+	if _, muted := group.Muted[target]; !muted {
+		groupsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("%s is not muted in %s", target, name))
+		return
+	}
+	delete(group.Muted, target)
+	groupsMux.Unlock()
+
+	log.Printf("User %s unmuted %s in group %s", msg.From, target, msg.To)
+	recordAudit(msg.From, protocol.ActionUnmute, msg.To, target, "")
+	sendGroupNotice(msg.To, fmt.Sprintf("%s unmuted %s", msg.From, target))
+	sendGroupList()
+}
+
+// expireMute lifts a mute once it is over, unless it has been replaced
+func expireMute(groupID, username, until string) {
+	groupsMux.Lock()
+	group, exists := groups[groupID]
+	if !exists || group.Muted[username] != until {
+		groupsMux.Unlock()
+		return
+	}
+	delete(group.Muted, username)
+	groupsMux.Unlock()
+
+	log.Printf("Mute of %s in group %s expired", username, groupID)
+	sendGroupList()
+}
+
+// checkMute returns why a group message is rejected if its sender is
+// muted, or ""
+func checkMute(msg protocol.Message) string {
+	groupsMux.RLock()
+	defer groupsMux.RUnlock()
+
+	group, exists := groups[msg.To]
+	if !exists {
+		return ""
+	}
+	until, muted := group.Muted[msg.From]
+	if !muted {
+		return ""
+	}
+	expires, err := time.Parse(time.RFC3339, until)
+	if err != nil || !time.Now().Before(expires) {
+		return ""
+	}
+	return fmt.Sprintf("You are muted in %s for another %s", group.Name, time.Until(expires).Round(time.Second))
+}
+
+// reportModerators returns who handles a report: the members of its group
+// who may mute, and the server moderators
+func reportModerators(report protocol.Report) []string {
+	var moderators []string
+	if report.Group != "" {
+		groupsMux.RLock()
+		if group, exists := groups[report.Group]; exists {
+			for _, member := range group.Members {
+				if roleAllows(groupRole(group, member), PermMuteMembers) && !isBot(member) {
+					moderators = append(moderators, member)
+				}
+			}
+		}
+		groupsMux.RUnlock()
+	}
+
+	moderationMux.RLock()
+	for name := range serverModerators {
+		if !contains(moderators, name) {
+			moderators = append(moderators, name)
+		}
+	}
+	moderationMux.RUnlock()
+	return moderators
+}
+
+// canHandleReport reports whether username may see and handle a report
+func canHandleReport(username string, report protocol.Report) bool {
+	return isServerModerator(username) ||
+		(report.Group != "" && hasGroupPermission(report.Group, username, PermMuteMembers))
+}
+
+// sendReport sends a report to its reporter and moderators
+func sendReport(report protocol.Report) {
+	message := map[string]interface{}{
+		protocol.KeyType:      protocol.TypeReport,
+		protocol.KeyReport:    report,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	}
+	msgBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling report %s: %v", report.ID, err)
+		return
+	}
+
+	if report.Reporter != systemReporter {
+		sendToUser(report.Reporter, msgBytes)
+	}
+	for _, moderator := range reportModerators(report) {
+		if moderator != report.Reporter {
+			sendToUser(moderator, msgBytes)
+		}
+	}
+}
+
+// reportMessage files a report about a message. msg.To is the group or the
+// other user of a private chat, and the content "MESSAGE_ID,REASON".
+func reportMessage(msg protocol.Message) {
+	id, reason, _ := strings.Cut(msg.Content, ",")
+	id, reason = strings.TrimSpace(id), strings.TrimSpace(reason)
+
+	report := protocol.Report{
+		Reporter: msg.From,
+		ChatType: protocol.TypePrivate,
+		Reason:   reason,
+		Status:   protocol.StatusPending,
+	}
+	var target protocol.Message
+	var found bool
+	if isGroupMember(msg.To, msg.From) {
+		report.ChatType, report.Group, report.GroupName = protocol.TypeGroup, msg.To, groupLabel(msg.To)
+		target, found = findMessage(groupMessages, msg.To, id)
+	} else {
+		target, found = findMessage(privateMessages, getConversationKey(msg.From, msg.To), id)
+	}
+	if !found {
+		sendError(msg.From, fmt.Sprintf("Message %s not found", id))
+		return
+	}
+	if target.From == msg.From {
+		sendError(msg.From, "You cannot report your own messages")
+		return
+	}
+	report.Message = target
+
+	moderationMux.RLock()
+	for _, existing := range reports {
+		if existing.Reporter == msg.From && existing.Message.ID == id && existing.Status == protocol.StatusPending {
+			moderationMux.RUnlock()
+			sendError(msg.From, "You already reported this message")
+			return
+		}
+	}
+	moderationMux.RUnlock()
+
+	log.Printf("User %s reported message %s from %s", msg.From, id, target.From)
+	fileReport(report)
+}
+
+// fileReport queues a new report and tells the moderators
+func fileReport(report protocol.Report) {
+	report.ID = generateID(8)
+	report.CreatedAt = time.Now().Format(time.RFC3339)
+
+	moderationMux.Lock()
+	reports = append(reports, &report)
+	saveReports()
+	moderationMux.Unlock()
+
+	recordAudit(report.Reporter, protocol.ActionReport, report.Group, report.Message.ID, report.Reason)
+	sendReport(report)
+}
+
+// handleReport resolves or dismisses a pending report. The content is
+// "REPORT_ID,NOTE".
+func handleReport(msg protocol.Message, resolve bool) {
+	id, note, _ := strings.Cut(msg.Content, ",")
+	id, note = strings.TrimSpace(id), strings.TrimSpace(note)
+
+	moderationMux.RLock()
+	var report *protocol.Report
+	for _, existing := range reports {
+		if existing.ID == id {
+			report = existing
+			break
+		}
+	}
+	var snapshot protocol.Report
+	if report != nil {
+		snapshot = *report
+	}
+	moderationMux.RUnlock()
+
+	if report == nil || !canHandleReport(msg.From, snapshot) {
+		sendError(msg.From, fmt.Sprintf("Report %s not found", id))
+		return
+	}
+
+	status, action := protocol.StatusDismissed, protocol.ActionDismissReport
+	if resolve {
+		status, action = protocol.StatusResolved, protocol.ActionResolveReport
+	}
+
+	moderationMux.Lock()
+	if report.Status != protocol.StatusPending {
+		moderationMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("Report %s was already %s by %s", id, report.Status, report.HandledBy))
+		return
+	}
+	report.Status = status
+	report.HandledBy = msg.From
+	report.Note = note
+	report.HandledAt = time.Now().Format(time.RFC3339)
+	snapshot = *report
+	saveReports()
+	moderationMux.Unlock()
+
+	log.Printf("User %s %s report %s", msg.From, status, id)
+	recordAudit(msg.From, action, snapshot.Group, id, note)
+	sendReport(snapshot)
+}
+
+// sendReports answers a list_reports message with the reports the user
+// filed or may handle, newest first. A status in the content filters them.
+func sendReports(client *Client, status string) {
+	moderationMux.RLock()
+	all := make([]protocol.Report, 0, len(reports))
+	for i := len(reports) - 1; i >= 0; i-- {
+		if status == "" || reports[i].Status == status {
+			all = append(all, *reports[i])
+		}
+	}
+	moderationMux.RUnlock()
+
+	visible := make([]protocol.Report, 0)
+	for _, report := range all {
+		if report.Reporter == client.Username || canHandleReport(client.Username, report) {
+			visible = append(visible, report)
+		}
+	}
+
+	message := map[string]interface{}{
+		protocol.KeyType:      protocol.TypeReports,
+		protocol.KeyReports:   visible,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	}
+	msgBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling reports for client %s: %v", client.Username, err)
+		return
+	}
+	sendToUser(client.Username, msgBytes)
+}
+
+// sendAuditLog answers a request_audit_log message with the latest audit
+// entries, newest first: those of a group for members who may mute there,
+// or all of them for server moderators when no group is given
+func sendAuditLog(client *Client, groupID string) {
+	allowed := isServerModerator(client.Username)
+	if groupID != "" && !allowed {
+		allowed = hasGroupPermission(groupID, client.Username, PermMuteMembers)
+	}
+	if !allowed {
+		sendError(client.Username, "You are not allowed to read this audit log")
+		return
+	}
+
+	moderationMux.RLock()
+	entries := make([]protocol.AuditEntry, 0)
+	for i := len(auditLog) - 1; i >= 0 && len(entries) < maxAuditReply; i-- {
+		if groupID == "" || auditLog[i].Group == groupID {
+			entry := auditLog[i]
+			entry.IP = "" // Addresses are for server admins only
+			entries = append(entries, entry)
+		}
+	}
+	moderationMux.RUnlock()
+
+	message := map[string]interface{}{
+		protocol.KeyType:      protocol.TypeAuditLog,
+		protocol.KeyTo:        groupID,
+		protocol.KeyAuditLog:  entries,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	}
+	msgBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling audit log for client %s: %v", client.Username, err)
+		return
+	}
+	sendToUser(client.Username, msgBytes)
+}
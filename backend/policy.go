@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Posting policy limits
+const (
+	maxSlowModeSeconds     = 6 * 60 * 60
+	maxMessageLengthPolicy = 65536
+)
+
+var (
+	// lastPosts records when each member last posted, per group, for slow
+	// mode
+	lastPosts    = make(map[string]map[string]time.Time)
+	lastPostsMux sync.Mutex
+)
+
+// validatePolicyUpdate returns the problems with the posting policy fields
+// of an update
+func validatePolicyUpdate(update protocol.GroupUpdate) []string {
+	var problems []string
+	if v := update.SlowModeSeconds; v != nil && (*v < 0 || *v > maxSlowModeSeconds) {
+		problems = append(problems, fmt.Sprintf("Slow mode must be between 0 and %d seconds", maxSlowModeSeconds))
+	}
+	if v := update.MaxMessageLength; v != nil && (*v < 0 || *v > maxMessageLengthPolicy) {
+		problems = append(problems, fmt.Sprintf("The maximum message length must be between 0 and %d", maxMessageLengthPolicy))
+	}
+	return problems
+}
+
+// applyPolicyUpdate changes the posting policy of a group and returns a
+// notice per change. The caller must hold groupsMux.
+func applyPolicyUpdate(group *protocol.Group, update protocol.GroupUpdate, by string) []string {
+	var notices []string
+	if v := update.AnnouncementOnly; v != nil && *v != group.AnnouncementOnly {
+		group.AnnouncementOnly = *v
+		if *v {
+			notices = append(notices, fmt.Sprintf("%s turned on announcement mode; only admins can post", by))
+		} else {
+			notices = append(notices, fmt.Sprintf("%s turned off announcement mode", by))
+		}
+	}
+	if v := update.SlowModeSeconds; v != nil && *v != group.SlowModeSeconds {
+		group.SlowModeSeconds = *v
+		if *v > 0 {
+			notices = append(notices, fmt.Sprintf("%s turned on slow mode: one message every %s", by, time.Duration(*v)*time.Second))
+		} else {
+			notices = append(notices, fmt.Sprintf("%s turned off slow mode", by))
+		}
+	}
+	if v := update.MaxMessageLength; v != nil && *v != group.MaxMessageLength {
+		group.MaxMessageLength = *v
+		if *v > 0 {
+			notices = append(notices, fmt.Sprintf("%s limited messages to %d characters", by, *v))
+		} else {
+			notices = append(notices, fmt.Sprintf("%s removed the message length limit", by))
+		}
+	}
+	return notices
+}
+
+// checkPostingPolicy enforces the posting policy of a group on a message
+// from one of its members and returns why it is rejected, or "" if it may
+// be posted. Admins are exempt from announcement mode, and members who may
+// delete messages from slow mode.
+func checkPostingPolicy(msg protocol.Message) string {
+	groupsMux.RLock()
+	group, exists := groups[msg.To]
+	if !exists {
+		groupsMux.RUnlock()
+		return ""
+	}
+	role := groupRole(group, msg.From)
+	name := group.Name
+	announcementOnly := group.AnnouncementOnly
+	slowMode := time.Duration(group.SlowModeSeconds) * time.Second
+	maxLength := group.MaxMessageLength
+	groupsMux.RUnlock()
+
+	if announcementOnly && !isAdminRole(role) {
+		return fmt.Sprintf("Only admins can post in %s", name)
+	}
+	if length := utf8.RuneCountInString(msg.Content); maxLength > 0 && length > maxLength {
+		return fmt.Sprintf("Messages in %s can be at most %d characters (yours has %d)", name, maxLength, length)
+	}
+	if slowMode <= 0 || roleAllows(role, PermDeleteMessages) {
+		return ""
+	}
+
+	lastPostsMux.Lock()
+	defer lastPostsMux.Unlock()
+
+	if last, posted := lastPosts[msg.To][msg.From]; posted {
+		if wait := time.Until(last.Add(slowMode)); wait > 0 {
+			return fmt.Sprintf("Slow mode is on in %s; you can post again in %s", name, wait.Round(time.Second))
+		}
+	}
+	return ""
+}
+
+// recordPost starts the slow mode interval of the sender of a group
+// message. It is called once the message went through, so messages that
+// checks further on reject do not count.
+func recordPost(msg protocol.Message) {
+	groupsMux.RLock()
+	group, exists := groups[msg.To]
+	throttled := exists && group.SlowModeSeconds > 0 && !roleAllows(groupRole(group, msg.From), PermDeleteMessages)
+	groupsMux.RUnlock()
+	if !throttled {
+		return
+	}
+
+	lastPostsMux.Lock()
+	defer lastPostsMux.Unlock()
+
+	if lastPosts[msg.To] == nil {
+		lastPosts[msg.To] = make(map[string]time.Time)
+	}
+	lastPosts[msg.To][msg.From] = time.Now()
+}
+
+// deleteGroupPostTimes forgets the slow mode state of a deleted group
+func deleteGroupPostTimes(groupID string) {
+	lastPostsMux.Lock()
+	defer lastPostsMux.Unlock()
+
+	delete(lastPosts, groupID)
+	log.Printf("Cleared slow mode state of group %s", groupID)
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+var (
+	// profileDir is where user profiles are persisted
+	profileDir = filepath.Join("data", "profiles")
+
+	profileStore *ProfileStore
+
+	profiles    = make(map[string]*protocol.UserProfile) // key: username
+	profilesMux sync.RWMutex
+)
+
+// ProfileStore persists user profiles as one JSON file per user
+type ProfileStore struct {
+	dir string
+}
+
+// NewProfileStore creates the profile directory if needed and returns the
+// store
+func NewProfileStore(dir string) (*ProfileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating profile directory: %w", err)
+	}
+	return &ProfileStore{dir: dir}, nil
+}
+
+// path names profile files by the hex of the username, which may contain
+// characters that are not safe in file names
+func (s *ProfileStore) path(username string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(username))+".json")
+}
+
+// Save writes a profile, replacing the previous version atomically
+func (s *ProfileStore) Save(profile protocol.UserProfile) error {
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(profile.Username), data)
+}
+
+// writeFileAtomic replaces the file at path with data, so readers never see
+// a partial write
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// LoadAll reads every stored profile
+func (s *ProfileStore) LoadAll() ([]protocol.UserProfile, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var loaded []protocol.UserProfile
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var profile protocol.UserProfile
+		if err := json.Unmarshal(data, &profile); err != nil {
+			log.Printf("Skipping unreadable profile %s: %v", path, err)
+			continue
+		}
+		loaded = append(loaded, profile)
+	}
+	return loaded, nil
+}
+
+// loadProfiles fills the profile cache from the store
+func loadProfiles() error {
+	loaded, err := profileStore.LoadAll()
+	if err != nil {
+		return err
+	}
+
+	profilesMux.Lock()
+	defer profilesMux.Unlock()
+	for i := range loaded {
+		profiles[loaded[i].Username] = &loaded[i]
+	}
+	log.Printf("Loaded %d user profiles", len(loaded))
+	return nil
+}
+
+// defaultProfile returns the settings of a user who never changed them
+func defaultProfile(username string) protocol.UserProfile {
+	return protocol.UserProfile{
+		Username:          username,
+		Blocked:           []string{},
+		DMPolicy:          protocol.PrivacyEveryone,
+		GroupInvitePolicy: protocol.PrivacyEveryone,
+	}
+}
+
+// getProfile returns a copy of a user's profile
+func getProfile(username string) protocol.UserProfile {
+	profilesMux.RLock()
+	defer profilesMux.RUnlock()
+
+	profile, exists := profiles[username]
+	if !exists {
+		return defaultProfile(username)
+	}
+	copied := *profile
+	copied.Blocked = append([]string{}, profile.Blocked...)
+	return copied
+}
+
+// updateProfile applies change to a user's profile, persists it and sends
+// the user the result
+func updateProfile(username string, change func(profile *protocol.UserProfile)) {
+	profilesMux.Lock()
+	profile, exists := profiles[username]
+	if !exists {
+		initial := defaultProfile(username)
+		profile = &initial
+		profiles[username] = profile
+	}
+	change(profile)
+	profile.UpdatedAt = time.Now().Format(time.RFC3339)
+	saved := *profile
+	saved.Blocked = append([]string{}, profile.Blocked...)
+	profilesMux.Unlock()
+
+	saveProfile(saved)
+	publishProfile(saved)
+	sendProfile(username)
+}
+
+// storeProfile replaces a user's profile with one changed on another node
+func storeProfile(profile protocol.UserProfile) {
+	profile.Blocked = append([]string{}, profile.Blocked...)
+	profilesMux.Lock()
+	profiles[profile.Username] = &profile
+	profilesMux.Unlock()
+	saveProfile(profile)
+}
+
+// saveProfile persists a profile
+func saveProfile(profile protocol.UserProfile) {
+	if profileStore != nil {
+		if err := profileStore.Save(profile); err != nil {
+			log.Printf("Error saving profile of %s: %v", profile.Username, err)
+		}
+	}
+}
+
+// sendProfile sends a user their own profile
+func sendProfile(username string) {
+	message := map[string]interface{}{
+		protocol.KeyType:      protocol.TypeProfile,
+		protocol.KeyProfile:   getProfile(username),
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	}
+
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling profile of %s: %v", username, err)
+		return
+	}
+	sendToUser(username, messageBytes)
+}
+
+// hasBlocked reports whether username has blocked other
+func hasBlocked(username, other string) bool {
+	profilesMux.RLock()
+	defer profilesMux.RUnlock()
+
+	profile, exists := profiles[username]
+	return exists && contains(profile.Blocked, other)
+}
+
+// sharesGroup reports whether two users are members of a common group
+func sharesGroup(user1, user2 string) bool {
+	groupsMux.RLock()
+	defer groupsMux.RUnlock()
+
+	for _, group := range groups {
+		if contains(group.Members, user1) && contains(group.Members, user2) {
+			return true
+		}
+	}
+	return false
+}
+
+// privacyAllows reports whether policy lets sender reach recipient
+func privacyAllows(policy, sender, recipient string) bool {
+	switch policy {
+	case protocol.PrivacyNobody:
+		return false
+	case protocol.PrivacyGroupMembers:
+		return sharesGroup(sender, recipient)
+	}
+	return true
+}
+
+// checkPrivateMessage decides whether a private message may be delivered.
+// Messages from blocked users are dropped silently (silent is true), so
+// the sender cannot tell; messages the recipient's DM policy refuses are
+// rejected with a reason.
+func checkPrivateMessage(msg protocol.Message) (reason string, silent bool) {
+	if hasBlocked(msg.To, msg.From) {
+		return "blocked", true
+	}
+	if !privacyAllows(getProfile(msg.To).DMPolicy, msg.From, msg.To) {
+		return fmt.Sprintf("%s does not accept private messages from you", msg.To), false
+	}
+	return "", false
+}
+
+// checkGroupInvite is checkPrivateMessage for invitations into groups
+func checkGroupInvite(inviter, invitee string) (reason string, silent bool) {
+	if hasBlocked(invitee, inviter) {
+		return "blocked", true
+	}
+	if !privacyAllows(getProfile(invitee).GroupInvitePolicy, inviter, invitee) {
+		return fmt.Sprintf("%s does not accept group invitations from you", invitee), false
+	}
+	return "", false
+}
+
+// blockUser adds msg.Content to the sender's block list
+func blockUser(msg protocol.Message) {
+	target := strings.TrimSpace(msg.Content)
+	if target == "" || target == msg.From {
+		sendError(msg.From, "Choose another user to block")
+		return
+	}
+
+	updateProfile(msg.From, func(profile *protocol.UserProfile) {
+		if !contains(profile.Blocked, target) {
+			profile.Blocked = append(profile.Blocked, target)
+			sort.Strings(profile.Blocked)
+		}
+	})
+	log.Printf("User %s blocked %s", msg.From, target)
+}
+
+// unblockUser removes msg.Content from the sender's block list
+func unblockUser(msg protocol.Message) {
+	target := strings.TrimSpace(msg.Content)
+	updateProfile(msg.From, func(profile *protocol.UserProfile) {
+		kept := profile.Blocked[:0]
+		for _, blocked := range profile.Blocked {
+			if blocked != target {
+				kept = append(kept, blocked)
+			}
+		}
+		profile.Blocked = kept
+	})
+	log.Printf("User %s unblocked %s", msg.From, target)
+}
+
+// updatePrivacy changes the sender's privacy settings. The content is a JSON
+// protocol.PrivacyUpdate.
+func updatePrivacy(msg protocol.Message) {
+	var update protocol.PrivacyUpdate
+	if err := json.Unmarshal([]byte(msg.Content), &update); err != nil {
+		sendError(msg.From, fmt.Sprintf("Invalid privacy settings: %v", err))
+		return
+	}
+	for _, policy := range []*string{update.DMPolicy, update.GroupInvitePolicy} {
+		if policy != nil && *policy != protocol.PrivacyEveryone &&
+			*policy != protocol.PrivacyGroupMembers && *policy != protocol.PrivacyNobody {
+			sendError(msg.From, fmt.Sprintf("Invalid privacy setting %q; use %s, %s or %s", *policy,
+				protocol.PrivacyEveryone, protocol.PrivacyGroupMembers, protocol.PrivacyNobody))
+			return
+		}
+	}
+
+	updateProfile(msg.From, func(profile *protocol.UserProfile) {
+		if update.DMPolicy != nil {
+			profile.DMPolicy = *update.DMPolicy
+		}
+		if update.GroupInvitePolicy != nil {
+			profile.GroupInvitePolicy = *update.GroupInvitePolicy
+		}
+	})
+	log.Printf("User %s updated their privacy settings", msg.From)
+}
@@ -0,0 +1,547 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// WebSocket subprotocols. Clients that ask for SubprotocolMsgpack exchange
+// binary MessagePack frames; everyone else exchanges JSON text frames. The
+// frames carry the same fields either way.
+const (
+	SubprotocolJSON    = "chatsync.json"
+	SubprotocolMsgpack = "chatsync.msgpack"
+)
+
+// maxCodecDepth bounds the nesting of frames, so hostile input cannot
+// exhaust the stack
+const maxCodecDepth = 64
+
+var errCodecDepth = errors.New("protocol: frame nested too deeply")
+
+// JSONToMsgpack appends the MessagePack encoding of a JSON document to dst.
+// Integers stay integers, other numbers become float64, and objects become
+// maps with string keys.
+func JSONToMsgpack(dst, src []byte) ([]byte, error) {
+	e := jsonTranscoder{src: src}
+	dst, err := e.value(dst, 0)
+	if err != nil {
+		return nil, err
+	}
+	e.skipSpace()
+	if e.pos != len(src) {
+		return nil, e.errorf("trailing data")
+	}
+	return dst, nil
+}
+
+// jsonTranscoder reads JSON and writes MessagePack
+type jsonTranscoder struct {
+	src []byte
+	pos int
+}
+
+func (e *jsonTranscoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("protocol: invalid JSON at offset %d: %s", e.pos, fmt.Sprintf(format, args...))
+}
+
+func (e *jsonTranscoder) skipSpace() {
+	for e.pos < len(e.src) {
+		switch e.src[e.pos] {
+		case ' ', '\t', '\n', '\r':
+			e.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (e *jsonTranscoder) literal(word string) bool {
+	if len(e.src)-e.pos < len(word) || string(e.src[e.pos:e.pos+len(word)]) != word {
+		return false
+	}
+	e.pos += len(word)
+	return true
+}
+
+func (e *jsonTranscoder) value(dst []byte, depth int) ([]byte, error) {
+	if depth > maxCodecDepth {
+		return nil, errCodecDepth
+	}
+	e.skipSpace()
+	if e.pos >= len(e.src) {
+		return nil, e.errorf("unexpected end")
+	}
+
+	switch c := e.src[e.pos]; {
+	case c == '{':
+		return e.object(dst, depth)
+	case c == '[':
+		return e.array(dst, depth)
+	case c == '"':
+		s, err := e.string()
+		if err != nil {
+			return nil, err
+		}
+		return appendMsgpackString(dst, s), nil
+	case c == 't' && e.literal("true"):
+		return append(dst, 0xc3), nil
+	case c == 'f' && e.literal("false"):
+		return append(dst, 0xc2), nil
+	case c == 'n' && e.literal("null"):
+		return append(dst, 0xc0), nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		return e.number(dst)
+	}
+	return nil, e.errorf("unexpected %q", e.src[e.pos])
+}
+
+// object and array reserve the largest header, encode the elements and then
+// move them back behind the header their count needs
+func (e *jsonTranscoder) object(dst []byte, depth int) ([]byte, error) {
+	e.pos++ // {
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0, 0)
+	count := 0
+	for {
+		e.skipSpace()
+		if e.pos < len(e.src) && e.src[e.pos] == '}' && count == 0 {
+			e.pos++
+			break
+		}
+		if e.pos >= len(e.src) || e.src[e.pos] != '"' {
+			return nil, e.errorf("expected an object key")
+		}
+		key, err := e.string()
+		if err != nil {
+			return nil, err
+		}
+		dst = appendMsgpackString(dst, key)
+
+		e.skipSpace()
+		if e.pos >= len(e.src) || e.src[e.pos] != ':' {
+			return nil, e.errorf("expected ':'")
+		}
+		e.pos++
+		if dst, err = e.value(dst, depth+1); err != nil {
+			return nil, err
+		}
+		count++
+
+		e.skipSpace()
+		if e.pos < len(e.src) && e.src[e.pos] == ',' {
+			e.pos++
+			continue
+		}
+		if e.pos < len(e.src) && e.src[e.pos] == '}' {
+			e.pos++
+			break
+		}
+		return nil, e.errorf("expected ',' or '}'")
+	}
+	return patchHeader(dst, start, count, 0x80, 0xde), nil
+}
+
+func (e *jsonTranscoder) array(dst []byte, depth int) ([]byte, error) {
+	e.pos++ // [
+	start := len(dst)
+	dst = append(dst, 0, 0, 0, 0, 0)
+	count := 0
+	for {
+		e.skipSpace()
+		if e.pos < len(e.src) && e.src[e.pos] == ']' && count == 0 {
+			e.pos++
+			break
+		}
+		var err error
+		if dst, err = e.value(dst, depth+1); err != nil {
+			return nil, err
+		}
+		count++
+
+		e.skipSpace()
+		if e.pos < len(e.src) && e.src[e.pos] == ',' {
+			e.pos++
+			continue
+		}
+		if e.pos < len(e.src) && e.src[e.pos] == ']' {
+			e.pos++
+			break
+		}
+		return nil, e.errorf("expected ',' or ']'")
+	}
+	return patchHeader(dst, start, count, 0x90, 0xdc), nil
+}
+
+// patchHeader writes the header of a map or array of count elements into
+// the five bytes reserved at start. fix is the fixmap or fixarray prefix and
+// code16 the code of the 16 bit form; the 32 bit form follows it.
+func patchHeader(dst []byte, start, count int, fix, code16 byte) []byte {
+	var header []byte
+	switch {
+	case count < 16:
+		header = []byte{fix | byte(count)}
+	case count <= math.MaxUint16:
+		header = []byte{code16, byte(count >> 8), byte(count)}
+	default:
+		header = binary.BigEndian.AppendUint32([]byte{code16 + 1}, uint32(count))
+	}
+	copy(dst[start:], header)
+	if len(header) < 5 {
+		n := copy(dst[start+len(header):], dst[start+5:])
+		dst = dst[:start+len(header)+n]
+	}
+	return dst
+}
+
+// string reads a JSON string. Strings without escapes are returned without
+// copying; the rare escaped ones are decoded by encoding/json.
+func (e *jsonTranscoder) string() ([]byte, error) {
+	start := e.pos
+	e.pos++ // "
+	escaped := false
+	for e.pos < len(e.src) {
+		switch c := e.src[e.pos]; {
+		case c == '"':
+			e.pos++
+			if !escaped {
+				return e.src[start+1 : e.pos-1], nil
+			}
+			var s string
+			if err := json.Unmarshal(e.src[start:e.pos], &s); err != nil {
+				return nil, fmt.Errorf("protocol: invalid JSON string: %w", err)
+			}
+			return []byte(s), nil
+		case c == '\\':
+			escaped = true
+			e.pos += 2
+		case c < 0x20:
+			return nil, e.errorf("control character in string")
+		default:
+			e.pos++
+		}
+	}
+	return nil, e.errorf("unterminated string")
+}
+
+func (e *jsonTranscoder) number(dst []byte) ([]byte, error) {
+	start := e.pos
+	integer := true
+	for e.pos < len(e.src) {
+		c := e.src[e.pos]
+		if c == '.' || c == 'e' || c == 'E' {
+			integer = false
+		} else if c != '-' && c != '+' && (c < '0' || c > '9') {
+			break
+		}
+		e.pos++
+	}
+	text := string(e.src[start:e.pos])
+
+	if integer {
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return appendMsgpackInt(dst, n), nil
+		}
+		if n, err := strconv.ParseUint(text, 10, 64); err == nil {
+			return binary.BigEndian.AppendUint64(append(dst, 0xcf), n), nil
+		}
+	}
+	f, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		e.pos = start
+		return nil, e.errorf("invalid number %q", text)
+	}
+	return binary.BigEndian.AppendUint64(append(dst, 0xcb), math.Float64bits(f)), nil
+}
+
+func appendMsgpackString(dst, s []byte) []byte {
+	switch n := len(s); {
+	case n < 32:
+		dst = append(dst, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		dst = append(dst, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		dst = append(dst, 0xda, byte(n>>8), byte(n))
+	default:
+		dst = binary.BigEndian.AppendUint32(append(dst, 0xdb), uint32(n))
+	}
+	return append(dst, s...)
+}
+
+// appendMsgpackInt uses the shortest encoding of n
+func appendMsgpackInt(dst []byte, n int64) []byte {
+	switch {
+	case n >= 0 && n <= math.MaxInt8:
+		return append(dst, byte(n))
+	case n < 0 && n >= -32:
+		return append(dst, byte(n))
+	case n >= math.MinInt8 && n <= math.MaxInt8:
+		return append(dst, 0xd0, byte(n))
+	case n >= math.MinInt16 && n <= math.MaxInt16:
+		return append(dst, 0xd1, byte(n>>8), byte(n))
+	case n >= math.MinInt32 && n <= math.MaxInt32:
+		return binary.BigEndian.AppendUint32(append(dst, 0xd2), uint32(n))
+	}
+	return binary.BigEndian.AppendUint64(append(dst, 0xd3), uint64(n))
+}
+
+// MsgpackToJSON appends the JSON encoding of a MessagePack document to dst.
+// Map keys must be strings; binary and extension values are not used by
+// the protocol and are rejected.
+func MsgpackToJSON(dst, src []byte) ([]byte, error) {
+	d := msgpackTranscoder{src: src}
+	dst, err := d.value(dst, 0)
+	if err != nil {
+		return nil, err
+	}
+	if d.pos != len(src) {
+		return nil, d.errorf("trailing data")
+	}
+	return dst, nil
+}
+
+// msgpackTranscoder reads MessagePack and writes JSON
+type msgpackTranscoder struct {
+	src []byte
+	pos int
+}
+
+func (d *msgpackTranscoder) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("protocol: invalid MessagePack at offset %d: %s", d.pos, fmt.Sprintf(format, args...))
+}
+
+// next consumes n bytes
+func (d *msgpackTranscoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.src)-d.pos < n {
+		return nil, d.errorf("unexpected end")
+	}
+	b := d.src[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+// length reads a big endian length of size bytes
+func (d *msgpackTranscoder) length(size int) (int, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	}
+	n := binary.BigEndian.Uint32(b)
+	if uint64(n) > uint64(len(d.src)) {
+		return 0, d.errorf("length %d exceeds the frame", n)
+	}
+	return int(n), nil
+}
+
+func (d *msgpackTranscoder) value(dst []byte, depth int) ([]byte, error) {
+	if depth > maxCodecDepth {
+		return nil, errCodecDepth
+	}
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return strconv.AppendInt(dst, int64(c), 10), nil
+	case c >= 0xe0:
+		return strconv.AppendInt(dst, int64(int8(c)), 10), nil
+	case c >= 0x80 && c <= 0x8f:
+		return d.object(dst, int(c&0x0f), depth)
+	case c >= 0x90 && c <= 0x9f:
+		return d.array(dst, int(c&0x0f), depth)
+	case c >= 0xa0 && c <= 0xbf:
+		return d.string(dst, int(c&0x1f))
+	}
+
+	switch c := b[0]; c {
+	case 0xc0:
+		return append(dst, "null"...), nil
+	case 0xc2:
+		return append(dst, "false"...), nil
+	case 0xc3:
+		return append(dst, "true"...), nil
+	case 0xca, 0xcb:
+		var f float64
+		if c == 0xca {
+			raw, err := d.next(4)
+			if err != nil {
+				return nil, err
+			}
+			f = float64(math.Float32frombits(binary.BigEndian.Uint32(raw)))
+		} else {
+			raw, err := d.next(8)
+			if err != nil {
+				return nil, err
+			}
+			f = math.Float64frombits(binary.BigEndian.Uint64(raw))
+		}
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, d.errorf("%v has no JSON encoding", f)
+		}
+		return strconv.AppendFloat(dst, f, 'g', -1, 64), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		raw, err := d.next(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		var n uint64
+		for _, x := range raw {
+			n = n<<8 | uint64(x)
+		}
+		return strconv.AppendUint(dst, n, 10), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		raw, err := d.next(size)
+		if err != nil {
+			return nil, err
+		}
+		var n uint64
+		for _, x := range raw {
+			n = n<<8 | uint64(x)
+		}
+		// Sign extend from the encoded width
+		shift := 64 - 8*size
+		return strconv.AppendInt(dst, int64(n<<shift)>>shift, 10), nil
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.length(1 << (c - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.string(dst, n)
+	case 0xdc, 0xdd:
+		n, err := d.length(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(dst, n, depth)
+	case 0xde, 0xdf:
+		n, err := d.length(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.object(dst, n, depth)
+	}
+	d.pos--
+	return nil, d.errorf("unsupported type 0x%02x", b[0])
+}
+
+func (d *msgpackTranscoder) object(dst []byte, n, depth int) ([]byte, error) {
+	// Every entry takes at least two bytes
+	if n > (len(d.src)-d.pos)/2 {
+		return nil, d.errorf("map of %d entries exceeds the frame", n)
+	}
+	dst = append(dst, '{')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		key, err := d.key()
+		if err != nil {
+			return nil, err
+		}
+		dst = appendJSONString(dst, key)
+		dst = append(dst, ':')
+		if dst, err = d.value(dst, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, '}'), nil
+}
+
+func (d *msgpackTranscoder) key() ([]byte, error) {
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	n := 0
+	switch c := b[0]; {
+	case c >= 0xa0 && c <= 0xbf:
+		n = int(c & 0x1f)
+	case c >= 0xd9 && c <= 0xdb:
+		if n, err = d.length(1 << (c - 0xd9)); err != nil {
+			return nil, err
+		}
+	default:
+		d.pos--
+		return nil, d.errorf("map key of type 0x%02x is not a string", c)
+	}
+	return d.next(n)
+}
+
+func (d *msgpackTranscoder) array(dst []byte, n, depth int) ([]byte, error) {
+	if n > len(d.src)-d.pos {
+		return nil, d.errorf("array of %d elements exceeds the frame", n)
+	}
+	dst = append(dst, '[')
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			dst = append(dst, ',')
+		}
+		var err error
+		if dst, err = d.value(dst, depth+1); err != nil {
+			return nil, err
+		}
+	}
+	return append(dst, ']'), nil
+}
+
+func (d *msgpackTranscoder) string(dst []byte, n int) ([]byte, error) {
+	s, err := d.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return appendJSONString(dst, s), nil
+}
+
+const hexDigits = "0123456789abcdef"
+
+// appendJSONString quotes s like encoding/json, replacing invalid UTF-8
+// with U+FFFD
+func appendJSONString(dst, s []byte) []byte {
+	dst = append(dst, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				dst = append(dst, '\\', c)
+			case c == '\n':
+				dst = append(dst, '\\', 'n')
+			case c == '\r':
+				dst = append(dst, '\\', 'r')
+			case c == '\t':
+				dst = append(dst, '\\', 't')
+			case c < 0x20 || c == '<' || c == '>' || c == '&':
+				dst = append(dst, '\\', 'u', '0', '0', hexDigits[c>>4], hexDigits[c&0xf])
+			default:
+				dst = append(dst, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRune(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			dst = append(dst, `\ufffd`...)
+		case r == '\u2028' || r == '\u2029':
+			dst = append(dst, '\\', 'u', '2', '0', '2', hexDigits[r&0xf])
+		default:
+			dst = append(dst, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(dst, '"')
+}
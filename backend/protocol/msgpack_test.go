@@ -0,0 +1,210 @@
+package protocol
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// groupMessageFrame is a typical frame: one message fanned out to a group
+func groupMessageFrame() []byte {
+	frame, _ := json.Marshal(Message{
+		ID:        "4f1c2a9be07d3c55",
+		Type:      TypeGroupMessage,
+		Content:   "Deploy finished, @alice can you check the dashboards?",
+		From:      "bob",
+		To:        "7e2d9a41c08b5f36",
+		Timestamp: "2026-10-18T12:30:00Z",
+		Mentions:  []string{"alice"},
+	})
+	return frame
+}
+
+// groupListFrame is a large frame: the group list sent after every change
+func groupListFrame() []byte {
+	groups := make([]Group, 20)
+	for i := range groups {
+		groups[i] = Group{
+			ID:          fmt.Sprintf("%016x", i),
+			Name:        fmt.Sprintf("team-%d", i),
+			Members:     []string{"alice", "bob", "carol", "dave"},
+			Roles:       map[string]string{"alice": RoleOwner, "bob": RoleAdmin},
+			Visibility:  VisibilityPrivate,
+			Description: "Where the team talks about things",
+			Admin:       "alice",
+			CreatedAt:   "2026-10-18T12:30:00Z",
+		}
+	}
+	frame, _ := json.Marshal(map[string]interface{}{
+		KeyType:      TypeGroupList,
+		KeyGroups:    groups,
+		KeyTimestamp: "2026-10-18T12:30:00Z",
+	})
+	return frame
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	docs := []string{
+		`{}`,
+		`[]`,
+		`null`,
+		`{"a": 1, "b": -1, "c": -33, "d": 300, "e": -70000, "f": 5000000000, "g": 18446744073709551615}`,
+		`{"float": 1.5, "exp": 1e300, "neg": -0.25, "zero": 0}`,
+		`{"t": true, "f": false, "n": null, "list": [1, "two", [3], {"four": 4}]}`,
+		`{"escaped": "line\nbreak \"quoted\" \\ tab\t é 😀 <b>&amp;</b>"}`,
+		`{"long": "` + strings.Repeat("x", 70000) + `"}`,
+		`[` + strings.Repeat(`1,`, 70000) + `1]`,
+		string(groupMessageFrame()),
+		string(groupListFrame()),
+	}
+	for _, doc := range docs {
+		packed, err := JSONToMsgpack(nil, []byte(doc))
+		if err != nil {
+			t.Fatalf("JSONToMsgpack(%.40s) failed: %v", doc, err)
+		}
+		back, err := MsgpackToJSON(nil, packed)
+		if err != nil {
+			t.Fatalf("MsgpackToJSON(%.40s) failed: %v", doc, err)
+		}
+
+		var want, got interface{}
+		if err := json.Unmarshal([]byte(doc), &want); err != nil {
+			t.Fatalf("invalid test document %.40s: %v", doc, err)
+		}
+		if err := json.Unmarshal(back, &got); err != nil {
+			t.Fatalf("MsgpackToJSON(%.40s) produced invalid JSON %.80s: %v", doc, back, err)
+		}
+		if !reflect.DeepEqual(want, got) {
+			t.Errorf("round trip of %.40s gave %.80s", doc, back)
+		}
+	}
+}
+
+func TestMsgpackEncoding(t *testing.T) {
+	tests := []struct {
+		json string
+		want []byte
+	}{
+		{`{"a":1}`, []byte{0x81, 0xa1, 'a', 0x01}},
+		{`[-1, -33, 200, 1.5]`, []byte{0x94, 0xff, 0xd0, 0xdf, 0xd1, 0x00, 0xc8, 0xcb, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}},
+		{`[true, false, null, ""]`, []byte{0x94, 0xc3, 0xc2, 0xc0, 0xa0}},
+		{`[` + strings.Repeat(`0,`, 15) + `0]`, append([]byte{0xdc, 0x00, 0x10}, make([]byte, 16)...)},
+	}
+	for _, tt := range tests {
+		got, err := JSONToMsgpack(nil, []byte(tt.json))
+		if err != nil {
+			t.Errorf("JSONToMsgpack(%s) failed: %v", tt.json, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.want) {
+			t.Errorf("JSONToMsgpack(%s) = % x, want % x", tt.json, got, tt.want)
+		}
+	}
+}
+
+func TestMsgpackRejectsInvalidInput(t *testing.T) {
+	for _, doc := range []string{`{"a":}`, `[1,]`, `{"a" 1}`, `"open`, `tru`, `1 2`, `-`} {
+		if _, err := JSONToMsgpack(nil, []byte(doc)); err == nil {
+			t.Errorf("JSONToMsgpack(%s) succeeded", doc)
+		}
+	}
+
+	deep := bytes.Repeat([]byte{0x91}, maxCodecDepth+2)
+	for _, data := range [][]byte{
+		{0x82, 0xa1, 'a'},                    // Truncated map
+		{0x81, 0x01, 0x01},                   // Integer key
+		{0xdd, 0xff, 0xff, 0xff, 0xff},       // Array longer than the frame
+		{0xc4, 0x01, 0x00},                   // Binary
+		{0xcb, 0x7f, 0xf8, 0, 0, 0, 0, 0, 0}, // NaN
+		{0xc0, 0xc0},                         // Trailing data
+		deep,
+	} {
+		if _, err := MsgpackToJSON(nil, data); err == nil {
+			t.Errorf("MsgpackToJSON(% x) succeeded", data)
+		}
+	}
+}
+
+// The benchmarks compare the server's JSON path, marshaling each frame,
+// with the MessagePack path, which transcodes the marshaled frame, and
+// report the size of a frame on the wire
+var benchFrames = []struct {
+	name  string
+	frame func() []byte
+}{
+	{"group_message", groupMessageFrame},
+	{"group_list", groupListFrame},
+}
+
+func BenchmarkEncodeJSON(b *testing.B) {
+	for _, bf := range benchFrames {
+		var frame map[string]interface{}
+		json.Unmarshal(bf.frame(), &frame)
+		b.Run(bf.name, func(b *testing.B) {
+			var data []byte
+			for i := 0; i < b.N; i++ {
+				data, _ = json.Marshal(frame)
+			}
+			b.ReportMetric(float64(len(data)), "wire-bytes")
+		})
+	}
+}
+
+func BenchmarkEncodeMsgpack(b *testing.B) {
+	for _, bf := range benchFrames {
+		var frame map[string]interface{}
+		json.Unmarshal(bf.frame(), &frame)
+		b.Run(bf.name, func(b *testing.B) {
+			var buf []byte
+			for i := 0; i < b.N; i++ {
+				data, _ := json.Marshal(frame)
+				buf, _ = JSONToMsgpack(buf[:0], data)
+			}
+			b.ReportMetric(float64(len(buf)), "wire-bytes")
+		})
+	}
+}
+
+// BenchmarkTranscodeMsgpack is the cost a MessagePack client adds to a
+// frame that was marshaled once for a whole group
+func BenchmarkTranscodeMsgpack(b *testing.B) {
+	for _, bf := range benchFrames {
+		data := bf.frame()
+		b.Run(bf.name, func(b *testing.B) {
+			var buf []byte
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				buf, _ = JSONToMsgpack(buf[:0], data)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeJSON(b *testing.B) {
+	for _, bf := range benchFrames {
+		data := bf.frame()
+		b.Run(bf.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var frame map[string]interface{}
+				json.Unmarshal(data, &frame)
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeMsgpack(b *testing.B) {
+	for _, bf := range benchFrames {
+		packed, _ := JSONToMsgpack(nil, bf.frame())
+		b.Run(bf.name, func(b *testing.B) {
+			var buf []byte
+			for i := 0; i < b.N; i++ {
+				var frame map[string]interface{}
+				buf, _ = MsgpackToJSON(buf[:0], packed)
+				json.Unmarshal(buf, &frame)
+			}
+		})
+	}
+}
@@ -0,0 +1,519 @@
+// Package protocol defines the JSON messages exchanged between ChatSync
+// clients and the server over the /ws WebSocket endpoint.
+package protocol
+
+// Message types
+const (
+	// Frontend to Backend
+	TypePrivateMessage    = "private_message"
+	TypeGroupMessage      = "group_message"
+	TypeCreateGroup       = "create_group"
+	TypeAddGroupMember    = "add_group_member"
+	TypeRemoveGroupMember = "remove_group_member"
+	TypeLeaveGroup        = "leave_group"
+	TypeRequestHistory    = "request_history"
+	TypeUpdateLastSeen    = "update_last_seen" // New type for updating last seen timestamp
+	TypeCreateWebhook     = "create_webhook"
+	TypeDeleteWebhook     = "delete_webhook"
+	TypeListWebhooks      = "list_webhooks"
+	TypeRequestUnread     = "request_unread"
+	TypeSearch            = "search"
+	TypeRequestMentions   = "request_mentions"
+	TypeSetGroupRole      = "set_group_role"
+	TypeTransferOwnership = "transfer_ownership"
+	TypeDeleteMessage     = "delete_message"
+	TypeCreateInviteCode  = "create_invite_code"
+	TypeAcceptInvitation  = "accept_invitation"
+	TypeDeclineInvitation = "decline_invitation"
+	TypeRevokeInvitation  = "revoke_invitation"
+	TypeRequestJoin       = "request_join"
+	TypeApproveJoin       = "approve_join_request"
+	TypeDenyJoin          = "deny_join_request"
+	TypeListInvitations   = "list_invitations"
+	TypeUpdateGroup       = "update_group"
+	TypeListPublicGroups  = "list_public_groups"
+	TypeJoinGroup         = "join_group"
+	TypeBlockUser         = "block_user"
+	TypeUnblockUser       = "unblock_user"
+	TypeUpdatePrivacy     = "update_privacy"
+	TypeRequestProfile    = "request_profile"
+	TypeMuteMember        = "mute_member"
+	TypeUnmuteMember      = "unmute_member"
+	TypeBanUser           = "ban_user"
+	TypeUnbanUser         = "unban_user"
+	TypeReportMessage     = "report_message"
+	TypeListReports       = "list_reports"
+	TypeResolveReport     = "resolve_report"
+	TypeDismissReport     = "dismiss_report"
+	TypeRequestAuditLog   = "request_audit_log"
+	TypeSetFilters        = "set_filters"
+	TypeRequestFilters    = "request_filters"
+	TypeSetRetention      = "set_retention"
+	TypeRequestRetention  = "request_retention"
+
+	// Backend Storage
+	TypePrivate = "private"
+	TypeGroup   = "group"
+
+	// Backend to Frontend
+	TypeUserList       = "user_list"
+	TypeGroupList      = "group_list"
+	TypeSystem         = "system"
+	TypeHistory        = "history"
+	TypeUnreadCount    = "unread_count" // New type for sending unread message counts
+	TypeWebhookList    = "webhook_list"
+	TypeSearchResults  = "search_results"
+	TypeMention        = "mention"  // A group message that mentions the recipient
+	TypeMentions       = "mentions" // Reply to request_mentions
+	TypeMessageDeleted = "message_deleted"
+	TypeError          = "error" // A request from the recipient was rejected
+	TypeInvitation     = "invitation"
+	TypeJoinRequest    = "join_request"
+	TypeInvitationList = "invitation_list"
+	TypePublicGroups   = "public_groups" // Reply to list_public_groups
+	TypeProfile        = "profile"       // The recipient's own profile
+	TypeReport         = "report"        // A report was filed or handled
+	TypeReports        = "reports"       // Reply to list_reports
+	TypeAuditLog       = "audit_log"     // Reply to request_audit_log
+	TypeFilters        = "filters"       // Reply to request_filters
+	TypeRetention      = "retention"     // Retention policy of a chat, on request and on change
+	TypeSession        = "session"       // First frame of every connection, see KeyToken
+)
+
+// Group visibility. Public groups are listed in the directory, can be
+// joined by anyone and previewed by non-members.
+const (
+	VisibilityPrivate = "private"
+	VisibilityPublic  = "public"
+)
+
+// Privacy settings: who may send a user private messages or invite them
+// into groups
+const (
+	PrivacyEveryone     = "everyone"
+	PrivacyGroupMembers = "group_members" // People who share a group with the user
+	PrivacyNobody       = "nobody"
+)
+
+// Group roles, from most to least privileged
+const (
+	RoleOwner     = "owner"
+	RoleAdmin     = "admin"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+	RoleReadOnly  = "read_only"
+)
+
+// Message keys
+const (
+	KeyType      = "type"
+	KeyFrom      = "from"
+	KeyTo        = "to"
+	KeyContent   = "content"
+	KeyTimestamp = "timestamp"
+	KeyUsers     = "users"
+	KeyGroups    = "groups"
+	KeyClients   = "clients"
+	KeyWebhooks  = "webhooks"
+	KeyBots      = "bots"
+	KeyChatType  = "chat_type"
+	KeyQuery     = "query"
+	KeyResults   = "results"
+	KeyError     = "error"
+
+	KeyMentionCounts = "mention_counts"
+	KeyInvitation    = "invitation"
+	KeyInvitations   = "invitations"
+	KeyJoinRequest   = "join_request"
+	KeyJoinRequests  = "join_requests"
+	KeyPublicGroups  = "public_groups"
+	KeyProfile       = "profile"
+	KeyReport        = "report"
+	KeyReports       = "reports"
+	KeyAuditLog      = "audit_log"
+	KeyFilters       = "filters"
+	KeyRetention     = "retention"
+
+	// Session frames carry the token a client resumes its session with, on
+	// reconnecting to /ws or /api/events with resume=TOKEN&seq=N. N is the
+	// number of frames the client received in the session, not counting
+	// session frames; a resumed session continues with frame N+1, so KeySeq
+	// is N, and a new one with frame 1, so KeySeq is 0.
+	KeyToken   = "token"
+	KeyResumed = "resumed"
+	KeySeq     = "seq"
+)
+
+// Invitation and join request states
+const (
+	StatusPending  = "pending"
+	StatusAccepted = "accepted"
+	StatusDeclined = "declined"
+	StatusExpired  = "expired"
+	StatusRevoked  = "revoked"
+	StatusApproved = "approved"
+	StatusDenied   = "denied"
+
+	// Reports
+	StatusResolved  = "resolved"
+	StatusDismissed = "dismissed"
+)
+
+// Actions recorded in the audit log
+const (
+	// Sessions. These are kept in the audit log file only, so logins do not
+	// push moderation actions out of request_audit_log replies.
+	ActionLogin       = "login"
+	ActionLoginDenied = "login_denied"
+	ActionLogout      = "logout"
+	ActionDisconnect  = "disconnect" // Connection closed by the server
+	ActionResume      = "resume"     // A dropped connection resumed its session
+
+	// Groups
+	ActionCreateGroup       = "create_group"
+	ActionDeleteGroup       = "delete_group" // The last member, or the last one who is not a bot, left
+	ActionUpdateGroup       = "update_group"
+	ActionAddMember         = "add_member" // Bots are added without an invitation
+	ActionJoinGroup         = "join_group"
+	ActionLeaveGroup        = "leave_group"
+	ActionTransferOwnership = "transfer_ownership"
+	ActionSetRetention      = "set_retention"
+	ActionCreateWebhook     = "create_webhook"
+	ActionDeleteWebhook     = "delete_webhook"
+	ActionBroadcast         = "broadcast" // Announcement to everyone from the admin API
+
+	// Moderation
+	ActionMute          = "mute"
+	ActionUnmute        = "unmute"
+	ActionKick          = "kick" // Removal from a group by a moderator
+	ActionBan           = "ban"
+	ActionUnban         = "unban"
+	ActionDeleteMessage = "delete_message"
+	ActionSetRole       = "set_role"
+	ActionReport        = "report"
+	ActionResolveReport = "resolve_report"
+	ActionDismissReport = "dismiss_report"
+	ActionSetFilters    = "set_filters"
+	ActionImport        = "import" // History loaded with /api/import
+)
+
+// Content filter rule kinds
+const (
+	FilterWords  = "words"  // Whole words, ignoring case
+	FilterRegex  = "regex"  // A regular expression
+	FilterLinks  = "links"  // Links to denied, or not allowed, domains
+	FilterRepeat = "repeat" // The same character repeated too often in a row
+)
+
+// Content filter actions
+const (
+	FilterReject = "reject" // Refuse the message
+	FilterRedact = "redact" // Mask the offending parts
+	FilterFlag   = "flag"   // Deliver it, but report it to the moderators
+)
+
+// Group keys
+const (
+	KeyName    = "name"
+	KeyAdmin   = "admin"
+	KeyMembers = "members"
+)
+
+// Message represents a chat message
+type Message struct {
+	ID        string `json:"id,omitempty"` // Assigned by the server to stored messages
+	Type      string `json:"type"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Content   string `json:"content"`
+	Timestamp string `json:"timestamp"`
+
+	// Integration is the webhook ID when the message was posted by an
+	// external integration instead of a connected user
+	Integration string `json:"integration,omitempty"`
+
+	// Attachments are files uploaded to /api/attachments. Clients send only
+	// the IDs; the server fills in the rest before delivery.
+	Attachments []Attachment `json:"attachments,omitempty"`
+
+	// Mentions lists the group members mentioned with @name, @here or @all.
+	// The server fills it in; values sent by clients are ignored.
+	Mentions []string `json:"mentions,omitempty"`
+
+	// ExpiresAt is when a disappearing message is deleted (RFC 3339). The
+	// server sets it from the conversation's retention policy.
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// Group represents a chat group. Groups are addressed by their ID, which
+// never changes; the name and other details can be edited.
+type Group struct {
+	ID          string   `json:"id"`
+	Name        string   `json:"name"`
+	Topic       string   `json:"topic,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Avatar      string   `json:"avatar,omitempty"` // Image URL
+	Visibility  string   `json:"visibility"`       // VisibilityPrivate or VisibilityPublic
+	Admin       string   `json:"admin"`            // Group owner
+	Members     []string `json:"members"`          // List of member usernames
+	CreatedAt   string   `json:"created_at"`
+
+	// Roles maps members to their role. Members without an entry have
+	// RoleMember.
+	Roles map[string]string `json:"roles,omitempty"`
+
+	// Muted maps muted members to when their mute ends (RFC 3339). Mutes
+	// outlast leaving and rejoining the group.
+	Muted map[string]string `json:"muted,omitempty"`
+
+	// Posting policy
+	AnnouncementOnly bool `json:"announcement_only,omitempty"`  // Only the owner and admins may post
+	SlowModeSeconds  int  `json:"slow_mode_seconds,omitempty"`  // Minimum interval between a member's messages
+	MaxMessageLength int  `json:"max_message_length,omitempty"` // In characters; zero means no limit
+
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+
+	// Version counts the changes to the group, so the nodes of a cluster
+	// agree on its newest state
+	Version int64 `json:"version,omitempty"`
+}
+
+// GroupUpdate is the content of an update_group message. Nil fields are
+// left unchanged.
+type GroupUpdate struct {
+	Name        *string `json:"name,omitempty"`
+	Topic       *string `json:"topic,omitempty"`
+	Description *string `json:"description,omitempty"`
+	Avatar      *string `json:"avatar,omitempty"`
+	Visibility  *string `json:"visibility,omitempty"`
+
+	AnnouncementOnly *bool `json:"announcement_only,omitempty"`
+	SlowModeSeconds  *int  `json:"slow_mode_seconds,omitempty"`
+	MaxMessageLength *int  `json:"max_message_length,omitempty"`
+}
+
+// PublicGroup is a directory entry of a public group, as listed to
+// non-members
+type PublicGroup struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Topic       string `json:"topic,omitempty"`
+	Description string `json:"description,omitempty"`
+	Avatar      string `json:"avatar,omitempty"`
+	MemberCount int    `json:"member_count"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// UserProfile holds a user's settings. Users only ever see their own
+// profile; nobody learns that they have been blocked.
+type UserProfile struct {
+	Username          string   `json:"username"`
+	Blocked           []string `json:"blocked"`             // Users whose messages and invitations are dropped
+	DMPolicy          string   `json:"dm_policy"`           // Who may send private messages
+	GroupInvitePolicy string   `json:"group_invite_policy"` // Who may invite the user into groups
+	UpdatedAt         string   `json:"updated_at,omitempty"`
+}
+
+// PrivacyUpdate is the content of an update_privacy message. Nil fields are
+// left unchanged.
+type PrivacyUpdate struct {
+	DMPolicy          *string `json:"dm_policy,omitempty"`
+	GroupInvitePolicy *string `json:"group_invite_policy,omitempty"`
+}
+
+// RetentionPolicy limits how long messages are kept in a chat, or on the
+// whole server. Zero fields mean no limit. Where the server and a chat both
+// set a limit, the stricter one applies.
+type RetentionPolicy struct {
+	MaxAgeSeconds    int `json:"max_age_seconds,omitempty"`
+	MaxCount         int `json:"max_count,omitempty"`         // Only the latest messages are kept
+	DisappearSeconds int `json:"disappear_seconds,omitempty"` // New messages are deleted this long after they are sent
+}
+
+// FilterConfig is the content filter chain of a group, or the server
+// default. Rules run in order.
+type FilterConfig struct {
+	Rules []FilterRule `json:"rules"`
+}
+
+// FilterRule is one stage of a content filter chain
+type FilterRule struct {
+	Name   string `json:"name,omitempty"` // Shown in rejections and reports; defaults to the kind
+	Kind   string `json:"kind"`
+	Action string `json:"action"`
+
+	Words        []string `json:"words,omitempty"`         // FilterWords
+	Pattern      string   `json:"pattern,omitempty"`       // FilterRegex
+	AllowDomains []string `json:"allow_domains,omitempty"` // FilterLinks: if set, only these domains
+	DenyDomains  []string `json:"deny_domains,omitempty"`  // FilterLinks
+	MaxRepeat    int      `json:"max_repeat,omitempty"`    // FilterRepeat
+}
+
+// Ban keeps a user off the server until it expires
+type Ban struct {
+	User      string `json:"user"`
+	Reason    string `json:"reason,omitempty"`
+	By        string `json:"by"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at,omitempty"` // Empty for permanent bans
+}
+
+// Report flags a message for the moderators of the chat it was posted in
+type Report struct {
+	ID        string  `json:"id"`
+	Reporter  string  `json:"reporter"`
+	ChatType  string  `json:"chat_type"`            // TypeGroup or TypePrivate
+	Group     string  `json:"group,omitempty"`      // Group ID of group messages
+	GroupName string  `json:"group_name,omitempty"` // Group name when the report was filed
+	Message   Message `json:"message"`              // The reported message as it was
+	Reason    string  `json:"reason,omitempty"`
+	Status    string  `json:"status"`
+	HandledBy string  `json:"handled_by,omitempty"`
+	Note      string  `json:"note,omitempty"` // Left by the moderator who handled it
+	CreatedAt string  `json:"created_at"`
+	HandledAt string  `json:"handled_at,omitempty"`
+}
+
+// AuditEntry records a security-relevant action
+type AuditEntry struct {
+	ID     string `json:"id"`
+	Time   string `json:"time"`
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	Group  string `json:"group,omitempty"`  // Group ID for actions within a group
+	Target string `json:"target,omitempty"` // User, message or report acted on
+	Reason string `json:"reason,omitempty"`
+
+	// IP is the address the action came from. Only the admin API shows it.
+	IP string `json:"ip,omitempty"`
+}
+
+// Export formats of /api/export
+const (
+	ExportJSONL = "jsonl" // An ExportHeader line, then one Message per line
+	ExportHTML  = "html"
+	ExportText  = "text"
+)
+
+// ExportHeader describes an exported conversation. It is the first line of
+// a JSON lines export, wrapped as {"export": {...}}.
+type ExportHeader struct {
+	Version    int      `json:"version"`
+	ChatType   string   `json:"chat_type"`           // TypeGroup or TypePrivate
+	ChatID     string   `json:"chat_id"`             // Group ID, or the other user of a private chat
+	ChatName   string   `json:"chat_name,omitempty"` // Group name
+	Topic      string   `json:"topic,omitempty"`     // Group topic
+	Members    []string `json:"members"`             // Group members, or both users of a private chat
+	ExportedBy string   `json:"exported_by"`
+	ExportedAt string   `json:"exported_at"`
+	Messages   int      `json:"messages"`
+}
+
+// ImportResult is the reply of /api/import
+type ImportResult struct {
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"`
+	Problems []string `json:"problems,omitempty"` // Why lines were skipped, up to a limit
+}
+
+// ConnectedClient describes a connection, as listed by the admin API
+type ConnectedClient struct {
+	Username      string `json:"username"`
+	IP            string `json:"ip,omitempty"`
+	Bot           bool   `json:"bot,omitempty"`       // Bots have no connection
+	Companion     bool   `json:"companion,omitempty"` // Connected alongside the user's client
+	Detached      bool   `json:"detached,omitempty"`  // Dropped, waiting to resume its session
+	ConnectedAt   string `json:"connected_at,omitempty"`
+	AgeSeconds    int    `json:"age_seconds"`
+	QueueDepth    int    `json:"queue_depth"` // Frames waiting to be written
+	QueueCapacity int    `json:"queue_capacity"`
+}
+
+// ServerStats are the storage statistics of the admin API
+type ServerStats struct {
+	Clients              int   `json:"clients"` // Connected users, not counting bots
+	Bots                 int   `json:"bots"`
+	Groups               int   `json:"groups"`
+	PrivateConversations int   `json:"private_conversations"`
+	PrivateMessages      int   `json:"private_messages"`
+	GroupMessages        int   `json:"group_messages"`
+	IndexedMessages      int   `json:"indexed_messages"`
+	Attachments          int   `json:"attachments"`
+	Blobs                int   `json:"blobs"`
+	BlobBytes            int64 `json:"blob_bytes"`
+	Profiles             int   `json:"profiles"`
+	Bans                 int   `json:"bans"`
+	PendingReports       int   `json:"pending_reports"`
+	Invitations          int   `json:"invitations"`
+	AuditLogBytes        int64 `json:"audit_log_bytes"`
+}
+
+// Event names of the SSE transport at /api/events. Frames are sent as
+// unnamed events whose data is the JSON frame. Long polls answer with
+// events in the same format.
+const (
+	// EventSession opens a stream; its data is the session token that
+	// commands are POSTed with
+	EventSession = "session"
+	// EventClose ends a stream; its data is a CloseEvent
+	EventClose = "close"
+)
+
+// CloseEvent says why the server ended an SSE stream, with the close code a
+// WebSocket connection would have received
+type CloseEvent struct {
+	Code   int    `json:"code"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Invitation invites a user into a group. Invitations without an Invitee
+// carry a shareable Code that anyone can redeem until it expires or runs
+// out of uses.
+type Invitation struct {
+	ID        string `json:"id"`
+	Group     string `json:"group"`      // Group ID
+	GroupName string `json:"group_name"` // Group name when the invitation was made
+	Inviter   string `json:"inviter"`
+	Invitee   string `json:"invitee,omitempty"`
+	Code      string `json:"code,omitempty"`
+	MaxUses   int    `json:"max_uses,omitempty"` // Zero means unlimited
+	Uses      int    `json:"uses,omitempty"`
+	Status    string `json:"status"`
+	CreatedAt string `json:"created_at"`
+	ExpiresAt string `json:"expires_at"`
+}
+
+// JoinRequest asks the admins of a group to let a user in
+type JoinRequest struct {
+	ID        string `json:"id"`
+	Group     string `json:"group"`      // Group ID
+	GroupName string `json:"group_name"` // Group name when the request was made
+	User      string `json:"user"`
+	Note      string `json:"note,omitempty"`
+	Status    string `json:"status"`
+	DecidedBy string `json:"decided_by,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// Webhook represents an incoming webhook that lets an external system post
+// into a group
+type Webhook struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`  // Integration name shown as the sender
+	Group     string `json:"group"` // Group the webhook posts into
+	Token     string `json:"token"` // Secret token embedded in the webhook URL
+	Creator   string `json:"creator"`
+	CreatedAt string `json:"created_at"`
+	URL       string `json:"url"`
+}
+
+// Attachment describes an uploaded file. URL and ThumbnailURL require a
+// username query parameter of a participant of the conversation.
+type Attachment struct {
+	ID           string `json:"id"`
+	Name         string `json:"name,omitempty"`
+	Size         int64  `json:"size,omitempty"`
+	MIMEType     string `json:"mime_type,omitempty"`
+	URL          string `json:"url,omitempty"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"` // Only set for images
+}
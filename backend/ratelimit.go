@@ -0,0 +1,300 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Quota keys besides message types
+const (
+	QuotaDefault = "default" // Message types without a quota of their own
+	QuotaUser    = "user"    // All messages of a user
+	QuotaIP      = "ip"      // All messages from an IP address
+	QuotaConnect = "connect" // WebSocket connections from an IP address
+	QuotaHTTP    = "http"    // HTTP API requests from an IP address
+)
+
+// Quota allows Rate events per second on average, in bursts of up to Burst
+type Quota struct {
+	Rate  float64
+	Burst float64
+}
+
+// defaultQuotas are the limits used unless CHATSYNC_RATE_LIMITS overrides
+// them
+func defaultQuotas() map[string]Quota {
+	return map[string]Quota{
+		protocol.TypePrivateMessage: {Rate: 5, Burst: 10},
+		protocol.TypeGroupMessage:   {Rate: 5, Burst: 10},
+		protocol.TypeCreateGroup:    {Rate: 0.2, Burst: 5},
+		protocol.TypeSearch:         {Rate: 2, Burst: 10},
+		protocol.TypeUpdateLastSeen: {Rate: 10, Burst: 30},
+		QuotaDefault:                {Rate: 10, Burst: 30},
+		QuotaUser:                   {Rate: 20, Burst: 60},
+		QuotaIP:                     {Rate: 50, Burst: 150},
+		QuotaConnect:                {Rate: 1, Burst: 30},
+		QuotaHTTP:                   {Rate: 10, Burst: 100},
+	}
+}
+
+// parseQuotas reads quota overrides of the form
+// "group_message=5/s:10,create_group=12/m" into quotas. The burst defaults
+// to the count per unit, but at least 1, since a bucket that cannot hold a
+// whole token never allows anything.
+func parseQuotas(spec string, quotas map[string]Quota) error {
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(item, "=")
+		if !ok {
+			return fmt.Errorf("rate limit %q: expected KEY=COUNT/UNIT[:BURST]", item)
+		}
+		rate, burst, hasBurst := strings.Cut(value, ":")
+		countText, unit, ok := strings.Cut(rate, "/")
+		if !ok {
+			return fmt.Errorf("rate limit %q: expected KEY=COUNT/UNIT[:BURST]", item)
+		}
+
+		count, err := strconv.ParseFloat(countText, 64)
+		if err != nil || count <= 0 {
+			return fmt.Errorf("rate limit %q: invalid count", item)
+		}
+		per := map[string]float64{"s": 1, "m": 60, "h": 3600}[unit]
+		if per == 0 {
+			return fmt.Errorf("rate limit %q: unit must be s, m or h", item)
+		}
+		quota := Quota{Rate: count / per, Burst: math.Max(count, 1)}
+		if hasBurst {
+			if quota.Burst, err = strconv.ParseFloat(burst, 64); err != nil || quota.Burst < 1 {
+				return fmt.Errorf("rate limit %q: invalid burst", item)
+			}
+		}
+		quotas[strings.TrimSpace(key)] = quota
+	}
+	return nil
+}
+
+// tokenBucket holds the tokens left for one key
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last refill
+func (b *tokenBucket) refill(q Quota, now time.Time) {
+	b.tokens = math.Min(q.Burst, b.tokens+now.Sub(b.last).Seconds()*q.Rate)
+	b.last = now
+}
+
+// wait returns how long until the bucket holds a token, or 0 if it does
+func (b *tokenBucket) wait(q Quota) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / q.Rate * float64(time.Second))
+}
+
+// limit is a quota applied to the bucket of one key
+type limit struct {
+	key   string
+	quota Quota
+}
+
+// RateLimiter applies token bucket quotas per message type and user, per
+// user and per IP address. Users who keep hitting the limits are cut off
+// for a cooldown period. Their IP address is not, since people behind the
+// same NAT share it; the per-IP quota still applies to it.
+type RateLimiter struct {
+	MaxStrikes   int           // Rejections within StrikeWindow that count as abuse
+	StrikeWindow time.Duration // Window over which rejections are counted
+	Cooldown     time.Duration // How long abusers cannot reconnect
+
+	mu          sync.Mutex
+	quotas      map[string]Quota
+	buckets     map[string]*tokenBucket
+	strikes     map[string][]time.Time // key: username
+	bannedUntil map[string]time.Time   // key: username
+	lastSweep   time.Time
+}
+
+// NewRateLimiter returns a limiter enforcing quotas
+func NewRateLimiter(quotas map[string]Quota) *RateLimiter {
+	return &RateLimiter{
+		MaxStrikes:   30,
+		StrikeWindow: time.Minute,
+		Cooldown:     time.Minute,
+		quotas:       quotas,
+		buckets:      make(map[string]*tokenBucket),
+		strikes:      make(map[string][]time.Time),
+		bannedUntil:  make(map[string]time.Time),
+	}
+}
+
+var rateLimiter = NewRateLimiter(defaultQuotas())
+
+// Configure replaces the quotas and forgets all buckets, strikes and bans
+func (l *RateLimiter) Configure(quotas map[string]Quota) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.quotas = quotas
+	l.buckets = make(map[string]*tokenBucket)
+	l.strikes = make(map[string][]time.Time)
+	l.bannedUntil = make(map[string]time.Time)
+}
+
+// take takes a token from the bucket of every limit, or from none of them
+// if one is empty, so a rejected event does not use up the other quotas. It
+// returns how long until all buckets hold a token when they do not. The
+// caller must hold l.mu.
+func (l *RateLimiter) take(now time.Time, limits ...limit) (bool, time.Duration) {
+	buckets := make([]*tokenBucket, len(limits))
+	var wait time.Duration
+	for i, lim := range limits {
+		bucket, exists := l.buckets[lim.key]
+		if !exists {
+			bucket = &tokenBucket{tokens: lim.quota.Burst, last: now}
+			l.buckets[lim.key] = bucket
+		}
+		bucket.refill(lim.quota, now)
+		if w := bucket.wait(lim.quota); w > wait {
+			wait = w
+		}
+		buckets[i] = bucket
+	}
+	if wait > 0 {
+		return false, wait
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+// sweep drops buckets that have been full for a while and expired bans.
+// The caller must hold l.mu.
+func (l *RateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.last) > 10*time.Minute {
+			delete(l.buckets, key)
+		}
+	}
+	for key, until := range l.bannedUntil {
+		if now.After(until) {
+			delete(l.bannedUntil, key)
+		}
+	}
+	for user, times := range l.strikes {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) > l.StrikeWindow {
+			delete(l.strikes, user)
+		}
+	}
+}
+
+// AllowConnect decides whether a user may open a WebSocket from ip. It
+// returns how long to wait when they may not.
+func (l *RateLimiter) AllowConnect(username, ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	if until, banned := l.bannedUntil[username]; banned && now.Before(until) {
+		return false, until.Sub(now)
+	}
+	return l.take(now, limit{"connect:" + ip, l.quotas[QuotaConnect]})
+}
+
+// AllowRequest decides whether an HTTP API request from ip may be served.
+// It returns how long to wait when it may not.
+func (l *RateLimiter) AllowRequest(ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+	return l.take(now, limit{"http:" + ip, l.quotas[QuotaHTTP]})
+}
+
+// Allow decides whether a user may send a message of the given type. When
+// they may not, it returns how long to wait and whether the user has been
+// rejected so often that they should be disconnected.
+func (l *RateLimiter) Allow(username, ip, msgType string) (ok bool, wait time.Duration, abusive bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	quota, exists := l.quotas[msgType]
+	if !exists {
+		quota = l.quotas[QuotaDefault]
+	}
+	ok, wait = l.take(now,
+		limit{"type:" + username + ":" + msgType, quota},
+		limit{"user:" + username, l.quotas[QuotaUser]},
+		limit{"ip:" + ip, l.quotas[QuotaIP]},
+	)
+	if ok {
+		return true, 0, false
+	}
+
+	// Count the strike and drop the ones that left the window
+	times := append(l.strikes[username], now)
+	for len(times) > 0 && now.Sub(times[0]) > l.StrikeWindow {
+		times = times[1:]
+	}
+	l.strikes[username] = times
+	if len(times) < l.MaxStrikes {
+		return false, wait, false
+	}
+
+	delete(l.strikes, username)
+	l.bannedUntil[username] = now.Add(l.Cooldown)
+	return false, wait, true
+}
+
+// limitRequests serves an HTTP API endpoint within the QuotaHTTP quota of
+// the client's IP address
+func limitRequests(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if ok, wait := rateLimiter.AllowRequest(ip); !ok {
+			log.Printf("Refused %s %s from %s: rate limited", r.Method, r.URL.Path, ip)
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter(wait)))
+			http.Error(w, "Too many requests, try again later", http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// clientIP returns the address a request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// retryAfter formats a wait for error messages and Retry-After headers,
+// rounded up to whole seconds
+func retryAfter(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
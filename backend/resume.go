@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+var (
+	// resumeGrace is how long a client whose connection dropped stays
+	// registered, so it can resume its session without missing frames and
+	// without join and leave noise. Zero disables resumption.
+	resumeGrace = 30 * time.Second
+)
+
+// resumeBufferSize is how many of the last frames of a session are kept for
+// replay. Clients that missed more get a new session.
+const resumeBufferSize = 512
+
+// session is the part of a client that survives its connections. Frames
+// are numbered from 1 in the order writePump takes them from the send
+// channel, whether or not the connection could still write them.
+type session struct {
+	mu     sync.Mutex
+	token  string
+	sent   uint64     // Number of frames taken so far
+	recent []outFrame // Ring of the last frames; frame n is at (n-1) % resumeBufferSize
+	ended  bool       // The server closed the connection on purpose
+}
+
+func newSession() *session {
+	return &session{token: generateID(16)}
+}
+
+// matches reports whether token is the resume token of the session
+func (s *session) matches(token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// restart turns the session into a new one, with a new token and no frames
+func (s *session) restart() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = generateID(16)
+	s.sent = 0
+	s.recent = nil
+}
+
+// record numbers the next frame of the session. It is a no-op for
+// companion connections, which have no session.
+func (s *session) record(f outFrame) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.recent) < resumeBufferSize {
+		s.recent = append(s.recent, f)
+	} else {
+		s.recent[s.sent%resumeBufferSize] = f
+	}
+	s.sent++
+}
+
+// since returns the frames after frame seq, or false if some of them are no
+// longer kept
+func (s *session) since(seq uint64) ([]outFrame, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if seq > s.sent || s.sent-seq > uint64(len(s.recent)) {
+		return nil, false
+	}
+	missed := make([]outFrame, 0, s.sent-seq)
+	for n := seq; n < s.sent; n++ {
+		missed = append(missed, s.recent[n%resumeBufferSize])
+	}
+	return missed, true
+}
+
+// end keeps the session from being resumed, for connections the server
+// closes on purpose. It is a no-op for bots, which have no session.
+func (s *session) end() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.ended = true
+	s.mu.Unlock()
+}
+
+// resumable reports whether a client may resume the session after its
+// connection dropped
+func (s *session) resumable() bool {
+	if s == nil || resumeGrace <= 0 {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.ended
+}
+
+// frame builds the session frame a connection starts with
+func (s *session) frame(resumed bool, seq uint64) outFrame {
+	s.mu.Lock()
+	token := s.token
+	s.mu.Unlock()
+
+	data, _ := json.Marshal(map[string]interface{}{
+		protocol.KeyType:      protocol.TypeSession,
+		protocol.KeyToken:     token,
+		protocol.KeyResumed:   resumed,
+		protocol.KeySeq:       seq,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	})
+	return outFrame{data: data}
+}
+
+// configureResume applies CHATSYNC_RESUME_GRACE, a duration such as "30s";
+// "0" disables resumption
+func configureResume(grace string) error {
+	if grace == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(grace)
+	if err != nil || d < 0 {
+		return fmt.Errorf("resume grace %q is not a duration", grace)
+	}
+	resumeGrace = d
+	return nil
+}
+
+// resumeClient hands the session named by the resume and seq parameters of
+// a connection request to the new connection, replacing the client that
+// held it. It returns nil if there is no such session, so the caller
+// registers a new client instead. The caller starts the pumps.
+func resumeClient(username, ip string, conn transport, params url.Values) *Client {
+	token := params.Get("resume")
+	seq, err := strconv.ParseUint(params.Get("seq"), 10, 64)
+	if token == "" || err != nil {
+		return nil
+	}
+
+	clientsMux.Lock()
+	old, exists := clients[username]
+	if !exists || !old.session.resumable() || !old.session.matches(token) {
+		clientsMux.Unlock()
+		return nil
+	}
+	client := &Client{
+		Username: username,
+		ip:       ip,
+		conn:     conn,
+		send:     make(chan outFrame, 256),
+		session:  old.session,
+		done:     make(chan struct{}),
+
+		connectedAt: old.connectedAt,
+	}
+	clients[username] = client
+	// The old connection may still look alive; close it first so its pump
+	// does not wait on writes while numbering the rest of its frames
+	old.conn.Close()
+	close(old.send)
+	clientsMux.Unlock()
+
+	<-old.done
+	missed, ok := client.session.since(seq)
+	if !ok {
+		// Too much was missed; start over, but the user never left
+		log.Printf("Session of %s cannot resume from frame %d; starting a new one", username, seq)
+		client.session.restart()
+		client.pending = []outFrame{client.session.frame(false, 0)}
+		sendInitialData(client)
+	} else {
+		log.Printf("Resumed the session of %s, replaying %d frames", username, len(missed))
+		client.pending = append([]outFrame{client.session.frame(true, seq)}, missed...)
+	}
+	recordSession(protocol.ActionResume, username, ip, "")
+	return client
+}
+
+// detach keeps a client whose connection dropped registered for
+// resumeGrace. writePump keeps numbering its frames until it resumes or the
+// grace period ends.
+func (c *Client) detach() {
+	log.Printf("Connection of %s dropped; keeping the session for %v", c.Username, resumeGrace)
+	time.AfterFunc(resumeGrace, func() {
+		clientsMux.Lock()
+		current := clients[c.Username] == c
+		if current {
+			delete(clients, c.Username)
+			close(c.send)
+		}
+		clientsMux.Unlock()
+		if current {
+			recordSession(protocol.ActionLogout, c.Username, c.ip, "session expired")
+			publishPresence()
+		}
+	})
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Retention limits
+const (
+	compactInterval     = 10 * time.Second
+	maxDisappearSeconds = 7 * 24 * 60 * 60
+)
+
+var (
+	// serverRetention applies to every chat. It is set with
+	// CHATSYNC_RETENTION_MAX_AGE and CHATSYNC_RETENTION_MAX_COUNT.
+	serverRetention protocol.RetentionPolicy
+	dmRetention     = make(map[string]protocol.RetentionPolicy) // key: "user1:user2"
+	retentionMux    sync.RWMutex
+)
+
+// stricter returns the smaller of two limits, where zero means no limit
+func stricter(a, b int) int {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+// effectiveRetention combines the server policy with the policy of a chat
+func effectiveRetention(server, chat protocol.RetentionPolicy) protocol.RetentionPolicy {
+	return protocol.RetentionPolicy{
+		MaxAgeSeconds:    stricter(server.MaxAgeSeconds, chat.MaxAgeSeconds),
+		MaxCount:         stricter(server.MaxCount, chat.MaxCount),
+		DisappearSeconds: chat.DisappearSeconds,
+	}
+}
+
+// chatRetention returns the retention policy a chat sets for itself. For
+// private messages the chat is identified by its two participants.
+func chatRetention(msg protocol.Message) protocol.RetentionPolicy {
+	if msg.Type == protocol.TypeGroupMessage {
+		groupsMux.RLock()
+		defer groupsMux.RUnlock()
+		if group, exists := groups[msg.To]; exists && group.Retention != nil {
+			return *group.Retention
+		}
+		return protocol.RetentionPolicy{}
+	}
+
+	retentionMux.RLock()
+	defer retentionMux.RUnlock()
+	return dmRetention[getConversationKey(msg.From, msg.To)]
+}
+
+// messageExpiry returns when a new message disappears, or "" if it does not
+func messageExpiry(msg protocol.Message) string {
+	disappear := chatRetention(msg).DisappearSeconds
+	if disappear <= 0 {
+		return ""
+	}
+	sent, err := time.Parse(time.RFC3339, msg.Timestamp)
+	if err != nil {
+		sent = time.Now()
+	}
+	return sent.Add(time.Duration(disappear) * time.Second).Format(time.RFC3339)
+}
+
+// pruneMessages splits the messages of a chat into those kept and those
+// past the policy or their own expiry at now
+func pruneMessages(messages []protocol.Message, policy protocol.RetentionPolicy, now time.Time) (kept, pruned []protocol.Message) {
+	kept = make([]protocol.Message, 0, len(messages))
+	cutoff := now.Add(-time.Duration(policy.MaxAgeSeconds) * time.Second)
+	for _, msg := range messages {
+		expired := false
+		if msg.ExpiresAt != "" {
+			if expires, err := time.Parse(time.RFC3339, msg.ExpiresAt); err == nil && !now.Before(expires) {
+				expired = true
+			}
+		}
+		if policy.MaxAgeSeconds > 0 {
+			if sent, err := time.Parse(time.RFC3339, msg.Timestamp); err == nil && sent.Before(cutoff) {
+				expired = true
+			}
+		}
+		if expired {
+			pruned = append(pruned, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+	if policy.MaxCount > 0 && len(kept) > policy.MaxCount {
+		excess := len(kept) - policy.MaxCount
+		pruned = append(pruned, kept[:excess]...)
+		kept = kept[excess:]
+	}
+	return kept, pruned
+}
+
+// compactMessages drops the messages that retention policies no longer
+// allow as of now, from the message store and the search index. Members
+// are told about messages that disappeared. It returns how many messages
+// were dropped.
+func compactMessages(now time.Time) int {
+	groupsMux.RLock()
+	groupPolicies := make(map[string]protocol.RetentionPolicy, len(groups))
+	for id, group := range groups {
+		if group.Retention != nil {
+			groupPolicies[id] = *group.Retention
+		}
+	}
+	groupsMux.RUnlock()
+
+	retentionMux.RLock()
+	server := serverRetention
+	dmPolicies := make(map[string]protocol.RetentionPolicy, len(dmRetention))
+	for key, policy := range dmRetention {
+		dmPolicies[key] = policy
+	}
+	retentionMux.RUnlock()
+
+	var pruned []protocol.Message
+	msgMux.Lock()
+	for _, chat := range []struct {
+		store    map[string][]protocol.Message
+		policies map[string]protocol.RetentionPolicy
+	}{
+		{privateMessages, dmPolicies},
+		{groupMessages, groupPolicies},
+	} {
+		for key, messages := range chat.store {
+			kept, dropped := pruneMessages(messages, effectiveRetention(server, chat.policies[key]), now)
+			if len(dropped) == 0 {
+				continue
+			}
+			// Replace rather than splice in place; history replies share the old slice
+			chat.store[key] = kept
+			pruned = append(pruned, dropped...)
+		}
+	}
+	msgMux.Unlock()
+
+	for _, msg := range pruned {
+		searchIndex.Remove(msg.ID)
+		if msg.ExpiresAt != "" {
+			notifyDisappeared(msg)
+		}
+	}
+	if len(pruned) > 0 {
+		log.Printf("Compactor dropped %d expired messages", len(pruned))
+	}
+	return len(pruned)
+}
+
+// notifyDisappeared tells the participants of a chat that a disappearing
+// message is gone
+func notifyDisappeared(msg protocol.Message) {
+	chatType := protocol.TypePrivate
+	if msg.Type == protocol.TypeGroupMessage {
+		chatType = protocol.TypeGroup
+	}
+	notification := map[string]interface{}{
+		protocol.KeyType:      protocol.TypeMessageDeleted,
+		protocol.KeyFrom:      "system",
+		protocol.KeyTo:        msg.To,
+		protocol.KeyChatType:  chatType,
+		protocol.KeyContent:   msg.ID,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	}
+	msgBytes, _ := json.Marshal(notification)
+	if chatType == protocol.TypeGroup {
+		sendToGroup(msg.To, msgBytes)
+	} else {
+		sendToUser(msg.From, msgBytes)
+		sendToUser(msg.To, msgBytes)
+	}
+}
+
+// startCompactor runs compactMessages every interval for the lifetime of the
+// process
+func startCompactor(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			compactMessages(now)
+		}
+	}()
+}
+
+// validateRetention returns what is wrong with a retention policy, or ""
+func validateRetention(policy protocol.RetentionPolicy) string {
+	if policy.MaxAgeSeconds < 0 || policy.MaxCount < 0 || policy.DisappearSeconds < 0 {
+		return "Retention limits cannot be negative"
+	}
+	if policy.DisappearSeconds > maxDisappearSeconds {
+		return fmt.Sprintf("Messages can disappear after at most %d seconds", maxDisappearSeconds)
+	}
+	return ""
+}
+
+// sendRetention sends a user the retention policy of one of their chats.
+// chatID is the group, or the other user of a private chat.
+func sendRetention(username, chatID, changedBy string, policy protocol.RetentionPolicy) {
+	message := map[string]interface{}{
+		protocol.KeyType:      protocol.TypeRetention,
+		protocol.KeyFrom:      changedBy,
+		protocol.KeyTo:        chatID,
+		protocol.KeyRetention: policy,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	}
+	msgBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling retention policy of %s: %v", chatID, err)
+		return
+	}
+	sendToUser(username, msgBytes)
+}
+
+// setRetention changes the retention policy of a chat. msg.To is a group,
+// whose policy members with PermSetPolicy may change, or the other user of
+// a private chat, whose policy either participant may change. The content
+// is a JSON protocol.RetentionPolicy and replaces the previous one. Messages
+// already sent keep their expiry.
+func setRetention(msg protocol.Message) {
+	var policy protocol.RetentionPolicy
+	if err := json.Unmarshal([]byte(msg.Content), &policy); err != nil {
+		sendError(msg.From, fmt.Sprintf("Invalid retention policy: %v", err))
+		return
+	}
+	if problem := validateRetention(policy); problem != "" {
+		sendError(msg.From, problem)
+		return
+	}
+
+	groupsMux.Lock()
+	group, isGroup := groups[msg.To]
+	if isGroup {
+		if !roleAllows(groupRole(group, msg.From), PermSetPolicy) {
+			groupsMux.Unlock()
+			sendError(msg.From, fmt.Sprintf("You are not allowed to change the retention policy of %s", group.Name))
+			return
+		}
+		group.Retention = &policy
+		if policy == (protocol.RetentionPolicy{}) {
+			group.Retention = nil
+		}
+		members := append([]string(nil), group.Members...)
+		groupsMux.Unlock()
+
+		log.Printf("User %s set the retention policy of group %s to %+v", msg.From, msg.To, policy)
+		recordAudit(msg.From, protocol.ActionSetRetention, msg.To, "", fmt.Sprintf("%+v", policy))
+		for _, member := range members {
+			sendRetention(member, msg.To, msg.From, policy)
+		}
+		sendGroupNotice(msg.To, fmt.Sprintf("%s changed how long messages are kept", msg.From))
+		sendGroupList()
+		return
+	}
+	groupsMux.Unlock()
+
+	if msg.To == "" || msg.To == msg.From {
+		sendError(msg.From, "Choose a group or another user")
+		return
+	}
+	if reason, silent := checkPrivateMessage(msg); reason != "" {
+		// As with private messages, a blocked user is not told they are blocked
+		if !silent {
+			sendError(msg.From, reason)
+		}
+		return
+	}
+	key := getConversationKey(msg.From, msg.To)
+	storeDMRetention(key, policy)
+	publishDMRetention(key, policy)
+
+	log.Printf("User %s set the retention policy of their chat with %s to %+v", msg.From, msg.To, policy)
+	recordAudit(msg.From, protocol.ActionSetRetention, "", msg.To, fmt.Sprintf("%+v", policy))
+	sendRetention(msg.From, msg.To, msg.From, policy)
+	sendRetention(msg.To, msg.From, msg.From, policy)
+}
+
+// storeDMRetention sets the retention policy of the private chat with the
+// given conversation key
+func storeDMRetention(key string, policy protocol.RetentionPolicy) {
+	retentionMux.Lock()
+	defer retentionMux.Unlock()
+	if policy == (protocol.RetentionPolicy{}) {
+		delete(dmRetention, key)
+	} else {
+		dmRetention[key] = policy
+	}
+}
+
+// requestRetention answers a request_retention message
+func requestRetention(client *Client, chatID string) {
+	groupsMux.RLock()
+	group, isGroup := groups[chatID]
+	var policy protocol.RetentionPolicy
+	member := isGroup && contains(group.Members, client.Username)
+	if member && group.Retention != nil {
+		policy = *group.Retention
+	}
+	groupsMux.RUnlock()
+
+	if isGroup && !member {
+		sendError(client.Username, fmt.Sprintf("You are not a member of %s", groupLabel(chatID)))
+		return
+	}
+
+	if !isGroup {
+		retentionMux.RLock()
+		policy = dmRetention[getConversationKey(client.Username, chatID)]
+		retentionMux.RUnlock()
+	}
+	sendRetention(client.Username, chatID, "", policy)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Group permissions
+const (
+	PermPost           = "post"
+	PermAddMember      = "add_member"
+	PermRemoveMember   = "remove_member"
+	PermRename         = "rename"
+	PermEditInfo       = "edit_info"       // Topic, description and avatar
+	PermSetVisibility  = "set_visibility"  // Make the group public or private
+	PermSetPolicy      = "set_policy"      // Announcement mode, slow mode and length limit
+	PermDeleteMessages = "delete_messages" // Delete other members' messages
+	PermMuteMembers    = "mute_members"    // Mute members and handle reports
+	PermManageRoles    = "manage_roles"
+	PermManageWebhooks = "manage_webhooks"
+)
+
+// rolePermissions is the permission matrix of the group roles
+var rolePermissions = map[string][]string{
+	protocol.RoleOwner:     {PermPost, PermAddMember, PermRemoveMember, PermRename, PermEditInfo, PermSetVisibility, PermSetPolicy, PermDeleteMessages, PermMuteMembers, PermManageRoles, PermManageWebhooks},
+	protocol.RoleAdmin:     {PermPost, PermAddMember, PermRemoveMember, PermRename, PermEditInfo, PermSetVisibility, PermSetPolicy, PermDeleteMessages, PermMuteMembers, PermManageRoles, PermManageWebhooks},
+	protocol.RoleModerator: {PermPost, PermAddMember, PermRemoveMember, PermEditInfo, PermDeleteMessages, PermMuteMembers},
+	protocol.RoleMember:    {PermPost},
+	protocol.RoleReadOnly:  {},
+}
+
+// roleRank orders the roles. Members can only remove, re-role or delete the
+// messages of members ranked below them, and only grant roles below their own.
+var roleRank = map[string]int{
+	protocol.RoleReadOnly:  1,
+	protocol.RoleMember:    2,
+	protocol.RoleModerator: 3,
+	protocol.RoleAdmin:     4,
+	protocol.RoleOwner:     5,
+}
+
+// groupRole returns the role of username in group, or "" if they are not a
+// member. The caller must hold groupsMux.
+func groupRole(group *protocol.Group, username string) string {
+	if !contains(group.Members, username) {
+		return ""
+	}
+	if username == group.Admin {
+		return protocol.RoleOwner
+	}
+	if role, ok := group.Roles[username]; ok {
+		return role
+	}
+	return protocol.RoleMember
+}
+
+// roleAllows reports whether role grants perm
+func roleAllows(role, perm string) bool {
+	return contains(rolePermissions[role], perm)
+}
+
+// hasGroupPermission reports whether username holds perm in a group
+func hasGroupPermission(groupID, username, perm string) bool {
+	groupsMux.RLock()
+	defer groupsMux.RUnlock()
+
+	group, exists := groups[groupID]
+	return exists && roleAllows(groupRole(group, username), perm)
+}
+
+// isAdminRole reports whether role is the owner or an admin
+func isAdminRole(role string) bool {
+	return roleRank[role] >= roleRank[protocol.RoleAdmin]
+}
+
+// setMemberRole records role for username. The caller must hold groupsMux.
+func setMemberRole(group *protocol.Group, username, role string) {
+	if role == protocol.RoleMember {
+		delete(group.Roles, username)
+		return
+	}
+	if group.Roles == nil {
+		group.Roles = make(map[string]string)
+	}
+	group.Roles[username] = role
+}
+
+// nextOwner picks the member who takes over a group when its owner leaves:
+// the highest-ranked member who is not a bot, and among those the one who
+// joined first. It returns "" if no such member is left. The caller must
+// hold groupsMux.
+func nextOwner(group *protocol.Group) string {
+	owner := ""
+	for _, member := range group.Members {
+		if member == group.Admin || isBot(member) {
+			continue
+		}
+		if owner == "" || roleRank[groupRole(group, member)] > roleRank[groupRole(group, owner)] {
+			owner = member
+		}
+	}
+	return owner
+}
+
+// sendError tells a user that one of their requests was rejected
+func sendError(username, content string) {
+	message := protocol.Message{
+		Type:      protocol.TypeError,
+		From:      "system",
+		To:        username,
+		Content:   content,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	msgBytes, _ := json.Marshal(message)
+	sendToUser(username, msgBytes)
+}
+
+// sendGroupNotice sends a system message to the members of a group
+func sendGroupNotice(groupID, content string) {
+	notification := protocol.Message{
+		Type:      protocol.TypeSystem,
+		Content:   content,
+		Timestamp: time.Now().Format(time.RFC3339),
+	}
+	msgBytes, _ := json.Marshal(notification)
+	sendToGroup(groupID, msgBytes)
+}
+
+// setGroupRole changes the role of a member. The content is "USER,ROLE".
+func setGroupRole(msg protocol.Message) {
+	target, role, ok := strings.Cut(msg.Content, ",")
+	target, role = strings.TrimSpace(target), strings.TrimSpace(role)
+	if !ok || target == "" {
+		sendError(msg.From, "Usage: set_group_role content must be USER,ROLE")
+		return
+	}
+	if _, valid := roleRank[role]; !valid || role == protocol.RoleOwner {
+		sendError(msg.From, fmt.Sprintf("Invalid role %q; use transfer_ownership to change the owner", role))
+		return
+	}
+
+	groupsMux.Lock()
+	group, exists := groups[msg.To]
+	if !exists {
+		groupsMux.Unlock()
+		log.Printf("Group %s not found", msg.To)
+		sendError(msg.From, fmt.Sprintf("Group %s not found", msg.To))
+		return
+	}
+
+	actorRole := groupRole(group, msg.From)
+	targetRole := groupRole(group, target)
+	switch {
+	case !roleAllows(actorRole, PermManageRoles):
+		groupsMux.Unlock()
+		log.Printf("User %s is not authorized to change roles in group %s", msg.From, msg.To)
+		sendError(msg.From, fmt.Sprintf("You are not allowed to change roles in %s", groupLabel(msg.To)))
+		return
+	case targetRole == "":
+		groupsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("%s is not a member of %s", target, groupLabel(msg.To)))
+		return
+	case roleRank[targetRole] >= roleRank[actorRole] || roleRank[role] >= roleRank[actorRole]:
+		groupsMux.Unlock()
+		log.Printf("User %s may not make %s a %s in group %s", msg.From, target, role, msg.To)
+		sendError(msg.From, fmt.Sprintf("You can only assign roles below your own to members below you in %s", groupLabel(msg.To)))
+		return
+	}
+
+	setMemberRole(group, target, role)
+	groupsMux.Unlock()
+
+	log.Printf("User %s set role of %s in group %s to %s", msg.From, target, msg.To, role)
+	recordAudit(msg.From, protocol.ActionSetRole, msg.To, target, role)
+	sendGroupNotice(msg.To, fmt.Sprintf("%s made %s a %s", msg.From, target, strings.ReplaceAll(role, "_", "-")))
+	sendGroupList()
+}
+
+// transferOwnership hands a group over to another member. The previous
+// owner stays on as an admin.
+func transferOwnership(msg protocol.Message) {
+	target := strings.TrimSpace(msg.Content)
+
+	groupsMux.Lock()
+	group, exists := groups[msg.To]
+	if !exists {
+		groupsMux.Unlock()
+		log.Printf("Group %s not found", msg.To)
+		sendError(msg.From, fmt.Sprintf("Group %s not found", msg.To))
+		return
+	}
+	if group.Admin != msg.From {
+		groupsMux.Unlock()
+		log.Printf("User %s is not the owner of group %s", msg.From, msg.To)
+		sendError(msg.From, fmt.Sprintf("Only the owner can transfer ownership of %s", groupLabel(msg.To)))
+		return
+	}
+	if target == msg.From || !contains(group.Members, target) {
+		groupsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("%s is not another member of %s", target, groupLabel(msg.To)))
+		return
+	}
+	if isBot(target) {
+		groupsMux.Unlock()
+		sendError(msg.From, fmt.Sprintf("%s is a bot and cannot own %s", target, groupLabel(msg.To)))
+		return
+	}
+
+	group.Admin = target
+	setMemberRole(group, target, protocol.RoleOwner)
+	setMemberRole(group, msg.From, protocol.RoleAdmin)
+	groupsMux.Unlock()
+
+	log.Printf("Ownership of group %s transferred from %s to %s", msg.To, msg.From, target)
+	recordAudit(msg.From, protocol.ActionTransferOwnership, msg.To, target, "")
+	sendGroupNotice(msg.To, fmt.Sprintf("%s transferred ownership of the group to %s", msg.From, target))
+	sendGroupList()
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// Search limits
+const (
+	defaultSearchLimit = 50
+	maxSearchLimit     = 200
+)
+
+// posting records where a term occurs in one message
+type posting struct {
+	doc       int
+	positions []int
+}
+
+// indexedMessage is a message in the search index together with the
+// conversation it belongs to
+type indexedMessage struct {
+	id       int
+	msg      protocol.Message
+	chatType string // protocol.TypePrivate or protocol.TypeGroup
+	chatKey  string // Conversation key for private chats, group ID for groups
+	time     time.Time
+}
+
+// SearchIndex is an in-memory positional inverted index over stored messages
+type SearchIndex struct {
+	mu       sync.RWMutex
+	docs     map[int]*indexedMessage
+	postings map[string][]posting // key: folded term, postings in doc order
+	byID     map[string]int       // key: message ID
+	nextDoc  int
+}
+
+// SearchQuery is a parsed search request
+type SearchQuery struct {
+	Terms    []string   // Individual terms that must all occur
+	Phrases  [][]string // Term sequences that must occur consecutively
+	From     string     // Only messages from this user
+	ChatType string     // With ChatID, only this conversation
+	ChatID   string     // Other user for private chats, group ID for groups
+	After    time.Time
+	Before   time.Time
+	Limit    int
+}
+
+var searchIndex = NewSearchIndex()
+
+// NewSearchIndex returns an empty index
+func NewSearchIndex() *SearchIndex {
+	return &SearchIndex{
+		docs:     make(map[int]*indexedMessage),
+		postings: make(map[string][]posting),
+		byID:     make(map[string]int),
+	}
+}
+
+// Len returns the number of indexed messages
+func (idx *SearchIndex) Len() int {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return len(idx.docs)
+}
+
+// tokenize splits text into case-folded terms. Letters and digits form
+// terms; everything else separates them.
+func tokenize(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// Add indexes a chat message
+func (idx *SearchIndex) Add(msg protocol.Message) {
+	doc := &indexedMessage{msg: msg}
+	switch msg.Type {
+	case protocol.TypePrivateMessage:
+		doc.chatType = protocol.TypePrivate
+		doc.chatKey = getConversationKey(msg.From, msg.To)
+	case protocol.TypeGroupMessage:
+		doc.chatType = protocol.TypeGroup
+		doc.chatKey = msg.To
+	default:
+		return
+	}
+	doc.time, _ = time.Parse(time.RFC3339, msg.Timestamp)
+	terms := tokenize(indexText(msg))
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	id := idx.nextDoc
+	idx.nextDoc++
+	doc.id = id
+	idx.docs[id] = doc
+	if msg.ID != "" {
+		idx.byID[msg.ID] = id
+	}
+
+	positions := make(map[string][]int)
+	for pos, term := range terms {
+		positions[term] = append(positions[term], pos)
+	}
+	for term, pos := range positions {
+		idx.postings[term] = append(idx.postings[term], posting{doc: id, positions: pos})
+	}
+}
+
+// Remove drops a message from the index
+func (idx *SearchIndex) Remove(msgID string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	id, ok := idx.byID[msgID]
+	if !ok {
+		return
+	}
+	doc := idx.docs[id]
+	delete(idx.byID, msgID)
+	delete(idx.docs, id)
+
+	for _, term := range tokenize(indexText(doc.msg)) {
+		list := idx.postings[term]
+		i := sort.Search(len(list), func(i int) bool { return list[i].doc >= id })
+		if i == len(list) || list[i].doc != id {
+			continue // Repeated term, already removed
+		}
+		if len(list) == 1 {
+			delete(idx.postings, term)
+			continue
+		}
+		idx.postings[term] = append(list[:i:i], list[i+1:]...)
+	}
+}
+
+// indexText returns the text of a message that is indexed. Attachment names
+// are searchable alongside the content.
+func indexText(msg protocol.Message) string {
+	text := msg.Content
+	for _, a := range msg.Attachments {
+		text += " " + a.Name
+	}
+	return text
+}
+
+// Search returns the messages matching q that username is allowed to see,
+// newest first
+func (idx *SearchIndex) Search(username string, q SearchQuery) []protocol.Message {
+	limit := q.Limit
+	if limit <= 0 {
+		limit = defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		limit = maxSearchLimit
+	}
+
+	if len(q.Terms) == 0 && len(q.Phrases) == 0 && q.From == "" && q.ChatID == "" &&
+		q.After.IsZero() && q.Before.IsZero() {
+		return []protocol.Message{}
+	}
+
+	chatKey := ""
+	if q.ChatID != "" {
+		chatKey = q.ChatID
+		if q.ChatType == protocol.TypePrivate {
+			chatKey = getConversationKey(username, q.ChatID)
+		}
+	}
+
+	idx.mu.RLock()
+	candidates := idx.match(q)
+	docs := make([]*indexedMessage, 0, len(candidates))
+	for _, id := range candidates {
+		doc := idx.docs[id]
+		if q.From != "" && doc.msg.From != q.From {
+			continue
+		}
+		if chatKey != "" && (doc.chatType != q.ChatType || doc.chatKey != chatKey) {
+			continue
+		}
+		if !q.After.IsZero() && !doc.time.After(q.After) {
+			continue
+		}
+		if !q.Before.IsZero() && !doc.time.Before(q.Before) {
+			continue
+		}
+		docs = append(docs, doc)
+	}
+	idx.mu.RUnlock()
+
+	// Newest first; timestamps have second precision, so ties fall back to
+	// insertion order
+	sort.Slice(docs, func(i, j int) bool {
+		if !docs[i].time.Equal(docs[j].time) {
+			return docs[i].time.After(docs[j].time)
+		}
+		return docs[i].id > docs[j].id
+	})
+
+	results := make([]protocol.Message, 0)
+	memberOf := make(map[string]bool)
+	for _, doc := range docs {
+		if !canSeeIndexed(username, doc, memberOf) {
+			continue
+		}
+		results = append(results, doc.msg)
+		if len(results) == limit {
+			break
+		}
+	}
+	return results
+}
+
+// canSeeIndexed reports whether username belongs to the message's
+// conversation. Group membership lookups are cached in memberOf.
+func canSeeIndexed(username string, doc *indexedMessage, memberOf map[string]bool) bool {
+	if doc.chatType == protocol.TypePrivate {
+		return doc.msg.From == username || doc.msg.To == username
+	}
+	member, cached := memberOf[doc.chatKey]
+	if !cached {
+		member = isGroupMember(doc.chatKey, username)
+		memberOf[doc.chatKey] = member
+	}
+	return member
+}
+
+// match returns the IDs of documents containing every term and phrase, in
+// ascending order. The caller must hold idx.mu.
+func (idx *SearchIndex) match(q SearchQuery) []int {
+	var lists [][]posting
+	for _, term := range q.Terms {
+		lists = append(lists, idx.postings[term])
+	}
+	for _, phrase := range q.Phrases {
+		for _, term := range phrase {
+			lists = append(lists, idx.postings[term])
+		}
+	}
+
+	if len(lists) == 0 {
+		// Filter-only query: every document is a candidate
+		ids := make([]int, 0, len(idx.docs))
+		for id := range idx.docs {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		return ids
+	}
+
+	// Intersect starting from the shortest posting list
+	sort.Slice(lists, func(i, j int) bool { return len(lists[i]) < len(lists[j]) })
+	ids := make([]int, 0, len(lists[0]))
+	for _, p := range lists[0] {
+		ids = append(ids, p.doc)
+	}
+	for _, list := range lists[1:] {
+		ids = intersect(ids, list)
+		if len(ids) == 0 {
+			return nil
+		}
+	}
+
+	if len(q.Phrases) == 0 {
+		return ids
+	}
+
+	matched := ids[:0]
+	for _, id := range ids {
+		ok := true
+		for _, phrase := range q.Phrases {
+			if !idx.containsPhrase(id, phrase) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			matched = append(matched, id)
+		}
+	}
+	return matched
+}
+
+// intersect keeps the IDs that also appear in list. Both are sorted by doc.
+func intersect(ids []int, list []posting) []int {
+	out := ids[:0]
+	i, j := 0, 0
+	for i < len(ids) && j < len(list) {
+		switch {
+		case ids[i] == list[j].doc:
+			out = append(out, ids[i])
+			i++
+			j++
+		case ids[i] < list[j].doc:
+			i++
+		default:
+			j++
+		}
+	}
+	return out
+}
+
+// positionsIn returns the positions of term in doc
+func (idx *SearchIndex) positionsIn(term string, doc int) []int {
+	list := idx.postings[term]
+	i := sort.Search(len(list), func(i int) bool { return list[i].doc >= doc })
+	if i < len(list) && list[i].doc == doc {
+		return list[i].positions
+	}
+	return nil
+}
+
+// containsPhrase reports whether the terms occur consecutively in doc
+func (idx *SearchIndex) containsPhrase(doc int, phrase []string) bool {
+	if len(phrase) == 0 {
+		return true
+	}
+
+	next := make([]map[int]bool, len(phrase))
+	for i, term := range phrase[1:] {
+		next[i+1] = make(map[int]bool)
+		for _, pos := range idx.positionsIn(term, doc) {
+			next[i+1][pos] = true
+		}
+	}
+
+	for _, start := range idx.positionsIn(phrase[0], doc) {
+		ok := true
+		for i := 1; i < len(phrase); i++ {
+			if !next[i][start+i] {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSearchDate accepts RFC 3339 timestamps or YYYY-MM-DD dates
+func parseSearchDate(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid date %q, use YYYY-MM-DD or RFC 3339", value)
+	}
+	return t, nil
+}
+
+// parseSearchQuery parses the search syntax used by the search message
+// type: words, "quoted phrases" and the filters from:USER, in:USER,
+// in:#GROUP, after:DATE and before:DATE. Group names are resolved as
+// username sees them.
+func parseSearchQuery(text, username string) (SearchQuery, error) {
+	var q SearchQuery
+
+	words, err := parseCommandArgs(text)
+	if err != nil {
+		return q, err
+	}
+
+	for _, word := range words {
+		key, value, hasFilter := strings.Cut(word, ":")
+		if hasFilter && value != "" {
+			switch strings.ToLower(key) {
+			case "from":
+				q.From = value
+				continue
+			case "in":
+				if strings.HasPrefix(value, "#") {
+					// People type group names; the store is keyed by ID
+					q.ChatType, q.ChatID = protocol.TypeGroup, value[1:]
+					if groupID, found := lookupGroup(q.ChatID, username); found {
+						q.ChatID = groupID
+					}
+				} else {
+					q.ChatType, q.ChatID = protocol.TypePrivate, value
+				}
+				continue
+			case "after":
+				if q.After, err = parseSearchDate(value); err != nil {
+					return q, err
+				}
+				continue
+			case "before":
+				if q.Before, err = parseSearchDate(value); err != nil {
+					return q, err
+				}
+				continue
+			}
+		}
+
+		// Quoted words and words like "e-mail" become phrases
+		terms := tokenize(word)
+		if len(terms) > 1 {
+			q.Phrases = append(q.Phrases, terms)
+		} else {
+			q.Terms = append(q.Terms, terms...)
+		}
+	}
+	return q, nil
+}
+
+// sendSearchResults runs a search request from a client and sends the hits
+func sendSearchResults(client *Client, queryText string) {
+	q, err := parseSearchQuery(queryText, client.Username)
+	if err != nil {
+		log.Printf("Invalid search query from %s: %v", client.Username, err)
+		q = SearchQuery{}
+	}
+
+	results := []protocol.Message{}
+	if err == nil {
+		results = searchIndex.Search(client.Username, q)
+	}
+
+	message := map[string]interface{}{
+		protocol.KeyType:      protocol.TypeSearchResults,
+		protocol.KeyQuery:     queryText,
+		protocol.KeyResults:   results,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	}
+	if err != nil {
+		message[protocol.KeyError] = err.Error()
+	}
+
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling search results for client %s: %v", client.Username, err)
+		return
+	}
+
+	log.Printf("Search by %s for %q returned %d results", client.Username, queryText, len(results))
+	sendToUser(client.Username, messageBytes)
+}
+
+// handleSearch serves GET /api/search. Query parameters: username and q
+// (search syntax), plus optional from, chat_type, chat_id, after, before
+// and limit which override filters given in q.
+func handleSearch(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	params := r.URL.Query()
+	username := params.Get("username")
+	if username == "" {
+		http.Error(w, "username is required", http.StatusBadRequest)
+		return
+	}
+	if refuseBanned(w, r, username) {
+		return
+	}
+
+	q, err := parseSearchQuery(params.Get("q"), username)
+	if err == nil {
+		err = applySearchParams(&q, params.Get)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	results := searchIndex.Search(username, q)
+	log.Printf("Search API request by %s for %q returned %d results", username, params.Get("q"), len(results))
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		protocol.KeyQuery:   params.Get("q"),
+		protocol.KeyResults: results,
+	})
+}
+
+// applySearchParams copies explicit filter parameters into q
+func applySearchParams(q *SearchQuery, get func(string) string) error {
+	var err error
+	if v := get("from"); v != "" {
+		q.From = v
+	}
+	if v := get("chat_id"); v != "" {
+		q.ChatID = v
+		q.ChatType = get("chat_type")
+		if q.ChatType != protocol.TypePrivate && q.ChatType != protocol.TypeGroup {
+			return errors.New("chat_type must be private or group")
+		}
+	}
+	if v := get("after"); v != "" {
+		if q.After, err = parseSearchDate(v); err != nil {
+			return err
+		}
+	}
+	if v := get("before"); v != "" {
+		if q.Before, err = parseSearchDate(v); err != nil {
+			return err
+		}
+	}
+	if v := get("limit"); v != "" {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit <= 0 {
+			return errors.New("limit must be a positive number")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	_ "image/gif" // Register GIF decoding for thumbnails
+	"image/jpeg"
+	_ "image/png" // Register PNG decoding for thumbnails
+	"io"
+)
+
+// thumbnailSize is the maximum width and height of generated thumbnails
+const thumbnailSize = 256
+
+// maxThumbnailPixels guards against decoding huge images into memory
+const maxThumbnailPixels = 40 * 1000 * 1000
+
+// makeThumbnail decodes an image and returns a JPEG thumbnail that fits in
+// thumbnailSize x thumbnailSize, preserving the aspect ratio
+func makeThumbnail(r io.ReadSeeker) ([]byte, error) {
+	cfg, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxThumbnailPixels {
+		return nil, image.ErrFormat
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	src, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, scaleDown(src, thumbnailSize), &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// scaleDown shrinks src to fit in max x max by averaging the source pixels
+// covered by each destination pixel. Images that already fit are copied.
+func scaleDown(src image.Image, max int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if w > max || h > max {
+		if w >= h {
+			dw, dh = max, h*max/w
+		} else {
+			dw, dh = w*max/h, max
+		}
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0 := b.Min.Y + y*h/dh
+		y1 := b.Min.Y + (y+1)*h/dh
+		if y1 <= y0 {
+			y1 = y0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			x0 := b.Min.X + x*w/dw
+			x1 := b.Min.X + (x+1)*w/dw
+			if x1 <= x0 {
+				x1 = x0 + 1
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(cr), g+uint64(cg), bl+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+
+			// Flatten onto white so transparent areas do not turn black in JPEG
+			ar, ag, ab, aa := r/n, g/n, bl/n, a/n
+			white := 0xffff - aa
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(ar + white),
+				G: uint16(ag + white),
+				B: uint16(ab + white),
+				A: 0xffff,
+			})
+		}
+	}
+	return dst
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"compress/flate"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// Compression of WebSocket connections that negotiated
+	// permessage-deflate
+	compressionLevel     = flate.BestSpeed
+	compressionThreshold = 512 // Smaller frames are sent uncompressed
+)
+
+// configureCompression applies the CHATSYNC_COMPRESSION settings: mode "off"
+// disables permessage-deflate, level is a flate level from -2 (Huffman
+// only) to 9, and threshold the size in bytes from which frames are
+// compressed. Empty settings keep the defaults.
+func configureCompression(mode, level, threshold string) error {
+	switch mode {
+	case "", "on":
+	case "off":
+		upgrader.EnableCompression = false
+	default:
+		return fmt.Errorf("compression mode %q is neither on nor off", mode)
+	}
+	if level != "" {
+		n, err := strconv.Atoi(level)
+		if err != nil || n < flate.HuffmanOnly || n > flate.BestCompression {
+			return fmt.Errorf("compression level %q is not between %d and %d", level, flate.HuffmanOnly, flate.BestCompression)
+		}
+		compressionLevel = n
+	}
+	if threshold != "" {
+		n, err := strconv.Atoi(threshold)
+		if err != nil || n < 0 {
+			return fmt.Errorf("compression threshold %q is not a number of bytes", threshold)
+		}
+		compressionThreshold = n
+	}
+	return nil
+}
+
+// outFrame is a JSON frame queued for a client. Frames sent to many clients
+// at once are shared, so each encoding is compressed once for all of them.
+type outFrame struct {
+	data   []byte
+	shared *sharedFrame
+}
+
+// shareFrame queues data for many clients
+func shareFrame(data []byte) outFrame {
+	return outFrame{data: data, shared: &sharedFrame{data: data}}
+}
+
+// sharedFrame prepares the WebSocket messages of a shared frame on first use
+type sharedFrame struct {
+	data []byte
+
+	textOnce sync.Once
+	text     *websocket.PreparedMessage
+	textErr  error
+
+	binaryOnce sync.Once
+	binary     *websocket.PreparedMessage
+	binaryErr  error
+}
+
+// prepared returns the frame as a JSON text message, or as a MessagePack
+// binary message
+func (s *sharedFrame) prepared(binary bool) (*websocket.PreparedMessage, error) {
+	if !binary {
+		s.textOnce.Do(func() {
+			s.text, s.textErr = websocket.NewPreparedMessage(websocket.TextMessage, s.data)
+		})
+		return s.text, s.textErr
+	}
+	s.binaryOnce.Do(func() {
+		packed, err := protocol.JSONToMsgpack(nil, s.data)
+		if err != nil {
+			s.binaryErr = err
+			return
+		}
+		s.binary, s.binaryErr = websocket.NewPreparedMessage(websocket.BinaryMessage, packed)
+	})
+	return s.binary, s.binaryErr
+}
+
+// transport carries frames between the server and one connected client.
+// readPump and writePump only talk to the transport, so the rest of the
+// server does not care whether a client uses a WebSocket or the SSE
+// fallback.
+type transport interface {
+	// readFrame blocks until the client sends the next frame
+	readFrame() ([]byte, error)
+	// writeFrame sends a frame to the client. Only writePump calls it.
+	writeFrame(f outFrame) error
+	// ping keeps an idle connection alive and fails once the client is gone
+	ping() error
+	// closeWith tells the client why the connection ends, using a WebSocket
+	// close code
+	closeWith(code int, reason string)
+	// Close ends the connection, unblocking readFrame
+	Close() error
+}
+
+// wsTransport is the transport of /ws connections. Clients that negotiated
+// protocol.SubprotocolMsgpack get binary frames, transcoded from the JSON
+// frames the server builds.
+type wsTransport struct {
+	conn   *websocket.Conn
+	binary bool
+	buf    []byte // Reused for transcoding; only writePump writes
+}
+
+// newWSTransport sets up the read limit, compression and the pong handler
+// that extends the read deadline
+func newWSTransport(conn *websocket.Conn) *wsTransport {
+	conn.SetReadLimit(maxMessageSize)
+	if err := conn.SetCompressionLevel(compressionLevel); err != nil {
+		log.Printf("Error setting compression level %d: %v", compressionLevel, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		conn.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+	return &wsTransport{conn: conn, binary: conn.Subprotocol() == protocol.SubprotocolMsgpack}
+}
+
+// readFrame accepts binary frames from any client, returning them as JSON
+func (t *wsTransport) readFrame() ([]byte, error) {
+	for {
+		messageType, message, err := t.conn.ReadMessage()
+		if err != nil || messageType != websocket.BinaryMessage {
+			return message, err
+		}
+		if message, err = protocol.MsgpackToJSON(nil, message); err == nil {
+			return message, nil
+		}
+		log.Printf("Error decoding binary frame: %v", err)
+	}
+}
+
+// writeFrame compresses frames from compressionThreshold bytes on, if the
+// client negotiated compression
+func (t *wsTransport) writeFrame(f outFrame) error {
+	t.conn.EnableWriteCompression(len(f.data) >= compressionThreshold)
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+
+	if f.shared != nil {
+		prepared, err := f.shared.prepared(t.binary)
+		if err != nil {
+			return err
+		}
+		return t.conn.WritePreparedMessage(prepared)
+	}
+
+	message, messageType := f.data, websocket.TextMessage
+	if t.binary {
+		var err error
+		if t.buf, err = protocol.JSONToMsgpack(t.buf[:0], message); err != nil {
+			return err
+		}
+		message, messageType = t.buf, websocket.BinaryMessage
+	}
+	return t.conn.WriteMessage(messageType, message)
+}
+
+func (t *wsTransport) ping() error {
+	t.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return t.conn.WriteMessage(websocket.PingMessage, nil)
+}
+
+// closeWith sends a close frame. WriteControl may be called concurrently
+// with writeFrame.
+func (t *wsTransport) closeWith(code int, reason string) {
+	closeMsg := websocket.FormatCloseMessage(code, reason)
+	t.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(writeWait))
+}
+
+func (t *wsTransport) Close() error {
+	return t.conn.Close()
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CpBruceMeena/Go-Chatsync/protocol"
+)
+
+// webhookPayload is the JSON body accepted by the webhook endpoint
+type webhookPayload struct {
+	Content string `json:"content"`
+}
+
+var (
+	webhooks    = make(map[string]*protocol.Webhook) // key: webhook ID
+	webhooksMux sync.RWMutex
+)
+
+// webhookPath returns the URL path an integration posts to
+func webhookPath(hook *protocol.Webhook) string {
+	return "/api/webhooks/" + hook.ID + "/" + hook.Token
+}
+
+// isWebhookName reports whether a webhook posts under name, so no user may
+// connect under it
+func isWebhookName(name string) bool {
+	webhooksMux.RLock()
+	defer webhooksMux.RUnlock()
+	for _, hook := range webhooks {
+		if hook.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// nameTaken reports whether name belongs to a bot or to a user the server
+// knows of, so webhooks cannot post under it
+func nameTaken(name string) bool {
+	if isBot(name) || isOnline(name) {
+		return true
+	}
+
+	profilesMux.RLock()
+	_, hasProfile := profiles[name]
+	profilesMux.RUnlock()
+	if hasProfile {
+		return true
+	}
+
+	groupsMux.RLock()
+	defer groupsMux.RUnlock()
+	for _, group := range groups {
+		if contains(group.Members, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// createWebhook creates a new incoming webhook for a group
+func createWebhook(client *Client, msg protocol.Message) {
+	if !hasGroupPermission(msg.To, msg.From, PermManageWebhooks) {
+		log.Printf("User %s is not authorized to create webhooks in group %s", msg.From, msg.To)
+		sendError(msg.From, fmt.Sprintf("You are not allowed to manage the webhooks of %s", groupLabel(msg.To)))
+		return
+	}
+
+	name := strings.TrimSpace(msg.Content)
+	if name == "" {
+		log.Printf("No integration name provided for webhook in group %s", msg.To)
+		sendError(msg.From, "A webhook needs a name")
+		return
+	}
+	if nameTaken(name) {
+		log.Printf("Refused webhook name %s in group %s: taken by a user or bot", name, msg.To)
+		sendError(msg.From, fmt.Sprintf("%s is the name of a user or bot", name))
+		return
+	}
+
+	hook := &protocol.Webhook{
+		ID:        generateID(8),
+		Name:      name,
+		Group:     msg.To,
+		Token:     generateID(24),
+		Creator:   msg.From,
+		CreatedAt: time.Now().Format(time.RFC3339),
+	}
+	hook.URL = webhookPath(hook)
+
+	webhooksMux.Lock()
+	webhooks[hook.ID] = hook
+	webhooksMux.Unlock()
+
+	log.Printf("Created webhook %s (%s) for group %s by %s", hook.ID, hook.Name, hook.Group, msg.From)
+	recordAudit(msg.From, protocol.ActionCreateWebhook, msg.To, hook.ID, hook.Name)
+	sendWebhookList(client, msg.To)
+}
+
+// deleteWebhook removes an incoming webhook from a group
+func deleteWebhook(client *Client, msg protocol.Message) {
+	if !hasGroupPermission(msg.To, msg.From, PermManageWebhooks) {
+		log.Printf("User %s is not authorized to delete webhooks in group %s", msg.From, msg.To)
+		sendError(msg.From, fmt.Sprintf("You are not allowed to manage the webhooks of %s", groupLabel(msg.To)))
+		return
+	}
+
+	webhooksMux.Lock()
+	hook, exists := webhooks[msg.Content]
+	if !exists || hook.Group != msg.To {
+		webhooksMux.Unlock()
+		log.Printf("Webhook %s not found in group %s", msg.Content, msg.To)
+		sendError(msg.From, fmt.Sprintf("Webhook %s not found", msg.Content))
+		return
+	}
+	delete(webhooks, hook.ID)
+	webhooksMux.Unlock()
+
+	log.Printf("Deleted webhook %s from group %s by %s", hook.ID, hook.Group, msg.From)
+	recordAudit(msg.From, protocol.ActionDeleteWebhook, msg.To, hook.ID, hook.Name)
+	sendWebhookList(client, msg.To)
+}
+
+// deleteGroupWebhooks removes every webhook that posts into a group
+func deleteGroupWebhooks(groupID string) {
+	webhooksMux.Lock()
+	defer webhooksMux.Unlock()
+
+	for id, hook := range webhooks {
+		if hook.Group == groupID {
+			delete(webhooks, id)
+			log.Printf("Deleted webhook %s as group %s no longer exists", id, groupID)
+		}
+	}
+}
+
+// sendWebhookList sends the webhooks of a group to a member who manages them
+func sendWebhookList(client *Client, groupID string) {
+	if !hasGroupPermission(groupID, client.Username, PermManageWebhooks) {
+		log.Printf("User %s is not authorized to list webhooks in group %s", client.Username, groupID)
+		sendError(client.Username, fmt.Sprintf("You are not allowed to manage the webhooks of %s", groupLabel(groupID)))
+		return
+	}
+
+	webhooksMux.RLock()
+	groupWebhooks := make([]protocol.Webhook, 0)
+	for _, hook := range webhooks {
+		if hook.Group == groupID {
+			groupWebhooks = append(groupWebhooks, *hook)
+		}
+	}
+	webhooksMux.RUnlock()
+
+	message := map[string]interface{}{
+		protocol.KeyType:      protocol.TypeWebhookList,
+		protocol.KeyTo:        groupID,
+		protocol.KeyWebhooks:  groupWebhooks,
+		protocol.KeyTimestamp: time.Now().Format(time.RFC3339),
+	}
+
+	messageBytes, err := json.Marshal(message)
+	if err != nil {
+		log.Printf("Error marshaling webhook list for client %s: %v", client.Username, err)
+		return
+	}
+
+	sendToUser(client.Username, messageBytes)
+}
+
+// handleWebhook accepts a JSON payload on /api/webhooks/{id}/{token} and
+// posts it into the webhook's group as a group message
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/webhooks/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	webhooksMux.RLock()
+	hook, exists := webhooks[parts[0]]
+	webhooksMux.RUnlock()
+
+	if !exists || subtle.ConstantTimeCompare([]byte(hook.Token), []byte(parts[1])) != 1 {
+		log.Printf("Rejected webhook request for %s from %s", parts[0], r.RemoteAddr)
+		http.NotFound(w, r)
+		return
+	}
+
+	var payload webhookPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&payload); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(payload.Content) == "" {
+		http.Error(w, "Content is required", http.StatusBadRequest)
+		return
+	}
+
+	groupsMux.RLock()
+	_, groupExists := groups[hook.Group]
+	groupsMux.RUnlock()
+	if !groupExists {
+		http.NotFound(w, r)
+		return
+	}
+	// Webhooks act for their creator, so they stop working while the
+	// creator is banned
+	if _, banned := activeBan(hook.Creator); banned {
+		log.Printf("Refused webhook request for %s: its creator %s is banned", hook.ID, hook.Creator)
+		http.Error(w, "The creator of this webhook is banned", http.StatusForbidden)
+		return
+	}
+
+	msg := protocol.Message{
+		Type:        protocol.TypeGroupMessage,
+		From:        hook.Name,
+		To:          hook.Group,
+		Content:     payload.Content,
+		Timestamp:   time.Now().Format(time.RFC3339),
+		Integration: hook.ID,
+	}
+
+	reason, flagged := applyFilters(&msg)
+	if reason != "" {
+		http.Error(w, reason, http.StatusUnprocessableEntity)
+		return
+	}
+
+	log.Printf("Webhook %s (%s) posting to group %s", hook.ID, hook.Name, hook.Group)
+	flagMessage(deliverGroupMessage(msg), flagged)
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -198,11 +198,11 @@ const Chat = () => {
         </Box>
         <Divider />
         <List sx={{ flex: 1, overflow: 'auto' }}>
-          {Object.entries(groups).map(([groupName, group]) => (
-            <ListItem key={groupName} disablePadding>
+          {Object.entries(groups).map(([groupId, group]) => (
+            <ListItem key={groupId} disablePadding>
               <ListItemButton
-                selected={selectedChat?.type === 'group' && selectedChat?.id === groupName}
-                onClick={() => handleChatSelect('group', groupName)}
+                selected={selectedChat?.type === 'group' && selectedChat?.id === groupId}
+                onClick={() => handleChatSelect('group', groupId)}
                 sx={{
                   '&.Mui-selected': {
                     bgcolor: 'primary.light',
@@ -214,7 +214,7 @@ const Chat = () => {
                 }}
               >
                 <Badge
-                  badgeContent={unreadMessages[groupName] || 0}
+                  badgeContent={unreadMessages[groupId] || 0}
                   color="error"
                   max={999999}
                   sx={{
@@ -227,7 +227,7 @@ const Chat = () => {
                   <GroupIcon sx={{ mr: 1, color: 'primary.main' }} />
                 </Badge>
                 <ListItemText 
-                  primary={groupName}
+                  primary={group.name}
                   secondary={`${group.members.length} members`}
                 />
               </ListItemButton>
@@ -0,0 +1,122 @@
+// How long a stream may take to deliver its session event before it is
+// taken to be buffered by a proxy
+const OPEN_TIMEOUT = 10000;
+
+// EventStreamSocket speaks the server's SSE transport behind the parts of
+// the WebSocket interface the app uses, for networks whose proxies break
+// WebSocket upgrades. Frames arrive on an EventSource and are sent with
+// POST requests, in order. Where proxies buffer the stream as well, the
+// socket long-polls instead, fetching the queued frames with one GET after
+// another.
+export default class EventStreamSocket {
+  // query is the query string of the stream, with the username and the
+  // session to resume, if any; poll selects long polling
+  constructor(query, poll = false) {
+    this.readyState = WebSocket.CONNECTING;
+    this.onopen = null;
+    this.onclose = null;
+    this.onmessage = null;
+    this.session = null;
+    this.pending = Promise.resolve();
+
+    if (poll) {
+      this.poll(`/api/events?${query}&poll=true`);
+      return;
+    }
+
+    this.source = new EventSource(`/api/events?${query}`);
+    this.timeout = setTimeout(() => {
+      console.log('Event stream did not open in time');
+      this.close();
+    }, OPEN_TIMEOUT);
+    this.source.addEventListener('session', (event) => this.open(event.data));
+    this.source.addEventListener('close', (event) => this.closedBy(event.data));
+    this.source.onmessage = (event) => this.onmessage?.(event);
+    // EventSource would reconnect on its own, but a new stream is a new
+    // session, so leave reconnecting to the owner like a WebSocket does
+    this.source.onerror = () => this.close();
+  }
+
+  open(session) {
+    clearTimeout(this.timeout);
+    this.session = session;
+    this.readyState = WebSocket.OPEN;
+    this.onopen?.();
+  }
+
+  closedBy(data) {
+    console.log('Event stream closed by the server:', data);
+    this.close();
+  }
+
+  // poll fetches url, dispatches the events of the response and polls the
+  // session again until the socket closes
+  async poll(url) {
+    while (this.readyState !== WebSocket.CLOSED) {
+      let body;
+      try {
+        const response = await fetch(url, { cache: 'no-store' });
+        if (!response.ok) {
+          throw new Error(`status ${response.status}`);
+        }
+        body = await response.text();
+      } catch (error) {
+        console.error('Event stream: polling failed:', error);
+        this.close();
+        return;
+      }
+      for (const block of body.split('\n\n')) {
+        this.dispatch(block);
+      }
+      url = `/api/events?session=${encodeURIComponent(this.session)}`;
+    }
+  }
+
+  // dispatch handles one event of a polled response
+  dispatch(block) {
+    let name = '';
+    let data = null;
+    for (const line of block.split('\n')) {
+      if (line.startsWith('event: ')) {
+        name = line.slice('event: '.length);
+      } else if (line.startsWith('data: ')) {
+        data = line.slice('data: '.length);
+      }
+    }
+    if (data === null || this.readyState === WebSocket.CLOSED) {
+      return;
+    }
+    if (name === 'session') {
+      this.open(data);
+    } else if (name === 'close') {
+      this.closedBy(data);
+    } else {
+      this.onmessage?.({ data });
+    }
+  }
+
+  send(data) {
+    if (this.readyState !== WebSocket.OPEN) {
+      throw new Error('Event stream is not open');
+    }
+    const url = `/api/events?session=${encodeURIComponent(this.session)}`;
+    this.pending = this.pending
+      .then(() => fetch(url, { method: 'POST', headers: { 'Content-Type': 'application/x-ndjson' }, body: data }))
+      .then((response) => {
+        if (!response.ok) {
+          console.error('Event stream: posting a frame failed:', response.status);
+        }
+      })
+      .catch((error) => console.error('Event stream: posting a frame failed:', error));
+  }
+
+  close() {
+    if (this.readyState === WebSocket.CLOSED) {
+      return;
+    }
+    this.readyState = WebSocket.CLOSED;
+    clearTimeout(this.timeout);
+    this.source?.close();
+    this.onclose?.();
+  }
+}
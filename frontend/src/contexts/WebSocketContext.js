@@ -1,4 +1,5 @@
 import React, { createContext, useContext, useEffect, useState, useCallback } from 'react';
+import EventStreamSocket from './EventStreamSocket';
 
 const WebSocketContext = createContext(null);
 
@@ -16,9 +17,21 @@ export const WebSocketProvider = ({ children }) => {
   const [username, setUsername] = useState('');
   const [users, setUsers] = useState([]);
   const [groups, setGroups] = useState({});
+  const [publicGroups, setPublicGroups] = useState([]);
+  const [profile, setProfile] = useState(null);
+  const [reports, setReports] = useState([]);
+  const [filters, setFilters] = useState({});
+  const [retention, setRetention] = useState({});
   const [messages, setMessages] = useState([]);
   const [selectedChat, setSelectedChat] = useState(null);
   const wsRef = React.useRef(null);
+  // The transport of the next connection. It moves from 'websocket' to
+  // 'events' when a WebSocket fails to open, e.g. behind a proxy that breaks
+  // upgrades, and on to 'poll' when an event stream fails to open too.
+  const transportRef = React.useRef('websocket');
+  // The session to resume on reconnect: its token and how many frames
+  // arrived in it
+  const resumeRef = React.useRef({ token: null, seq: 0 });
 
   const connect = useCallback(() => {
     if (!username) {
@@ -30,19 +43,38 @@ export const WebSocketProvider = ({ children }) => {
       wsRef.current.close();
     }
 
-    // Clear messages when connecting
-    setMessages([]);
+    // Clear messages when connecting, unless the session can be resumed
+    const { token, seq } = resumeRef.current;
+    if (!token) {
+      setMessages([]);
+    }
+    const query = `username=${encodeURIComponent(username)}` +
+      (token ? `&resume=${encodeURIComponent(token)}&seq=${seq}` : '');
 
-    const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-    const wsUrl = `${protocol}//${window.location.host}/ws?username=${encodeURIComponent(username)}`;
-    const ws = new WebSocket(wsUrl);
+    let ws;
+    let opened = false;
+    if (transportRef.current !== 'websocket') {
+      ws = new EventStreamSocket(query, transportRef.current === 'poll');
+    } else {
+      const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
+      const wsUrl = `${protocol}//${window.location.host}/ws?${query}`;
+      ws = new WebSocket(wsUrl);
+    }
     
     ws.onopen = () => {
+      opened = true;
       setIsConnected(true);
     };
 
     ws.onclose = () => {
       setIsConnected(false);
+      if (!opened && transportRef.current === 'websocket') {
+        console.log('WebSocket failed to open, falling back to the event stream');
+        transportRef.current = 'events';
+      } else if (!opened && transportRef.current === 'events') {
+        console.log('Event stream failed to open, falling back to long polling');
+        transportRef.current = 'poll';
+      }
       // Attempt to reconnect after 3 seconds
       setTimeout(() => {
         if (username) {
@@ -63,19 +95,26 @@ export const WebSocketProvider = ({ children }) => {
   // Connect when username changes
   useEffect(() => {
     if (username) {
+      resumeRef.current = { token: null, seq: 0 };
       connect();
     }
   }, [username, connect]);
 
   const handleMessage = useCallback((message) => {
     console.log('WebSocketContext: Received message:', message);
+    if (message.type === 'session') {
+      resumeRef.current = { token: message.token, seq: message.seq };
+      return;
+    }
+    // Every other frame counts towards where a resumed session continues
+    resumeRef.current.seq += 1;
     switch (message.type) {
       case 'user_list':
         setUsers(Object.keys(message.users));
         break;
       case 'group_list': {
         const groupsMap = message.groups.reduce((acc, group) => {
-          acc[group.name] = group;
+          acc[group.id] = group;
           return acc;
         }, {});
         console.log('WebSocketContext: Updating groups:', groupsMap);
@@ -107,6 +146,54 @@ export const WebSocketProvider = ({ children }) => {
           console.error('WebSocketContext: Error parsing unread counts:', error);
         }
         break;
+      case 'invitation': {
+        const invitation = message.invitation;
+        if (invitation.invitee === username && invitation.status === 'pending') {
+          const accepted = window.confirm(`${invitation.inviter} invited you to join "${invitation.group_name}". Accept?`);
+          wsRef.current?.send(JSON.stringify({
+            type: accepted ? 'accept_invitation' : 'decline_invitation',
+            content: invitation.id
+          }));
+        }
+        break;
+      }
+      case 'invitation_list':
+        message.invitations
+          .filter(invitation => invitation.invitee === username)
+          .forEach(invitation => handleMessage({ type: 'invitation', invitation }));
+        break;
+      case 'join_request': {
+        const request = message.join_request;
+        if (request.user !== username && request.status === 'pending') {
+          const approved = window.confirm(`${request.user} asked to join "${request.group_name}". Approve?`);
+          wsRef.current?.send(JSON.stringify({
+            type: approved ? 'approve_join_request' : 'deny_join_request',
+            content: request.id
+          }));
+        }
+        break;
+      }
+      case 'profile':
+        setProfile(message.profile);
+        break;
+      case 'report':
+        setReports(prev => [message.report, ...prev.filter(r => r.id !== message.report.id)]);
+        break;
+      case 'reports':
+        setReports(message.reports);
+        break;
+      case 'retention':
+        setRetention(prev => ({ ...prev, [message.to]: message.retention }));
+        break;
+      case 'filters':
+        setFilters(prev => ({ ...prev, [message.to]: message.filters }));
+        break;
+      case 'public_groups':
+        setPublicGroups(message.public_groups);
+        break;
+      case 'error':
+        console.error('Server error:', message.content);
+        break;
       default:
         console.log('Unknown message type:', message.type);
     }
@@ -188,6 +275,73 @@ export const WebSocketProvider = ({ children }) => {
     });
   };
 
+  const listPublicGroups = () => {
+    sendMessage({ type: 'list_public_groups' });
+  };
+
+  const joinGroup = (groupId) => {
+    sendMessage({ type: 'join_group', to: groupId });
+  };
+
+  const blockUser = (user) => {
+    sendMessage({ type: 'block_user', content: user });
+  };
+
+  const unblockUser = (user) => {
+    sendMessage({ type: 'unblock_user', content: user });
+  };
+
+  const updatePrivacy = (settings) => {
+    sendMessage({ type: 'update_privacy', content: JSON.stringify(settings) });
+  };
+
+  const muteMember = (groupId, user, duration, reason = '') => {
+    sendMessage({ type: 'mute_member', to: groupId, content: `${user},${duration},${reason}` });
+  };
+
+  const unmuteMember = (groupId, user) => {
+    sendMessage({ type: 'unmute_member', to: groupId, content: user });
+  };
+
+  const reportMessage = (chatId, messageId, reason = '') => {
+    sendMessage({ type: 'report_message', to: chatId, content: `${messageId},${reason}` });
+  };
+
+  const listReports = (status = '') => {
+    sendMessage({ type: 'list_reports', content: status });
+  };
+
+  const resolveReport = (reportId, note = '') => {
+    sendMessage({ type: 'resolve_report', content: `${reportId},${note}` });
+  };
+
+  const dismissReport = (reportId, note = '') => {
+    sendMessage({ type: 'dismiss_report', content: `${reportId},${note}` });
+  };
+
+  const requestRetention = (chatId) => {
+    sendMessage({ type: 'request_retention', to: chatId });
+  };
+
+  const updateRetention = (chatId, policy) => {
+    sendMessage({ type: 'set_retention', to: chatId, content: JSON.stringify(policy) });
+  };
+
+  // exportUrl returns the download URL of a conversation export; format is
+  // jsonl, html or text
+  const exportUrl = (chatType, chatId, format = 'jsonl') => {
+    const params = new URLSearchParams({ username, chat_type: chatType, chat_id: chatId, format });
+    return `/api/export?${params}`;
+  };
+
+  const requestFilters = (groupId) => {
+    sendMessage({ type: 'request_filters', to: groupId });
+  };
+
+  const updateFilters = (groupId, rules) => {
+    sendMessage({ type: 'set_filters', to: groupId, content: JSON.stringify({ rules }) });
+  };
+
   useEffect(() => {
     if (!wsRef.current) return;
 
@@ -209,6 +363,11 @@ export const WebSocketProvider = ({ children }) => {
     setUsername,
     users,
     groups,
+    publicGroups,
+    profile,
+    reports,
+    filters,
+    retention,
     messages,
     selectedChat,
     setSelectedChat,
@@ -217,6 +376,22 @@ export const WebSocketProvider = ({ children }) => {
     createGroup,
     addGroupMember,
     removeGroupMember,
+    listPublicGroups,
+    joinGroup,
+    blockUser,
+    unblockUser,
+    updatePrivacy,
+    muteMember,
+    unmuteMember,
+    reportMessage,
+    listReports,
+    resolveReport,
+    dismissReport,
+    requestFilters,
+    updateFilters,
+    requestRetention,
+    updateRetention,
+    exportUrl,
     ws: wsRef.current
   };
 